@@ -0,0 +1,97 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"sort"
+	"strings"
+)
+
+// Path permission scopes stored in sftp_path_perms.
+const (
+	PathPermScopeUser  = "user"
+	PathPermScopeGroup = "group"
+)
+
+// PathPerm grants a permission bitmask on a virtual path prefix to a user or a group.
+type PathPerm struct {
+	ID    int
+	Scope string
+	Name  string
+	Path  string
+	Perms Permission
+}
+
+// FetchPathPerms returns the path permissions of the user and of the user's group.
+func (s *UserStore) FetchPathPerms(ctx context.Context, user *User) ([]PathPerm, error) {
+	query := fmt.Sprintf(`SELECT id, scope, name, path, perms FROM sftp_path_perms WHERE (scope = 'user' AND name = %s) OR (scope = 'group' AND name = %s) ORDER BY id`,
+		s.placeholder(1), s.placeholder(2))
+	rows, err := s.db.QueryContext(ctx, query, user.Username, user.GroupName)
+	if err != nil {
+		s.logger.Errorf("Error fetching path permissions: %v", err)
+		return nil, err
+	}
+	defer rows.Close()
+	var perms []PathPerm
+	for rows.Next() {
+		var p PathPerm
+		if err := rows.Scan(&p.ID, &p.Scope, &p.Name, &p.Path, &p.Perms); err != nil {
+			return nil, err
+		}
+		perms = append(perms, p)
+	}
+	return perms, rows.Err()
+}
+
+// pathACL resolves the permissions of a user for a virtual path. The most
+// specific (longest) matching prefix wins; on the same prefix a user entry
+// beats a group entry. Paths no entry matches get the user's own bitmask.
+type pathACL struct {
+	def     Permission
+	entries []PathPerm // longest path first, user before group
+}
+
+func newPathACL(def Permission, perms []PathPerm) *pathACL {
+	entries := make([]PathPerm, len(perms))
+	for i, p := range perms {
+		p.Path = cleanPath(p.Path)
+		entries[i] = p
+	}
+	sort.SliceStable(entries, func(i, j int) bool {
+		if len(entries[i].Path) != len(entries[j].Path) {
+			return len(entries[i].Path) > len(entries[j].Path)
+		}
+		return entries[i].Scope == PathPermScopeUser && entries[j].Scope != PathPermScopeUser
+	})
+	return &pathACL{def: def, entries: entries}
+}
+
+// pathWithin reports whether p is prefix itself or lies below it.
+func pathWithin(p, prefix string) bool {
+	return prefix == "/" || p == prefix || strings.HasPrefix(p, prefix+"/")
+}
+
+// Perms returns the expanded permissions that apply to p (a cleaned virtual path).
+func (a *pathACL) Perms(p string) Permission {
+	for _, e := range a.entries {
+		if pathWithin(p, e.Path) {
+			return e.Perms.Expand()
+		}
+	}
+	return a.def.Expand()
+}
+
+// AllowsTree reports whether perm is granted on p and on every path below p
+// that has an entry of its own, as a recursive operation on p such as removing
+// or renaming a directory needs.
+func (a *pathACL) AllowsTree(p string, perm Permission) bool {
+	if a.Perms(p)&perm == 0 {
+		return false
+	}
+	for _, e := range a.entries {
+		if e.Path != p && pathWithin(e.Path, p) && a.Perms(e.Path)&perm == 0 {
+			return false
+		}
+	}
+	return true
+}
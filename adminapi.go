@@ -0,0 +1,861 @@
+package main
+
+import (
+	"crypto/sha256"
+	"crypto/subtle"
+	"crypto/tls"
+	"crypto/x509"
+	"database/sql"
+	_ "embed"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+
+	"go.uber.org/zap"
+	"golang.org/x/crypto/bcrypt"
+)
+
+//go:embed openapi.yaml
+var adminAPISpec []byte
+
+// adminAPI serves the REST API of ADMIN_LISTEN_ADDR over the user store and
+// the session registry. openapi.yaml describes it.
+type adminAPI struct {
+	store    *UserStore
+	sessions *sessionRegistry
+	tokens   [][sha256.Size]byte // of ADMIN_API_TOKENS; none: mTLS only
+	logger   *zap.SugaredLogger
+}
+
+// apiError is an error answered with its status and message.
+type apiError struct {
+	status int
+	msg    string
+}
+
+func (e *apiError) Error() string { return e.msg }
+
+func errBadRequest(format string, args ...any) error {
+	return &apiError{http.StatusBadRequest, fmt.Sprintf(format, args...)}
+}
+
+func errNotFound(format string, args ...any) error {
+	return &apiError{http.StatusNotFound, fmt.Sprintf(format, args...)}
+}
+
+func errConflict(format string, args ...any) error {
+	return &apiError{http.StatusConflict, fmt.Sprintf(format, args...)}
+}
+
+// startAdminAPI listens on ADMIN_LISTEN_ADDR and serves the admin API in the
+// background. It returns nil when ADMIN_LISTEN_ADDR is not set. Clients
+// authenticate with a bearer token from ADMIN_API_TOKENS, a certificate signed
+// by ADMIN_TLS_CLIENT_CA, or both when both are set.
+func startAdminAPI(store *UserStore, sessions *sessionRegistry, logger *zap.SugaredLogger) (*http.Server, error) {
+	addr := getEnvOrDefault("ADMIN_LISTEN_ADDR", "")
+	if addr == "" {
+		return nil, nil
+	}
+	api := &adminAPI{store: store, sessions: sessions, logger: logger}
+	for _, token := range strings.Split(getEnvOrDefault("ADMIN_API_TOKENS", ""), ",") {
+		if token = strings.TrimSpace(token); token != "" {
+			api.tokens = append(api.tokens, sha256.Sum256([]byte(token)))
+		}
+	}
+	var (
+		certFile = getEnvOrDefault("ADMIN_TLS_CERT", "")
+		keyFile  = getEnvOrDefault("ADMIN_TLS_KEY", "")
+		clientCA = getEnvOrDefault("ADMIN_TLS_CLIENT_CA", "")
+	)
+	if (certFile == "") != (keyFile == "") {
+		return nil, fmt.Errorf("ADMIN_TLS_CERT and ADMIN_TLS_KEY must be set together")
+	}
+	if clientCA != "" && certFile == "" {
+		return nil, fmt.Errorf("ADMIN_TLS_CLIENT_CA needs ADMIN_TLS_CERT and ADMIN_TLS_KEY")
+	}
+	if len(api.tokens) == 0 && clientCA == "" {
+		return nil, fmt.Errorf("the admin API needs ADMIN_API_TOKENS or ADMIN_TLS_CLIENT_CA")
+	}
+	if len(api.tokens) > 0 && certFile == "" {
+		logger.Warnf("Admin API tokens are sent in clear text: ADMIN_TLS_CERT is not set, bind ADMIN_LISTEN_ADDR to a loopback or management address")
+	}
+
+	srv := &http.Server{
+		Addr:              addr,
+		Handler:           api.routes(),
+		ReadHeaderTimeout: 10 * time.Second,
+	}
+	if certFile != "" {
+		srv.TLSConfig = &tls.Config{MinVersion: tls.VersionTLS12}
+		if clientCA != "" {
+			pem, err := os.ReadFile(clientCA)
+			if err != nil {
+				return nil, err
+			}
+			pool := x509.NewCertPool()
+			if !pool.AppendCertsFromPEM(pem) {
+				return nil, fmt.Errorf("no certificates in %s", clientCA)
+			}
+			srv.TLSConfig.ClientCAs = pool
+			srv.TLSConfig.ClientAuth = tls.RequireAndVerifyClientCert
+		}
+	}
+	listener, err := listen("admin", addr)
+	if err != nil {
+		return nil, err
+	}
+	go func() {
+		var err error
+		if certFile != "" {
+			err = srv.ServeTLS(listener, certFile, keyFile)
+		} else {
+			err = srv.Serve(listener)
+		}
+		if err != nil && !errors.Is(err, http.ErrServerClosed) {
+			logger.Errorf("Admin API stopped: %v", err)
+		}
+	}()
+	scheme := "http"
+	if certFile != "" {
+		scheme = "https"
+	}
+	logger.Infof("Admin API listening on %s://%s/api/v1/", scheme, listener.Addr())
+	return srv, nil
+}
+
+func (a *adminAPI) routes() http.Handler {
+	mux := http.NewServeMux()
+	handle := func(pattern string, h func(http.ResponseWriter, *http.Request) error) {
+		mux.Handle(pattern, a.serve(h))
+	}
+	handle("GET /api/v1/openapi.yaml", func(w http.ResponseWriter, r *http.Request) error {
+		w.Header().Set("Content-Type", "application/yaml")
+		_, err := w.Write(adminAPISpec)
+		return err
+	})
+
+	handle("GET /api/v1/users", a.listUsers)
+	handle("POST /api/v1/users", a.createUser)
+	handle("GET /api/v1/users/{username}", a.getUser)
+	handle("PATCH /api/v1/users/{username}", a.updateUser)
+	handle("DELETE /api/v1/users/{username}", a.deleteUser)
+	handle("PUT /api/v1/users/{username}/password", a.setPassword)
+	handle("DELETE /api/v1/users/{username}/password", a.setPassword)
+	handle("POST /api/v1/users/{username}/disable", a.setDisabled)
+	handle("POST /api/v1/users/{username}/enable", a.setDisabled)
+	handle("GET /api/v1/users/{username}/keys", a.listKeys)
+	handle("POST /api/v1/users/{username}/keys", a.addKey)
+	handle("DELETE /api/v1/users/{username}/keys/{id}", a.deleteKey)
+	handle("GET /api/v1/users/{username}/quota", a.getQuota)
+	handle("GET /api/v1/users/{username}/bandwidth", a.getBandwidth)
+	handle("DELETE /api/v1/users/{username}/sessions", a.closeUserSessions)
+
+	handle("GET /api/v1/groups", a.listGroups)
+	handle("POST /api/v1/groups", a.createGroup)
+	handle("GET /api/v1/groups/{name}", a.getGroup)
+	handle("PATCH /api/v1/groups/{name}", a.updateGroup)
+	handle("DELETE /api/v1/groups/{name}", a.deleteGroup)
+
+	handle("GET /api/v1/sessions", a.listSessions)
+	handle("GET /api/v1/sessions/{id}", a.getSession)
+	handle("DELETE /api/v1/sessions/{id}", a.closeSession)
+	return mux
+}
+
+// serve authenticates the request, runs h and answers its error as JSON.
+func (a *adminAPI) serve(h func(http.ResponseWriter, *http.Request) error) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if !a.authorized(r) {
+			a.logger.Warnf("Admin API: unauthorized %s %s from %s", r.Method, r.URL.Path, r.RemoteAddr)
+			w.Header().Set("WWW-Authenticate", `Bearer realm="v-sftp"`)
+			writeJSON(w, http.StatusUnauthorized, map[string]string{"error": "unauthorized"})
+			return
+		}
+		err := h(w, r)
+		var apiErr *apiError
+		switch {
+		case err == nil:
+			a.logger.Infof("Admin API: %s %s from %s", r.Method, r.URL.Path, r.RemoteAddr)
+		case errors.As(err, &apiErr):
+			a.logger.Warnf("Admin API: %s %s from %s: %v", r.Method, r.URL.Path, r.RemoteAddr, err)
+			writeJSON(w, apiErr.status, map[string]string{"error": apiErr.msg})
+		default:
+			a.logger.Errorf("Admin API: %s %s from %s: %v", r.Method, r.URL.Path, r.RemoteAddr, err)
+			writeJSON(w, http.StatusInternalServerError, map[string]string{"error": "internal error"})
+		}
+	})
+}
+
+// authorized checks the bearer token. Without tokens the client certificate,
+// verified during the TLS handshake, is the only credential.
+func (a *adminAPI) authorized(r *http.Request) bool {
+	if len(a.tokens) == 0 {
+		return r.TLS != nil && len(r.TLS.VerifiedChains) > 0
+	}
+	token, ok := strings.CutPrefix(r.Header.Get("Authorization"), "Bearer ")
+	if !ok {
+		return false
+	}
+	sum := sha256.Sum256([]byte(token))
+	for _, t := range a.tokens {
+		if subtle.ConstantTimeCompare(sum[:], t[:]) == 1 {
+			return true
+		}
+	}
+	return false
+}
+
+func writeJSON(w http.ResponseWriter, status int, v any) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	enc := json.NewEncoder(w)
+	enc.SetIndent("", "  ")
+	enc.Encode(v)
+}
+
+// decodeJSON reads the request body into v, rejecting unknown fields.
+func decodeJSON(r *http.Request, v any) error {
+	dec := json.NewDecoder(http.MaxBytesReader(nil, r.Body, 1<<20))
+	dec.DisallowUnknownFields()
+	if err := dec.Decode(v); err != nil {
+		return errBadRequest("invalid JSON body: %v", err)
+	}
+	return nil
+}
+
+// parsePermsJSON parses a perms field: a number, names joined by '|' as for
+// --perms, or null for the group's.
+func parsePermsJSON(raw json.RawMessage) (sql.NullInt64, error) {
+	var v any
+	if err := json.Unmarshal(raw, &v); err != nil {
+		return sql.NullInt64{}, errBadRequest("invalid perms: %v", err)
+	}
+	var s string
+	switch v := v.(type) {
+	case nil:
+		return sql.NullInt64{}, nil
+	case float64:
+		s = strconv.FormatFloat(v, 'f', -1, 64)
+	case string:
+		s = v
+	default:
+		return sql.NullInt64{}, errBadRequest("invalid perms: want a number, names or null")
+	}
+	p, err := ParsePermission(s)
+	if err != nil {
+		return sql.NullInt64{}, errBadRequest("invalid perms: %v", err)
+	}
+	return sql.NullInt64{Int64: int64(p), Valid: true}, nil
+}
+
+// nullString maps "" to NULL.
+func nullString(s string) sql.NullString {
+	return sql.NullString{String: s, Valid: s != ""}
+}
+
+func hashPassword(password string) (sql.NullString, error) {
+	if password == "" {
+		return sql.NullString{}, errBadRequest("empty password")
+	}
+	b, err := bcrypt.GenerateFromPassword([]byte(password), bcrypt.DefaultCost)
+	if err != nil {
+		return sql.NullString{}, err
+	}
+	return sql.NullString{String: string(b), Valid: true}, nil
+}
+
+// userFromPath fetches the stored user named in the URL.
+func (a *adminAPI) userFromPath(r *http.Request) (*UserRecord, error) {
+	username := r.PathValue("username")
+	u, err := a.store.FetchUserRecord(r.Context(), username)
+	if errors.Is(err, sql.ErrNoRows) {
+		return nil, errNotFound("no user %q", username)
+	}
+	return u, err
+}
+
+func (a *adminAPI) listUsers(w http.ResponseWriter, r *http.Request) error {
+	users, err := a.store.ListUsers(r.Context())
+	if err != nil {
+		return err
+	}
+	list := make([]userJSON, 0, len(users))
+	for i := range users {
+		list = append(list, newUserJSON(&users[i]))
+	}
+	writeJSON(w, http.StatusOK, list)
+	return nil
+}
+
+// getUser answers the user with their effective settings and keys, like user show.
+func (a *adminAPI) getUser(w http.ResponseWriter, r *http.Request) error {
+	u, err := a.userFromPath(r)
+	if err != nil {
+		return err
+	}
+	v := newUserJSON(u)
+	effective, err := a.store.FetchUserByUsername(r.Context(), u.Username)
+	if err != nil {
+		return err
+	}
+	v.EffectiveRoot, v.EffectivePerms = &effective.RootPath, &effective.Perms
+	keys, err := a.store.FetchUserKeys(r.Context(), u.ID)
+	if err != nil {
+		return err
+	}
+	v.Keys = make([]keyJSON, 0, len(keys))
+	for i := range keys {
+		v.Keys = append(v.Keys, newKeyJSON(&keys[i]))
+	}
+	writeJSON(w, http.StatusOK, v)
+	return nil
+}
+
+// userInput is the body of POST and PATCH on users. Absent fields are left
+// unchanged (PATCH) or get their defaults (POST).
+type userInput struct {
+	Username    *string         `json:"username"`
+	DisplayName *string         `json:"display_name"`
+	GroupName   *string         `json:"group_name"`
+	RootPath    *string         `json:"root_path"`
+	Perms       json.RawMessage `json:"perms"`
+	Disabled    *bool           `json:"disabled"`
+	Password    *string         `json:"password"`    // POST only
+	PublicKeys  []string        `json:"public_keys"` // POST only
+}
+
+// apply copies the fields given in in to u.
+func (in *userInput) apply(u *UserRecord) error {
+	if in.Username != nil {
+		if u.Username = strings.TrimSpace(*in.Username); u.Username == "" {
+			return errBadRequest("empty username")
+		}
+	}
+	if in.DisplayName != nil {
+		u.DisplayName = *in.DisplayName
+	}
+	if in.GroupName != nil {
+		u.GroupName = *in.GroupName
+	}
+	if in.RootPath != nil {
+		u.RootPath = *in.RootPath
+	}
+	if in.Perms != nil {
+		perms, err := parsePermsJSON(in.Perms)
+		if err != nil {
+			return err
+		}
+		u.Perms = perms
+	}
+	if in.Disabled != nil {
+		u.Disabled = *in.Disabled
+	}
+	return nil
+}
+
+func (a *adminAPI) createUser(w http.ResponseWriter, r *http.Request) error {
+	var in userInput
+	if err := decodeJSON(r, &in); err != nil {
+		return err
+	}
+	if in.Username == nil {
+		return errBadRequest("missing username")
+	}
+	u := &UserRecord{GroupName: "default"}
+	if err := in.apply(u); err != nil {
+		return err
+	}
+	if u.DisplayName == "" {
+		u.DisplayName = u.Username
+	}
+	var keys []*UserKey
+	for _, line := range in.PublicKeys {
+		line, comment, err := parseAuthorizedKey(line)
+		if err != nil {
+			return errBadRequest("%v", err)
+		}
+		keys = append(keys, &UserKey{PublicKey: line, Comment: nullString(comment), Enabled: true})
+	}
+	if in.Password != nil {
+		hash, err := hashPassword(*in.Password)
+		if err != nil {
+			return err
+		}
+		u.PasswordHash = hash
+	}
+	if _, err := a.store.FetchUserRecord(r.Context(), u.Username); err == nil {
+		return errConflict("user %q already exists", u.Username)
+	}
+	if err := a.store.CreateUser(r.Context(), u, keys...); err != nil {
+		return err
+	}
+	v := newUserJSON(u)
+	for _, k := range keys {
+		v.Keys = append(v.Keys, newKeyJSON(k))
+	}
+	writeJSON(w, http.StatusCreated, v)
+	return nil
+}
+
+func (a *adminAPI) updateUser(w http.ResponseWriter, r *http.Request) error {
+	u, err := a.userFromPath(r)
+	if err != nil {
+		return err
+	}
+	var in userInput
+	if err := decodeJSON(r, &in); err != nil {
+		return err
+	}
+	if in.Password != nil || in.PublicKeys != nil {
+		return errBadRequest("use the password and keys endpoints to change credentials")
+	}
+	oldName, wasDisabled := u.Username, u.Disabled
+	if err := in.apply(u); err != nil {
+		return err
+	}
+	if u.Username != oldName {
+		if _, err := a.store.FetchUserRecord(r.Context(), u.Username); err == nil {
+			return errConflict("user %q already exists", u.Username)
+		}
+	}
+	if _, err := a.store.UpdateUser(r.Context(), u); err != nil {
+		return err
+	}
+	// Live sessions were authorized under the old name or state.
+	switch {
+	case u.Disabled && !wasDisabled:
+		if n := a.sessions.closeUser(oldName); n > 0 {
+			a.logger.Infof("Admin API: disconnected %d session(s) of disabled user %s", n, oldName)
+		}
+	case u.Username != oldName:
+		if n := a.sessions.closeUser(oldName); n > 0 {
+			a.logger.Infof("Admin API: disconnected %d session(s) of user %s, renamed to %s", n, oldName, u.Username)
+		}
+	}
+	writeJSON(w, http.StatusOK, newUserJSON(u))
+	return nil
+}
+
+func (a *adminAPI) deleteUser(w http.ResponseWriter, r *http.Request) error {
+	username := r.PathValue("username")
+	deleted, err := a.store.DeleteUser(r.Context(), username)
+	if err != nil {
+		return err
+	}
+	if !deleted {
+		return errNotFound("no user %q", username)
+	}
+	if n := a.sessions.closeUser(username); n > 0 {
+		a.logger.Infof("Admin API: disconnected %d session(s) of deleted user %s", n, username)
+	}
+	w.WriteHeader(http.StatusNoContent)
+	return nil
+}
+
+// setPassword sets (PUT {"password": ...}) or removes (DELETE) a password.
+func (a *adminAPI) setPassword(w http.ResponseWriter, r *http.Request) error {
+	u, err := a.userFromPath(r)
+	if err != nil {
+		return err
+	}
+	var hash sql.NullString
+	if r.Method == http.MethodPut {
+		var in struct {
+			Password string `json:"password"`
+		}
+		if err := decodeJSON(r, &in); err != nil {
+			return err
+		}
+		if hash, err = hashPassword(in.Password); err != nil {
+			return err
+		}
+	}
+	if _, err := a.store.SetUserPassword(r.Context(), u.Username, hash); err != nil {
+		return err
+	}
+	u.PasswordHash = hash
+	writeJSON(w, http.StatusOK, newUserJSON(u))
+	return nil
+}
+
+func (a *adminAPI) setDisabled(w http.ResponseWriter, r *http.Request) error {
+	u, err := a.userFromPath(r)
+	if err != nil {
+		return err
+	}
+	u.Disabled = strings.HasSuffix(r.URL.Path, "/disable")
+	if _, err := a.store.UpdateUser(r.Context(), u); err != nil {
+		return err
+	}
+	if u.Disabled {
+		if n := a.sessions.closeUser(u.Username); n > 0 {
+			a.logger.Infof("Admin API: disconnected %d session(s) of disabled user %s", n, u.Username)
+		}
+	}
+	writeJSON(w, http.StatusOK, newUserJSON(u))
+	return nil
+}
+
+func (a *adminAPI) listKeys(w http.ResponseWriter, r *http.Request) error {
+	u, err := a.userFromPath(r)
+	if err != nil {
+		return err
+	}
+	keys, err := a.store.FetchUserKeys(r.Context(), u.ID)
+	if err != nil {
+		return err
+	}
+	list := make([]keyJSON, 0, len(keys))
+	for i := range keys {
+		list = append(list, newKeyJSON(&keys[i]))
+	}
+	writeJSON(w, http.StatusOK, list)
+	return nil
+}
+
+func (a *adminAPI) addKey(w http.ResponseWriter, r *http.Request) error {
+	u, err := a.userFromPath(r)
+	if err != nil {
+		return err
+	}
+	var in struct {
+		PublicKey string  `json:"public_key"`
+		Comment   *string `json:"comment"`
+		ExpiresAt *string `json:"expires_at"`
+		Enabled   *bool   `json:"enabled"`
+	}
+	if err := decodeJSON(r, &in); err != nil {
+		return err
+	}
+	line, comment, err := parseAuthorizedKey(in.PublicKey)
+	if err != nil {
+		return errBadRequest("%v", err)
+	}
+	if in.Comment != nil {
+		comment = *in.Comment
+	}
+	k := &UserKey{UserID: u.ID, PublicKey: line, Comment: nullString(comment), Enabled: in.Enabled == nil || *in.Enabled}
+	if in.ExpiresAt != nil {
+		t, err := parseExpiry(*in.ExpiresAt)
+		if err != nil {
+			return errBadRequest("invalid expires_at %q: want RFC 3339 or YYYY-MM-DD", *in.ExpiresAt)
+		}
+		k.ExpiresAt = sql.NullTime{Time: t, Valid: true}
+	}
+	if err := a.store.AddUserKey(r.Context(), k); err != nil {
+		return err
+	}
+	writeJSON(w, http.StatusCreated, newKeyJSON(k))
+	return nil
+}
+
+func (a *adminAPI) deleteKey(w http.ResponseWriter, r *http.Request) error {
+	u, err := a.userFromPath(r)
+	if err != nil {
+		return err
+	}
+	id, err := strconv.Atoi(r.PathValue("id"))
+	if err != nil {
+		return errBadRequest("invalid key id %q", r.PathValue("id"))
+	}
+	removed, err := a.store.DeleteUserKey(r.Context(), u.ID, id)
+	if err != nil {
+		return err
+	}
+	if !removed {
+		return errNotFound("user %s has no key %d", u.Username, id)
+	}
+	w.WriteHeader(http.StatusNoContent)
+	return nil
+}
+
+// quotaJSON is a user's quota and usage. Live usage is the count kept by the
+// user's open sessions; otherwise the filesystem is scanned.
+type quotaJSON struct {
+	Username string `json:"username"`
+	MaxBytes *int64 `json:"max_bytes"` // null: unlimited
+	MaxFiles *int64 `json:"max_files"`
+	Bytes    int64  `json:"bytes"`
+	Files    int64  `json:"files"`
+	Live     bool   `json:"live"`
+}
+
+func (a *adminAPI) getQuota(w http.ResponseWriter, r *http.Request) error {
+	username := r.PathValue("username")
+	user, err := a.store.FetchUserByUsername(r.Context(), username)
+	if errors.Is(err, sql.ErrNoRows) {
+		return errNotFound("no user %q", username)
+	}
+	if err != nil {
+		return err
+	}
+	limit, err := a.store.FetchQuota(r.Context(), user)
+	if err != nil {
+		return err
+	}
+	v := quotaJSON{Username: user.Username}
+	if limit != nil {
+		if limit.MaxBytes.Valid {
+			v.MaxBytes = &limit.MaxBytes.Int64
+		}
+		if limit.MaxFiles.Valid {
+			v.MaxFiles = &limit.MaxFiles.Int64
+		}
+	}
+	v.Bytes, v.Files, v.Live = currentQuotaUsage(user.Username)
+	if !v.Live {
+		fs, _, err := openUserFileSystem(r.Context(), a.store, user, a.logger)
+		if err != nil {
+			return err
+		}
+		if v.Bytes, v.Files, err = diskUsage(fs, "/"); err != nil {
+			return fmt.Errorf("scanning usage of %s: %w", user.Username, err)
+		}
+	}
+	writeJSON(w, http.StatusOK, v)
+	return nil
+}
+
+// bandwidthJSON is a user's effective bandwidth limits in bytes per second.
+type bandwidthJSON struct {
+	Username     string `json:"username"`
+	UploadRate   int64  `json:"upload_rate"` // 0: unlimited
+	DownloadRate int64  `json:"download_rate"`
+}
+
+// getBandwidth answers the limits the user's next session gets. Changed rows
+// in sftp_bandwidth_limits reach open sessions on SIGHUP.
+func (a *adminAPI) getBandwidth(w http.ResponseWriter, r *http.Request) error {
+	username := r.PathValue("username")
+	user, err := a.store.FetchUserByUsername(r.Context(), username)
+	if errors.Is(err, sql.ErrNoRows) {
+		return errNotFound("no user %q", username)
+	}
+	if err != nil {
+		return err
+	}
+	limits, err := a.store.FetchBandwidthLimits(r.Context(), user, defaultBandwidthLimits())
+	if err != nil {
+		return err
+	}
+	writeJSON(w, http.StatusOK, bandwidthJSON{Username: user.Username, UploadRate: limits.Upload, DownloadRate: limits.Download})
+	return nil
+}
+
+// groupJSON is a group as answered by the admin API.
+type groupJSON struct {
+	ID           int         `json:"id"`
+	Name         string      `json:"name"`
+	Description  string      `json:"description"`
+	Perms        *Permission `json:"perms"` // null: members without perms get none
+	RootTemplate string      `json:"root_template"`
+	CreatedAt    *time.Time  `json:"created_at,omitempty"`
+}
+
+func newGroupJSON(g *Group) groupJSON {
+	v := groupJSON{ID: g.ID, Name: g.Name, Description: g.Description.String, RootTemplate: g.RootTemplate.String}
+	if g.Perms.Valid {
+		p := Permission(g.Perms.Int64)
+		v.Perms = &p
+	}
+	if g.CreatedAt.Valid {
+		v.CreatedAt = &g.CreatedAt.Time
+	}
+	return v
+}
+
+// groupInput is the body of POST and PATCH on groups. Empty strings clear the
+// description and root template.
+type groupInput struct {
+	Name         *string         `json:"name"`
+	Description  *string         `json:"description"`
+	Perms        json.RawMessage `json:"perms"`
+	RootTemplate *string         `json:"root_template"`
+}
+
+func (in *groupInput) apply(g *Group) error {
+	if in.Name != nil {
+		if g.Name = strings.TrimSpace(*in.Name); g.Name == "" {
+			return errBadRequest("empty group name")
+		}
+	}
+	if in.Description != nil {
+		g.Description = nullString(*in.Description)
+	}
+	if in.Perms != nil {
+		perms, err := parsePermsJSON(in.Perms)
+		if err != nil {
+			return err
+		}
+		g.Perms = perms
+	}
+	if in.RootTemplate != nil {
+		g.RootTemplate = nullString(*in.RootTemplate)
+	}
+	return nil
+}
+
+// groupFromPath fetches the group named in the URL.
+func (a *adminAPI) groupFromPath(r *http.Request) (*Group, error) {
+	name := r.PathValue("name")
+	g, err := a.store.FetchGroup(r.Context(), name)
+	if errors.Is(err, sql.ErrNoRows) {
+		return nil, errNotFound("no group %q", name)
+	}
+	return g, err
+}
+
+func (a *adminAPI) listGroups(w http.ResponseWriter, r *http.Request) error {
+	groups, err := a.store.ListGroups(r.Context())
+	if err != nil {
+		return err
+	}
+	list := make([]groupJSON, 0, len(groups))
+	for i := range groups {
+		list = append(list, newGroupJSON(&groups[i]))
+	}
+	writeJSON(w, http.StatusOK, list)
+	return nil
+}
+
+func (a *adminAPI) getGroup(w http.ResponseWriter, r *http.Request) error {
+	g, err := a.groupFromPath(r)
+	if err != nil {
+		return err
+	}
+	writeJSON(w, http.StatusOK, newGroupJSON(g))
+	return nil
+}
+
+func (a *adminAPI) createGroup(w http.ResponseWriter, r *http.Request) error {
+	var in groupInput
+	if err := decodeJSON(r, &in); err != nil {
+		return err
+	}
+	if in.Name == nil {
+		return errBadRequest("missing name")
+	}
+	g := &Group{}
+	if err := in.apply(g); err != nil {
+		return err
+	}
+	if _, err := a.store.FetchGroup(r.Context(), g.Name); err == nil {
+		return errConflict("group %q already exists", g.Name)
+	}
+	if err := a.store.CreateGroup(r.Context(), g); err != nil {
+		return err
+	}
+	writeJSON(w, http.StatusCreated, newGroupJSON(g))
+	return nil
+}
+
+func (a *adminAPI) updateGroup(w http.ResponseWriter, r *http.Request) error {
+	g, err := a.groupFromPath(r)
+	if err != nil {
+		return err
+	}
+	var in groupInput
+	if err := decodeJSON(r, &in); err != nil {
+		return err
+	}
+	oldName := g.Name
+	if err := in.apply(g); err != nil {
+		return err
+	}
+	if g.Name != oldName {
+		if _, err := a.store.FetchGroup(r.Context(), g.Name); err == nil {
+			return errConflict("group %q already exists", g.Name)
+		}
+	}
+	if _, err := a.store.UpdateGroup(r.Context(), g); err != nil {
+		return err
+	}
+	writeJSON(w, http.StatusOK, newGroupJSON(g))
+	return nil
+}
+
+func (a *adminAPI) deleteGroup(w http.ResponseWriter, r *http.Request) error {
+	name := r.PathValue("name")
+	deleted, err := a.store.DeleteGroup(r.Context(), name)
+	if err != nil {
+		return err
+	}
+	if !deleted {
+		return errNotFound("no group %q", name)
+	}
+	w.WriteHeader(http.StatusNoContent)
+	return nil
+}
+
+// sessionJSON is an open SSH session as answered by the admin API.
+type sessionJSON struct {
+	ID            string       `json:"id"`
+	Username      string       `json:"username"`
+	RemoteAddr    string       `json:"remote_addr"`
+	ClientVersion string       `json:"client_version"`
+	AuthMethod    string       `json:"auth_method"`
+	StartedAt     time.Time    `json:"started_at"`
+	LastActiveAt  time.Time    `json:"last_active_at"`
+	BytesIn       int64        `json:"bytes_in"`
+	BytesOut      int64        `json:"bytes_out"`
+	Handles       []handleJSON `json:"handles"`
+}
+
+type handleJSON struct {
+	Path     string    `json:"path"`
+	Mode     string    `json:"mode"`
+	OpenedAt time.Time `json:"opened_at"`
+	Bytes    int64     `json:"bytes"`
+}
+
+func newSessionJSON(s *Session) sessionJSON {
+	v := sessionJSON{ID: s.ID, Username: s.Username, RemoteAddr: s.RemoteAddr, ClientVersion: s.ClientVersion, AuthMethod: s.AuthMethod, StartedAt: s.StartedAt, LastActiveAt: s.LastActive()}
+	v.BytesIn, v.BytesOut = s.Bytes()
+	v.Handles = []handleJSON{}
+	for _, h := range s.Handles() {
+		v.Handles = append(v.Handles, handleJSON{h.Path, h.Mode, h.OpenedAt, h.Bytes})
+	}
+	return v
+}
+
+func (a *adminAPI) listSessions(w http.ResponseWriter, r *http.Request) error {
+	sessions := a.sessions.list()
+	list := make([]sessionJSON, 0, len(sessions))
+	for _, s := range sessions {
+		list = append(list, newSessionJSON(s))
+	}
+	writeJSON(w, http.StatusOK, list)
+	return nil
+}
+
+func (a *adminAPI) getSession(w http.ResponseWriter, r *http.Request) error {
+	s := a.sessions.get(r.PathValue("id"))
+	if s == nil {
+		return errNotFound("no session %q", r.PathValue("id"))
+	}
+	writeJSON(w, http.StatusOK, newSessionJSON(s))
+	return nil
+}
+
+func (a *adminAPI) closeSession(w http.ResponseWriter, r *http.Request) error {
+	id := r.PathValue("id")
+	if !a.sessions.close(id) {
+		return errNotFound("no session %q", id)
+	}
+	a.logger.Infof("Admin API: disconnected session %s", id)
+	w.WriteHeader(http.StatusNoContent)
+	return nil
+}
+
+func (a *adminAPI) closeUserSessions(w http.ResponseWriter, r *http.Request) error {
+	username := r.PathValue("username")
+	n := a.sessions.closeUser(username)
+	a.logger.Infof("Admin API: disconnected %d session(s) of %s", n, username)
+	writeJSON(w, http.StatusOK, map[string]any{"username": username, "disconnected": n})
+	return nil
+}
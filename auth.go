@@ -0,0 +1,455 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+
+	"go.uber.org/zap"
+	"golang.org/x/crypto/ssh"
+)
+
+// sshAuth implements the ssh.ServerConfig authentication callbacks on top of the
+// user provider: passwords, plain keys, CA-signed certificates and the TOTP second
+// factor. Server-side state (TOTP, key usage, IP rules) is kept in the SQL store.
+// When hook is set, passwords and plain keys are checked by the external auth
+// hook instead, which also supplies the User.
+type sshAuth struct {
+	users         UserProvider
+	store         *UserStore
+	logger        *zap.SugaredLogger
+	certAuthority *userCertAuthority
+	certChecker   *ssh.CertChecker
+	defender      *defender
+	hook          *authHook
+	sessionLimit  func(username string) error // refuses users with too many sessions; nil: none
+}
+
+// hookUserExtension carries the JSON-encoded User built by the auth hook from
+// the authentication callbacks to the SFTP session.
+const hookUserExtension = "hook-user"
+
+func newSSHAuth(users UserProvider, store *UserStore, logger *zap.SugaredLogger, certAuthority *userCertAuthority, defender *defender, hook *authHook, sessionLimit func(string) error) *sshAuth {
+	a := &sshAuth{users: users, store: store, logger: logger, certAuthority: certAuthority, defender: defender, hook: hook, sessionLimit: sessionLimit}
+	// Certificates signed by a trusted CA are validated by CertChecker (principals,
+	// validity window, revocation); plain keys fall through to plainKeyCallback.
+	a.certChecker = &ssh.CertChecker{
+		IsUserAuthority: certAuthority.IsUserAuthority,
+		IsRevoked:       certAuthority.IsRevoked,
+		UserKeyFallback: a.plainKeyCallback,
+	}
+	return a
+}
+
+// configure wires the callbacks into the server config.
+func (a *sshAuth) configure(config *ssh.ServerConfig) {
+	config.PasswordCallback = func(c ssh.ConnMetadata, pass []byte) (*ssh.Permissions, error) {
+		return a.limitSessions(a.PasswordCallback(c, pass))
+	}
+	config.PublicKeyCallback = func(c ssh.ConnMetadata, key ssh.PublicKey) (*ssh.Permissions, error) {
+		return a.limitSessions(a.PublicKeyCallback(c, key))
+	}
+	config.KeyboardInteractiveCallback = func(c ssh.ConnMetadata, client ssh.KeyboardInteractiveChallenge) (*ssh.Permissions, error) {
+		return a.limitSessions(a.KeyboardInteractiveCallback(c, client))
+	}
+	config.AuthLogCallback = a.AuthLogCallback
+}
+
+// limitSessions refuses a login that has passed every factor when its user
+// already has as many sessions as allowed. The reason is sent as a banner,
+// which clients show, before the authentication failure.
+func (a *sshAuth) limitSessions(perms *ssh.Permissions, err error) (*ssh.Permissions, error) {
+	var partial *ssh.PartialSuccessError
+	if errors.As(err, &partial) && partial.Next.KeyboardInteractiveCallback != nil {
+		next := partial.Next.KeyboardInteractiveCallback
+		partial.Next.KeyboardInteractiveCallback = func(c ssh.ConnMetadata, client ssh.KeyboardInteractiveChallenge) (*ssh.Permissions, error) {
+			return a.limitSessions(next(c, client))
+		}
+		return nil, err
+	}
+	if err != nil || a.sessionLimit == nil {
+		return perms, err
+	}
+	if err := a.sessionLimit(perms.Extensions["username"]); err != nil {
+		a.logger.Warnf("Rejecting login of %s: %v", perms.Extensions["username"], err)
+		metricConnectionsRejected.inc("user_sessions")
+		return nil, &ssh.BannerError{Err: err, Message: err.Error() + "\n"}
+	}
+	return perms, nil
+}
+
+// AuthLogCallback counts every attempt in the metrics and feeds failed password
+// and keyboard-interactive attempts (which include second-factor codes) to the
+// defender. Public key failures are not fed: clients routinely offer several
+// keys before the right one. Nor are logins refused for the user's session
+// limit, whose credentials were right.
+func (a *sshAuth) AuthLogCallback(c ssh.ConnMetadata, method string, err error) {
+	metricAuthAttempts.inc(authMethodLabel(method), authResultLabel(err))
+	if err == nil || (method != "password" && method != "keyboard-interactive") {
+		return
+	}
+	var partial *ssh.PartialSuccessError
+	var limit *limitError
+	if errors.As(err, &partial) || errors.As(err, &limit) {
+		return
+	}
+	// attempts rejected because of an existing ban do not extend it
+	if a.defender.CheckConn(c.RemoteAddr(), c.User()) != nil {
+		return
+	}
+	a.defender.RecordFailure(c.RemoteAddr(), c.User())
+}
+
+// fetchUser loads the connecting user and rejects disabled, locked or banned logins.
+func (a *sshAuth) fetchUser(c ssh.ConnMetadata) (*User, error) {
+	if err := a.checkBan(c); err != nil {
+		return nil, err
+	}
+	cxt, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	user, err := a.users.FetchUserByUsername(cxt, c.User())
+	if err != nil {
+		a.logger.Warnf("User %s not found: %v", c.User(), err)
+		return nil, err
+	}
+	return user, a.admit(cxt, c, user)
+}
+
+// hookUser asks the auth hook to authenticate the attempt and applies the same
+// ban, disabled and source address checks as fetchUser to the returned User.
+func (a *sshAuth) hookUser(c ssh.ConnMetadata, req *authHookRequest) (*User, error) {
+	if err := a.checkBan(c); err != nil {
+		return nil, err
+	}
+	req.Username = c.User()
+	req.RemoteIP = remoteIP(c.RemoteAddr())
+	req.ClientVersion = string(c.ClientVersion())
+	user, err := a.hook.Authenticate(context.Background(), req)
+	if err != nil {
+		a.logger.Warnf("Auth hook rejected %s login for user %s: %v", req.Method, c.User(), err)
+		return nil, err
+	}
+	cxt, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	return user, a.admit(cxt, c, user)
+}
+
+func (a *sshAuth) checkBan(c ssh.ConnMetadata) error {
+	if err := a.defender.CheckConn(c.RemoteAddr(), c.User()); err != nil {
+		a.logger.Warnf("Login for user %s from %s refused: %v", c.User(), c.RemoteAddr(), err)
+		return err
+	}
+	return nil
+}
+
+// admit rejects disabled users and sources outside their IP rules.
+func (a *sshAuth) admit(ctx context.Context, c ssh.ConnMetadata, user *User) error {
+	if user.Disabled {
+		a.logger.Warnf("User %s is disabled", c.User())
+		return fmt.Errorf("user disabled")
+	}
+	if err := a.checkSourceIP(ctx, c, user); err != nil {
+		a.logger.Warnf("Login for user %s from %s rejected: %v", c.User(), c.RemoteAddr(), err)
+		return fmt.Errorf("source address not allowed")
+	}
+	return nil
+}
+
+// withHookUser records a hook-built user in perms so that sessionUser does not
+// have to look it up in the provider, where it may not exist.
+func (a *sshAuth) withHookUser(user *User, perms *ssh.Permissions) (*ssh.Permissions, error) {
+	session := *user
+	session.PasswordHash = sql.NullString{}
+	b, err := json.Marshal(&session)
+	if err != nil {
+		return nil, err
+	}
+	perms.Extensions[hookUserExtension] = string(b)
+	return perms, nil
+}
+
+// sessionUser returns the user an authenticated connection belongs to.
+func (a *sshAuth) sessionUser(ctx context.Context, perms *ssh.Permissions) (*User, error) {
+	if raw, ok := perms.Extensions[hookUserExtension]; ok {
+		var user User
+		if err := json.Unmarshal([]byte(raw), &user); err != nil {
+			return nil, fmt.Errorf("invalid hook user: %w", err)
+		}
+		return &user, nil
+	}
+	return a.users.FetchUserByUsername(ctx, perms.Extensions["username"])
+}
+
+// touchKey records the use of the stored key the connection authenticated
+// with. It is called once the handshake has succeeded: the public key
+// callback also answers queries for keys the client never signs with.
+func (a *sshAuth) touchKey(ctx context.Context, perms *ssh.Permissions) {
+	keyID, err := strconv.Atoi(perms.Extensions["key-id"])
+	if err != nil || keyID == 0 {
+		return
+	}
+	if err := a.store.TouchUserKey(ctx, keyID); err != nil {
+		a.logger.Warnf("Failed to record key usage for user %s: %v", perms.Extensions["username"], err)
+	}
+}
+
+// checkSourceIP enforces the user's and group's CIDR allow/deny rules.
+func (a *sshAuth) checkSourceIP(ctx context.Context, c ssh.ConnMetadata, user *User) error {
+	ip, ok := addrIP(c.RemoteAddr())
+	if !ok {
+		return fmt.Errorf("cannot determine source address from %s", c.RemoteAddr())
+	}
+	rules, err := a.store.FetchIPRules(ctx, user)
+	if err != nil {
+		return err
+	}
+	return checkUserIP(rules, ip)
+}
+
+func (a *sshAuth) checkPassword(user *User, pass []byte) error {
+	cxt, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	if err := a.users.CheckPassword(cxt, user, pass); err != nil {
+		a.logger.Warnf("Password rejected for user %s: %v", user.Username, err)
+		return err
+	}
+	return nil
+}
+
+func (a *sshAuth) PasswordCallback(c ssh.ConnMetadata, pass []byte) (*ssh.Permissions, error) {
+	a.logger.Infof("Password auth attempt for user: %s", c.User())
+	user, err := a.passwordUser(c, "password", pass)
+	if err != nil {
+		return nil, err
+	}
+	//attach user info to session
+	perms := &ssh.Permissions{Extensions: map[string]string{"username": user.Username, "auth-method": "password"}}
+	if a.hook != nil {
+		if perms, err = a.withHookUser(user, perms); err != nil {
+			return nil, err
+		}
+	}
+	return a.secondFactor(user, "password", perms)
+}
+
+// passwordUser checks a password through the auth hook or the user provider.
+func (a *sshAuth) passwordUser(c ssh.ConnMetadata, method string, pass []byte) (*User, error) {
+	if a.hook != nil {
+		return a.hookUser(c, &authHookRequest{Method: method, Password: string(pass)})
+	}
+	user, err := a.fetchUser(c)
+	if err != nil {
+		return nil, err
+	}
+	if err := a.checkPassword(user, pass); err != nil {
+		return nil, err
+	}
+	return user, nil
+}
+
+// KeyboardInteractiveCallback lets clients that only speak keyboard-interactive
+// log in with a password, followed by a verification code when required.
+func (a *sshAuth) KeyboardInteractiveCallback(c ssh.ConnMetadata, client ssh.KeyboardInteractiveChallenge) (*ssh.Permissions, error) {
+	a.logger.Infof("Keyboard-interactive auth attempt for user: %s", c.User())
+	answers, err := client("", "", []string{"Password: "}, []bool{false})
+	if err != nil {
+		return nil, err
+	}
+	if len(answers) != 1 {
+		return nil, fmt.Errorf("unexpected number of answers")
+	}
+	user, err := a.passwordUser(c, "keyboard-interactive", []byte(answers[0]))
+	if err != nil {
+		return nil, err
+	}
+	perms := &ssh.Permissions{Extensions: map[string]string{"username": user.Username, "auth-method": "keyboard-interactive"}}
+	if a.hook != nil {
+		if perms, err = a.withHookUser(user, perms); err != nil {
+			return nil, err
+		}
+	}
+	totp, err := a.fetchTOTP(user)
+	if err != nil {
+		return nil, err
+	}
+	if !totp.Required("keyboard-interactive") {
+		return perms, nil
+	}
+	return a.totpCallback(user, totp, perms)(c, client)
+}
+
+func (a *sshAuth) PublicKeyCallback(c ssh.ConnMetadata, key ssh.PublicKey) (*ssh.Permissions, error) {
+	perms, err := a.certChecker.Authenticate(c, key)
+	if err != nil {
+		a.logger.Warnf("Public key rejected for user %s: %v", c.User(), err)
+		return nil, err
+	}
+	cert, ok := key.(*ssh.Certificate)
+	if !ok {
+		return a.secondFactorForUser(c, "publickey", perms)
+	}
+	// The certificate is valid for this principal; make sure the account exists and is enabled.
+	user, err := a.fetchUser(c)
+	if err != nil {
+		return nil, err
+	}
+	if err := a.certChecker.CheckCert(user.Username, cert); err != nil {
+		a.logger.Warnf("Certificate for %s not valid for stored username %s: %v", c.User(), user.Username, err)
+		return nil, err
+	}
+	fingerprint := ssh.FingerprintSHA256(cert.Key)
+	a.logger.Infof("Certificate accepted for user %s: serial=%d id=%q key %s", c.User(), cert.Serial, cert.KeyId, fingerprint)
+	// keep CriticalOptions so the ssh package enforces source-address
+	return a.secondFactor(user, "publickey", &ssh.Permissions{
+		CriticalOptions: perms.CriticalOptions,
+		Extensions: map[string]string{
+			"username":        user.Username,
+			"auth-method":     "publickey",
+			"key-fingerprint": fingerprint,
+			"cert-serial":     strconv.FormatUint(cert.Serial, 10),
+			"cert-key-id":     cert.KeyId,
+		},
+	})
+}
+
+func (a *sshAuth) plainKeyCallback(c ssh.ConnMetadata, key ssh.PublicKey) (*ssh.Permissions, error) {
+	a.logger.Infof("Public key auth attempt for user: %s", c.User())
+	if a.hook != nil {
+		return a.hookKeyCallback(c, key)
+	}
+	user, err := a.fetchUser(c)
+	if err != nil {
+		return nil, err
+	}
+	if a.certAuthority.KeyRevoked(key) {
+		a.logger.Warnf("Revoked public key %s offered for user %s", ssh.FingerprintSHA256(key), c.User())
+		return nil, fmt.Errorf("public key revoked")
+	}
+	cxt, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	userKey, err := a.users.MatchUserKey(cxt, user, key)
+	if err != nil {
+		a.logger.Warnf("Public key rejected for user %s: %v", c.User(), err)
+		return nil, err
+	}
+	fingerprint := ssh.FingerprintSHA256(key)
+	a.logger.Infof("Public key %s accepted for user %s", fingerprint, c.User())
+	//attach user info to session
+	perms := &ssh.Permissions{Extensions: map[string]string{
+		"username":        user.Username,
+		"auth-method":     "publickey",
+		"key-fingerprint": fingerprint,
+		"key-id":          strconv.Itoa(userKey.ID),
+	}}
+	return perms, nil
+}
+
+// hookKeyCallback sends the offered key to the auth hook. Revoked keys are
+// refused before the hook is asked.
+func (a *sshAuth) hookKeyCallback(c ssh.ConnMetadata, key ssh.PublicKey) (*ssh.Permissions, error) {
+	fingerprint := ssh.FingerprintSHA256(key)
+	if a.certAuthority.KeyRevoked(key) {
+		a.logger.Warnf("Revoked public key %s offered for user %s", fingerprint, c.User())
+		return nil, fmt.Errorf("public key revoked")
+	}
+	user, err := a.hookUser(c, &authHookRequest{
+		Method:               "publickey",
+		PublicKeyFingerprint: fingerprint,
+		PublicKey:            strings.TrimSpace(string(ssh.MarshalAuthorizedKey(key))),
+	})
+	if err != nil {
+		return nil, err
+	}
+	a.logger.Infof("User %s authenticated with key %s via auth hook", c.User(), fingerprint)
+	return a.withHookUser(user, &ssh.Permissions{Extensions: map[string]string{
+		"username":        user.Username,
+		"auth-method":     "publickey",
+		"key-fingerprint": fingerprint,
+	}})
+}
+
+// secondFactorForUser reloads the user named in perms before applying secondFactor;
+// used where the first factor did not hand back the User.
+func (a *sshAuth) secondFactorForUser(c ssh.ConnMetadata, method string, perms *ssh.Permissions) (*ssh.Permissions, error) {
+	if _, ok := perms.Extensions[hookUserExtension]; ok {
+		user, err := a.sessionUser(context.Background(), perms)
+		if err != nil {
+			return nil, err
+		}
+		return a.secondFactor(user, method, perms)
+	}
+	user, err := a.fetchUser(c)
+	if err != nil {
+		return nil, err
+	}
+	return a.secondFactor(user, method, perms)
+}
+
+func (a *sshAuth) fetchTOTP(user *User) (*UserTOTP, error) {
+	cxt, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	totp, err := a.store.FetchUserTOTP(cxt, user.ID)
+	if err != nil {
+		a.logger.Errorf("Failed to load TOTP settings for user %s: %v", user.Username, err)
+		return nil, err
+	}
+	return totp, nil
+}
+
+// secondFactor returns perms unchanged when the user has no TOTP requirement for
+// method. Otherwise it answers with SSH partial success so the client is asked to
+// continue with keyboard-interactive, where the verification code is collected.
+func (a *sshAuth) secondFactor(user *User, method string, perms *ssh.Permissions) (*ssh.Permissions, error) {
+	totp, err := a.fetchTOTP(user)
+	if err != nil {
+		return nil, err
+	}
+	if !totp.Required(method) {
+		return perms, nil
+	}
+	a.logger.Infof("User %s passed %s; verification code required", user.Username, method)
+	return nil, &ssh.PartialSuccessError{Next: ssh.ServerAuthCallbacks{
+		KeyboardInteractiveCallback: a.totpCallback(user, totp, perms),
+	}}
+}
+
+// totpCallback prompts for a TOTP or recovery code and, once accepted, grants perms.
+func (a *sshAuth) totpCallback(user *User, totp *UserTOTP, perms *ssh.Permissions) func(ssh.ConnMetadata, ssh.KeyboardInteractiveChallenge) (*ssh.Permissions, error) {
+	return func(c ssh.ConnMetadata, client ssh.KeyboardInteractiveChallenge) (*ssh.Permissions, error) {
+		answers, err := client("", "Two-factor authentication", []string{"Verification code: "}, []bool{false})
+		if err != nil {
+			return nil, err
+		}
+		if len(answers) != 1 {
+			return nil, fmt.Errorf("unexpected number of answers")
+		}
+		cxt, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+		defer cancel()
+		ok, err := a.store.VerifyTOTP(cxt, totp, answers[0])
+		if err != nil {
+			a.logger.Errorf("Failed to verify TOTP for user %s: %v", user.Username, err)
+			return nil, err
+		}
+		if !ok {
+			if ok, err = a.store.UseRecoveryCode(cxt, user.ID, answers[0]); err != nil {
+				a.logger.Errorf("Failed to check recovery code for user %s: %v", user.Username, err)
+				return nil, err
+			}
+			if ok {
+				a.logger.Warnf("User %s used a recovery code", user.Username)
+			}
+		}
+		if !ok {
+			a.logger.Warnf("Invalid verification code for user %s", user.Username)
+			return nil, fmt.Errorf("invalid verification code")
+		}
+		a.logger.Infof("User %s passed two-factor authentication", user.Username)
+		perms.Extensions["auth-method"] += "+totp"
+		return perms, nil
+	}
+}
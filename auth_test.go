@@ -0,0 +1,169 @@
+package main
+
+import (
+	"context"
+	"crypto/ed25519"
+	"crypto/rand"
+	"errors"
+	"net"
+	"testing"
+
+	"go.uber.org/zap"
+	"golang.org/x/crypto/ssh"
+)
+
+// testConnMetadata is the part of ssh.ConnMetadata the auth callbacks use.
+type testConnMetadata struct {
+	ssh.ConnMetadata
+	user string
+}
+
+func (c testConnMetadata) User() string { return c.user }
+
+func (c testConnMetadata) RemoteAddr() net.Addr {
+	return &net.TCPAddr{IP: net.IPv4(192, 0, 2, 1), Port: 2222}
+}
+
+func TestPublicKeyCallbackDefersKeyUsage(t *testing.T) {
+	ctx := context.Background()
+	s := newTestStore(t)
+	logger := zap.NewNop().Sugar()
+	a := newSSHAuth(s, s, logger, &userCertAuthority{}, newDefender(s, logger), nil, nil)
+
+	pub, _, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	key, err := ssh.NewPublicKey(pub)
+	if err != nil {
+		t.Fatal(err)
+	}
+	u := &UserRecord{Username: "alice", GroupName: "default", RootPath: t.TempDir()}
+	if err := s.CreateUser(ctx, u); err != nil {
+		t.Fatal(err)
+	}
+	k := &UserKey{UserID: u.ID, PublicKey: string(ssh.MarshalAuthorizedKey(key)), Enabled: true}
+	if err := s.AddUserKey(ctx, k); err != nil {
+		t.Fatal(err)
+	}
+	lastUsed := func() bool {
+		keys, err := s.FetchUserKeys(ctx, u.ID)
+		if err != nil || len(keys) != 1 {
+			t.Fatalf("FetchUserKeys = %v, %v", keys, err)
+		}
+		return keys[0].LastUsedAt.Valid
+	}
+
+	// the callback also answers queries, made before the client signs anything
+	perms, err := a.PublicKeyCallback(testConnMetadata{user: "alice"}, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if lastUsed() {
+		t.Error("key usage recorded by the public key callback")
+	}
+	a.touchKey(ctx, perms)
+	if !lastUsed() {
+		t.Error("key usage not recorded after the handshake")
+	}
+
+	// the legacy sftp_users.public_key has no key row to touch
+	a.touchKey(ctx, &ssh.Permissions{Extensions: map[string]string{"username": "alice", "key-id": "0"}})
+	a.touchKey(ctx, &ssh.Permissions{Extensions: map[string]string{"username": "alice"}})
+}
+
+// testHandshake runs an SSH handshake of user with password against config and
+// returns the banners the client was sent.
+func testHandshake(t *testing.T, config *ssh.ServerConfig, user, password string) ([]string, error) {
+	t.Helper()
+	// both ends send their version first, which a net.Pipe would deadlock on
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+	done := make(chan error, 1)
+	go func() {
+		serverConn, err := l.Accept()
+		if err != nil {
+			done <- err
+			return
+		}
+		defer serverConn.Close()
+		conn, _, _, err := ssh.NewServerConn(serverConn, config)
+		if err == nil {
+			conn.Close()
+		}
+		done <- err
+	}()
+	var banners []string
+	clientConfig := &ssh.ClientConfig{
+		User:            user,
+		Auth:            []ssh.AuthMethod{ssh.Password(password)},
+		HostKeyCallback: ssh.InsecureIgnoreHostKey(),
+		BannerCallback: func(message string) error {
+			banners = append(banners, message)
+			return nil
+		},
+	}
+	client, err := ssh.Dial("tcp", l.Addr().String(), clientConfig)
+	if err == nil {
+		client.Close()
+	}
+	return banners, <-done
+}
+
+func TestSessionLimitRefusesLogin(t *testing.T) {
+	ctx := context.Background()
+	s := newTestStore(t)
+	logger := zap.NewNop().Sugar()
+	hash, err := hashPassword("secret")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := s.CreateUser(ctx, &UserRecord{Username: "alice", GroupName: "default", PasswordHash: hash}); err != nil {
+		t.Fatal(err)
+	}
+	full := true
+	limit := func(username string) error {
+		if full {
+			return &limitError{disconnectTooManyConnections, "too many sessions of " + username + " (limit 1)"}
+		}
+		return nil
+	}
+	d := newDefender(s, logger)
+	a := newSSHAuth(s, s, logger, &userCertAuthority{}, d, nil, limit)
+	_, hostKey, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	signer, err := ssh.NewSignerFromKey(hostKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	config := &ssh.ServerConfig{}
+	a.configure(config)
+	config.AddHostKey(signer)
+
+	banners, err := testHandshake(t, config, "alice", "secret")
+	var authErr *ssh.ServerAuthError
+	if !errors.As(err, &authErr) {
+		t.Fatalf("handshake over the limit = %v, want an authentication failure", err)
+	}
+	if len(banners) == 0 || banners[0] != "too many sessions of alice (limit 1)\n" {
+		t.Errorf("banners %q, want the session limit", banners)
+	}
+	if len(d.failures) > 0 {
+		t.Errorf("defender recorded %v", d.failures)
+	}
+
+	// wrong credentials are refused without mentioning the limit
+	if banners, err = testHandshake(t, config, "alice", "wrong"); err == nil || len(banners) > 0 {
+		t.Errorf("handshake with a wrong password = %v, banners %q", err, banners)
+	}
+
+	full = false
+	if _, err := testHandshake(t, config, "alice", "secret"); err != nil {
+		t.Errorf("handshake under the limit = %v", err)
+	}
+}
@@ -0,0 +1,191 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"sync"
+	"time"
+
+	"go.uber.org/zap"
+)
+
+// authHookRequest is POSTed to AUTH_HOOK_URL for every login attempt.
+type authHookRequest struct {
+	Username             string `json:"username"`
+	RemoteIP             string `json:"remote_ip"`
+	Method               string `json:"method"` // password, publickey or keyboard-interactive
+	ClientVersion        string `json:"client_version,omitempty"`
+	Password             string `json:"password,omitempty"`
+	PublicKeyFingerprint string `json:"public_key_fingerprint,omitempty"` // SHA256:...
+	PublicKey            string `json:"public_key,omitempty"`             // authorized_keys line
+}
+
+// authHookResponse is the JSON answer expected from the hook. Only allow is
+// required; the other fields override the matching User fields when present.
+type authHookResponse struct {
+	Allow       bool        `json:"allow"`
+	Message     string      `json:"message,omitempty"`
+	DisplayName *string     `json:"display_name,omitempty"`
+	GroupName   *string     `json:"group_name,omitempty"`
+	RootPath    *string     `json:"root_path,omitempty"`
+	Perms       *Permission `json:"perms,omitempty"`
+	Disabled    *bool       `json:"disabled,omitempty"`
+}
+
+var errAuthHookDenied = errors.New("denied by auth hook")
+
+type authHookCacheEntry struct {
+	user    User
+	expires time.Time
+}
+
+// authHook delegates credential checks to an external HTTP service. Positive
+// answers can be cached for cacheTTL, keyed by a hash of the whole request so a
+// changed password or key never hits a stale entry.
+type authHook struct {
+	url      string
+	client   *http.Client
+	merge    bool // start from the provider's user row when it exists
+	cacheTTL time.Duration
+	users    UserProvider
+	logger   *zap.SugaredLogger
+
+	mu    sync.Mutex
+	cache map[string]authHookCacheEntry
+}
+
+// newAuthHookFromEnv returns nil when AUTH_HOOK_URL is not set.
+func newAuthHookFromEnv(users UserProvider, logger *zap.SugaredLogger) *authHook {
+	url := getEnvOrDefault("AUTH_HOOK_URL", "")
+	if url == "" {
+		return nil
+	}
+	return &authHook{
+		url:      url,
+		client:   &http.Client{Timeout: getEnvDuration("AUTH_HOOK_TIMEOUT", 5*time.Second)},
+		merge:    getEnvBool("AUTH_HOOK_MERGE", false),
+		cacheTTL: getEnvDuration("AUTH_HOOK_CACHE_TTL", 0),
+		users:    users,
+		logger:   logger,
+		cache:    map[string]authHookCacheEntry{},
+	}
+}
+
+func (h *authHook) cacheKey(req *authHookRequest) string {
+	b, _ := json.Marshal(req)
+	sum := sha256.Sum256(b)
+	return hex.EncodeToString(sum[:])
+}
+
+func (h *authHook) cached(key string) (*User, bool) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	entry, ok := h.cache[key]
+	if !ok {
+		return nil, false
+	}
+	if time.Now().After(entry.expires) {
+		delete(h.cache, key)
+		return nil, false
+	}
+	user := entry.user
+	return &user, true
+}
+
+func (h *authHook) store(key string, user *User) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	now := time.Now()
+	// drop expired entries so the cache cannot grow without bound
+	for k, entry := range h.cache {
+		if now.After(entry.expires) {
+			delete(h.cache, k)
+		}
+	}
+	h.cache[key] = authHookCacheEntry{user: *user, expires: now.Add(h.cacheTTL)}
+}
+
+// Authenticate asks the hook whether the attempt is allowed and builds the User
+// from its answer, optionally on top of the provider's row for the username.
+func (h *authHook) Authenticate(ctx context.Context, req *authHookRequest) (*User, error) {
+	key := ""
+	if h.cacheTTL > 0 {
+		key = h.cacheKey(req)
+		if user, ok := h.cached(key); ok {
+			h.logger.Debugf("Auth hook cache hit for user %s (%s)", req.Username, req.Method)
+			return user, nil
+		}
+	}
+	resp, err := h.call(ctx, req)
+	if err != nil {
+		return nil, err
+	}
+	if !resp.Allow {
+		if resp.Message != "" {
+			return nil, fmt.Errorf("%w: %s", errAuthHookDenied, resp.Message)
+		}
+		return nil, errAuthHookDenied
+	}
+	user := &User{Username: req.Username}
+	if h.merge {
+		if row, err := h.users.FetchUserByUsername(ctx, req.Username); err == nil {
+			user = row
+		} else {
+			h.logger.Debugf("No stored user to merge for %s: %v", req.Username, err)
+		}
+	}
+	if resp.DisplayName != nil {
+		user.DisplayName = *resp.DisplayName
+	}
+	if resp.GroupName != nil {
+		user.GroupName = *resp.GroupName
+	}
+	if resp.RootPath != nil {
+		user.RootPath = *resp.RootPath
+	}
+	if resp.Perms != nil {
+		user.Perms = *resp.Perms
+	}
+	if resp.Disabled != nil {
+		user.Disabled = *resp.Disabled
+	}
+	if h.cacheTTL > 0 {
+		h.store(key, user)
+	}
+	return user, nil
+}
+
+func (h *authHook) call(ctx context.Context, req *authHookRequest) (*authHookResponse, error) {
+	body, err := json.Marshal(req)
+	if err != nil {
+		return nil, err
+	}
+	httpReq, err := http.NewRequestWithContext(ctx, http.MethodPost, h.url, bytes.NewReader(body))
+	if err != nil {
+		return nil, err
+	}
+	httpReq.Header.Set("Content-Type", "application/json")
+	res, err := h.client.Do(httpReq)
+	if err != nil {
+		return nil, fmt.Errorf("auth hook request failed: %w", err)
+	}
+	defer res.Body.Close()
+	switch {
+	case res.StatusCode == http.StatusUnauthorized || res.StatusCode == http.StatusForbidden:
+		return &authHookResponse{Allow: false, Message: res.Status}, nil
+	case res.StatusCode != http.StatusOK:
+		return nil, fmt.Errorf("auth hook returned %s", res.Status)
+	}
+	var resp authHookResponse
+	if err := json.NewDecoder(io.LimitReader(res.Body, 1<<20)).Decode(&resp); err != nil {
+		return nil, fmt.Errorf("invalid auth hook response: %w", err)
+	}
+	return &resp, nil
+}
@@ -0,0 +1,185 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"go.uber.org/zap"
+)
+
+// newTestAuthHook starts a hook server answering with handler and returns an
+// authHook pointed at it, with a 200ms timeout.
+func newTestAuthHook(t *testing.T, users UserProvider, handler http.HandlerFunc) *authHook {
+	t.Helper()
+	srv := httptest.NewServer(handler)
+	t.Cleanup(srv.Close)
+	return &authHook{
+		url:    srv.URL,
+		client: &http.Client{Timeout: 200 * time.Millisecond},
+		users:  users,
+		logger: zap.NewNop().Sugar(),
+		cache:  map[string]authHookCacheEntry{},
+	}
+}
+
+// answer returns a handler that replies with status and body.
+func answer(status int, body string) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(status)
+		w.Write([]byte(body))
+	}
+}
+
+func TestAuthHookResponses(t *testing.T) {
+	tests := []struct {
+		name    string
+		handler http.HandlerFunc
+		denied  bool // errAuthHookDenied
+		failed  bool // any other error
+		message string
+	}{
+		{name: "allow", handler: answer(http.StatusOK, `{"allow": true}`)},
+		{name: "deny", handler: answer(http.StatusOK, `{"allow": false}`), denied: true},
+		{name: "deny with message", handler: answer(http.StatusOK, `{"allow": false, "message": "outside office hours"}`), denied: true, message: "outside office hours"},
+		{name: "unauthorized", handler: answer(http.StatusUnauthorized, ""), denied: true, message: "401 Unauthorized"},
+		{name: "forbidden", handler: answer(http.StatusForbidden, `{"allow": true}`), denied: true, message: "403 Forbidden"},
+		{name: "server error", handler: answer(http.StatusInternalServerError, `{"allow": true}`), failed: true, message: "500 Internal Server Error"},
+		{name: "not found", handler: http.NotFound, failed: true, message: "404 Not Found"},
+		{name: "invalid JSON", handler: answer(http.StatusOK, `allow`), failed: true, message: "invalid auth hook response"},
+		{name: "empty body", handler: answer(http.StatusOK, ""), failed: true, message: "invalid auth hook response"},
+		{name: "timeout", handler: func(w http.ResponseWriter, r *http.Request) {
+			// with the body read the server notices when the client gives up
+			io.Copy(io.Discard, r.Body)
+			<-r.Context().Done()
+		}, failed: true, message: "auth hook request failed"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			h := newTestAuthHook(t, nil, tt.handler)
+			user, err := h.Authenticate(context.Background(), &authHookRequest{Username: "alice", Method: "password", Password: "secret"})
+			switch {
+			case tt.denied:
+				if !errors.Is(err, errAuthHookDenied) {
+					t.Fatalf("Authenticate = %v, %v; want denied", user, err)
+				}
+			case tt.failed:
+				if err == nil || errors.Is(err, errAuthHookDenied) {
+					t.Fatalf("Authenticate = %v, %v; want an error other than a denial", user, err)
+				}
+			default:
+				if err != nil || user == nil || user.Username != "alice" {
+					t.Fatalf("Authenticate = %v, %v; want alice", user, err)
+				}
+			}
+			if err != nil && !strings.Contains(err.Error(), tt.message) {
+				t.Errorf("error %q does not mention %q", err, tt.message)
+			}
+		})
+	}
+}
+
+func TestAuthHookRequest(t *testing.T) {
+	var got authHookRequest
+	var contentType string
+	h := newTestAuthHook(t, nil, func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodPost {
+			http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+			return
+		}
+		contentType = r.Header.Get("Content-Type")
+		if err := json.NewDecoder(r.Body).Decode(&got); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		w.Write([]byte(`{"allow": true}`))
+	})
+	req := authHookRequest{Username: "alice", RemoteIP: "192.0.2.1", Method: "publickey", ClientVersion: "SSH-2.0-test", PublicKeyFingerprint: "SHA256:abc", PublicKey: "ssh-ed25519 AAAA"}
+	if _, err := h.Authenticate(context.Background(), &req); err != nil {
+		t.Fatal(err)
+	}
+	if got != req || contentType != "application/json" {
+		t.Errorf("hook received %+v as %q, want %+v as JSON", got, contentType, req)
+	}
+}
+
+func TestAuthHookUser(t *testing.T) {
+	ctx := context.Background()
+	s := newTestStore(t)
+	if err := s.CreateUser(ctx, &UserRecord{Username: "alice", DisplayName: "Alice", GroupName: "default", RootPath: "/srv/alice", Perms: sql.NullInt64{Int64: int64(PermRead | PermList), Valid: true}}); err != nil {
+		t.Fatal(err)
+	}
+	full := `{"allow": true, "display_name": "Alice Hook", "root_path": "/srv/hook", "perms": 7, "disabled": true}`
+	tests := []struct {
+		name     string
+		merge    bool
+		username string
+		body     string
+		want     User
+	}{
+		{"no overrides", false, "alice", `{"allow": true}`, User{Username: "alice"}},
+		{"overrides", false, "alice", full, User{Username: "alice", DisplayName: "Alice Hook", RootPath: "/srv/hook", Perms: 7, Disabled: true}},
+		{"merged", true, "alice", `{"allow": true, "root_path": "/srv/hook"}`, User{Username: "alice", DisplayName: "Alice", GroupName: "default", RootPath: "/srv/hook", Perms: PermRead | PermList}},
+		{"merge without a stored user", true, "bob", `{"allow": true, "group_name": "guests"}`, User{Username: "bob", GroupName: "guests"}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			h := newTestAuthHook(t, s, answer(http.StatusOK, tt.body))
+			h.merge = tt.merge
+			user, err := h.Authenticate(ctx, &authHookRequest{Username: tt.username, Method: "password", Password: "secret"})
+			if err != nil {
+				t.Fatal(err)
+			}
+			user.ID = 0
+			if *user != tt.want {
+				t.Errorf("user = %+v, want %+v", *user, tt.want)
+			}
+		})
+	}
+}
+
+func TestAuthHookCache(t *testing.T) {
+	var calls atomic.Int32
+	var deny atomic.Bool
+	h := newTestAuthHook(t, nil, func(w http.ResponseWriter, r *http.Request) {
+		calls.Add(1)
+		json.NewEncoder(w).Encode(authHookResponse{Allow: !deny.Load()})
+	})
+	h.cacheTTL = time.Minute
+	req := func(password string) (*User, error) {
+		return h.Authenticate(context.Background(), &authHookRequest{Username: "alice", Method: "password", Password: password})
+	}
+
+	if _, err := req("secret"); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := req("secret"); err != nil || calls.Load() != 1 {
+		t.Errorf("cached attempt = %v after %d calls, want 1", err, calls.Load())
+	}
+	// a different password is a different attempt
+	deny.Store(true)
+	if _, err := req("other"); !errors.Is(err, errAuthHookDenied) || calls.Load() != 2 {
+		t.Errorf("new password = %v after %d calls, want a denial from the hook", err, calls.Load())
+	}
+	// denials are not cached
+	if _, err := req("other"); calls.Load() != 3 {
+		t.Errorf("denied attempt = %v after %d calls, want 3", err, calls.Load())
+	}
+
+	// expired entries are asked again
+	for key, entry := range h.cache {
+		entry.expires = time.Now().Add(-time.Second)
+		h.cache[key] = entry
+	}
+	if _, err := req("secret"); !errors.Is(err, errAuthHookDenied) || calls.Load() != 4 {
+		t.Errorf("expired entry = %v after %d calls, want a denial from the hook", err, calls.Load())
+	}
+}
@@ -0,0 +1,230 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+	"sync"
+	"time"
+
+	"go.uber.org/zap"
+)
+
+// BandwidthLimits caps a user's throughput in bytes per second. Zero is
+// unlimited.
+type BandwidthLimits struct {
+	Upload   int64
+	Download int64
+}
+
+// defaultBandwidthLimits reads the server-wide limits from the environment.
+func defaultBandwidthLimits() BandwidthLimits {
+	return BandwidthLimits{
+		Upload:   int64(getEnvInt("UPLOAD_RATE_LIMIT", 0)),
+		Download: int64(getEnvInt("DOWNLOAD_RATE_LIMIT", 0)),
+	}
+}
+
+// FetchBandwidthLimits returns the user's limits: each rate column of their
+// own row in sftp_bandwidth_limits that is set, otherwise their group's,
+// otherwise the one from defaults.
+func (s *UserStore) FetchBandwidthLimits(ctx context.Context, user *User, defaults BandwidthLimits) (BandwidthLimits, error) {
+	query := fmt.Sprintf(`SELECT scope, upload_rate, download_rate FROM sftp_bandwidth_limits WHERE (scope = 'user' AND name = %s) OR (scope = 'group' AND name = %s)`,
+		s.placeholder(1), s.placeholder(2))
+	rows, err := s.db.QueryContext(ctx, query, user.Username, user.GroupName)
+	if err != nil {
+		s.logger.Errorf("Error fetching bandwidth limits: %v", err)
+		return defaults, err
+	}
+	defer rows.Close()
+	var userRow, groupRow [2]sql.NullInt64
+	for rows.Next() {
+		var scope string
+		var row [2]sql.NullInt64
+		if err := rows.Scan(&scope, &row[0], &row[1]); err != nil {
+			return defaults, err
+		}
+		if scope == SessionLimitScopeUser {
+			userRow = row
+		} else {
+			groupRow = row
+		}
+	}
+	if err := rows.Err(); err != nil {
+		return defaults, err
+	}
+	l := defaults
+	for i, rate := range []*int64{&l.Upload, &l.Download} {
+		switch {
+		case userRow[i].Valid:
+			*rate = userRow[i].Int64
+		case groupRow[i].Valid:
+			*rate = groupRow[i].Int64
+		}
+	}
+	return l, nil
+}
+
+// tokenBucket lets through rate bytes per second on average, with bursts of
+// up to one second's worth. Callers that overdraw it wait until the debt is
+// paid off, so concurrent transfers share the rate.
+type tokenBucket struct {
+	mu     sync.Mutex
+	rate   int64 // 0: unlimited
+	tokens float64
+	last   time.Time
+}
+
+func (b *tokenBucket) setRate(rate int64) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.refill(time.Now())
+	b.rate = rate
+	if b.tokens > float64(rate) {
+		b.tokens = float64(rate)
+	}
+}
+
+func (b *tokenBucket) refill(now time.Time) {
+	if b.rate > 0 {
+		b.tokens += now.Sub(b.last).Seconds() * float64(b.rate)
+		if b.tokens > float64(b.rate) {
+			b.tokens = float64(b.rate)
+		}
+	}
+	b.last = now
+}
+
+// wait takes n bytes from the bucket and blocks until they are covered or
+// done is closed.
+func (b *tokenBucket) wait(n int, done <-chan struct{}) {
+	b.mu.Lock()
+	if b.rate <= 0 || n <= 0 {
+		b.mu.Unlock()
+		return
+	}
+	b.refill(time.Now())
+	b.tokens -= float64(n)
+	delay := time.Duration(-b.tokens / float64(b.rate) * float64(time.Second))
+	b.mu.Unlock()
+	if delay <= 0 {
+		return
+	}
+	timer := time.NewTimer(delay)
+	defer timer.Stop()
+	select {
+	case <-timer.C:
+	case <-done:
+	}
+}
+
+// userBandwidth is the bandwidth of one user, shared by all of their
+// sessions. Its limits are updated when a session starts and on reload.
+type userBandwidth struct {
+	user *User // as loaded by the latest session, guarded by bandwidthsMu
+	refs int   // sessions using it, guarded by bandwidthsMu
+
+	upload   tokenBucket
+	download tokenBucket
+
+	mu     sync.Mutex
+	limits BandwidthLimits
+}
+
+var (
+	bandwidthsMu sync.Mutex
+	bandwidths   = map[string]*userBandwidth{}
+)
+
+// acquireBandwidth returns the shared bandwidth of user and sets its limits.
+// Call release when the session ends.
+func acquireBandwidth(user *User, limits BandwidthLimits) *userBandwidth {
+	bandwidthsMu.Lock()
+	b := bandwidths[user.Username]
+	if b == nil {
+		b = &userBandwidth{}
+		bandwidths[user.Username] = b
+	}
+	b.user = user
+	b.refs++
+	bandwidthsMu.Unlock()
+	b.setLimits(limits)
+	return b
+}
+
+func (b *userBandwidth) release() {
+	bandwidthsMu.Lock()
+	defer bandwidthsMu.Unlock()
+	if b.refs--; b.refs == 0 {
+		delete(bandwidths, b.user.Username)
+	}
+}
+
+// setLimits changes the rates of the user's transfers in progress and to come.
+// It reports whether they changed.
+func (b *userBandwidth) setLimits(limits BandwidthLimits) bool {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if limits == b.limits {
+		return false
+	}
+	b.limits = limits
+	b.upload.setRate(limits.Upload)
+	b.download.setRate(limits.Download)
+	return true
+}
+
+// reloadBandwidthLimits rereads the limits of the users with open sessions,
+// so that changed defaults and sftp_bandwidth_limits rows apply without
+// dropping connections.
+func reloadBandwidthLimits(store *UserStore, logger *zap.SugaredLogger) {
+	bandwidthsMu.Lock()
+	users := make(map[*userBandwidth]*User, len(bandwidths))
+	for _, b := range bandwidths {
+		users[b] = b.user
+	}
+	bandwidthsMu.Unlock()
+	defaults := defaultBandwidthLimits()
+	for b, user := range users {
+		ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+		limits, err := store.FetchBandwidthLimits(ctx, user, defaults)
+		cancel()
+		if err != nil {
+			logger.Errorf("Failed to reload bandwidth limits of %s: %v", user.Username, err)
+			continue
+		}
+		if b.setLimits(limits) {
+			logger.Infof("Bandwidth limits of %s: upload %d B/s, download %d B/s (0: unlimited)", user.Username, limits.Upload, limits.Download)
+		}
+	}
+}
+
+// throttle limits the transfers through file to the user's rates. Waits end
+// early once done is closed.
+func (b *userBandwidth) throttle(file File, done <-chan struct{}) File {
+	return &throttledFile{File: file, bandwidth: b, done: done}
+}
+
+type throttledFile struct {
+	File
+	bandwidth *userBandwidth
+	done      <-chan struct{}
+}
+
+func (f *throttledFile) ReadAt(b []byte, off int64) (int, error) {
+	n, err := f.File.ReadAt(b, off)
+	f.bandwidth.download.wait(n, f.done)
+	return n, err
+}
+
+func (f *throttledFile) WriteAt(b []byte, off int64) (int, error) {
+	f.bandwidth.upload.wait(len(b), f.done)
+	return f.File.WriteAt(b, off)
+}
+
+// TransferError passes the notification on to the wrapped file.
+func (f *throttledFile) TransferError(err error) {
+	if te, ok := f.File.(interface{ TransferError(error) }); ok {
+		te.TransferError(err)
+	}
+}
@@ -0,0 +1,52 @@
+package main
+
+import (
+	"context"
+	"path/filepath"
+	"testing"
+
+	"go.uber.org/zap"
+)
+
+// newTestStore returns a store over a new, migrated SQLite database.
+func newTestStore(t *testing.T) *UserStore {
+	t.Helper()
+	db, err := dialectSQLite.open(filepath.Join(t.TempDir(), "sftp.db"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { db.Close() })
+	s := &UserStore{dialect: dialectSQLite, db: db, logger: zap.NewNop().Sugar()}
+	if _, err := s.Migrate(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	return s
+}
+
+func TestFetchBandwidthLimits(t *testing.T) {
+	s := newTestStore(t)
+	ctx := context.Background()
+	_, err := s.db.ExecContext(ctx, `INSERT INTO sftp_bandwidth_limits (scope, name, upload_rate, download_rate) VALUES
+		('group', 'partners', 1000, 2000),
+		('user', 'alice', NULL, 0),
+		('user', 'bob', 3000, NULL)`)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defaults := BandwidthLimits{Upload: 10, Download: 20}
+	tests := []struct {
+		user *User
+		want BandwidthLimits
+	}{
+		{&User{Username: "alice", GroupName: "partners"}, BandwidthLimits{Upload: 1000, Download: 0}},
+		{&User{Username: "bob", GroupName: "partners"}, BandwidthLimits{Upload: 3000, Download: 2000}},
+		{&User{Username: "bob", GroupName: "staff"}, BandwidthLimits{Upload: 3000, Download: 20}},
+		{&User{Username: "carol", GroupName: "staff"}, defaults},
+	}
+	for _, tt := range tests {
+		got, err := s.FetchBandwidthLimits(ctx, tt.user, defaults)
+		if err != nil || got != tt.want {
+			t.Errorf("FetchBandwidthLimits(%s of %s) = %+v, %v; want %+v", tt.user.Username, tt.user.GroupName, got, err, tt.want)
+		}
+	}
+}
@@ -0,0 +1,71 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"os"
+	"strings"
+
+	"golang.org/x/crypto/ssh"
+)
+
+// userCertAuthority holds the CA keys trusted to sign user certificates and the
+// revocation list consulted for both certificates and plain keys.
+type userCertAuthority struct {
+	authorities []ssh.PublicKey
+	revoked     *revocationList
+}
+
+// loadUserCertAuthority reads trusted CA public keys (authorized_keys format, one
+// or more per file) from the comma-separated caPaths and the optional KRL or
+// plain revocation file at revokedPath. Empty paths are skipped.
+func loadUserCertAuthority(caPaths, revokedPath string) (*userCertAuthority, error) {
+	ca := &userCertAuthority{}
+	for _, path := range strings.Split(caPaths, ",") {
+		path = strings.TrimSpace(path)
+		if path == "" {
+			continue
+		}
+		b, err := os.ReadFile(path)
+		if err != nil {
+			return nil, fmt.Errorf("read trusted CA %s: %w", path, err)
+		}
+		for len(bytes.TrimSpace(b)) > 0 {
+			key, _, _, rest, err := ssh.ParseAuthorizedKey(b)
+			if err != nil {
+				return nil, fmt.Errorf("parse trusted CA %s: %w", path, err)
+			}
+			ca.authorities = append(ca.authorities, key)
+			b = rest
+		}
+	}
+	if revokedPath = strings.TrimSpace(revokedPath); revokedPath != "" {
+		revoked, err := loadRevocationList(revokedPath)
+		if err != nil {
+			return nil, fmt.Errorf("load revocation list %s: %w", revokedPath, err)
+		}
+		ca.revoked = revoked
+	}
+	return ca, nil
+}
+
+// IsUserAuthority implements ssh.CertChecker.IsUserAuthority.
+func (ca *userCertAuthority) IsUserAuthority(auth ssh.PublicKey) bool {
+	blob := auth.Marshal()
+	for _, key := range ca.authorities {
+		if bytes.Equal(blob, key.Marshal()) {
+			return true
+		}
+	}
+	return false
+}
+
+// IsRevoked implements ssh.CertChecker.IsRevoked.
+func (ca *userCertAuthority) IsRevoked(cert *ssh.Certificate) bool {
+	return ca.revoked.CertRevoked(cert)
+}
+
+// KeyRevoked reports whether a plain (non-certificate) key has been revoked.
+func (ca *userCertAuthority) KeyRevoked(key ssh.PublicKey) bool {
+	return ca.revoked.KeyRevoked(key)
+}
@@ -0,0 +1,406 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"crypto/ed25519"
+	"crypto/rand"
+	"crypto/rsa"
+	"encoding/json"
+	"encoding/pem"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"strings"
+	"text/tabwriter"
+	"time"
+
+	"golang.org/x/crypto/bcrypt"
+	"golang.org/x/crypto/ssh"
+	"golang.org/x/term"
+)
+
+const commandUsage = `usage:
+  v-sftp                       run the SFTP server
+  v-sftp [--json] <command>    run an admin command; --json prints the result as JSON
+
+commands:
+  bans list                    list IP bans and account lockouts
+  bans lift ip <addr>          lift a ban on a source address
+  bans lift user <name>        unlock an account
+  migrate status               list schema migrations and whether they are applied
+  migrate up [--dry-run]       apply pending migrations, or print them with --dry-run
+  user list                    list users
+  user show <name>             show a user with their effective permissions and keys
+  user add <name> [--display-name s] [--group g] [--root path] [--perms p]
+                  [--password] [--key key|@file] [--disabled]
+                               create a user; --password asks for one
+  user update <name> [--display-name s] [--group g] [--root path]
+                     [--perms p|inherit] [--rename new]
+                               change the given fields of a user
+  user disable|enable <name>   refuse or allow the user's logins
+  user delete <name>           delete a user with their keys and settings
+  user passwd <name> [--clear] set (prompting, or reading stdin) or remove a password
+  user key list <name>         list a user's authorized keys
+  user key add <name> <key|@file|-> [--comment s] [--expires time]
+                               register an authorized key
+  user key remove <name> <id>  remove an authorized key
+  hash-password                print the bcrypt hash of a password read like passwd
+  hostkey generate [--type ed25519|rsa] [--force]
+                               create the host key at HOST_KEY_PATH
+  hostkey show-fingerprint     print the host key's type, fingerprint and public key
+
+Permissions (--perms) are a number or names joined by '|' (see README).`
+
+// cmdOutput prints the results of admin commands as text or, with --json, as JSON.
+type cmdOutput struct {
+	json bool
+}
+
+// parseGlobalFlags removes the flags common to all commands from args.
+func parseGlobalFlags(args []string) ([]string, cmdOutput) {
+	var out cmdOutput
+	rest := make([]string, 0, len(args))
+	for _, arg := range args {
+		if arg == "--json" || arg == "-json" {
+			out.json = true
+			continue
+		}
+		rest = append(rest, arg)
+	}
+	return rest, out
+}
+
+// print writes v as JSON in JSON mode, and calls text otherwise.
+func (o cmdOutput) print(v any, text func() error) error {
+	if o.json {
+		enc := json.NewEncoder(os.Stdout)
+		enc.SetIndent("", "  ")
+		return enc.Encode(v)
+	}
+	return text()
+}
+
+// table returns a writer aligning tab-separated columns; call Flush when done.
+func table() *tabwriter.Writer {
+	return tabwriter.NewWriter(os.Stdout, 0, 4, 2, ' ', 0)
+}
+
+// parseFlags parses flags given before, between or after the positional
+// arguments, and returns the positional arguments.
+func parseFlags(fs *flag.FlagSet, args []string) ([]string, error) {
+	var positional []string
+	for {
+		if err := fs.Parse(args); err != nil {
+			return nil, err
+		}
+		if fs.NArg() == 0 {
+			return positional, nil
+		}
+		positional = append(positional, fs.Arg(0))
+		args = fs.Args()[1:]
+	}
+}
+
+func newFlagSet(name string) *flag.FlagSet {
+	fs := flag.NewFlagSet(name, flag.ContinueOnError)
+	fs.SetOutput(io.Discard)
+	return fs
+}
+
+// runLocalCommand executes the admin commands that do not use the database.
+// It reports whether args named one.
+func runLocalCommand(args []string, out cmdOutput, hostKeyPath string) (bool, error) {
+	switch args[0] {
+	case "hash-password":
+		password, err := readPassword()
+		if err != nil {
+			return true, err
+		}
+		hash, err := bcrypt.GenerateFromPassword([]byte(password), bcrypt.DefaultCost)
+		if err != nil {
+			return true, err
+		}
+		return true, out.print(map[string]string{"hash": string(hash)}, func() error {
+			fmt.Println(string(hash))
+			return nil
+		})
+	case "hostkey":
+		return true, runHostKeyCommand(args[1:], out, hostKeyPath)
+	case "help", "-h", "--help":
+		fmt.Println(commandUsage)
+		return true, nil
+	default:
+		return false, nil
+	}
+}
+
+// runCommand executes an admin subcommand against the user store.
+func runCommand(store *UserStore, args []string, out cmdOutput) error {
+	switch args[0] {
+	case "bans":
+		return runBansCommand(store, args[1:], out)
+	case "migrate":
+		return runMigrateCommand(store, args[1:], out)
+	case "user":
+		return runUserCommand(store, args[1:], out)
+	default:
+		return fmt.Errorf("unknown command %q\n%s", args[0], commandUsage)
+	}
+}
+
+// readPassword asks for a password twice on a terminal, or reads the first
+// line of stdin otherwise.
+func readPassword() (string, error) {
+	fd := int(os.Stdin.Fd())
+	if !term.IsTerminal(fd) {
+		line, err := bufio.NewReader(os.Stdin).ReadString('\n')
+		if err != nil && !errors.Is(err, io.EOF) {
+			return "", err
+		}
+		if line = strings.TrimRight(line, "\r\n"); line == "" {
+			return "", fmt.Errorf("no password on stdin")
+		}
+		return line, nil
+	}
+	fmt.Fprint(os.Stderr, "Password: ")
+	first, err := term.ReadPassword(fd)
+	fmt.Fprintln(os.Stderr)
+	if err != nil {
+		return "", err
+	}
+	if len(first) == 0 {
+		return "", fmt.Errorf("empty password")
+	}
+	fmt.Fprint(os.Stderr, "Repeat password: ")
+	second, err := term.ReadPassword(fd)
+	fmt.Fprintln(os.Stderr)
+	if err != nil {
+		return "", err
+	}
+	if string(first) != string(second) {
+		return "", fmt.Errorf("passwords do not match")
+	}
+	return string(first), nil
+}
+
+func runBansCommand(store *UserStore, args []string, out cmdOutput) error {
+	cxt, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	if len(args) == 0 {
+		return fmt.Errorf("missing bans subcommand\n%s", commandUsage)
+	}
+	switch args[0] {
+	case "list":
+		bans, err := store.ListBans(cxt)
+		if err != nil {
+			return err
+		}
+		type banJSON struct {
+			Kind        string    `json:"kind"`
+			Value       string    `json:"value"`
+			Active      bool      `json:"active"`
+			BannedUntil time.Time `json:"banned_until"`
+			Strikes     int       `json:"strikes"`
+			Reason      string    `json:"reason,omitempty"`
+		}
+		now := time.Now()
+		list := make([]banJSON, 0, len(bans))
+		for _, b := range bans {
+			list = append(list, banJSON{b.Kind, b.Value, b.Active(now), b.BannedUntil, b.Strikes, b.Reason.String})
+		}
+		return out.print(list, func() error {
+			w := table()
+			fmt.Fprintln(w, "KIND\tVALUE\tSTATE\tUNTIL\tSTRIKES\tREASON")
+			for _, b := range list {
+				state := "expired"
+				if b.Active {
+					state = "active"
+				}
+				fmt.Fprintf(w, "%s\t%s\t%s\t%s\t%d\t%s\n", b.Kind, b.Value, state, b.BannedUntil.Local().Format(time.RFC3339), b.Strikes, b.Reason)
+			}
+			return w.Flush()
+		})
+	case "lift":
+		if len(args) != 3 || (args[1] != BanKindIP && args[1] != BanKindUser) {
+			return fmt.Errorf("usage: bans lift ip|user <value>")
+		}
+		removed, err := store.DeleteBan(cxt, args[1], args[2])
+		if err != nil {
+			return err
+		}
+		if !removed {
+			return fmt.Errorf("no ban found for %s %s", args[1], args[2])
+		}
+		return out.print(map[string]string{"kind": args[1], "value": args[2]}, func() error {
+			fmt.Printf("Lifted ban on %s %s\n", args[1], args[2])
+			return nil
+		})
+	default:
+		return fmt.Errorf("unknown bans subcommand %q\n%s", args[0], commandUsage)
+	}
+}
+
+func runMigrateCommand(store *UserStore, args []string, out cmdOutput) error {
+	cxt, cancel := context.WithTimeout(context.Background(), 5*time.Minute)
+	defer cancel()
+	if len(args) == 0 {
+		return fmt.Errorf("missing migrate subcommand\n%s", commandUsage)
+	}
+	type migrationJSON struct {
+		Version   int        `json:"version"`
+		Name      string     `json:"name"`
+		State     string     `json:"state,omitempty"`
+		AppliedAt *time.Time `json:"applied_at,omitempty"`
+		SQL       string     `json:"sql,omitempty"`
+	}
+	switch args[0] {
+	case "status":
+		statuses, err := store.MigrationStatus(cxt)
+		if err != nil {
+			return err
+		}
+		list := make([]migrationJSON, 0, len(statuses))
+		for _, st := range statuses {
+			m := migrationJSON{Version: st.Version, Name: st.Name, State: "pending"}
+			if st.AppliedAt.Valid {
+				m.State, m.AppliedAt = "applied", &st.AppliedAt.Time
+				if st.SQL == "" {
+					m.State = "unknown" // applied by a newer version
+				}
+			}
+			list = append(list, m)
+		}
+		return out.print(list, func() error {
+			w := table()
+			fmt.Fprintln(w, "VERSION\tNAME\tSTATE\tAPPLIED")
+			for _, m := range list {
+				applied := ""
+				if m.AppliedAt != nil {
+					applied = m.AppliedAt.Local().Format(time.RFC3339)
+				}
+				fmt.Fprintf(w, "%04d\t%s\t%s\t%s\n", m.Version, m.Name, m.State, applied)
+			}
+			return w.Flush()
+		})
+	case "up":
+		if len(args) > 2 || (len(args) == 2 && args[1] != "--dry-run") {
+			return fmt.Errorf("usage: migrate up [--dry-run]")
+		}
+		if len(args) == 2 {
+			pending, err := store.PendingMigrations(cxt)
+			if err != nil {
+				return err
+			}
+			list := make([]migrationJSON, 0, len(pending))
+			for _, m := range pending {
+				list = append(list, migrationJSON{Version: m.Version, Name: m.Name, SQL: strings.TrimSpace(m.SQL)})
+			}
+			return out.print(list, func() error {
+				if len(pending) == 0 {
+					fmt.Println("No pending migrations")
+				}
+				for _, m := range pending {
+					fmt.Printf("-- %s\n%s\n", m, strings.TrimSpace(m.SQL))
+				}
+				return nil
+			})
+		}
+		applied, err := store.Migrate(cxt)
+		if err != nil {
+			for _, m := range applied {
+				fmt.Fprintf(os.Stderr, "Applied %s\n", m)
+			}
+			return err
+		}
+		list := make([]migrationJSON, 0, len(applied))
+		for _, m := range applied {
+			list = append(list, migrationJSON{Version: m.Version, Name: m.Name, State: "applied"})
+		}
+		return out.print(list, func() error {
+			for _, m := range applied {
+				fmt.Printf("Applied %s\n", m)
+			}
+			if len(applied) == 0 {
+				fmt.Println("No pending migrations")
+			}
+			return nil
+		})
+	default:
+		return fmt.Errorf("unknown migrate subcommand %q\n%s", args[0], commandUsage)
+	}
+}
+
+func runHostKeyCommand(args []string, out cmdOutput, path string) error {
+	if len(args) == 0 {
+		return fmt.Errorf("missing hostkey subcommand\n%s", commandUsage)
+	}
+	switch args[0] {
+	case "generate":
+		fs := newFlagSet("hostkey generate")
+		keyType := fs.String("type", "ed25519", "")
+		force := fs.Bool("force", false, "")
+		if rest, err := parseFlags(fs, args[1:]); err != nil || len(rest) != 0 {
+			return fmt.Errorf("usage: hostkey generate [--type ed25519|rsa] [--force]")
+		}
+		if _, err := os.Stat(path); err == nil && !*force {
+			return fmt.Errorf("%s already exists; use --force to replace it", path)
+		}
+		var key any
+		switch *keyType {
+		case "ed25519":
+			_, priv, err := ed25519.GenerateKey(rand.Reader)
+			if err != nil {
+				return err
+			}
+			key = priv
+		case "rsa":
+			priv, err := rsa.GenerateKey(rand.Reader, 3072)
+			if err != nil {
+				return err
+			}
+			key = priv
+		default:
+			return fmt.Errorf("unknown key type %q (want ed25519 or rsa)", *keyType)
+		}
+		block, err := ssh.MarshalPrivateKey(key, "")
+		if err != nil {
+			return err
+		}
+		if err := os.WriteFile(path, pem.EncodeToMemory(block), 0600); err != nil {
+			return err
+		}
+		return printHostKey(path, out)
+	case "show-fingerprint":
+		if len(args) != 1 {
+			return fmt.Errorf("usage: hostkey show-fingerprint")
+		}
+		return printHostKey(path, out)
+	default:
+		return fmt.Errorf("unknown hostkey subcommand %q\n%s", args[0], commandUsage)
+	}
+}
+
+func printHostKey(path string, out cmdOutput) error {
+	b, err := os.ReadFile(path)
+	if err != nil {
+		return fmt.Errorf("reading host key (created on first start or by hostkey generate): %w", err)
+	}
+	signer, err := ssh.ParsePrivateKey(b)
+	if err != nil {
+		return err
+	}
+	pub := signer.PublicKey()
+	info := map[string]string{
+		"path":        path,
+		"type":        pub.Type(),
+		"fingerprint": ssh.FingerprintSHA256(pub),
+		"public_key":  strings.TrimSpace(string(ssh.MarshalAuthorizedKey(pub))),
+	}
+	return out.print(info, func() error {
+		fmt.Printf("%s %s (%s)\n%s\n", info["type"], info["fingerprint"], path, info["public_key"])
+		return nil
+	})
+}
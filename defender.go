@@ -0,0 +1,303 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+	"net"
+	"sync"
+	"time"
+
+	"go.uber.org/zap"
+)
+
+// Ban kinds stored in sftp_bans.
+const (
+	BanKindIP   = "ip"
+	BanKindUser = "user"
+)
+
+// Ban is a temporary block on a source IP or an account.
+type Ban struct {
+	ID          int
+	Kind        string
+	Value       string
+	Reason      sql.NullString
+	Strikes     int
+	BannedUntil time.Time
+	CreatedAt   sql.NullTime
+}
+
+// Active reports whether the ban is still in force.
+func (b *Ban) Active(now time.Time) bool { return now.Before(b.BannedUntil) }
+
+// ListBans returns all bans, including expired ones kept for escalation history.
+func (s *UserStore) ListBans(ctx context.Context) ([]Ban, error) {
+	rows, err := s.db.QueryContext(ctx, `SELECT id, kind, value, reason, strikes, banned_until, created_at FROM sftp_bans ORDER BY banned_until DESC`)
+	if err != nil {
+		s.logger.Errorf("Error listing bans: %v", err)
+		return nil, err
+	}
+	defer rows.Close()
+	var bans []Ban
+	for rows.Next() {
+		var b Ban
+		if err := rows.Scan(&b.ID, &b.Kind, &b.Value, &b.Reason, &b.Strikes, &b.BannedUntil, &b.CreatedAt); err != nil {
+			s.logger.Errorf("Error scanning ban: %v", err)
+			return nil, err
+		}
+		bans = append(bans, b)
+	}
+	return bans, rows.Err()
+}
+
+// FetchBan returns the ban row for kind/value or nil if there is none.
+func (s *UserStore) FetchBan(ctx context.Context, kind, value string) (*Ban, error) {
+	query := fmt.Sprintf(`SELECT id, kind, value, reason, strikes, banned_until, created_at FROM sftp_bans WHERE kind = %s AND value = %s`, s.placeholder(1), s.placeholder(2))
+	var b Ban
+	err := s.db.QueryRowContext(ctx, query, kind, value).Scan(&b.ID, &b.Kind, &b.Value, &b.Reason, &b.Strikes, &b.BannedUntil, &b.CreatedAt)
+	if errors.Is(err, sql.ErrNoRows) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	return &b, nil
+}
+
+// SaveBan inserts the ban or updates the existing row for the same kind/value.
+func (s *UserStore) SaveBan(ctx context.Context, b *Ban) error {
+	update := fmt.Sprintf(`UPDATE sftp_bans SET reason = %s, strikes = %s, banned_until = %s WHERE kind = %s AND value = %s`,
+		s.placeholder(1), s.placeholder(2), s.placeholder(3), s.placeholder(4), s.placeholder(5))
+	res, err := s.db.ExecContext(ctx, update, b.Reason, b.Strikes, b.BannedUntil.UTC(), b.Kind, b.Value)
+	if err != nil {
+		return err
+	}
+	if n, err := res.RowsAffected(); err != nil || n > 0 {
+		return err
+	}
+	insert := fmt.Sprintf(`INSERT INTO sftp_bans (kind, value, reason, strikes, banned_until) VALUES (%s, %s, %s, %s, %s)`,
+		s.placeholder(1), s.placeholder(2), s.placeholder(3), s.placeholder(4), s.placeholder(5))
+	_, err = s.db.ExecContext(ctx, insert, b.Kind, b.Value, b.Reason, b.Strikes, b.BannedUntil.UTC())
+	return err
+}
+
+// DeleteBan lifts a ban and forgets its escalation history. It reports whether a row was removed.
+func (s *UserStore) DeleteBan(ctx context.Context, kind, value string) (bool, error) {
+	query := fmt.Sprintf(`DELETE FROM sftp_bans WHERE kind = %s AND value = %s`, s.placeholder(1), s.placeholder(2))
+	res, err := s.db.ExecContext(ctx, query, kind, value)
+	if err != nil {
+		return false, err
+	}
+	n, err := res.RowsAffected()
+	return n > 0, err
+}
+
+// defender counts failed logins per source IP and per username over a sliding
+// window and bans the offender once a threshold is reached. Each repeat ban of
+// the same IP/account doubles the ban time up to maxBanTime. Bans are persisted
+// in the user store and re-synced periodically, so they survive restarts and
+// lifting a ban from the CLI takes effect on a running server.
+type defender struct {
+	store  *UserStore
+	logger *zap.SugaredLogger
+
+	enabled       bool
+	window        time.Duration
+	ipThreshold   int
+	userThreshold int
+	banTime       time.Duration
+	maxBanTime    time.Duration
+
+	mu       sync.Mutex
+	failures map[string][]time.Time // "kind:value" -> failure times within window
+	bans     map[string]time.Time   // "kind:value" -> banned until
+}
+
+func newDefender(store *UserStore, logger *zap.SugaredLogger) *defender {
+	return &defender{
+		store:         store,
+		logger:        logger,
+		enabled:       getEnvBool("DEFENDER_ENABLED", true),
+		window:        getEnvDuration("DEFENDER_WINDOW", 10*time.Minute),
+		ipThreshold:   getEnvInt("DEFENDER_IP_THRESHOLD", 10),
+		userThreshold: getEnvInt("DEFENDER_USER_THRESHOLD", 5),
+		banTime:       getEnvDuration("DEFENDER_BAN_TIME", 15*time.Minute),
+		maxBanTime:    getEnvDuration("DEFENDER_MAX_BAN_TIME", 24*time.Hour),
+		failures:      map[string][]time.Time{},
+		bans:          map[string]time.Time{},
+	}
+}
+
+func banKey(kind, value string) string { return kind + ":" + value }
+
+// remoteIP extracts the host part of a connection address.
+func remoteIP(addr net.Addr) string {
+	host, _, err := net.SplitHostPort(addr.String())
+	if err != nil {
+		return addr.String()
+	}
+	return host
+}
+
+// sync replaces the in-memory ban set with the active bans from the store.
+func (d *defender) sync(ctx context.Context) error {
+	bans, err := d.store.ListBans(ctx)
+	if err != nil {
+		return err
+	}
+	now := time.Now()
+	active := make(map[string]time.Time, len(bans))
+	for _, b := range bans {
+		if b.Active(now) {
+			active[banKey(b.Kind, b.Value)] = b.BannedUntil
+		}
+	}
+	d.mu.Lock()
+	d.bans = active
+	d.mu.Unlock()
+	return nil
+}
+
+// run loads persisted bans and keeps them in sync with the store until stop is closed.
+func (d *defender) run(interval time.Duration, stop <-chan struct{}) {
+	if !d.enabled {
+		d.logger.Infof("Defender disabled")
+		return
+	}
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		cxt, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+		if err := d.sync(cxt); err != nil {
+			d.logger.Errorf("Failed to sync bans from store: %v", err)
+		}
+		cancel()
+		d.prune()
+		select {
+		case <-ticker.C:
+		case <-stop:
+			return
+		}
+	}
+}
+
+// prune drops failure records that have left the window.
+func (d *defender) prune() {
+	cutoff := time.Now().Add(-d.window)
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	for key, times := range d.failures {
+		if len(times) == 0 || times[len(times)-1].Before(cutoff) {
+			delete(d.failures, key)
+		}
+	}
+}
+
+// Banned reports whether kind/value is currently banned and until when.
+func (d *defender) Banned(kind, value string) (time.Time, bool) {
+	if !d.enabled {
+		return time.Time{}, false
+	}
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	until, ok := d.bans[banKey(kind, value)]
+	if !ok {
+		return time.Time{}, false
+	}
+	if time.Now().After(until) {
+		delete(d.bans, banKey(kind, value))
+		return time.Time{}, false
+	}
+	return until, true
+}
+
+// CheckConn returns an error if the connection's source IP or requested username is banned.
+func (d *defender) CheckConn(addr net.Addr, username string) error {
+	if until, ok := d.Banned(BanKindIP, remoteIP(addr)); ok {
+		return fmt.Errorf("source address banned until %s", until.Format(time.RFC3339))
+	}
+	if until, ok := d.Banned(BanKindUser, username); ok {
+		return fmt.Errorf("account locked until %s", until.Format(time.RFC3339))
+	}
+	return nil
+}
+
+// RecordFailure registers a failed login and bans the IP and/or account when
+// their threshold is reached within the window.
+func (d *defender) RecordFailure(addr net.Addr, username string) {
+	if !d.enabled {
+		return
+	}
+	ip := remoteIP(addr)
+	if d.hit(BanKindIP, ip, d.ipThreshold) {
+		d.ban(BanKindIP, ip, fmt.Sprintf("%d failed logins within %s", d.ipThreshold, d.window))
+	}
+	if d.hit(BanKindUser, username, d.userThreshold) {
+		d.ban(BanKindUser, username, fmt.Sprintf("%d failed logins within %s (last from %s)", d.userThreshold, d.window, ip))
+	}
+}
+
+// hit records one failure and reports whether the threshold was reached.
+func (d *defender) hit(kind, value string, threshold int) bool {
+	if threshold <= 0 || value == "" {
+		return false
+	}
+	now := time.Now()
+	cutoff := now.Add(-d.window)
+	key := banKey(kind, value)
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	times := d.failures[key]
+	kept := times[:0]
+	for _, t := range times {
+		if t.After(cutoff) {
+			kept = append(kept, t)
+		}
+	}
+	kept = append(kept, now)
+	if len(kept) >= threshold {
+		delete(d.failures, key)
+		return true
+	}
+	d.failures[key] = kept
+	return false
+}
+
+// ban records a ban in memory and in the store, escalating on repeat offences.
+func (d *defender) ban(kind, value, reason string) {
+	cxt, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	strikes := 1
+	if prev, err := d.store.FetchBan(cxt, kind, value); err != nil {
+		d.logger.Errorf("Failed to load previous ban for %s %s: %v", kind, value, err)
+	} else if prev != nil {
+		strikes = prev.Strikes + 1
+	}
+	duration := d.banTime
+	for i := 1; i < strikes && duration < d.maxBanTime; i++ {
+		duration *= 2
+	}
+	if duration > d.maxBanTime {
+		duration = d.maxBanTime
+	}
+	until := time.Now().Add(duration)
+	d.mu.Lock()
+	d.bans[banKey(kind, value)] = until
+	d.mu.Unlock()
+	d.logger.Warnf("Banning %s %s for %s (strike %d): %s", kind, value, duration, strikes, reason)
+	b := &Ban{Kind: kind, Value: value, Reason: sql.NullString{String: reason, Valid: true}, Strikes: strikes, BannedUntil: until}
+	if err := d.store.SaveBan(cxt, b); err != nil {
+		d.logger.Errorf("Failed to persist ban for %s %s: %v", kind, value, err)
+	}
+}
+
+// Lift removes a ban immediately, both in memory and in the store.
+func (d *defender) Lift(ctx context.Context, kind, value string) (bool, error) {
+	d.mu.Lock()
+	delete(d.bans, banKey(kind, value))
+	delete(d.failures, banKey(kind, value))
+	d.mu.Unlock()
+	return d.store.DeleteBan(ctx, kind, value)
+}
@@ -0,0 +1,171 @@
+package main
+
+import (
+	"context"
+	"net"
+	"testing"
+	"time"
+
+	"go.uber.org/zap"
+)
+
+// newTestDefender returns an enabled defender with a 10 minute window and a
+// 15 minute ban, doubling up to an hour.
+func newTestDefender(t *testing.T, ipThreshold, userThreshold int) *defender {
+	t.Helper()
+	t.Setenv("DEFENDER_ENABLED", "true")
+	t.Setenv("DEFENDER_WINDOW", "10m")
+	t.Setenv("DEFENDER_BAN_TIME", "15m")
+	t.Setenv("DEFENDER_MAX_BAN_TIME", "1h")
+	d := newDefender(newTestStore(t), zap.NewNop().Sugar())
+	d.ipThreshold, d.userThreshold = ipThreshold, userThreshold
+	return d
+}
+
+func TestDefenderThreshold(t *testing.T) {
+	tests := []struct {
+		name          string
+		ipThreshold   int
+		userThreshold int
+		username      string
+		failures      int
+		ipBanned      bool
+		userBanned    bool
+	}{
+		{"below both", 3, 2, "alice", 1, false, false},
+		{"user threshold", 3, 2, "alice", 2, false, true},
+		{"both thresholds", 3, 2, "alice", 3, true, true},
+		{"ip threshold only", 2, 5, "alice", 4, true, false},
+		{"user counting off", 2, 0, "alice", 5, true, false},
+		{"ip counting off", 0, 2, "alice", 5, false, true},
+		{"no username", 3, 1, "", 2, false, false},
+	}
+	addr := &net.TCPAddr{IP: net.IPv4(192, 0, 2, 1), Port: 2222}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			d := newTestDefender(t, tt.ipThreshold, tt.userThreshold)
+			for range tt.failures {
+				d.RecordFailure(addr, tt.username)
+			}
+			if _, ok := d.Banned(BanKindIP, "192.0.2.1"); ok != tt.ipBanned {
+				t.Errorf("IP banned = %v, want %v", ok, tt.ipBanned)
+			}
+			if _, ok := d.Banned(BanKindUser, tt.username); ok != tt.userBanned {
+				t.Errorf("user banned = %v, want %v", ok, tt.userBanned)
+			}
+			if err := d.CheckConn(addr, tt.username); (err != nil) != (tt.ipBanned || tt.userBanned) {
+				t.Errorf("CheckConn = %v", err)
+			}
+			// other sources and accounts are unaffected
+			if err := d.CheckConn(&net.TCPAddr{IP: net.IPv4(192, 0, 2, 2), Port: 2222}, "bob"); err != nil {
+				t.Errorf("CheckConn of another source = %v", err)
+			}
+		})
+	}
+}
+
+func TestDefenderWindow(t *testing.T) {
+	d := newTestDefender(t, 0, 3)
+	key := banKey(BanKindUser, "alice")
+	now := time.Now()
+	tests := []struct {
+		name  string
+		prior []time.Time
+		want  bool
+		kept  int
+	}{
+		{"all recent", []time.Time{now.Add(-9 * time.Minute), now.Add(-time.Minute)}, true, 0},
+		{"one outside the window", []time.Time{now.Add(-11 * time.Minute), now.Add(-time.Minute)}, false, 2},
+		{"all outside the window", []time.Time{now.Add(-time.Hour), now.Add(-20 * time.Minute)}, false, 1},
+	}
+	for _, tt := range tests {
+		d.failures[key] = append([]time.Time(nil), tt.prior...)
+		if got := d.hit(BanKindUser, "alice", d.userThreshold); got != tt.want {
+			t.Errorf("%s: hit = %v, want %v", tt.name, got, tt.want)
+		}
+		if got := len(d.failures[key]); got != tt.kept {
+			t.Errorf("%s: %d failures kept, want %d", tt.name, got, tt.kept)
+		}
+		delete(d.failures, key)
+	}
+	// a ban starts the count again
+	d.failures[key] = []time.Time{now, now}
+	if !d.hit(BanKindUser, "alice", d.userThreshold) || d.hit(BanKindUser, "alice", d.userThreshold) {
+		t.Error("failures counted across a ban")
+	}
+}
+
+func TestDefenderBanEscalation(t *testing.T) {
+	ctx := context.Background()
+	d := newTestDefender(t, 1, 0)
+	for _, want := range []time.Duration{15 * time.Minute, 30 * time.Minute, time.Hour, time.Hour} {
+		start := time.Now()
+		d.ban(BanKindIP, "192.0.2.1", "test")
+		until, ok := d.Banned(BanKindIP, "192.0.2.1")
+		if !ok {
+			t.Fatal("not banned")
+		}
+		if got := until.Sub(start); got < want || got > want+time.Minute {
+			t.Errorf("banned for %s, want %s", got, want)
+		}
+		b, err := d.store.FetchBan(ctx, BanKindIP, "192.0.2.1")
+		if err != nil || b == nil || !b.BannedUntil.Equal(until.UTC().Round(0)) {
+			t.Errorf("stored ban %+v, %v; want until %s", b, err, until)
+		}
+	}
+
+	// an expired ban is dropped when it is next checked
+	d.bans[banKey(BanKindIP, "192.0.2.1")] = time.Now().Add(-time.Second)
+	if _, ok := d.Banned(BanKindIP, "192.0.2.1"); ok {
+		t.Error("expired ban still in force")
+	}
+	if _, ok := d.bans[banKey(BanKindIP, "192.0.2.1")]; ok {
+		t.Error("expired ban kept in memory")
+	}
+	if err := d.CheckConn(&net.TCPAddr{IP: net.IPv4(192, 0, 2, 1), Port: 2222}, "alice"); err != nil {
+		t.Errorf("CheckConn after expiry = %v", err)
+	}
+
+	// lifting forgets the history
+	if ok, err := d.Lift(ctx, BanKindIP, "192.0.2.1"); err != nil || !ok {
+		t.Fatalf("Lift = %v, %v", ok, err)
+	}
+	start := time.Now()
+	d.ban(BanKindIP, "192.0.2.1", "test")
+	if until, _ := d.Banned(BanKindIP, "192.0.2.1"); until.Sub(start) > 16*time.Minute {
+		t.Errorf("banned for %s after Lift, want 15m", until.Sub(start))
+	}
+}
+
+func TestDefenderSync(t *testing.T) {
+	ctx := context.Background()
+	d := newTestDefender(t, 1, 1)
+	now := time.Now()
+	for _, b := range []*Ban{
+		{Kind: BanKindIP, Value: "192.0.2.1", Strikes: 1, BannedUntil: now.Add(time.Hour)},
+		{Kind: BanKindUser, Value: "alice", Strikes: 2, BannedUntil: now.Add(-time.Hour)},
+	} {
+		if err := d.store.SaveBan(ctx, b); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := d.sync(ctx); err != nil {
+		t.Fatal(err)
+	}
+	if _, ok := d.Banned(BanKindIP, "192.0.2.1"); !ok {
+		t.Error("stored ban not loaded")
+	}
+	if _, ok := d.Banned(BanKindUser, "alice"); ok {
+		t.Error("expired stored ban loaded")
+	}
+
+	// a disabled defender neither counts nor enforces
+	d.enabled = false
+	d.RecordFailure(&net.TCPAddr{IP: net.IPv4(192, 0, 2, 3), Port: 2222}, "bob")
+	if len(d.failures) > 0 {
+		t.Errorf("disabled defender recorded %v", d.failures)
+	}
+	if err := d.CheckConn(&net.TCPAddr{IP: net.IPv4(192, 0, 2, 1), Port: 2222}, "alice"); err != nil {
+		t.Errorf("disabled defender: CheckConn = %v", err)
+	}
+}
@@ -0,0 +1,81 @@
+package main
+
+import (
+	"database/sql"
+	"fmt"
+	"strings"
+
+	"github.com/go-sql-driver/mysql"
+)
+
+// dialect is a supported DB_TYPE. It names the database/sql driver and the
+// migrations directory, and holds the SQL differences between databases so
+// that queries do not test the type themselves.
+type dialect string
+
+const (
+	dialectSQLite   dialect = "sqlite"
+	dialectPostgres dialect = "postgres"
+	dialectMySQL    dialect = "mysql" // MySQL 8 and MariaDB 10.3 or newer
+)
+
+func parseDialect(dbType string) (dialect, error) {
+	switch d := dialect(strings.ToLower(dbType)); d {
+	case dialectSQLite, dialectPostgres, dialectMySQL:
+		return d, nil
+	case "mariadb":
+		return dialectMySQL, nil
+	default:
+		return "", fmt.Errorf("unsupported DB_TYPE %q (want sqlite, postgres or mysql)", dbType)
+	}
+}
+
+// open connects to the database. MySQL DSNs get the options the store relies
+// on: DATETIME columns scanned as time.Time in UTC, and UPDATE reporting the
+// rows it matched rather than those it changed, as the other databases do.
+func (d dialect) open(dsn string) (*sql.DB, error) {
+	if d == dialectMySQL {
+		cfg, err := mysql.ParseDSN(dsn)
+		if err != nil {
+			return nil, err
+		}
+		cfg.ParseTime = true
+		cfg.ClientFoundRows = true
+		dsn = cfg.FormatDSN()
+	}
+	return sql.Open(string(d), dsn)
+}
+
+// placeholder returns the bind parameter for the n-th (1-based) argument.
+func (d dialect) placeholder(n int) string {
+	if d == dialectPostgres {
+		return fmt.Sprintf("$%d", n)
+	}
+	return "?"
+}
+
+// tableExistsQuery returns a query counting the tables named by its only argument.
+func (d dialect) tableExistsQuery() string {
+	switch d {
+	case dialectSQLite:
+		return `SELECT COUNT(*) FROM sqlite_master WHERE type = 'table' AND name = ?`
+	case dialectMySQL:
+		return `SELECT COUNT(*) FROM information_schema.tables WHERE table_schema = DATABASE() AND table_name = ?`
+	default:
+		return `SELECT COUNT(*) FROM information_schema.tables WHERE table_schema = current_schema() AND table_name = $1`
+	}
+}
+
+// timestampType is the column type for a point in time. MySQL's TIMESTAMP
+// ends in 2038 and may get an implicit ON UPDATE default.
+func (d dialect) timestampType() string {
+	if d == dialectMySQL {
+		return "DATETIME"
+	}
+	return "TIMESTAMP"
+}
+
+// placeholder returns the bind parameter of the store's database for the n-th (1-based) argument.
+func (s *UserStore) placeholder(n int) string {
+	return s.dialect.placeholder(n)
+}
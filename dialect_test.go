@@ -0,0 +1,54 @@
+package main
+
+import "testing"
+
+func TestParseDialect(t *testing.T) {
+	tests := []struct {
+		dbType string
+		want   dialect
+	}{
+		{"sqlite", dialectSQLite},
+		{"Postgres", dialectPostgres},
+		{"mysql", dialectMySQL},
+		{"MariaDB", dialectMySQL},
+	}
+	for _, tt := range tests {
+		if got, err := parseDialect(tt.dbType); err != nil || got != tt.want {
+			t.Errorf("parseDialect(%q) = %q, %v; want %q", tt.dbType, got, err, tt.want)
+		}
+	}
+	if _, err := parseDialect("oracle"); err == nil {
+		t.Error("parseDialect(oracle) succeeded")
+	}
+}
+
+func TestPlaceholder(t *testing.T) {
+	tests := []struct {
+		d    dialect
+		n    int
+		want string
+	}{
+		{dialectSQLite, 1, "?"},
+		{dialectSQLite, 3, "?"},
+		{dialectMySQL, 1, "?"},
+		{dialectMySQL, 3, "?"},
+		{dialectPostgres, 1, "$1"},
+		{dialectPostgres, 12, "$12"},
+	}
+	for _, tt := range tests {
+		if got := tt.d.placeholder(tt.n); got != tt.want {
+			t.Errorf("%s placeholder(%d) = %q, want %q", tt.d, tt.n, got, tt.want)
+		}
+	}
+}
+
+func TestMySQLOpenSetsOptions(t *testing.T) {
+	db, err := dialectMySQL.open("sftp:secret@tcp(localhost:3306)/sftp")
+	if err != nil {
+		t.Fatal(err)
+	}
+	db.Close()
+	if _, err := dialectMySQL.open("not a dsn"); err == nil {
+		t.Error("open accepted an invalid DSN")
+	}
+}
@@ -0,0 +1,157 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+	"strings"
+)
+
+// Group holds defaults for the users whose group_name is Name (sftp_groups).
+// A group's quota, IP rules, path permissions and session limits are its
+// scope 'group' rows in scopeTables.
+type Group struct {
+	ID           int
+	Name         string
+	Description  sql.NullString
+	Perms        sql.NullInt64  // used when the user's perms is NULL
+	RootTemplate sql.NullString // used when the user's root_path is empty
+	CreatedAt    sql.NullTime
+}
+
+// scopeTables hold rows for a user or a group, keyed by scope ('user' or
+// 'group') and name. Renaming or deleting a group carries over to its rows.
+var scopeTables = []string{"sftp_quotas", "sftp_ip_rules", "sftp_path_perms", "sftp_session_limits", "sftp_bandwidth_limits"}
+
+// expandRootTemplate replaces {group} and {username} in a root template.
+func expandRootTemplate(template string, user *User) string {
+	return strings.NewReplacer("{group}", user.GroupName, "{username}", user.Username).Replace(template)
+}
+
+// applyTo resolves the effective settings of user, a member of g: settings the
+// user leaves unset come from the group. perms is the user's own, possibly
+// NULL, perms column. g may be nil if the group has no row.
+func (g *Group) applyTo(user *User, perms sql.NullInt64) {
+	switch {
+	case perms.Valid:
+		user.Perms = Permission(perms.Int64)
+	case g != nil && g.Perms.Valid:
+		user.Perms = Permission(g.Perms.Int64)
+	}
+	if strings.TrimSpace(user.RootPath) == "" && g != nil && g.RootTemplate.Valid && g.RootTemplate.String != "" {
+		user.RootPath = expandRootTemplate(g.RootTemplate.String, user)
+	}
+}
+
+const groupColumns = `id, name, description, perms, root_template, created_at`
+
+func scanGroup(scan func(dest ...any) error) (*Group, error) {
+	var g Group
+	if err := scan(&g.ID, &g.Name, &g.Description, &g.Perms, &g.RootTemplate, &g.CreatedAt); err != nil {
+		return nil, err
+	}
+	return &g, nil
+}
+
+// ListGroups returns every group with a row in sftp_groups, ordered by name.
+func (s *UserStore) ListGroups(ctx context.Context) ([]Group, error) {
+	rows, err := s.db.QueryContext(ctx, `SELECT `+groupColumns+` FROM sftp_groups ORDER BY name`)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	var groups []Group
+	for rows.Next() {
+		g, err := scanGroup(rows.Scan)
+		if err != nil {
+			return nil, err
+		}
+		groups = append(groups, *g)
+	}
+	return groups, rows.Err()
+}
+
+// FetchGroup returns a group's row, or sql.ErrNoRows.
+func (s *UserStore) FetchGroup(ctx context.Context, name string) (*Group, error) {
+	query := fmt.Sprintf(`SELECT %s FROM sftp_groups WHERE name = %s`, groupColumns, s.placeholder(1))
+	return scanGroup(s.db.QueryRowContext(ctx, query, name).Scan)
+}
+
+// CreateGroup inserts g and sets its ID and creation time.
+func (s *UserStore) CreateGroup(ctx context.Context, g *Group) error {
+	insert := fmt.Sprintf(`INSERT INTO sftp_groups (name, description, perms, root_template) VALUES (%s, %s, %s, %s)`,
+		s.placeholder(1), s.placeholder(2), s.placeholder(3), s.placeholder(4))
+	if _, err := s.db.ExecContext(ctx, insert, g.Name, g.Description, g.Perms, g.RootTemplate); err != nil {
+		return err
+	}
+	created, err := s.FetchGroup(ctx, g.Name)
+	if err != nil {
+		return err
+	}
+	g.ID, g.CreatedAt = created.ID, created.CreatedAt
+	return nil
+}
+
+// UpdateGroup saves every field of g but the ID and creation time. A new name
+// is carried over to the members and to the group's rows in scopeTables. It
+// reports whether the group exists.
+func (s *UserStore) UpdateGroup(ctx context.Context, g *Group) (bool, error) {
+	tx, err := s.db.BeginTx(ctx, nil)
+	if err != nil {
+		return false, err
+	}
+	defer tx.Rollback()
+
+	var oldName string
+	err = tx.QueryRowContext(ctx, fmt.Sprintf(`SELECT name FROM sftp_groups WHERE id = %s`, s.placeholder(1)), g.ID).Scan(&oldName)
+	if errors.Is(err, sql.ErrNoRows) {
+		return false, nil
+	}
+	if err != nil {
+		return false, err
+	}
+	update := fmt.Sprintf(`UPDATE sftp_groups SET name = %s, description = %s, perms = %s, root_template = %s WHERE id = %s`,
+		s.placeholder(1), s.placeholder(2), s.placeholder(3), s.placeholder(4), s.placeholder(5))
+	if _, err := tx.ExecContext(ctx, update, g.Name, g.Description, g.Perms, g.RootTemplate, g.ID); err != nil {
+		return false, err
+	}
+	if g.Name != oldName {
+		rename := fmt.Sprintf(`UPDATE sftp_users SET group_name = %s WHERE group_name = %s`, s.placeholder(1), s.placeholder(2))
+		if _, err := tx.ExecContext(ctx, rename, g.Name, oldName); err != nil {
+			return false, err
+		}
+		for _, table := range scopeTables {
+			rename := fmt.Sprintf(`UPDATE %s SET name = %s WHERE scope = 'group' AND name = %s`, table, s.placeholder(1), s.placeholder(2))
+			if _, err := tx.ExecContext(ctx, rename, g.Name, oldName); err != nil {
+				return false, err
+			}
+		}
+	}
+	return true, tx.Commit()
+}
+
+// DeleteGroup removes a group's row with its quota, IP rule, path permission
+// and session limit rows. Members keep their group_name and lose the group's
+// defaults. It reports whether the group existed.
+func (s *UserStore) DeleteGroup(ctx context.Context, name string) (bool, error) {
+	tx, err := s.db.BeginTx(ctx, nil)
+	if err != nil {
+		return false, err
+	}
+	defer tx.Rollback()
+
+	res, err := tx.ExecContext(ctx, fmt.Sprintf(`DELETE FROM sftp_groups WHERE name = %s`, s.placeholder(1)), name)
+	if err != nil {
+		return false, err
+	}
+	if n, err := res.RowsAffected(); err != nil || n == 0 {
+		return false, err
+	}
+	for _, table := range scopeTables {
+		if _, err := tx.ExecContext(ctx, fmt.Sprintf(`DELETE FROM %s WHERE scope = 'group' AND name = %s`, table, s.placeholder(1)), name); err != nil {
+			return false, err
+		}
+	}
+	return true, tx.Commit()
+}
@@ -1,11 +1,13 @@
 package main
 
 import (
-	"errors"
+	"context"
+	"database/sql"
+	"fmt"
 	"io"
 	"os"
-	"path/filepath"
-	"runtime"
+	"path"
+	"strconv"
 	"strings"
 	"time"
 
@@ -20,249 +22,441 @@ const (
 	SSH_FXP_MKDIR    = "Mkdir"
 	SSH_FXP_RMDIR    = "Rmdir"
 	SSH_FXP_SET_STAT = "Setstat"
+	SSH_FXP_SYMLINK  = "Symlink"
 )
 
-// SftpHandler is used by sftp.NewRequestServer to handle requests.
-// It uses the OS filesystem but enforces virtual root + permission checks.
-type SftpHandler struct {
-	user   *User
-	logger *zap.SugaredLogger
-}
-
-// resolvePath returns absolute canonical path for requested path inside user's root.
-// It prevents escaping root by path traversal (../) or weird absolute requests.
-// relative to the user's configured root directory.
-func (h *SftpHandler) resolvePath(requested string) (string, error) {
-	h.logger.Infof("Resolving path for request: %s", requested)
+// errPermissionDenied is returned when the user's permissions refuse a
+// request. It is os.ErrPermission, which the sftp package would otherwise
+// report as a generic failure, sent as SSH_FX_PERMISSION_DENIED.
+var errPermissionDenied error = permissionDenied{}
 
-	// Base directory under which all user roots must live
-	baseRoot := getEnvOrDefault("BASE_FS_ROOT", "./data/fs")
+type permissionDenied struct{}
 
-	// Normalize incoming path separators for the current OS
-	req := filepath.FromSlash(requested)
+func (permissionDenied) Error() string { return "permission denied" }
 
-	// Strip any leading volume or leading separators so the request is always treated as relative.
-	if vol := filepath.VolumeName(req); vol != "" {
-		req = strings.TrimPrefix(req, vol)
-	}
-	req = strings.TrimPrefix(req, string(filepath.Separator))
-	req = strings.TrimPrefix(req, "/")
-
-	// Clean up any ../ or ./ sequences in the requested path itself
-	req = filepath.Clean(req)
-
-	// Treat root-like requests as empty relative path so we map "/" -> user root
-	if req == "." || req == string(filepath.Separator) || req == "/" || req == "" {
-		req = ""
-	}
+func (permissionDenied) Unwrap() []error {
+	return []error{os.ErrPermission, sftp.ErrSSHFxPermissionDenied}
+}
 
-	// Determine user's root. If not set or invalid, allocate under BASE_FS_ROOT/<username>
-	userRoot := filepath.FromSlash(strings.TrimSpace(h.user.RootPath))
-	if userRoot == "" {
-		userRoot = filepath.Join(baseRoot, h.user.Username)
-	}
+// SftpHandler is used by sftp.NewRequestServer to handle requests.
+// It serves the user's FileSystem and enforces permission checks per path.
+type SftpHandler struct {
+	user       *User
+	session    *Session // nil outside of an SSH session
+	fs         FileSystem
+	acl        *pathACL
+	uploadMode string
+	quota      *quotaUsage // nil if the user has no quota
+	bandwidth  *userBandwidth
+	logger     *zap.SugaredLogger
+}
 
-	// Resolve absolute paths
-	baseAbs, err := filepath.Abs(baseRoot)
+// newSftpHandler opens the user's filesystem according to their storage settings,
+// starts tracking their usage if they have a quota and joins their shared
+// bandwidth. Call Close when the session ends.
+func newSftpHandler(ctx context.Context, store *UserStore, user *User, session *Session, logger *zap.SugaredLogger) (*SftpHandler, error) {
+	fs, storage, err := openUserFileSystem(ctx, store, user, logger)
 	if err != nil {
-		h.logger.Errorf("Error resolving base root absolute path: %v", err)
-		return "", err
+		return nil, err
 	}
-	userRootAbs, err := filepath.Abs(userRoot)
+	mode, err := uploadMode(storage)
 	if err != nil {
-		h.logger.Errorf("Error resolving user's root absolute path: %v", err)
-		return "", err
-	}
-
-	// Ensure user's root is inside baseRoot. If not, rebase it under baseRoot.
-	relToBase, rerr := filepath.Rel(baseAbs, userRootAbs)
-	if rerr != nil || strings.HasPrefix(relToBase, "..") || relToBase == ".." {
-		h.logger.Warnf("User root %s is outside BASE_FS_ROOT; rebasing to %s", userRootAbs, baseAbs)
-		userRootAbs = filepath.Join(baseAbs, h.user.Username)
+		return nil, err
 	}
-
-	// Ensure the user root directory exists
-	if mkerr := os.MkdirAll(userRootAbs, 0755); mkerr != nil {
-		h.logger.Warnf("Failed to create user root dir (%s): %v", userRootAbs, mkerr)
+	if aw, ok := fs.(atomicWriter); ok && aw.AtomicWrites() {
+		mode = UploadModeDirect
 	}
-
-	// Update in-memory user root so subsequent calls use the resolved path
-	h.user.RootPath = userRootAbs
-
-	// If req is empty it means client asked for the user's root (e.g. "/")
-	var joined string
-	if req == "" {
-		joined = userRootAbs
-	} else {
-		joined = filepath.Join(userRootAbs, req)
+	pathPerms, err := store.FetchPathPerms(ctx, user)
+	if err != nil {
+		return nil, err
 	}
-
-	abs, err := filepath.Abs(joined)
+	rates, err := store.FetchBandwidthLimits(ctx, user, defaultBandwidthLimits())
 	if err != nil {
-		h.logger.Errorf("Error resolving absolute path: %v", err)
-		return "", err
+		return nil, err
 	}
-
-	// Ensure the resolved path is within the user's root directory
-	rel, err := filepath.Rel(userRootAbs, abs)
+	limit, err := store.FetchQuota(ctx, user)
 	if err != nil {
-		h.logger.Errorf("Error getting relative path: %v", err)
-		return "", errors.New("access denied")
+		return nil, err
 	}
-	if strings.HasPrefix(rel, "..") || strings.HasPrefix(rel, ".."+string(filepath.Separator)) {
-		h.logger.Warnf("Attempt to escape root directory: %s -> %s", requested, abs)
-		return "", errors.New("access denied")
+	var usage *quotaUsage
+	if limit != nil {
+		if usage, err = acquireQuotaUsage(user, *limit, fs, logger); err != nil {
+			return nil, err
+		}
 	}
+	return &SftpHandler{user: user, session: session, fs: fs, acl: newPathACL(user.Perms, pathPerms), uploadMode: mode, quota: usage,
+		bandwidth: acquireBandwidth(user, rates), logger: logger}, nil
+}
 
-	h.logger.Infof("Resolved path: %s", abs)
-	return abs, nil
+// Close releases the session's hold on the user's usage and bandwidth.
+func (h *SftpHandler) Close() {
+	h.quota.release()
+	h.bandwidth.release()
 }
 
-// hasPermission checks if the user has the specified permission.
-func (h *SftpHandler) hasPermission(perm Permission) bool {
-	hasPerm := h.user.Perms&perm != 0
-	h.logger.Debugf("Checking permission [%s] for user %s: %v", perm, h.user.Username, hasPerm)
+// hasPermission checks if the user has the specified permission on p, a
+// cleaned virtual path, according to the most specific path permission.
+func (h *SftpHandler) hasPermission(p string, perm Permission) bool {
+	hasPerm := h.acl.Perms(p)&perm != 0
+	h.logger.Debugf("Checking permission [%s] on %s for user %s: %v", perm, p, h.user.Username, hasPerm)
 	return hasPerm
 }
+
+// hasTreePermission is hasPermission for operations that also affect
+// everything below p, such as removing or renaming a directory.
+func (h *SftpHandler) hasTreePermission(p string, perm Permission) bool {
+	hasPerm := h.acl.AllowsTree(p, perm)
+	h.logger.Debugf("Checking permission [%s] on %s and below for user %s: %v", perm, p, h.user.Username, hasPerm)
+	return hasPerm
+}
+
+// permissionNames lists the names ParsePermission accepts and String prints.
+var permissionNames = []struct {
+	perm Permission
+	name string
+}{
+	{PermRead, "read"},
+	{PermList, "list"},
+	{PermWrite, "write"},
+	{PermDelete, "delete"},
+	{PermDownload, "download"},
+	{PermUpload, "upload"},
+	{PermOverwrite, "overwrite"},
+	{PermCreateDir, "create-dir"},
+	{PermRename, "rename"},
+	{PermDeleteFile, "delete-file"},
+	{PermDeleteDir, "delete-dir"},
+	{PermChmod, "chmod"},
+	{PermChtimes, "chtimes"},
+	{PermChown, "chown"},
+	{PermCreateSymlink, "create-symlink"},
+}
+
 func (p Permission) String() string {
-	switch p {
-	case PermRead:
-		return "read"
-	case PermWrite:
-		return "write"
-	case PermDelete:
-		return "delete"
-	case PermList:
-		return "list"
-	default:
-		return "unknown"
+	var names []string
+	for _, n := range permissionNames {
+		if p&n.perm != 0 {
+			names = append(names, n.name)
+			p &^= n.perm
+		}
+	}
+	if p != 0 || len(names) == 0 {
+		names = append(names, "unknown")
+	}
+	return strings.Join(names, "|")
+}
+
+func permissionByName(name string) (Permission, bool) {
+	for _, n := range permissionNames {
+		if n.name == name {
+			return n.perm, true
+		}
+	}
+	return 0, false
+}
+
+// ParsePermission parses a bitmask given either as a number ("7") or as
+// permission names separated by '|', '+' or ',' ("read|list|write").
+func ParsePermission(s string) (Permission, error) {
+	s = strings.TrimSpace(s)
+	if n, err := strconv.ParseUint(s, 10, 32); err == nil {
+		return Permission(n), nil
+	}
+	var perms Permission
+	for _, name := range strings.FieldsFunc(s, func(r rune) bool { return r == '|' || r == '+' || r == ',' }) {
+		perm, ok := permissionByName(strings.ToLower(strings.TrimSpace(name)))
+		if !ok {
+			return 0, fmt.Errorf("unknown permission %q", name)
+		}
+		perms |= perm
 	}
+	return perms, nil
 }
 
 // Fileread reads a file from the user's root directory.
 // Handles download/open-for-read requests
 func (h *SftpHandler) Fileread(r *sftp.Request) (io.ReaderAt, error) {
 	h.logger.Debugf("[FileRead] User: %s, Path: %s", h.user.Username, r.Filepath)
-	if !h.hasPermission(PermRead) {
-		h.logger.Warnf("Read permission denied for user: %s", h.user.Username)
-		return nil, os.ErrPermission
-	}
-
-	// Resolve the absolute path for the requested file
-	absPath, err := h.resolvePath(r.Filepath)
-	if err != nil {
-		h.logger.Errorf("Error resolving file path: %v", err)
-		return nil, err
+	absPath := cleanPath(r.Filepath)
+	if !h.hasPermission(absPath, PermDownload) {
+		h.logger.Warnf("Download permission denied on %s for user: %s", absPath, h.user.Username)
+		return nil, errPermissionDenied
 	}
 
 	// Open the file for reading
-	file, err := os.Open(absPath)
+	file, err := h.fs.Open(absPath)
 	if err != nil {
 		h.logger.Errorf("Error opening file: %v", err)
 		return nil, err
 	}
-	return file, nil
+	return h.session.trackFile(h.bandwidth.throttle(file, h.session.Done()), absPath, "read"), nil
 }
 
 // Filewrite writes a file to the user's root directory.
 // Handles upload/open-for-write requests
 func (h *SftpHandler) Filewrite(r *sftp.Request) (io.WriterAt, error) {
-	h.logger.Debugf("[Filewrite] User: %s, Path: %s", h.user.Username, r.Filepath)
-	if !h.hasPermission(PermWrite) {
-		h.logger.Warnf("Write permission denied for user: %s", h.user.Username)
-		return nil, os.ErrPermission
+	h.logger.Debugf("[Filewrite] User: %s, Path: %s, Flags: %+v", h.user.Username, r.Filepath, r.Pflags())
+	target := cleanPath(r.Filepath)
+	file, err := h.openWrite(target, openFlags(r.Pflags()))
+	if err != nil {
+		return nil, err
+	}
+	return h.session.trackFile(h.bandwidth.throttle(file, h.session.Done()), target, "write"), nil
+}
+
+// OpenFile implements sftp.OpenFileWriter for handles opened for both reading
+// and writing, which clients use to seek within a file and to resume transfers.
+func (h *SftpHandler) OpenFile(r *sftp.Request) (sftp.WriterAtReaderAt, error) {
+	h.logger.Debugf("[OpenFile] User: %s, Path: %s, Flags: %+v", h.user.Username, r.Filepath, r.Pflags())
+	target := cleanPath(r.Filepath)
+	flag := openFlags(r.Pflags())
+	// A handle that truncates or exclusively creates the file can only read
+	// back what the client wrote itself, so it needs no Download permission
+	// (some clients open every upload read-write).
+	needRead := flag&os.O_TRUNC == 0 && flag&(os.O_CREATE|os.O_EXCL) != os.O_CREATE|os.O_EXCL
+	if needRead && !h.hasPermission(target, PermDownload) {
+		h.logger.Warnf("Download permission denied on %s for user: %s", target, h.user.Username)
+		return nil, errPermissionDenied
+	}
+	file, err := h.openWrite(target, flag)
+	if err != nil {
+		return nil, err
+	}
+	return h.session.trackFile(h.bandwidth.throttle(file, h.session.Done()), target, "read-write"), nil
+}
+
+// openFlags maps SFTP open pflags to os.OpenFile flags. Append is dropped:
+// clients still send explicit offsets, and os.File.WriteAt refuses O_APPEND.
+// Without Trunc an existing file keeps its content, so a resumed upload
+// continues from wherever the client starts writing.
+func openFlags(pf sftp.FileOpenFlags) int {
+	flag := os.O_WRONLY
+	if pf.Read {
+		flag = os.O_RDWR
+	}
+	if pf.Creat {
+		flag |= os.O_CREATE
+	}
+	if pf.Trunc {
+		flag |= os.O_TRUNC
+	}
+	if pf.Excl {
+		flag |= os.O_EXCL
+	}
+	return flag
+}
+
+// openWrite opens target for writing with the given os.OpenFile flags. A new
+// file needs Upload permission; writing to an existing one, including
+// resuming it, needs Overwrite.
+func (h *SftpHandler) openWrite(target string, flag int) (File, error) {
+	fi, err := h.fs.Stat(target)
+	if err != nil && !os.IsNotExist(err) {
+		h.logger.Errorf("Error stat path: %v", err)
+		return nil, err
+	}
+	exists := err == nil
+	if exists && fi.IsDir() {
+		return nil, os.ErrInvalid
+	}
+	perm := PermUpload
+	if exists {
+		perm = PermOverwrite
+	}
+	if !h.hasPermission(target, perm) {
+		h.logger.Warnf("%s permission denied on %s for user: %s", perm, target, h.user.Username)
+		return nil, errPermissionDenied
+	}
+	if !exists && flag&os.O_CREATE != 0 {
+		// Ensure the directory exists
+		dir := path.Dir(target)
+		if _, err := h.fs.Stat(dir); os.IsNotExist(err) {
+			if !h.hasPermission(dir, PermCreateDir) {
+				h.logger.Warnf("Create-dir permission denied on %s for user: %s", dir, h.user.Username)
+				return nil, errPermissionDenied
+			}
+			if err := h.fs.MkdirAll(dir, 0755); err != nil {
+				h.logger.Errorf("Error creating directories: %v", err)
+				return nil, err
+			}
+		}
+	}
+	var size int64 // size of the file once open
+	if exists && flag&os.O_TRUNC == 0 {
+		size = fi.Size()
+	}
+	var replaced int64 // bytes freed by truncating the existing file
+	if exists && flag&os.O_TRUNC != 0 {
+		replaced = fi.Size()
+	}
+	created := !exists && flag&os.O_CREATE != 0
+	if created {
+		if err := h.quota.reserve(0, 1); err != nil {
+			h.logger.Warnf("File quota exceeded for user: %s", h.user.Username)
+			return nil, err
+		}
+	}
+	// Replacing or creating a file in atomic mode goes through a temporary
+	// file. Opening an existing file without truncating it (a resume or an
+	// in-place edit) writes in place: an interrupted atomic upload leaves
+	// nothing to resume.
+	atomic := h.uploadMode == UploadModeAtomic && (created || exists && flag&os.O_TRUNC != 0)
+	var file File
+	switch {
+	case atomic && exists && flag&os.O_EXCL != 0:
+		err = os.ErrExist
+	case atomic:
+		file, err = h.atomicUpload(target, flag)
+	default:
+		file, err = h.fs.OpenFile(target, flag, 0644)
+		if err != nil {
+			h.logger.Errorf("Error opening file for write: %v", err)
+		}
 	}
-	// Resolve the absolute path for the requested file
-	absPath, err := h.resolvePath(r.Filepath)
 	if err != nil {
-		h.logger.Errorf("Error resolving file path: %v", err)
+		if created {
+			h.quota.adjust(0, -1)
+		}
 		return nil, err
 	}
-	// Ensure the directory exists
-	dir := filepath.Dir(absPath)
-	if err := os.MkdirAll(dir, 0755); err != nil {
-		h.logger.Errorf("Error creating directories: %v", err)
+	if h.quota == nil {
+		return file, nil
+	}
+	h.quota.adjust(-replaced, 0)
+	// Backends that write on close, like S3, also keep nothing when it fails
+	if aw, ok := h.fs.(atomicWriter); ok && aw.AtomicWrites() {
+		atomic = true
+	}
+	return &quotaFile{File: file, usage: h.quota, size: size, atomic: atomic, created: created, replaced: replaced}, nil
+}
+
+// atomicUpload opens a temporary file that replaces target on a clean close.
+func (h *SftpHandler) atomicUpload(target string, flag int) (File, error) {
+	temp, err := uploadTempName(target)
+	if err != nil {
 		return nil, err
 	}
-	// Open the file for writing (create if not exists)
-	file, err := os.OpenFile(absPath, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0644)
+	file, err := h.fs.OpenFile(temp, flag&(os.O_WRONLY|os.O_RDWR)|os.O_CREATE|os.O_EXCL, 0644)
 	if err != nil {
-		h.logger.Errorf("Error opening file for write: %v", err)
+		h.logger.Errorf("Error opening temporary upload file: %v", err)
 		return nil, err
 	}
-	return file, nil
+	h.logger.Debugf("Uploading %s via %s", target, temp)
+	return &atomicUpload{fs: h.fs, file: file, temp: temp, final: target, logger: h.logger}, nil
 }
 
 // Filecmd handles other file commands like Delete, Rename, Mkdir, Rmdir
 func (h *SftpHandler) Filecmd(r *sftp.Request) error {
 	h.logger.Debugf("[Filecmd] User: %s, Method: %s, Path: %s", h.user.Username, r.Method, r.Filepath)
-	// Resolve the absolute path for the requested file
-	absPath, err := h.resolvePath(r.Filepath)
-	if err != nil {
-		h.logger.Errorf("Error resolving file path: %v", err)
-		return err
-	}
+	absPath := cleanPath(r.Filepath)
 	switch r.Method {
 	case SSH_FXP_REMOVE:
-		if !h.hasPermission(PermDelete) {
-			h.logger.Warnf("Delete permission denied for user: %s", h.user.Username)
-			return os.ErrPermission
+		// Remove also takes empty directories, which need Delete-dir
+		perm := PermDeleteFile
+		if fi, err := h.fs.Lstat(absPath); err == nil && fi.IsDir() {
+			perm = PermDeleteDir
+		}
+		if !h.hasPermission(absPath, perm) {
+			h.logger.Warnf("%s permission denied on %s for user: %s", perm, absPath, h.user.Username)
+			return errPermissionDenied
 		}
 		// Handle file deletion
-		if err := os.Remove(absPath); err != nil {
+		bytes, files := h.usageOf(absPath)
+		if err := h.fs.Remove(absPath); err != nil {
 			h.logger.Errorf("Error deleting file: %v", err)
 			return err
 		}
+		h.quota.adjust(-bytes, -files)
 	case SSH_FXP_RENAME:
-		if !h.hasPermission(PermWrite) {
-			h.logger.Warnf("Write permission denied for user: %s", h.user.Username)
-			return os.ErrPermission
+		// Both ends need Rename, including any paths with their own
+		// permissions below them when a directory is moved. Replacing an
+		// existing file also needs Overwrite on it.
+		target := cleanPath(r.Target)
+		if !h.hasTreePermission(absPath, PermRename) || !h.hasTreePermission(target, PermRename) {
+			h.logger.Warnf("Rename permission denied renaming %s to %s for user: %s", absPath, target, h.user.Username)
+			return errPermissionDenied
 		}
-		newPath, err := h.resolvePath(r.Target)
-		if err != nil {
-			h.logger.Errorf("Error resolving new file path: %v", err)
-			return err
+		if fi, err := h.fs.Lstat(target); err == nil && !fi.IsDir() && target != absPath && !h.hasPermission(target, PermOverwrite) {
+			h.logger.Warnf("Overwrite permission denied renaming %s to %s for user: %s", absPath, target, h.user.Username)
+			return errPermissionDenied
 		}
-		// Handle file renaming
-		if err := os.Rename(absPath, newPath); err != nil {
+		// Handle file renaming; a file it replaces no longer counts
+		var bytes, files int64
+		if target != absPath {
+			bytes, files = h.usageOf(target)
+		}
+		if err := h.fs.Rename(absPath, target); err != nil {
 			h.logger.Errorf("Error renaming file: %v", err)
 			return err
 		}
+		h.quota.adjust(-bytes, -files)
 	case SSH_FXP_MKDIR:
-		if !h.hasPermission(PermWrite) {
-			h.logger.Warnf("Write permission denied for user: %s", h.user.Username)
-			return os.ErrPermission
+		if !h.hasPermission(absPath, PermCreateDir) {
+			h.logger.Warnf("Create-dir permission denied on %s for user: %s", absPath, h.user.Username)
+			return errPermissionDenied
 		}
 		// Handle directory creation
-		if err := os.MkdirAll(absPath, 0755); err != nil {
+		if err := h.fs.MkdirAll(absPath, 0755); err != nil {
 			h.logger.Errorf("Error creating directory: %v", err)
 			return err
 		}
 	case SSH_FXP_RMDIR:
-		if !h.hasPermission(PermDelete) {
-			h.logger.Warnf("Delete permission denied for user: %s", h.user.Username)
-			return os.ErrPermission
+		// The directory is removed with its contents, which then need
+		// Delete-file too.
+		fi, err := h.fs.Lstat(absPath)
+		if err != nil {
+			return err
+		}
+		if !fi.IsDir() {
+			return os.ErrInvalid
+		}
+		perms := []Permission{PermDeleteDir}
+		if entries, err := h.fs.ReadDir(absPath); err == nil && len(entries) > 0 {
+			perms = append(perms, PermDeleteFile)
+		}
+		// Each is required; one check would pass with either of them
+		for _, perm := range perms {
+			if !h.hasTreePermission(absPath, perm) {
+				h.logger.Warnf("%s permission denied on %s for user: %s", perm, absPath, h.user.Username)
+				return errPermissionDenied
+			}
 		}
 		// Handle directory removal
-		if err := os.RemoveAll(absPath); err != nil {
+		bytes, files := h.usageOf(absPath)
+		if err := h.fs.RemoveAll(absPath); err != nil {
 			h.logger.Errorf("Error removing directory: %v", err)
 			return err
 		}
+		h.quota.adjust(-bytes, -files)
 	case SSH_FXP_SET_STAT:
 		// Apply Setstat attributes best-effort with virtual-root safety and permission checks.
-		if !h.hasPermission(PermWrite) {
-			h.logger.Warnf("Setstat denied (write permission required) for user: %s", h.user.Username)
-			return os.ErrPermission
-		}
 		attrs := r.Attributes()
 		if attrs == nil {
 			h.logger.Debugf("[Setstat] No attributes provided for %s", absPath)
 			return nil
 		}
+		// Each attribute needs its own permission; check them all before changing anything.
+		var need Permission
+		if attrs.Mode != 0 {
+			need |= PermChmod
+		}
+		if attrs.Atime != 0 || attrs.Mtime != 0 {
+			need |= PermChtimes
+		}
+		if attrs.UID != 0 || attrs.GID != 0 {
+			need |= PermChown
+		}
+		if attrs.Size > 0 {
+			need |= PermOverwrite
+		}
+		if missing := need &^ h.acl.Perms(absPath); missing != 0 {
+			h.logger.Warnf("Setstat denied (%s permission required) on %s for user: %s", missing, absPath, h.user.Username)
+			return errPermissionDenied
+		}
 		// 1) Permissions (Mode)
 		if attrs.Mode != 0 {
 			perm := os.FileMode(attrs.Mode & 0o777)
-			if err := os.Chmod(absPath, perm); err != nil {
+			if err := h.fs.Chmod(absPath, perm); err != nil {
 				h.logger.Errorf("[Setstat] Chmod failed on %s: %v", absPath, err)
 				return err
 			}
@@ -281,33 +475,37 @@ func (h *SftpHandler) Filecmd(r *sftp.Request) error {
 			}
 			atime := time.Unix(int64(at), 0)
 			mtime := time.Unix(int64(mt), 0)
-			if err := os.Chtimes(absPath, atime, mtime); err != nil {
+			if err := h.fs.Chtimes(absPath, atime, mtime); err != nil {
 				h.logger.Errorf("[Setstat] Chtimes failed on %s: %v", absPath, err)
 				return err
 			}
 			h.logger.Debugf("[Setstat] Applied chtimes atime=%v mtime=%v to %s", atime, mtime, absPath)
 		}
-		// 3) Ownership (UID/GID) — unsupported on Windows.
-		if runtime.GOOS != "windows" && (attrs.UID != 0 || attrs.GID != 0) {
-			if err := os.Chown(absPath, int(attrs.UID), int(attrs.GID)); err != nil {
+		// 3) Ownership (UID/GID) — left to the filesystem, which may ignore it.
+		if attrs.UID != 0 || attrs.GID != 0 {
+			if err := h.fs.Chown(absPath, int(attrs.UID), int(attrs.GID)); err != nil {
 				h.logger.Errorf("[Setstat] Chown failed on %s: %v", absPath, err)
 				return err
 			}
 			h.logger.Debugf("[Setstat] Applied chown uid=%d gid=%d to %s", attrs.UID, attrs.GID, absPath)
-		} else if runtime.GOOS == "windows" && (attrs.UID != 0 || attrs.GID != 0) {
-			h.logger.Debugf("[Setstat] Skipping chown on Windows for %s (uid=%d gid=%d)", absPath, attrs.UID, attrs.GID)
 		}
 		// 4) Size (truncate). Ambiguity: FileStat lacks flags; to avoid destructive truncation to 0
 		// when size is not explicitly set, we only act when Size > 0.
 		if attrs.Size > 0 {
 			// Ensure it is a regular file before truncating
-			fi, statErr := os.Stat(absPath)
+			fi, statErr := h.fs.Stat(absPath)
 			if statErr != nil {
 				h.logger.Errorf("[Setstat] Stat before truncate failed on %s: %v", absPath, statErr)
 				return statErr
 			}
 			if fi.Mode().IsRegular() {
-				if err := os.Truncate(absPath, int64(attrs.Size)); err != nil {
+				delta := int64(attrs.Size) - fi.Size()
+				if err := h.quota.reserve(delta, 0); err != nil {
+					h.logger.Warnf("[Setstat] Quota exceeded extending %s for user: %s", absPath, h.user.Username)
+					return err
+				}
+				if err := h.fs.Truncate(absPath, int64(attrs.Size)); err != nil {
+					h.quota.adjust(-delta, 0)
 					h.logger.Errorf("[Setstat] Truncate failed on %s: %v", absPath, err)
 					return err
 				}
@@ -320,6 +518,16 @@ func (h *SftpHandler) Filecmd(r *sftp.Request) error {
 			h.logger.Debugf("[Setstat] Size=0 ignored for safety on %s (ambiguous: not applying truncate)", absPath)
 		}
 		return nil
+	case SSH_FXP_SYMLINK:
+		// Target is the new link, Filepath what it points to
+		link := cleanPath(r.Target)
+		if !h.hasPermission(link, PermCreateSymlink) {
+			h.logger.Warnf("Create-symlink permission denied on %s for user: %s", link, h.user.Username)
+			return errPermissionDenied
+		}
+		// No filesystem creates links: on local disk one could point outside
+		// the user's root.
+		return sftp.ErrSSHFxOpUnsupported
 	default:
 		h.logger.Warnf("Unsupported file command: %s", r.Method)
 		return os.ErrInvalid
@@ -327,28 +535,67 @@ func (h *SftpHandler) Filecmd(r *sftp.Request) error {
 	return nil
 }
 
+// usageOf returns what p counts towards the user's quota, or zero if the user
+// has no quota or p does not exist.
+func (h *SftpHandler) usageOf(p string) (bytes, files int64) {
+	if h.quota == nil {
+		return 0, 0
+	}
+	bytes, files, err := diskUsage(h.fs, p)
+	if err != nil && !os.IsNotExist(err) {
+		h.logger.Warnf("Failed to measure %s for quota: %v", p, err)
+	}
+	return bytes, files
+}
+
+// StatVFS implements sftp.StatVFSFileCmder for the statvfs@openssh.com
+// extension. It reports the user's quota as the size of the filesystem and
+// their usage as the space taken, so clients such as "df" in OpenSSH sftp can
+// show it. Users without a quota get SSH_FX_OP_UNSUPPORTED.
+func (h *SftpHandler) StatVFS(r *sftp.Request) (*sftp.StatVFS, error) {
+	h.logger.Debugf("[StatVFS] User: %s, Path: %s", h.user.Username, r.Filepath)
+	if h.quota == nil {
+		return nil, sftp.ErrSSHFxOpUnsupported
+	}
+	bytes, files, limit := h.quota.snapshot()
+	const blockSize = 4096
+	st := &sftp.StatVFS{Bsize: blockSize, Frsize: blockSize, Namemax: 255}
+	st.Blocks, st.Bfree = statVFSCounts((bytes+blockSize-1)/blockSize, limit.MaxBytes, blockSize)
+	st.Files, st.Ffree = statVFSCounts(files, limit.MaxFiles, 1)
+	st.Bavail, st.Favail = st.Bfree, st.Ffree
+	return st, nil
+}
+
+// statVFSCounts returns the total and free units for a quota dimension where
+// used units are taken and limit is given in units of unit bytes. Without a
+// limit the free amount is reported as a petabyte's worth of units.
+func statVFSCounts(used int64, limit sql.NullInt64, unit int64) (total, free uint64) {
+	if !limit.Valid {
+		free = uint64(1<<50) / uint64(unit)
+		return uint64(used) + free, free
+	}
+	total = uint64((limit.Int64 + unit - 1) / unit)
+	if uint64(used) < total {
+		free = total - uint64(used)
+	}
+	return total, free
+}
+
 // Filelist lists files in a directory within the user's root directory.
 // Handles directory listing requests
 func (h *SftpHandler) Filelist(r *sftp.Request) (sftp.ListerAt, error) {
 	h.logger.Debugf("[Filelist] User: %s, Path: %s", h.user.Username, r.Filepath)
-	if !h.hasPermission(PermList) {
-		h.logger.Warnf("List permission denied for user: %s", h.user.Username)
-		return nil, os.ErrPermission
+	// The request server sends SSH_FXP_STAT here too, with Method "Stat".
+	if r.Method == "Stat" {
+		return h.Stat(r)
 	}
-	// Resolve the absolute path for the requested directory
-	absPath, err := h.resolvePath(r.Filepath)
-	if err != nil {
-		h.logger.Errorf("Error resolving directory path: %v", err)
-		return nil, err
+	absPath := cleanPath(r.Filepath)
+	if !h.hasPermission(absPath, PermList) {
+		h.logger.Warnf("List permission denied on %s for user: %s", absPath, h.user.Username)
+		return nil, errPermissionDenied
 	}
 	// Read the directory contents
-	fis, err := os.Open(absPath)
-	if err != nil {
-		h.logger.Errorf("Error reading directory: %v", err)
-		return nil, err
-	}
-	defer fis.Close()
-	fisList, err := fis.Readdir(-1)
+	fisList, err := h.fs.ReadDir(absPath)
 	if err != nil {
 		h.logger.Errorf("Error listing directory contents: %v", err)
 		return nil, err
@@ -383,16 +630,12 @@ func (h *SftpHandler) Lstat(r *sftp.Request) (sftp.ListerAt, error) {
 	// WinSCP issues LSTAT when entering directories; ensure we resolve the
 	// virtual path and do not leak the raw request path.
 	h.logger.Debugf("[Lstat] User: %s, Path: %s", h.user.Username, r.Filepath)
-	if !h.hasPermission(PermList) && !h.hasPermission(PermRead) {
-		h.logger.Warnf("Lstat permission denied for user: %s", h.user.Username)
-		return nil, os.ErrPermission
-	}
-	absPath, err := h.resolvePath(r.Filepath)
-	if err != nil {
-		h.logger.Errorf("Error resolving lstat path: %v", err)
-		return nil, err
+	absPath := cleanPath(r.Filepath)
+	if !h.hasPermission(absPath, PermList|PermDownload) {
+		h.logger.Warnf("Lstat permission denied on %s for user: %s", absPath, h.user.Username)
+		return nil, errPermissionDenied
 	}
-	fi, err := os.Lstat(absPath)
+	fi, err := h.fs.Lstat(absPath)
 	if err != nil {
 		if os.IsNotExist(err) {
 			h.logger.Warnf("Path does not exist for lstat: %s", absPath)
@@ -410,16 +653,12 @@ func (h *SftpHandler) Lstat(r *sftp.Request) (sftp.ListerAt, error) {
 func (h *SftpHandler) Stat(r *sftp.Request) (sftp.ListerAt, error) {
 	// Ensure we resolve the virtual path and do not leak the raw request path.
 	h.logger.Debugf("[Stat] User: %s, Path: %s", h.user.Username, r.Filepath)
-	if !h.hasPermission(PermList) && !h.hasPermission(PermRead) {
-		h.logger.Warnf("Stat permission denied for user: %s", h.user.Username)
-		return nil, os.ErrPermission
-	}
-	absPath, err := h.resolvePath(r.Filepath)
-	if err != nil {
-		h.logger.Errorf("Error resolving stat path: %v", err)
-		return nil, err
+	absPath := cleanPath(r.Filepath)
+	if !h.hasPermission(absPath, PermList|PermDownload) {
+		h.logger.Warnf("Stat permission denied on %s for user: %s", absPath, h.user.Username)
+		return nil, errPermissionDenied
 	}
-	fi, err := os.Stat(absPath)
+	fi, err := h.fs.Stat(absPath)
 	if err != nil {
 		if os.IsNotExist(err) {
 			h.logger.Warnf("Path does not exist for stat: %s", absPath)
@@ -0,0 +1,373 @@
+package main
+
+import (
+	"errors"
+	"io"
+	"os"
+	"testing"
+	"time"
+
+	"github.com/pkg/sftp"
+	"go.uber.org/zap"
+)
+
+// newTestHandler returns a handler for a user with perms and pathPerms over a
+// new MemFS holding files.
+func newTestHandler(t *testing.T, perms Permission, pathPerms []PathPerm, files map[string]string) (*SftpHandler, *MemFS) {
+	t.Helper()
+	fs := NewMemFS()
+	for name, content := range files {
+		if err := writeMemFile(fs, name, content); err != nil {
+			t.Fatal(err)
+		}
+	}
+	user := &User{Username: "alice", Perms: perms}
+	h := &SftpHandler{user: user, fs: fs, acl: newPathACL(perms, pathPerms), uploadMode: UploadModeDirect,
+		bandwidth: acquireBandwidth(user, BandwidthLimits{}), logger: zap.NewNop().Sugar()}
+	t.Cleanup(h.Close)
+	return h, fs
+}
+
+func writeMemFile(fs *MemFS, name, content string) error {
+	if err := fs.MkdirAll(cleanPath(name+"/.."), 0755); err != nil {
+		return err
+	}
+	f, err := fs.OpenFile(name, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0644)
+	if err != nil {
+		return err
+	}
+	if _, err := f.WriteAt([]byte(content), 0); err != nil {
+		return err
+	}
+	return f.Close()
+}
+
+func readMemFile(t *testing.T, fs *MemFS, name string) string {
+	t.Helper()
+	fi, err := fs.Stat(name)
+	if err != nil {
+		t.Fatal(err)
+	}
+	f, err := fs.Open(name)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+	b := make([]byte, fi.Size())
+	if _, err := f.ReadAt(b, 0); err != nil && err != io.EOF {
+		t.Fatal(err)
+	}
+	return string(b)
+}
+
+// pipeConn joins the ends of two pipes into the server side of a connection.
+type pipeConn struct {
+	io.Reader
+	io.WriteCloser
+}
+
+// newTestClient serves h over in-memory pipes and returns a client for it.
+func newTestClient(t *testing.T, h *SftpHandler) *sftp.Client {
+	t.Helper()
+	toServer, fromClient := io.Pipe()
+	toClient, fromServer := io.Pipe()
+	server := sftp.NewRequestServer(pipeConn{toServer, fromServer}, sftp.Handlers{FileGet: h, FilePut: h, FileCmd: h, FileList: h})
+	go server.Serve()
+	client, err := sftp.NewClientPipe(toClient, fromClient)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() {
+		server.Close()
+		client.Close()
+	})
+	return client
+}
+
+func clientWrite(client *sftp.Client, name, content string, flag int) error {
+	f, err := client.OpenFile(name, flag)
+	if err != nil {
+		return err
+	}
+	if _, err := f.Write([]byte(content)); err != nil {
+		f.Close()
+		return err
+	}
+	return f.Close()
+}
+
+func clientRead(client *sftp.Client, name string) (string, error) {
+	f, err := client.Open(name)
+	if err != nil {
+		return "", err
+	}
+	defer f.Close()
+	b, err := io.ReadAll(f)
+	return string(b), err
+}
+
+const allPerms = PermRead | PermList | PermWrite | PermDelete
+
+// everyPerm is allPerms as the fine-grained bits, so single ones can be taken away.
+var everyPerm = allPerms.Expand()
+
+func TestHandlerWriteRead(t *testing.T) {
+	h, fs := newTestHandler(t, allPerms, nil, map[string]string{"/old.txt": "old content"})
+	client := newTestClient(t, h)
+
+	// Filewrite, creating the missing directory
+	if err := clientWrite(client, "/dir/new.txt", "hello", os.O_WRONLY|os.O_CREATE|os.O_TRUNC); err != nil {
+		t.Fatal(err)
+	}
+	if got := readMemFile(t, fs, "/dir/new.txt"); got != "hello" {
+		t.Errorf("written file = %q", got)
+	}
+	// OpenFile, as clients that open uploads read-write do
+	if err := clientWrite(client, "/old.txt", "new", os.O_RDWR|os.O_CREATE|os.O_TRUNC); err != nil {
+		t.Fatal(err)
+	}
+	if got := readMemFile(t, fs, "/old.txt"); got != "new" {
+		t.Errorf("overwritten file = %q", got)
+	}
+	// Fileread
+	if got, err := clientRead(client, "/dir/new.txt"); err != nil || got != "hello" {
+		t.Errorf("read = %q, %v", got, err)
+	}
+	if _, err := clientRead(client, "/missing.txt"); !errors.Is(err, os.ErrNotExist) {
+		t.Errorf("reading a missing file = %v", err)
+	}
+	if err := clientWrite(client, "/dir", "x", os.O_WRONLY|os.O_CREATE|os.O_TRUNC); err == nil {
+		t.Error("writing over a directory succeeded")
+	}
+	fis, err := client.ReadDir("/")
+	if err != nil || len(fis) != 2 {
+		t.Errorf("ReadDir = %d entries, %v; want 2", len(fis), err)
+	}
+}
+
+func TestHandlerFileCommands(t *testing.T) {
+	h, fs := newTestHandler(t, allPerms, nil, map[string]string{
+		"/a.txt":       "a",
+		"/b.txt":       "b",
+		"/full/x.txt":  "x",
+		"/full/sub/y":  "y",
+		"/other/z.txt": "z",
+	})
+	client := newTestClient(t, h)
+
+	if err := client.Rename("/a.txt", "/full/a.txt"); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := fs.Stat("/a.txt"); !errors.Is(err, os.ErrNotExist) {
+		t.Errorf("source still there after rename: %v", err)
+	}
+	if got := readMemFile(t, fs, "/full/a.txt"); got != "a" {
+		t.Errorf("renamed file = %q", got)
+	}
+	if err := client.Rename("/other", "/moved"); err != nil {
+		t.Fatal(err)
+	}
+	if got := readMemFile(t, fs, "/moved/z.txt"); got != "z" {
+		t.Errorf("file in renamed directory = %q", got)
+	}
+
+	if err := client.Mkdir("/empty"); err != nil {
+		t.Fatal(err)
+	}
+	if err := client.RemoveDirectory("/empty"); err != nil {
+		t.Errorf("rmdir of an empty directory: %v", err)
+	}
+	// Rmdir takes the directory's contents with it
+	if err := client.RemoveDirectory("/full"); err != nil {
+		t.Fatalf("rmdir of a non-empty directory: %v", err)
+	}
+	for _, p := range []string{"/full", "/full/x.txt", "/full/sub/y"} {
+		if _, err := fs.Stat(p); !errors.Is(err, os.ErrNotExist) {
+			t.Errorf("%s still there after rmdir: %v", p, err)
+		}
+	}
+	if err := client.Remove("/b.txt"); err != nil {
+		t.Fatal(err)
+	}
+	if err := client.Remove("/b.txt"); !errors.Is(err, os.ErrNotExist) {
+		t.Errorf("removing a missing file = %v", err)
+	}
+	if err := client.RemoveDirectory("/b.txt"); !errors.Is(err, os.ErrNotExist) {
+		t.Errorf("rmdir of a missing directory = %v", err)
+	}
+	if err := client.RemoveDirectory("/moved/z.txt"); err == nil {
+		t.Error("rmdir of a file succeeded")
+	}
+}
+
+func TestHandlerSetstat(t *testing.T) {
+	h, fs := newTestHandler(t, allPerms, nil, map[string]string{"/f.txt": "12345"})
+	client := newTestClient(t, h)
+
+	if err := client.Chmod("/f.txt", 0600); err != nil {
+		t.Fatal(err)
+	}
+	if err := client.Truncate("/f.txt", 8); err != nil {
+		t.Fatal(err)
+	}
+	mtime := time.Date(2024, 3, 1, 12, 0, 0, 0, time.UTC)
+	if err := client.Chtimes("/f.txt", mtime, mtime); err != nil {
+		t.Fatal(err)
+	}
+	fi, err := fs.Stat("/f.txt")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if fi.Mode().Perm() != 0600 || !fi.ModTime().Equal(mtime) || fi.Size() != 8 {
+		t.Errorf("after setstat: mode %v, mtime %v, size %d", fi.Mode(), fi.ModTime(), fi.Size())
+	}
+	// A size of zero cannot be told apart from no size and is not applied
+	if err := client.Truncate("/f.txt", 0); err != nil {
+		t.Fatal(err)
+	}
+	if fi, _ := fs.Stat("/f.txt"); fi.Size() != 8 {
+		t.Errorf("truncate to 0 applied: size %d", fi.Size())
+	}
+}
+
+func TestHandlerPermissionBits(t *testing.T) {
+	files := map[string]string{"/existing.txt": "keep", "/dir/inner.txt": "inner"}
+	tests := []struct {
+		name  string
+		perms Permission
+		op    func(*sftp.Client) error
+	}{
+		{"download", everyPerm &^ PermDownload, func(c *sftp.Client) error {
+			_, err := clientRead(c, "/existing.txt")
+			return err
+		}},
+		{"read-write open needs download", everyPerm &^ PermDownload, func(c *sftp.Client) error {
+			return clientWrite(c, "/existing.txt", "x", os.O_RDWR)
+		}},
+		{"upload", everyPerm &^ PermUpload, func(c *sftp.Client) error {
+			return clientWrite(c, "/new.txt", "x", os.O_WRONLY|os.O_CREATE|os.O_TRUNC)
+		}},
+		{"overwrite", everyPerm &^ PermOverwrite, func(c *sftp.Client) error {
+			return clientWrite(c, "/existing.txt", "x", os.O_WRONLY|os.O_CREATE|os.O_TRUNC)
+		}},
+		{"resume needs overwrite", everyPerm &^ PermOverwrite, func(c *sftp.Client) error {
+			return clientWrite(c, "/existing.txt", "x", os.O_WRONLY)
+		}},
+		{"create-dir for a new file's directory", everyPerm &^ PermCreateDir, func(c *sftp.Client) error {
+			return clientWrite(c, "/newdir/f.txt", "x", os.O_WRONLY|os.O_CREATE|os.O_TRUNC)
+		}},
+		{"mkdir", everyPerm &^ PermCreateDir, func(c *sftp.Client) error { return c.Mkdir("/newdir") }},
+		{"rename", everyPerm &^ PermRename, func(c *sftp.Client) error { return c.Rename("/existing.txt", "/renamed.txt") }},
+		{"rename over a file needs overwrite", everyPerm &^ PermOverwrite, func(c *sftp.Client) error {
+			return c.PosixRename("/dir/inner.txt", "/existing.txt")
+		}},
+		{"delete-file", everyPerm &^ PermDeleteFile, func(c *sftp.Client) error { return c.Remove("/existing.txt") }},
+		{"delete-dir", everyPerm &^ PermDeleteDir, func(c *sftp.Client) error { return c.RemoveDirectory("/dir") }},
+		{"rmdir of a non-empty directory needs delete-file", everyPerm &^ PermDeleteFile, func(c *sftp.Client) error {
+			return c.RemoveDirectory("/dir")
+		}},
+		{"rmdir does not remove files", everyPerm &^ PermDeleteFile, func(c *sftp.Client) error {
+			if err := c.RemoveDirectory("/existing.txt"); err == nil {
+				return nil
+			}
+			return c.Remove("/existing.txt")
+		}},
+		{"chmod", everyPerm &^ PermChmod, func(c *sftp.Client) error { return c.Chmod("/existing.txt", 0600) }},
+		{"chtimes", everyPerm &^ PermChtimes, func(c *sftp.Client) error {
+			return c.Chtimes("/existing.txt", time.Now(), time.Now())
+		}},
+		{"chown", everyPerm &^ PermChown, func(c *sftp.Client) error { return c.Chown("/existing.txt", 1000, 1000) }},
+		{"truncate needs overwrite", everyPerm &^ PermOverwrite, func(c *sftp.Client) error { return c.Truncate("/existing.txt", 10) }},
+		{"symlink", everyPerm &^ PermCreateSymlink, func(c *sftp.Client) error { return c.Symlink("/existing.txt", "/link") }},
+		{"list", everyPerm &^ PermList, func(c *sftp.Client) error {
+			_, err := c.ReadDir("/dir")
+			return err
+		}},
+		{"stat needs list or download", everyPerm &^ (PermList | PermDownload), func(c *sftp.Client) error {
+			_, err := c.Stat("/existing.txt")
+			return err
+		}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			h, fs := newTestHandler(t, tt.perms, nil, files)
+			if err := tt.op(newTestClient(t, h)); !errors.Is(err, os.ErrPermission) {
+				t.Errorf("without the permission: %v, want permission denied", err)
+			}
+			if got := readMemFile(t, fs, "/existing.txt"); got != "keep" {
+				t.Errorf("denied operation changed the file: %q", got)
+			}
+			if got := readMemFile(t, fs, "/dir/inner.txt"); got != "inner" {
+				t.Errorf("denied operation changed the directory: %q", got)
+			}
+		})
+	}
+}
+
+func TestHandlerDropBox(t *testing.T) {
+	// list|upload|create-dir: files can be added but not read, replaced or removed
+	h, fs := newTestHandler(t, PermList|PermUpload|PermCreateDir, nil, map[string]string{"/existing.txt": "keep"})
+	client := newTestClient(t, h)
+	if err := clientWrite(client, "/in/new.txt", "dropped", os.O_WRONLY|os.O_CREATE|os.O_TRUNC); err != nil {
+		t.Fatal(err)
+	}
+	if got := readMemFile(t, fs, "/in/new.txt"); got != "dropped" {
+		t.Errorf("dropped file = %q", got)
+	}
+	if _, err := clientRead(client, "/in/new.txt"); !errors.Is(err, os.ErrPermission) {
+		t.Errorf("reading back = %v, want permission denied", err)
+	}
+	if err := clientWrite(client, "/existing.txt", "x", os.O_WRONLY|os.O_CREATE|os.O_TRUNC); !errors.Is(err, os.ErrPermission) {
+		t.Errorf("replacing = %v, want permission denied", err)
+	}
+	if fis, err := client.ReadDir("/"); err != nil || len(fis) != 2 {
+		t.Errorf("ReadDir = %d entries, %v; want 2", len(fis), err)
+	}
+}
+
+func TestHandlerPathPerms(t *testing.T) {
+	pathPerms := []PathPerm{
+		{Scope: PathPermScopeGroup, Path: "/shared", Perms: PermRead | PermList},
+		{Scope: PathPermScopeUser, Path: "/shared/mine", Perms: PermRead | PermList | PermWrite | PermDelete},
+		{Scope: PathPermScopeGroup, Path: "/shared/mine", Perms: PermList},
+		{Scope: PathPermScopeUser, Path: "/home/locked", Perms: PermList},
+	}
+	h, fs := newTestHandler(t, allPerms, pathPerms, map[string]string{
+		"/shared/doc.txt":    "doc",
+		"/shared/mine/a.txt": "a",
+		"/home/f.txt":        "f",
+		"/home/locked/l.txt": "l",
+	})
+	client := newTestClient(t, h)
+
+	if got, err := clientRead(client, "/shared/doc.txt"); err != nil || got != "doc" {
+		t.Errorf("reading a read-only path = %q, %v", got, err)
+	}
+	if err := clientWrite(client, "/shared/new.txt", "x", os.O_WRONLY|os.O_CREATE|os.O_TRUNC); !errors.Is(err, os.ErrPermission) {
+		t.Errorf("writing to a read-only path = %v", err)
+	}
+	if err := client.Remove("/shared/doc.txt"); !errors.Is(err, os.ErrPermission) {
+		t.Errorf("removing from a read-only path = %v", err)
+	}
+	// The longer prefix wins, and the user's entry beats the group's
+	if err := clientWrite(client, "/shared/mine/b.txt", "b", os.O_WRONLY|os.O_CREATE|os.O_TRUNC); err != nil {
+		t.Errorf("writing below a writable override: %v", err)
+	}
+	// Moving out of a read-only path needs rename on both ends
+	if err := client.Rename("/shared/doc.txt", "/home/doc.txt"); !errors.Is(err, os.ErrPermission) {
+		t.Errorf("renaming out of a read-only path = %v", err)
+	}
+	// Removing or renaming a tree needs the permission on the paths below it too
+	if err := client.RemoveDirectory("/home"); !errors.Is(err, os.ErrPermission) {
+		t.Errorf("rmdir over a locked subdirectory = %v", err)
+	}
+	if err := client.Rename("/home", "/elsewhere"); !errors.Is(err, os.ErrPermission) {
+		t.Errorf("renaming a directory with a locked subdirectory = %v", err)
+	}
+	if got := readMemFile(t, fs, "/home/locked/l.txt"); got != "l" {
+		t.Errorf("locked file changed: %q", got)
+	}
+	if err := client.Remove("/home/f.txt"); err != nil {
+		t.Errorf("removing outside the path permissions: %v", err)
+	}
+}
@@ -0,0 +1,176 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"net/netip"
+	"strings"
+)
+
+// IP rule scopes and actions stored in sftp_ip_rules.
+const (
+	IPRuleScopeUser  = "user"
+	IPRuleScopeGroup = "group"
+	IPRuleAllow      = "allow"
+	IPRuleDeny       = "deny"
+)
+
+// IPRule is one allow or deny entry for a user or a group.
+type IPRule struct {
+	ID     int
+	Scope  string
+	Name   string
+	Action string
+	CIDR   string
+}
+
+// ipFilter is an allow/deny list of networks. Deny entries always win; when the
+// allow list is non-empty the address must also match one of its entries.
+type ipFilter struct {
+	allow []netip.Prefix
+	deny  []netip.Prefix
+}
+
+// parsePrefix accepts a CIDR or a bare IPv4/IPv6 address (treated as a host route).
+func parsePrefix(s string) (netip.Prefix, error) {
+	s = strings.TrimSpace(s)
+	if strings.Contains(s, "/") {
+		p, err := netip.ParsePrefix(s)
+		if err != nil {
+			return netip.Prefix{}, err
+		}
+		if p.Addr().Is4In6() && p.Bits() >= 96 {
+			p = netip.PrefixFrom(p.Addr().Unmap(), p.Bits()-96)
+		}
+		return p.Masked(), nil
+	}
+	addr, err := netip.ParseAddr(s)
+	if err != nil {
+		return netip.Prefix{}, err
+	}
+	addr = addr.Unmap()
+	return netip.PrefixFrom(addr, addr.BitLen()), nil
+}
+
+// parseCIDRList parses a comma-separated list of networks, e.g. from the environment.
+func parseCIDRList(list string) ([]netip.Prefix, error) {
+	var prefixes []netip.Prefix
+	for _, item := range strings.Split(list, ",") {
+		if strings.TrimSpace(item) == "" {
+			continue
+		}
+		p, err := parsePrefix(item)
+		if err != nil {
+			return nil, fmt.Errorf("invalid network %q: %w", item, err)
+		}
+		prefixes = append(prefixes, p)
+	}
+	return prefixes, nil
+}
+
+// addrIP converts a connection address to a comparable, unmapped netip.Addr.
+func addrIP(addr net.Addr) (netip.Addr, bool) {
+	if tcp, ok := addr.(*net.TCPAddr); ok {
+		ip, ok := netip.AddrFromSlice(tcp.IP)
+		return ip.Unmap(), ok
+	}
+	ip, err := netip.ParseAddr(remoteIP(addr))
+	if err != nil {
+		return netip.Addr{}, false
+	}
+	return ip.Unmap(), true
+}
+
+func matchAny(prefixes []netip.Prefix, ip netip.Addr) (netip.Prefix, bool) {
+	for _, p := range prefixes {
+		if p.Contains(ip) {
+			return p, true
+		}
+	}
+	return netip.Prefix{}, false
+}
+
+// Empty reports whether the filter has no entries at all.
+func (f *ipFilter) Empty() bool { return f == nil || (len(f.allow) == 0 && len(f.deny) == 0) }
+
+// Check returns a descriptive error if ip is not permitted by the filter.
+func (f *ipFilter) Check(ip netip.Addr) error {
+	if f == nil {
+		return nil
+	}
+	if p, ok := matchAny(f.deny, ip); ok {
+		return fmt.Errorf("address %s matches deny rule %s", ip, p)
+	}
+	if len(f.allow) > 0 {
+		if _, ok := matchAny(f.allow, ip); !ok {
+			return fmt.Errorf("address %s is not in the allow list", ip)
+		}
+	}
+	return nil
+}
+
+// newGlobalIPFilter builds the server-wide filter from GLOBAL_ALLOW_CIDRS and GLOBAL_DENY_CIDRS.
+func newGlobalIPFilter() (*ipFilter, error) {
+	allow, err := parseCIDRList(getEnvOrDefault("GLOBAL_ALLOW_CIDRS", ""))
+	if err != nil {
+		return nil, fmt.Errorf("GLOBAL_ALLOW_CIDRS: %w", err)
+	}
+	deny, err := parseCIDRList(getEnvOrDefault("GLOBAL_DENY_CIDRS", ""))
+	if err != nil {
+		return nil, fmt.Errorf("GLOBAL_DENY_CIDRS: %w", err)
+	}
+	return &ipFilter{allow: allow, deny: deny}, nil
+}
+
+// FetchIPRules returns the rules attached to the user and to the user's group.
+func (s *UserStore) FetchIPRules(ctx context.Context, user *User) ([]IPRule, error) {
+	query := fmt.Sprintf(`SELECT id, scope, name, action, cidr FROM sftp_ip_rules WHERE (scope = 'user' AND name = %s) OR (scope = 'group' AND name = %s) ORDER BY id`,
+		s.placeholder(1), s.placeholder(2))
+	rows, err := s.db.QueryContext(ctx, query, user.Username, user.GroupName)
+	if err != nil {
+		s.logger.Errorf("Error fetching IP rules: %v", err)
+		return nil, err
+	}
+	defer rows.Close()
+	var rules []IPRule
+	for rows.Next() {
+		var r IPRule
+		if err := rows.Scan(&r.ID, &r.Scope, &r.Name, &r.Action, &r.CIDR); err != nil {
+			return nil, err
+		}
+		rules = append(rules, r)
+	}
+	return rules, rows.Err()
+}
+
+// checkUserIP applies the user's and group's rules to ip. Deny rules from either
+// scope reject the address. Allow rules on the user replace those on the group,
+// so a user can be granted a narrower (or different) set of networks.
+func checkUserIP(rules []IPRule, ip netip.Addr) error {
+	var user, group ipFilter
+	for _, r := range rules {
+		p, err := parsePrefix(r.CIDR)
+		if err != nil {
+			// a broken rule must not silently widen access
+			return fmt.Errorf("invalid %s rule %d (%q): %w", r.Scope, r.ID, r.CIDR, err)
+		}
+		target := &user
+		if r.Scope == IPRuleScopeGroup {
+			target = &group
+		}
+		switch r.Action {
+		case IPRuleAllow:
+			target.allow = append(target.allow, p)
+		case IPRuleDeny:
+			target.deny = append(target.deny, p)
+		default:
+			return fmt.Errorf("invalid action %q in %s rule %d", r.Action, r.Scope, r.ID)
+		}
+	}
+	combined := ipFilter{deny: append(user.deny, group.deny...), allow: user.allow}
+	if len(combined.allow) == 0 {
+		combined.allow = group.allow
+	}
+	return combined.Check(ip)
+}
@@ -0,0 +1,98 @@
+package main
+
+import (
+	"context"
+	"net/netip"
+	"testing"
+)
+
+func TestParsePrefix(t *testing.T) {
+	tests := []struct {
+		in, want string
+	}{
+		{"192.0.2.1", "192.0.2.1/32"},
+		{" 192.0.2.7/24 ", "192.0.2.0/24"},
+		{"2001:db8::1", "2001:db8::1/128"},
+		{"::ffff:192.0.2.1", "192.0.2.1/32"},
+		{"::ffff:192.0.2.0/120", "192.0.2.0/24"},
+	}
+	for _, tt := range tests {
+		p, err := parsePrefix(tt.in)
+		if err != nil || p.String() != tt.want {
+			t.Errorf("parsePrefix(%q) = %v, %v; want %s", tt.in, p, err, tt.want)
+		}
+	}
+	for _, in := range []string{"", "192.0.2.1/33", "example.com", "192.0.2/24"} {
+		if _, err := parsePrefix(in); err == nil {
+			t.Errorf("parsePrefix(%q) succeeded", in)
+		}
+	}
+}
+
+func TestCheckUserIP(t *testing.T) {
+	rule := func(scope, action, cidr string) IPRule {
+		return IPRule{Scope: scope, Name: "x", Action: action, CIDR: cidr}
+	}
+	userAllow := func(cidr string) IPRule { return rule(IPRuleScopeUser, IPRuleAllow, cidr) }
+	userDeny := func(cidr string) IPRule { return rule(IPRuleScopeUser, IPRuleDeny, cidr) }
+	groupAllow := func(cidr string) IPRule { return rule(IPRuleScopeGroup, IPRuleAllow, cidr) }
+	groupDeny := func(cidr string) IPRule { return rule(IPRuleScopeGroup, IPRuleDeny, cidr) }
+
+	tests := []struct {
+		name  string
+		rules []IPRule
+		ip    string
+		ok    bool
+	}{
+		{"no rules", nil, "192.0.2.1", true},
+		{"user allow", []IPRule{userAllow("192.0.2.0/24")}, "192.0.2.1", true},
+		{"outside user allow", []IPRule{userAllow("192.0.2.0/24")}, "198.51.100.1", false},
+		{"user deny beats user allow", []IPRule{userAllow("192.0.2.0/24"), userDeny("192.0.2.1")}, "192.0.2.1", false},
+		{"rest of user allow", []IPRule{userAllow("192.0.2.0/24"), userDeny("192.0.2.1")}, "192.0.2.2", true},
+		{"user deny beats group allow", []IPRule{groupAllow("192.0.2.0/24"), userDeny("192.0.2.1")}, "192.0.2.1", false},
+		{"group deny beats user allow", []IPRule{userAllow("192.0.2.0/24"), groupDeny("192.0.2.0/28")}, "192.0.2.1", false},
+		{"deny only", []IPRule{groupDeny("192.0.2.0/24")}, "198.51.100.1", true},
+		{"group allow", []IPRule{groupAllow("192.0.2.0/24")}, "192.0.2.1", true},
+		{"outside group allow", []IPRule{groupAllow("192.0.2.0/24")}, "198.51.100.1", false},
+		{"user allow replaces group allow", []IPRule{groupAllow("192.0.2.0/24"), userAllow("198.51.100.0/24")}, "192.0.2.1", false},
+		{"user allow outside group allow", []IPRule{groupAllow("192.0.2.0/24"), userAllow("198.51.100.0/24")}, "198.51.100.1", true},
+		{"IPv6", []IPRule{userAllow("2001:db8::/32")}, "2001:db8::1", true},
+		{"IPv4 rule against IPv6", []IPRule{userAllow("192.0.2.0/24")}, "2001:db8::1", false},
+		{"invalid network", []IPRule{userAllow("192.0.2.0/24"), groupDeny("not a network")}, "192.0.2.1", false},
+		{"invalid action", []IPRule{rule(IPRuleScopeUser, "permit", "192.0.2.0/24")}, "192.0.2.1", false},
+	}
+	for _, tt := range tests {
+		err := checkUserIP(tt.rules, netip.MustParseAddr(tt.ip))
+		if (err == nil) != tt.ok {
+			t.Errorf("%s: checkUserIP(%s) = %v, want allowed %v", tt.name, tt.ip, err, tt.ok)
+		}
+	}
+}
+
+func TestFetchIPRules(t *testing.T) {
+	ctx := context.Background()
+	s := newTestStore(t)
+	for _, r := range []IPRule{
+		{Scope: IPRuleScopeUser, Name: "alice", Action: IPRuleDeny, CIDR: "192.0.2.1"},
+		{Scope: IPRuleScopeGroup, Name: "staff", Action: IPRuleAllow, CIDR: "192.0.2.0/24"},
+		{Scope: IPRuleScopeUser, Name: "bob", Action: IPRuleAllow, CIDR: "198.51.100.0/24"},
+		{Scope: IPRuleScopeGroup, Name: "alice", Action: IPRuleAllow, CIDR: "203.0.113.0/24"},
+	} {
+		if _, err := s.db.ExecContext(ctx, `INSERT INTO sftp_ip_rules (scope, name, action, cidr) VALUES (?, ?, ?, ?)`, r.Scope, r.Name, r.Action, r.CIDR); err != nil {
+			t.Fatal(err)
+		}
+	}
+	rules, err := s.FetchIPRules(ctx, &User{Username: "alice", GroupName: "staff"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(rules) != 2 || rules[0].CIDR != "192.0.2.1" || rules[1].CIDR != "192.0.2.0/24" {
+		t.Fatalf("rules of alice in staff = %+v", rules)
+	}
+	if err := checkUserIP(rules, netip.MustParseAddr("192.0.2.1")); err == nil {
+		t.Error("denied address allowed")
+	}
+	if err := checkUserIP(rules, netip.MustParseAddr("192.0.2.2")); err != nil {
+		t.Errorf("address allowed by the group: %v", err)
+	}
+}
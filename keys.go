@@ -0,0 +1,92 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"database/sql"
+	"fmt"
+	"time"
+
+	"golang.org/x/crypto/ssh"
+)
+
+// UserKey is one authorized public key registered for a user in sftp_user_keys.
+type UserKey struct {
+	ID         int
+	UserID     int
+	PublicKey  string // authorized_keys line (openssh format)
+	Comment    sql.NullString
+	Enabled    bool
+	ExpiresAt  sql.NullTime
+	LastUsedAt sql.NullTime
+	CreatedAt  sql.NullTime
+}
+
+// Active reports whether the key may be used to authenticate at the given time.
+func (k *UserKey) Active(now time.Time) bool {
+	if !k.Enabled {
+		return false
+	}
+	return !k.ExpiresAt.Valid || now.Before(k.ExpiresAt.Time)
+}
+
+// FetchUserKeys returns every key registered for the user, including disabled and expired ones.
+func (s *UserStore) FetchUserKeys(ctx context.Context, userID int) ([]UserKey, error) {
+	s.logger.Debugf("Fetching keys for user id: %d", userID)
+	query := fmt.Sprintf(`SELECT id, user_id, public_key, comment, enabled, expires_at, last_used_at, created_at FROM sftp_user_keys WHERE user_id = %s ORDER BY id`, s.placeholder(1))
+	rows, err := s.db.QueryContext(ctx, query, userID)
+	if err != nil {
+		s.logger.Errorf("Error fetching user keys: %v", err)
+		return nil, err
+	}
+	defer rows.Close()
+	var keys []UserKey
+	for rows.Next() {
+		var k UserKey
+		if err := rows.Scan(&k.ID, &k.UserID, &k.PublicKey, &k.Comment, &k.Enabled, &k.ExpiresAt, &k.LastUsedAt, &k.CreatedAt); err != nil {
+			s.logger.Errorf("Error scanning user key: %v", err)
+			return nil, err
+		}
+		keys = append(keys, k)
+	}
+	return keys, rows.Err()
+}
+
+// TouchUserKey records that the key was just used to authenticate.
+func (s *UserStore) TouchUserKey(ctx context.Context, keyID int) error {
+	query := fmt.Sprintf(`UPDATE sftp_user_keys SET last_used_at = %s WHERE id = %s`, s.placeholder(1), s.placeholder(2))
+	_, err := s.db.ExecContext(ctx, query, time.Now().UTC(), keyID)
+	return err
+}
+
+// MatchUserKey looks up the presented key among the user's active keys. The legacy
+// sftp_users.public_key column is still honoured and reported with a zero key ID.
+func (s *UserStore) MatchUserKey(ctx context.Context, user *User, key ssh.PublicKey) (*UserKey, error) {
+	presented := key.Marshal()
+	keys, err := s.FetchUserKeys(ctx, user.ID)
+	if err != nil {
+		return nil, err
+	}
+	if user.PublicKey.Valid && user.PublicKey.String != "" {
+		keys = append(keys, UserKey{UserID: user.ID, PublicKey: user.PublicKey.String, Enabled: true})
+	}
+	now := time.Now()
+	for i := range keys {
+		k := &keys[i]
+		authorizedKey, _, _, _, err := ssh.ParseAuthorizedKey([]byte(k.PublicKey))
+		if err != nil {
+			s.logger.Warnf("Skipping unparsable key %d for user %s: %v", k.ID, user.Username, err)
+			continue
+		}
+		// compare marshaled keys to avoid depending on ssh.KeysEqual
+		if !bytes.Equal(presented, authorizedKey.Marshal()) {
+			continue
+		}
+		if !k.Active(now) {
+			s.logger.Warnf("Key %d for user %s is disabled or expired", k.ID, user.Username)
+			return nil, fmt.Errorf("public key inactive")
+		}
+		return k, nil
+	}
+	return nil, fmt.Errorf("public key mismatch")
+}
@@ -0,0 +1,379 @@
+package main
+
+import (
+	"bytes"
+	"crypto/rand"
+	"crypto/sha1"
+	"crypto/sha256"
+	"encoding/binary"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"go.uber.org/zap"
+	"golang.org/x/crypto/ssh"
+)
+
+// The KRLs in testdata/krl were made from the .spec files next to them:
+//
+//	ssh-keygen -k -s ca.pub -f list.krl list.spec      # also range, bitmap, keyid
+//	ssh-keygen -k -f key.krl key.spec                  # also sha1, sha256
+//
+// ssh-keygen writes each as a single section of the type in its name. It
+// cannot write a section for any CA; those are built by krlFile.
+
+func readTestKey(t *testing.T, name string) ssh.PublicKey {
+	t.Helper()
+	b, err := os.ReadFile(filepath.Join("testdata", "krl", name))
+	if err != nil {
+		t.Fatal(err)
+	}
+	key, _, _, _, err := ssh.ParseAuthorizedKey(b)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return key
+}
+
+func readTestSigner(t *testing.T, name string) ssh.Signer {
+	t.Helper()
+	b, err := os.ReadFile(filepath.Join("testdata", "krl", name))
+	if err != nil {
+		t.Fatal(err)
+	}
+	signer, err := ssh.ParsePrivateKey(b)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return signer
+}
+
+func loadTestKRL(t *testing.T, name string) *revocationList {
+	t.Helper()
+	l, err := loadRevocationList(filepath.Join("testdata", "krl", name))
+	if err != nil {
+		t.Fatal(err)
+	}
+	return l
+}
+
+// signTestCert returns a user certificate for alice signed by ca.
+func signTestCert(t *testing.T, ca ssh.Signer, key ssh.PublicKey, serial uint64, keyID string) *ssh.Certificate {
+	t.Helper()
+	cert := &ssh.Certificate{
+		Key:             key,
+		Serial:          serial,
+		CertType:        ssh.UserCert,
+		KeyId:           keyID,
+		ValidPrincipals: []string{"alice"},
+		ValidBefore:     ssh.CertTimeInfinity,
+	}
+	if err := cert.SignCert(rand.Reader, ca); err != nil {
+		t.Fatal(err)
+	}
+	return cert
+}
+
+func TestKRLCertSections(t *testing.T) {
+	ca, ca2 := readTestSigner(t, "ca"), readTestSigner(t, "ca2")
+	key := readTestKey(t, "u4.pub")
+	tests := []struct {
+		file   string
+		ca     ssh.Signer
+		serial uint64
+		keyID  string
+		want   bool
+	}{
+		{"list.krl", ca, 5, "", true},
+		{"list.krl", ca, 1000000, "", true},
+		{"list.krl", ca, 6, "", false},
+		{"list.krl", ca2, 5, "", false},
+		{"range.krl", ca, 999, "", false},
+		{"range.krl", ca, 1000, "", true},
+		{"range.krl", ca, 1500, "", true},
+		{"range.krl", ca, 2000, "", true},
+		{"range.krl", ca, 2001, "", false},
+		{"range.krl", ca2, 1500, "", false},
+		{"bitmap.krl", ca, 199, "", false},
+		{"bitmap.krl", ca, 200, "", true},
+		{"bitmap.krl", ca, 201, "", false},
+		{"bitmap.krl", ca, 216, "", true},
+		{"bitmap.krl", ca, 230, "", true},
+		{"bitmap.krl", ca, 232, "", false},
+		{"keyid.krl", ca, 1, "build-bot@example", true},
+		{"keyid.krl", ca, 1, "build-bot", false},
+		{"keyid.krl", ca2, 1, "build-bot@example", false},
+	}
+	for _, tt := range tests {
+		l := loadTestKRL(t, tt.file)
+		cert := signTestCert(t, tt.ca, key, tt.serial, tt.keyID)
+		if got := l.CertRevoked(cert); got != tt.want {
+			t.Errorf("%s: certificate by %s with serial %d, key ID %q revoked = %v, want %v",
+				tt.file, ssh.FingerprintSHA256(cert.SignatureKey), tt.serial, tt.keyID, got, tt.want)
+		}
+		if l.KeyRevoked(key) {
+			t.Errorf("%s: certified key revoked", tt.file)
+		}
+	}
+}
+
+func TestKRLKeySections(t *testing.T) {
+	ca := readTestSigner(t, "ca")
+	tests := []struct {
+		file    string
+		revoked string
+	}{
+		{"key.krl", "u1.pub"},
+		{"sha1.krl", "u2.pub"},
+		{"sha256.krl", "u3.pub"},
+	}
+	for _, tt := range tests {
+		l := loadTestKRL(t, tt.file)
+		for _, name := range []string{"u1.pub", "u2.pub", "u3.pub", "u4.pub"} {
+			key := readTestKey(t, name)
+			want := name == tt.revoked
+			if got := l.KeyRevoked(key); got != want {
+				t.Errorf("%s: %s revoked = %v, want %v", tt.file, name, got, want)
+			}
+			// a certificate for a revoked key is revoked with it
+			if got := l.CertRevoked(signTestCert(t, ca, key, 1, "")); got != want {
+				t.Errorf("%s: certificate for %s revoked = %v, want %v", tt.file, name, got, want)
+			}
+		}
+	}
+}
+
+// krlFile returns a binary KRL holding sections, each a type and its content.
+func krlFile(sections ...[]byte) []byte {
+	var b bytes.Buffer
+	b.WriteString(krlMagic)
+	binary.Write(&b, binary.BigEndian, uint32(krlFormatVersion))
+	binary.Write(&b, binary.BigEndian, [3]uint64{1, 0, 0}) // krl_version, generated_date, flags
+	b.Write(krlString(nil))                                // reserved
+	b.Write(krlString([]byte("test")))                     // comment
+	for _, s := range sections {
+		b.Write(s)
+	}
+	return b.Bytes()
+}
+
+func krlString(v []byte) []byte {
+	return append(binary.BigEndian.AppendUint32(nil, uint32(len(v))), v...)
+}
+
+func krlSection(sectionType byte, content ...[]byte) []byte {
+	data := bytes.Join(content, nil)
+	return append([]byte{sectionType}, krlString(data)...)
+}
+
+func TestKRLAnyCA(t *testing.T) {
+	ca, ca2 := readTestSigner(t, "ca"), readTestSigner(t, "ca2")
+	key := readTestKey(t, "u4.pub")
+	serials := binary.BigEndian.AppendUint64(nil, 42)
+	keyIDs := krlString([]byte("build-bot@example"))
+	anyCA := krlSection(krlSectionCertificates, krlString(nil), krlString(nil),
+		krlSection(krlCertSerialList, serials), krlSection(krlCertKeyID, keyIDs))
+	oneCA := krlSection(krlSectionCertificates, krlString(ca2.PublicKey().Marshal()), krlString(nil),
+		krlSection(krlCertSerialRange, binary.BigEndian.AppendUint64(binary.BigEndian.AppendUint64(nil, 100), 200)))
+	l, err := parseKRL(krlFile(anyCA, oneCA))
+	if err != nil {
+		t.Fatal(err)
+	}
+	tests := []struct {
+		ca     ssh.Signer
+		serial uint64
+		keyID  string
+		want   bool
+	}{
+		{ca, 42, "", true},
+		{ca2, 42, "", true},
+		{ca, 1, "build-bot@example", true},
+		{ca2, 1, "build-bot@example", true},
+		{ca, 150, "", false},
+		{ca2, 150, "", true},
+		{ca2, 201, "", false},
+	}
+	for _, tt := range tests {
+		cert := signTestCert(t, tt.ca, key, tt.serial, tt.keyID)
+		if got := l.CertRevoked(cert); got != tt.want {
+			t.Errorf("certificate by %s with serial %d, key ID %q revoked = %v, want %v",
+				ssh.FingerprintSHA256(cert.SignatureKey), tt.serial, tt.keyID, got, tt.want)
+		}
+	}
+}
+
+func TestKRLBitmapOffset(t *testing.T) {
+	ca := readTestSigner(t, "ca")
+	key := readTestKey(t, "u4.pub")
+	// bits 0, 1 and 9 from the least significant one: serials 1000, 1001 and 1009
+	bitmap := append(binary.BigEndian.AppendUint64(nil, 1000), krlString([]byte{0x02, 0x03})...)
+	l, err := parseKRL(krlFile(krlSection(krlSectionCertificates, krlString(ca.PublicKey().Marshal()), krlString(nil),
+		krlSection(krlCertSerialBitmap, bitmap))))
+	if err != nil {
+		t.Fatal(err)
+	}
+	for serial := uint64(998); serial < 1020; serial++ {
+		want := serial == 1000 || serial == 1001 || serial == 1009
+		if got := l.CertRevoked(signTestCert(t, ca, key, serial, "")); got != want {
+			t.Errorf("serial %d revoked = %v, want %v", serial, got, want)
+		}
+	}
+}
+
+func TestKRLKeyHashes(t *testing.T) {
+	key := readTestKey(t, "u4.pub")
+	sum := sha1.Sum(key.Marshal())
+	sha256Sum := sha256.Sum256(key.Marshal())
+	for _, section := range [][]byte{
+		krlSection(krlSectionExplicitKey, krlString(key.Marshal())),
+		krlSection(krlSectionFingerprintSHA1, krlString(sum[:])),
+		krlSection(krlSectionFingerprintSHA256, krlString(sha256Sum[:])),
+	} {
+		l, err := parseKRL(krlFile(section))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !l.KeyRevoked(key) {
+			t.Errorf("section %d does not revoke the key", section[0])
+		}
+		if l.KeyRevoked(readTestKey(t, "u1.pub")) {
+			t.Errorf("section %d revokes another key", section[0])
+		}
+	}
+}
+
+func TestKRLInvalid(t *testing.T) {
+	for _, name := range []string{"list.krl", "range.krl", "bitmap.krl", "keyid.krl", "key.krl", "sha1.krl", "sha256.krl"} {
+		b, err := os.ReadFile(filepath.Join("testdata", "krl", name))
+		if err != nil {
+			t.Fatal(err)
+		}
+		// the header ends with the reserved and comment strings
+		r := &krlReader{b: b[len(krlMagic)+4+3*8:]}
+		r.string()
+		r.string()
+		header := len(b) - len(r.b)
+		// cuts in the header or in the only section; none may panic
+		for n := len(krlMagic); n < len(b); n++ {
+			if _, err := parseKRL(b[:n]); err == nil && n != header {
+				t.Errorf("%s cut to %d of %d bytes parsed", name, n, len(b))
+			}
+		}
+	}
+	badVersion := krlFile()
+	binary.BigEndian.PutUint32(badVersion[len(krlMagic):], 2)
+	tests := map[string][]byte{
+		"format version":          badVersion,
+		"section type":            krlFile(krlSection(9, nil)),
+		"certificate section":     krlFile(krlSection(krlSectionCertificates, krlString(nil), krlString(nil), krlSection(0x30, nil))),
+		"serial in list":          krlFile(krlSection(krlSectionCertificates, krlString(nil), krlString(nil), krlSection(krlCertSerialList, []byte{1, 2, 3}))),
+		"range end":               krlFile(krlSection(krlSectionCertificates, krlString(nil), krlString(nil), krlSection(krlCertSerialRange, make([]byte, 12)))),
+		"section length":          append(krlFile(), krlSectionExplicitKey, 0, 0, 1, 0),
+		"key in explicit section": krlFile(krlSection(krlSectionExplicitKey, []byte{0, 0, 0, 9, 1})),
+	}
+	for name, b := range tests {
+		if _, err := parseKRL(b); err == nil {
+			t.Errorf("invalid %s parsed", name)
+		}
+	}
+}
+
+func TestRevocationText(t *testing.T) {
+	ca := readTestSigner(t, "ca")
+	u1, u2, u3, u4 := readTestKey(t, "u1.pub"), readTestKey(t, "u2.pub"), readTestKey(t, "u3.pub"), readTestKey(t, "u4.pub")
+	text := strings.Join([]string{
+		"# revoked on 2026-10-01",
+		"",
+		"serial: 42",
+		"serial: 100-200",
+		"serial: 0x1000",
+		"id: build-bot@example",
+		"key: " + strings.TrimSpace(string(ssh.MarshalAuthorizedKey(u1))),
+		"  " + strings.TrimSpace(string(ssh.MarshalAuthorizedKey(u2))) + " bare line",
+		"sha256: " + ssh.FingerprintSHA256(u3),
+	}, "\n")
+	l, err := parseRevocationText([]byte(text))
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, tt := range []struct {
+		serial uint64
+		keyID  string
+		want   bool
+	}{
+		{42, "", true},
+		{43, "", false},
+		{100, "", true},
+		{200, "", true},
+		{201, "", false},
+		{0x1000, "", true},
+		{1, "build-bot@example", true},
+		{1, "other", false},
+	} {
+		// the text format applies to certificates of any CA
+		if got := l.CertRevoked(signTestCert(t, ca, u4, tt.serial, tt.keyID)); got != tt.want {
+			t.Errorf("serial %d, key ID %q revoked = %v, want %v", tt.serial, tt.keyID, got, tt.want)
+		}
+	}
+	for i, key := range []ssh.PublicKey{u1, u2, u3, u4} {
+		if got, want := l.KeyRevoked(key), i < 3; got != want {
+			t.Errorf("u%d revoked = %v, want %v", i+1, got, want)
+		}
+	}
+	// the SHA256: prefix is optional
+	l, err = parseRevocationText([]byte("hash: " + strings.TrimPrefix(ssh.FingerprintSHA256(u4), "SHA256:")))
+	if err != nil || !l.KeyRevoked(u4) {
+		t.Errorf("hash without prefix: revoked = %v, %v", l != nil && l.KeyRevoked(u4), err)
+	}
+
+	for _, invalid := range []string{
+		"serial: x",
+		"serial: 10-",
+		"serial: 200-100",
+		"key: ssh-ed25519 !!!",
+		"fingerprint: SHA256:abc",
+		"not a key",
+	} {
+		if _, err := parseRevocationText([]byte(invalid)); err == nil {
+			t.Errorf("%q parsed", invalid)
+		}
+	}
+}
+
+func TestCertCheckerRejectsRevoked(t *testing.T) {
+	dir := t.TempDir()
+	revoked := filepath.Join(dir, "revoked")
+	if err := os.WriteFile(revoked, []byte("serial: 7\nid: build-bot@example\n"), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	ca := readTestSigner(t, "ca")
+	for _, krl := range []string{revoked, filepath.Join("testdata", "krl", "list.krl")} {
+		authority, err := loadUserCertAuthority(filepath.Join("testdata", "krl", "ca.pub"), krl)
+		if err != nil {
+			t.Fatal(err)
+		}
+		logger := zap.NewNop().Sugar()
+		a := newSSHAuth(nil, nil, logger, authority, nil, nil, nil)
+		key := readTestKey(t, "u4.pub")
+		conn := testConnMetadata{user: "alice"}
+		for _, tt := range []struct {
+			serial uint64
+			keyID  string
+			want   bool
+		}{
+			{1, "", false},
+			{7, "", krl == revoked},
+			{5, "", krl != revoked},
+			{1, "build-bot@example", krl == revoked},
+		} {
+			cert := signTestCert(t, ca, key, tt.serial, tt.keyID)
+			if got := a.certChecker.IsRevoked(cert); got != tt.want {
+				t.Errorf("%s: serial %d, key ID %q: IsRevoked = %v, want %v", krl, tt.serial, tt.keyID, got, tt.want)
+			}
+			if _, err := a.certChecker.Authenticate(conn, cert); (err != nil) != tt.want {
+				t.Errorf("%s: serial %d, key ID %q: Authenticate = %v, want revoked %v", krl, tt.serial, tt.keyID, err, tt.want)
+			}
+		}
+	}
+}
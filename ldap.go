@@ -0,0 +1,322 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/tls"
+	"errors"
+	"fmt"
+	"net/url"
+	"strings"
+	"time"
+
+	"github.com/go-ldap/ldap/v3"
+	"go.uber.org/zap"
+	"golang.org/x/crypto/ssh"
+)
+
+// ldapGroupPerm maps an LDAP group (full DN or CN) to a permission set.
+type ldapGroupPerm struct {
+	group string
+	perms Permission
+}
+
+// ldapConfig configures LDAPUserProvider; see newLDAPConfigFromEnv for the variables.
+type ldapConfig struct {
+	URL                string
+	StartTLS           bool
+	InsecureSkipVerify bool
+	Timeout            time.Duration
+
+	// Service account used to look users up; empty means anonymous search.
+	BindDN       string
+	BindPassword string
+
+	BaseDN          string
+	UserFilter      string // %s is replaced with the escaped username
+	DisplayNameAttr string
+	HomeAttr        string
+	KeyAttr         string
+	GroupAttr       string // attribute on the user listing group DNs, e.g. memberOf
+
+	// Optional group search for servers without memberOf. {dn} and {username}
+	// in GroupFilter are replaced with the escaped user DN and username.
+	GroupBaseDN string
+	GroupFilter string
+
+	GroupPerms   []ldapGroupPerm
+	DefaultPerms Permission
+}
+
+func newLDAPConfigFromEnv() (ldapConfig, error) {
+	groupPerms, err := parseLDAPGroupPerms(getEnvOrDefault("LDAP_GROUP_PERMS", ""))
+	if err != nil {
+		return ldapConfig{}, fmt.Errorf("LDAP_GROUP_PERMS: %w", err)
+	}
+	defaultPerms, err := ParsePermission(getEnvOrDefault("LDAP_DEFAULT_PERMS", "0"))
+	if err != nil {
+		return ldapConfig{}, fmt.Errorf("LDAP_DEFAULT_PERMS: %w", err)
+	}
+	return ldapConfig{
+		URL:                getEnvOrDefault("LDAP_URL", "ldap://localhost:389"),
+		StartTLS:           getEnvBool("LDAP_START_TLS", false),
+		InsecureSkipVerify: getEnvBool("LDAP_INSECURE_SKIP_VERIFY", false),
+		Timeout:            getEnvDuration("LDAP_TIMEOUT", 5*time.Second),
+		BindDN:             getEnvOrDefault("LDAP_BIND_DN", ""),
+		BindPassword:       getEnvOrDefault("LDAP_BIND_PASSWORD", ""),
+		BaseDN:             getEnvOrDefault("LDAP_BASE_DN", ""),
+		UserFilter:         getEnvOrDefault("LDAP_USER_FILTER", "(&(objectClass=posixAccount)(uid=%s))"),
+		DisplayNameAttr:    getEnvOrDefault("LDAP_DISPLAY_NAME_ATTR", "cn"),
+		HomeAttr:           getEnvOrDefault("LDAP_HOME_ATTR", "homeDirectory"),
+		KeyAttr:            getEnvOrDefault("LDAP_KEY_ATTR", "sshPublicKey"),
+		GroupAttr:          getEnvOrDefault("LDAP_GROUP_ATTR", "memberOf"),
+		GroupBaseDN:        getEnvOrDefault("LDAP_GROUP_BASE_DN", ""),
+		GroupFilter:        getEnvOrDefault("LDAP_GROUP_FILTER", ""),
+		GroupPerms:         groupPerms,
+		DefaultPerms:       defaultPerms,
+	}, nil
+}
+
+// parseLDAPGroupPerms parses "group=perms;group=perms". Groups may be full DNs
+// (which contain '='), so the permission is taken after the last '='.
+func parseLDAPGroupPerms(spec string) ([]ldapGroupPerm, error) {
+	var out []ldapGroupPerm
+	for _, item := range strings.Split(spec, ";") {
+		item = strings.TrimSpace(item)
+		if item == "" {
+			continue
+		}
+		i := strings.LastIndex(item, "=")
+		if i <= 0 {
+			return nil, fmt.Errorf("invalid group mapping %q", item)
+		}
+		perms, err := ParsePermission(item[i+1:])
+		if err != nil {
+			return nil, fmt.Errorf("invalid group mapping %q: %w", item, err)
+		}
+		out = append(out, ldapGroupPerm{group: strings.TrimSpace(item[:i]), perms: perms})
+	}
+	return out, nil
+}
+
+// ldapConn is the subset of *ldap.Conn used by LDAPUserProvider, so tests can
+// plug in an in-process stand-in instead of a real directory.
+type ldapConn interface {
+	Bind(username, password string) error
+	Search(req *ldap.SearchRequest) (*ldap.SearchResult, error)
+	Close() error
+}
+
+// LDAPUserProvider implements UserProvider against an LDAP directory. Passwords
+// are verified by binding as the user; keys, home path and group membership are
+// read from attributes, and groups are mapped to the Permission bitmask.
+type LDAPUserProvider struct {
+	config ldapConfig
+	logger *zap.SugaredLogger
+	dial   func() (ldapConn, error)
+}
+
+func NewLDAPUserProvider(config ldapConfig, logger *zap.SugaredLogger) (*LDAPUserProvider, error) {
+	if config.BaseDN == "" {
+		return nil, errors.New("LDAP_BASE_DN is required")
+	}
+	if !strings.Contains(config.UserFilter, "%s") {
+		return nil, fmt.Errorf("LDAP_USER_FILTER %q must contain %%s", config.UserFilter)
+	}
+	p := &LDAPUserProvider{config: config, logger: logger}
+	p.dial = p.dialURL
+	return p, nil
+}
+
+func (p *LDAPUserProvider) dialURL() (ldapConn, error) {
+	u, err := url.Parse(p.config.URL)
+	if err != nil {
+		return nil, err
+	}
+	tlsConfig := &tls.Config{ServerName: u.Hostname(), InsecureSkipVerify: p.config.InsecureSkipVerify}
+	conn, err := ldap.DialURL(p.config.URL, ldap.DialWithTLSConfig(tlsConfig))
+	if err != nil {
+		return nil, err
+	}
+	conn.SetTimeout(p.config.Timeout)
+	if p.config.StartTLS && u.Scheme == "ldap" {
+		if err := conn.StartTLS(tlsConfig); err != nil {
+			conn.Close()
+			return nil, err
+		}
+	}
+	return conn, nil
+}
+
+// connect dials the directory and binds with the service account (or anonymously).
+func (p *LDAPUserProvider) connect() (ldapConn, error) {
+	conn, err := p.dial()
+	if err != nil {
+		return nil, fmt.Errorf("ldap dial: %w", err)
+	}
+	if p.config.BindDN != "" {
+		if err := conn.Bind(p.config.BindDN, p.config.BindPassword); err != nil {
+			conn.Close()
+			return nil, fmt.Errorf("ldap service bind: %w", err)
+		}
+	}
+	return conn, nil
+}
+
+// findUser returns the single entry matching username.
+func (p *LDAPUserProvider) findUser(conn ldapConn, username string) (*ldap.Entry, error) {
+	attrs := []string{p.config.DisplayNameAttr, p.config.HomeAttr, p.config.KeyAttr}
+	if p.config.GroupAttr != "" {
+		attrs = append(attrs, p.config.GroupAttr)
+	}
+	req := ldap.NewSearchRequest(p.config.BaseDN, ldap.ScopeWholeSubtree, ldap.NeverDerefAliases, 2, int(p.config.Timeout/time.Second), false,
+		fmt.Sprintf(p.config.UserFilter, ldap.EscapeFilter(username)), attrs, nil)
+	res, err := conn.Search(req)
+	if err != nil && !ldap.IsErrorWithCode(err, ldap.LDAPResultSizeLimitExceeded) {
+		return nil, fmt.Errorf("ldap search: %w", err)
+	}
+	if res == nil || len(res.Entries) == 0 {
+		return nil, fmt.Errorf("user %s not found in directory", username)
+	}
+	if len(res.Entries) > 1 {
+		return nil, fmt.Errorf("user %s is ambiguous in directory", username)
+	}
+	return res.Entries[0], nil
+}
+
+// groupsOf returns the DNs of the groups the entry belongs to.
+func (p *LDAPUserProvider) groupsOf(conn ldapConn, entry *ldap.Entry, username string) ([]string, error) {
+	var groups []string
+	if p.config.GroupAttr != "" {
+		groups = append(groups, entry.GetAttributeValues(p.config.GroupAttr)...)
+	}
+	if p.config.GroupBaseDN == "" || p.config.GroupFilter == "" {
+		return groups, nil
+	}
+	filter := strings.NewReplacer("{dn}", ldap.EscapeFilter(entry.DN), "{username}", ldap.EscapeFilter(username)).Replace(p.config.GroupFilter)
+	req := ldap.NewSearchRequest(p.config.GroupBaseDN, ldap.ScopeWholeSubtree, ldap.NeverDerefAliases, 0, int(p.config.Timeout/time.Second), false,
+		filter, []string{"cn"}, nil)
+	res, err := conn.Search(req)
+	if err != nil {
+		return nil, fmt.Errorf("ldap group search: %w", err)
+	}
+	for _, g := range res.Entries {
+		groups = append(groups, g.DN)
+	}
+	return groups, nil
+}
+
+// groupMatches compares a configured group against a group DN, either as a
+// full DN or by its leading RDN value (e.g. "sftp-admins" for "cn=sftp-admins,ou=groups,...").
+func groupMatches(configured, groupDN string) bool {
+	if strings.EqualFold(configured, groupDN) {
+		return true
+	}
+	dn, err := ldap.ParseDN(groupDN)
+	if err != nil || len(dn.RDNs) == 0 || len(dn.RDNs[0].Attributes) == 0 {
+		return false
+	}
+	return strings.EqualFold(configured, dn.RDNs[0].Attributes[0].Value)
+}
+
+// mapGroups ORs the permissions of every matching group mapping and returns the
+// first matching configured group as the user's group name.
+func (p *LDAPUserProvider) mapGroups(groups []string) (Permission, string) {
+	var perms Permission
+	groupName := ""
+	for _, mapping := range p.config.GroupPerms {
+		for _, g := range groups {
+			if groupMatches(mapping.group, g) {
+				perms |= mapping.perms
+				if groupName == "" {
+					groupName = mapping.group
+				}
+				break
+			}
+		}
+	}
+	if groupName == "" {
+		perms = p.config.DefaultPerms
+	}
+	return perms, groupName
+}
+
+// FetchUserByUsername implements UserProvider. Users without any permission
+// (no mapped group and LDAP_DEFAULT_PERMS=0) are returned as disabled.
+func (p *LDAPUserProvider) FetchUserByUsername(ctx context.Context, username string) (*User, error) {
+	p.logger.Infof("Fetching LDAP user by username: %s", username)
+	conn, err := p.connect()
+	if err != nil {
+		p.logger.Errorf("Error connecting to LDAP: %v", err)
+		return nil, err
+	}
+	defer conn.Close()
+	entry, err := p.findUser(conn, username)
+	if err != nil {
+		return nil, err
+	}
+	groups, err := p.groupsOf(conn, entry, username)
+	if err != nil {
+		p.logger.Errorf("Error fetching LDAP groups for %s: %v", username, err)
+		return nil, err
+	}
+	perms, groupName := p.mapGroups(groups)
+	user := &User{
+		DisplayName: entry.GetAttributeValue(p.config.DisplayNameAttr),
+		GroupName:   groupName,
+		Username:    username,
+		RootPath:    entry.GetAttributeValue(p.config.HomeAttr),
+		Perms:       perms,
+		Disabled:    perms == 0,
+	}
+	if keys := entry.GetAttributeValues(p.config.KeyAttr); len(keys) > 0 {
+		user.PublicKey.String = strings.Join(keys, "\n")
+		user.PublicKey.Valid = true
+	}
+	return user, nil
+}
+
+// CheckPassword implements UserProvider by binding as the user.
+func (p *LDAPUserProvider) CheckPassword(ctx context.Context, user *User, password []byte) error {
+	// an empty password would be an unauthenticated bind, which servers accept
+	if len(password) == 0 {
+		return fmt.Errorf("empty password")
+	}
+	conn, err := p.connect()
+	if err != nil {
+		p.logger.Errorf("Error connecting to LDAP: %v", err)
+		return err
+	}
+	defer conn.Close()
+	entry, err := p.findUser(conn, user.Username)
+	if err != nil {
+		return err
+	}
+	if err := conn.Bind(entry.DN, string(password)); err != nil {
+		if ldap.IsErrorWithCode(err, ldap.LDAPResultInvalidCredentials) {
+			return fmt.Errorf("invalid password")
+		}
+		return fmt.Errorf("ldap user bind: %w", err)
+	}
+	return nil
+}
+
+// MatchUserKey implements UserProvider using the keys read from the user's
+// entry (one authorized_keys line per attribute value).
+func (p *LDAPUserProvider) MatchUserKey(ctx context.Context, user *User, key ssh.PublicKey) (*UserKey, error) {
+	presented := key.Marshal()
+	for _, line := range strings.Split(user.PublicKey.String, "\n") {
+		if strings.TrimSpace(line) == "" {
+			continue
+		}
+		authorizedKey, _, _, _, err := ssh.ParseAuthorizedKey([]byte(line))
+		if err != nil {
+			p.logger.Warnf("Skipping unparsable LDAP key for user %s: %v", user.Username, err)
+			continue
+		}
+		if bytes.Equal(presented, authorizedKey.Marshal()) {
+			return &UserKey{PublicKey: line, Enabled: true}, nil
+		}
+	}
+	return nil, fmt.Errorf("public key mismatch")
+}
@@ -0,0 +1,228 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"strings"
+	"testing"
+
+	"github.com/go-ldap/ldap/v3"
+	"go.uber.org/zap"
+)
+
+// fakeLDAP is an in-process ldapConn. Searches return entries and err;
+// binds succeed for the DNs in passwords with the matching password.
+type fakeLDAP struct {
+	entries   []*ldap.Entry
+	err       error
+	passwords map[string]string
+
+	filters []string
+	binds   []string
+	closed  bool
+}
+
+func (c *fakeLDAP) Bind(username, password string) error {
+	c.binds = append(c.binds, username)
+	if want, ok := c.passwords[username]; ok && want == password {
+		return nil
+	}
+	return ldap.NewError(ldap.LDAPResultInvalidCredentials, errors.New("invalid credentials"))
+}
+
+func (c *fakeLDAP) Search(req *ldap.SearchRequest) (*ldap.SearchResult, error) {
+	c.filters = append(c.filters, req.Filter)
+	return &ldap.SearchResult{Entries: c.entries}, c.err
+}
+
+func (c *fakeLDAP) Close() error {
+	c.closed = true
+	return nil
+}
+
+func newTestLDAPProvider(t *testing.T, conn *fakeLDAP, config ldapConfig) *LDAPUserProvider {
+	t.Helper()
+	config.BaseDN = "dc=example,dc=org"
+	if config.UserFilter == "" {
+		config.UserFilter = "(uid=%s)"
+	}
+	config.DisplayNameAttr = "cn"
+	config.HomeAttr = "homeDirectory"
+	config.KeyAttr = "sshPublicKey"
+	p, err := NewLDAPUserProvider(config, zap.NewNop().Sugar())
+	if err != nil {
+		t.Fatal(err)
+	}
+	p.dial = func() (ldapConn, error) { return conn, nil }
+	return p
+}
+
+func TestLDAPFindUserEscapesFilter(t *testing.T) {
+	conn := &fakeLDAP{entries: []*ldap.Entry{ldap.NewEntry("uid=x,dc=example,dc=org", nil)}}
+	p := newTestLDAPProvider(t, conn, ldapConfig{UserFilter: "(&(objectClass=posixAccount)(uid=%s))"})
+	if _, err := p.findUser(conn, `*)(uid=admin\`); err != nil {
+		t.Fatal(err)
+	}
+	want := `(&(objectClass=posixAccount)(uid=\2a\29\28uid=admin\5c))`
+	if len(conn.filters) != 1 || conn.filters[0] != want {
+		t.Errorf("filters = %q, want [%q]", conn.filters, want)
+	}
+}
+
+func TestLDAPFindUserEntries(t *testing.T) {
+	entry := ldap.NewEntry("uid=alice,dc=example,dc=org", nil)
+	tests := []struct {
+		name    string
+		conn    *fakeLDAP
+		wantErr string
+	}{
+		{"single", &fakeLDAP{entries: []*ldap.Entry{entry}}, ""},
+		{"missing", &fakeLDAP{}, "not found"},
+		{"ambiguous", &fakeLDAP{entries: []*ldap.Entry{entry, ldap.NewEntry("uid=alice,ou=other,dc=example,dc=org", nil)}}, "ambiguous"},
+		// the search asks for two entries to detect duplicates, which servers may report as an error
+		{"ambiguous size limit", &fakeLDAP{
+			entries: []*ldap.Entry{entry, ldap.NewEntry("uid=alice,ou=other,dc=example,dc=org", nil)},
+			err:     ldap.NewError(ldap.LDAPResultSizeLimitExceeded, errors.New("size limit exceeded")),
+		}, "ambiguous"},
+		{"search error", &fakeLDAP{err: ldap.NewError(ldap.LDAPResultOperationsError, errors.New("boom"))}, "ldap search"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			p := newTestLDAPProvider(t, tt.conn, ldapConfig{})
+			got, err := p.findUser(tt.conn, "alice")
+			if tt.wantErr == "" {
+				if err != nil || got != entry {
+					t.Fatalf("findUser = %v, %v; want %v", got, err, entry)
+				}
+				return
+			}
+			if err == nil || !strings.Contains(err.Error(), tt.wantErr) {
+				t.Fatalf("findUser error = %v, want one containing %q", err, tt.wantErr)
+			}
+		})
+	}
+}
+
+func TestGroupMatches(t *testing.T) {
+	const dn = "cn=sftp-admins,ou=groups,dc=example,dc=org"
+	tests := []struct {
+		configured string
+		groupDN    string
+		want       bool
+	}{
+		{dn, dn, true},
+		{"CN=SFTP-Admins,OU=Groups,DC=example,DC=org", dn, true},
+		{"sftp-admins", dn, true},
+		{"SFTP-ADMINS", dn, true},
+		{"groups", dn, false},
+		{"sftp", dn, false},
+		{"cn=sftp-admins,ou=other,dc=example,dc=org", dn, false},
+		{"sftp-admins", "not a dn", false},
+	}
+	for _, tt := range tests {
+		if got := groupMatches(tt.configured, tt.groupDN); got != tt.want {
+			t.Errorf("groupMatches(%q, %q) = %v, want %v", tt.configured, tt.groupDN, got, tt.want)
+		}
+	}
+}
+
+func TestLDAPMapGroups(t *testing.T) {
+	p := newTestLDAPProvider(t, &fakeLDAP{}, ldapConfig{
+		GroupPerms: []ldapGroupPerm{
+			{group: "cn=readers,ou=groups,dc=example,dc=org", perms: PermRead | PermList},
+			{group: "writers", perms: PermWrite},
+			{group: "deleters", perms: PermDelete},
+		},
+		DefaultPerms: PermList,
+	})
+	tests := []struct {
+		name      string
+		groups    []string
+		wantPerms Permission
+		wantGroup string
+	}{
+		{"none", nil, PermList, ""},
+		{"unmapped", []string{"cn=others,ou=groups,dc=example,dc=org"}, PermList, ""},
+		{"one", []string{"cn=writers,ou=groups,dc=example,dc=org"}, PermWrite, "writers"},
+		{"or", []string{
+			"cn=writers,ou=groups,dc=example,dc=org",
+			"cn=others,ou=groups,dc=example,dc=org",
+			"cn=readers,ou=groups,dc=example,dc=org",
+		}, PermRead | PermList | PermWrite, "cn=readers,ou=groups,dc=example,dc=org"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			perms, group := p.mapGroups(tt.groups)
+			if perms != tt.wantPerms || group != tt.wantGroup {
+				t.Errorf("mapGroups = %d, %q; want %d, %q", perms, group, tt.wantPerms, tt.wantGroup)
+			}
+		})
+	}
+}
+
+func TestLDAPFetchUserByUsername(t *testing.T) {
+	entry := ldap.NewEntry("uid=alice,dc=example,dc=org", map[string][]string{
+		"cn":            {"Alice"},
+		"homeDirectory": {"/home/alice"},
+		"sshPublicKey":  {"ssh-ed25519 AAAA one", "ssh-ed25519 AAAA two"},
+		"memberOf":      {"cn=writers,ou=groups,dc=example,dc=org"},
+	})
+	conn := &fakeLDAP{entries: []*ldap.Entry{entry}}
+	p := newTestLDAPProvider(t, conn, ldapConfig{
+		GroupAttr:  "memberOf",
+		GroupPerms: []ldapGroupPerm{{group: "writers", perms: PermWrite}},
+	})
+	u, err := p.FetchUserByUsername(context.Background(), "alice")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if u.DisplayName != "Alice" || u.RootPath != "/home/alice" || u.GroupName != "writers" || u.Perms != PermWrite || u.Disabled {
+		t.Errorf("user = %+v", u)
+	}
+	if u.PublicKey.String != "ssh-ed25519 AAAA one\nssh-ed25519 AAAA two" {
+		t.Errorf("keys = %q", u.PublicKey.String)
+	}
+	if !conn.closed {
+		t.Error("connection not closed")
+	}
+
+	// without a mapped group or default perms the user may not log in
+	conn.entries = []*ldap.Entry{ldap.NewEntry(entry.DN, map[string][]string{"cn": {"Alice"}})}
+	if u, err = p.FetchUserByUsername(context.Background(), "alice"); err != nil {
+		t.Fatal(err)
+	}
+	if u.Perms != 0 || !u.Disabled {
+		t.Errorf("unmapped user: perms %d, disabled %v; want 0, true", u.Perms, u.Disabled)
+	}
+}
+
+func TestLDAPCheckPassword(t *testing.T) {
+	const dn = "uid=alice,dc=example,dc=org"
+	user := &User{Username: "alice"}
+	tests := []struct {
+		name     string
+		password string
+		wantErr  string
+	}{
+		{"correct", "secret", ""},
+		{"wrong", "guess", "invalid password"},
+		{"empty", "", "empty password"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			conn := &fakeLDAP{entries: []*ldap.Entry{ldap.NewEntry(dn, nil)}, passwords: map[string]string{dn: "secret"}}
+			p := newTestLDAPProvider(t, conn, ldapConfig{})
+			err := p.CheckPassword(context.Background(), user, []byte(tt.password))
+			if tt.wantErr == "" {
+				if err != nil {
+					t.Fatal(err)
+				}
+			} else if err == nil || !strings.Contains(err.Error(), tt.wantErr) {
+				t.Fatalf("CheckPassword error = %v, want one containing %q", err, tt.wantErr)
+			}
+			if tt.password == "" && len(conn.binds) > 0 {
+				t.Errorf("empty password reached the directory: binds %q", conn.binds)
+			}
+		})
+	}
+}
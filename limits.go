@@ -0,0 +1,144 @@
+package main
+
+import (
+	"encoding/binary"
+	"fmt"
+	"io"
+	"net"
+	"sync"
+	"time"
+)
+
+// SSH_MSG_DISCONNECT reason codes (RFC 4253, section 11.1).
+const (
+	disconnectTooManyConnections = 12
+)
+
+// limitError refuses a connection or session because a limit is reached.
+type limitError struct {
+	reason uint32 // SSH_MSG_DISCONNECT reason code
+	msg    string // shown to the client
+}
+
+func (e *limitError) Error() string { return e.msg }
+
+// connLimits caps the connections and sessions the server accepts. A zero
+// limit is unlimited. The limits are read from the environment and can be
+// changed on reload; the counts survive it.
+type connLimits struct {
+	mu              sync.Mutex
+	maxConns        int // concurrent connections
+	maxPerIP        int // concurrent connections from one source address
+	maxHandshakes   int // connections not yet authenticated
+	maxUserSessions int // concurrent sessions of one user
+	maxChannels     int // concurrent session channels of one connection
+
+	conns      int
+	perIP      map[string]int
+	handshakes int
+}
+
+func newConnLimits() *connLimits {
+	l := &connLimits{perIP: map[string]int{}}
+	l.configure()
+	return l
+}
+
+// configure reads the limits from the environment.
+func (l *connLimits) configure() {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.maxConns = getEnvInt("MAX_CONNECTIONS", 0)
+	l.maxPerIP = getEnvInt("MAX_CONNECTIONS_PER_IP", 0)
+	l.maxHandshakes = getEnvInt("MAX_HANDSHAKES", 100)
+	l.maxUserSessions = getEnvInt("MAX_SESSIONS_PER_USER", 0)
+	l.maxChannels = getEnvInt("MAX_CHANNELS_PER_CONNECTION", 10)
+}
+
+// acquire counts a new connection from ip, which starts its handshake, or
+// returns a *limitError. Call handshakeDone after the handshake and release
+// when the connection ends.
+func (l *connLimits) acquire(ip string) error {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	switch {
+	case l.maxConns > 0 && l.conns >= l.maxConns:
+		return &limitError{disconnectTooManyConnections, fmt.Sprintf("too many connections to the server (limit %d)", l.maxConns)}
+	case l.maxPerIP > 0 && l.perIP[ip] >= l.maxPerIP:
+		return &limitError{disconnectTooManyConnections, fmt.Sprintf("too many connections from %s (limit %d)", ip, l.maxPerIP)}
+	case l.maxHandshakes > 0 && l.handshakes >= l.maxHandshakes:
+		return &limitError{disconnectTooManyConnections, fmt.Sprintf("too many unauthenticated connections (limit %d)", l.maxHandshakes)}
+	}
+	l.conns++
+	l.perIP[ip]++
+	l.handshakes++
+	return nil
+}
+
+// handshakeDone stops counting a connection as unauthenticated.
+func (l *connLimits) handshakeDone() {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.handshakes--
+}
+
+// release forgets a connection from ip.
+func (l *connLimits) release(ip string) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.conns--
+	if l.perIP[ip]--; l.perIP[ip] <= 0 {
+		delete(l.perIP, ip)
+	}
+}
+
+// userSessions returns the per-user session limit.
+func (l *connLimits) userSessions() int {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	return l.maxUserSessions
+}
+
+// channels returns the per-connection channel limit.
+func (l *connLimits) channels() int {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	return l.maxChannels
+}
+
+// rejectConn tells an SSH client why its connection is refused and closes it.
+// Before key exchange packets are unencrypted, so an SSH_MSG_DISCONNECT can
+// follow the version line without a handshake; OpenSSH prints its message.
+func rejectConn(conn net.Conn, e *limitError) {
+	defer conn.Close()
+	conn.SetDeadline(time.Now().Add(2 * time.Second))
+	payload := []byte{1} // SSH_MSG_DISCONNECT
+	payload = binary.BigEndian.AppendUint32(payload, e.reason)
+	payload = appendSSHString(payload, e.msg)
+	payload = appendSSHString(payload, "") // language tag
+	// packet_length, padding_length, payload and at least 4 bytes of padding,
+	// a multiple of 8 bytes in all
+	padding := 8 - (5+len(payload))%8
+	if padding < 4 {
+		padding += 8
+	}
+	packet := []byte("SSH-2.0-Go\r\n")
+	packet = binary.BigEndian.AppendUint32(packet, uint32(1+len(payload)+padding))
+	packet = append(packet, byte(padding))
+	packet = append(packet, payload...)
+	packet = append(packet, make([]byte, padding)...)
+	if _, err := conn.Write(packet); err != nil {
+		return
+	}
+	// Closing with unread input would reset the connection and could discard
+	// the message; let the client hang up first.
+	if tc, ok := conn.(*net.TCPConn); ok {
+		tc.CloseWrite()
+	}
+	io.Copy(io.Discard, conn)
+}
+
+func appendSSHString(b []byte, s string) []byte {
+	b = binary.BigEndian.AppendUint32(b, uint32(len(s)))
+	return append(b, s...)
+}
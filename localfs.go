@@ -0,0 +1,200 @@
+package main
+
+import (
+	"errors"
+	"os"
+	"path/filepath"
+	"runtime"
+	"strings"
+	"time"
+
+	"go.uber.org/zap"
+)
+
+// LocalFS serves a user's root directory on the local disk.
+type LocalFS struct {
+	root   string // absolute, inside BASE_FS_ROOT
+	logger *zap.SugaredLogger
+}
+
+// NewLocalFS resolves the user's root directory and creates it if needed. If
+// root_path is not set, the root is BASE_FS_ROOT/<username>. A root outside
+// baseRoot is rebased under it.
+func NewLocalFS(baseRoot string, user *User, logger *zap.SugaredLogger) (*LocalFS, error) {
+	// Determine user's root. If not set or invalid, allocate under BASE_FS_ROOT/<username>
+	userRoot := filepath.FromSlash(strings.TrimSpace(user.RootPath))
+	if userRoot == "" {
+		userRoot = filepath.Join(baseRoot, user.Username)
+	}
+
+	// Resolve absolute paths
+	baseAbs, err := filepath.Abs(baseRoot)
+	if err != nil {
+		logger.Errorf("Error resolving base root absolute path: %v", err)
+		return nil, err
+	}
+	userRootAbs, err := filepath.Abs(userRoot)
+	if err != nil {
+		logger.Errorf("Error resolving user's root absolute path: %v", err)
+		return nil, err
+	}
+
+	// Ensure user's root is inside baseRoot. If not, rebase it under baseRoot.
+	relToBase, rerr := filepath.Rel(baseAbs, userRootAbs)
+	if rerr != nil || strings.HasPrefix(relToBase, "..") || relToBase == ".." {
+		logger.Warnf("User root %s is outside BASE_FS_ROOT; rebasing to %s", userRootAbs, baseAbs)
+		userRootAbs = filepath.Join(baseAbs, user.Username)
+	}
+
+	// Ensure the user root directory exists
+	if mkerr := os.MkdirAll(userRootAbs, 0755); mkerr != nil {
+		logger.Warnf("Failed to create user root dir (%s): %v", userRootAbs, mkerr)
+	}
+	return &LocalFS{root: userRootAbs, logger: logger}, nil
+}
+
+// resolve returns the absolute disk path for name inside the user's root.
+// It prevents escaping root by path traversal (../) or weird absolute requests.
+func (fs *LocalFS) resolve(name string) (string, error) {
+	fs.logger.Infof("Resolving path for request: %s", name)
+	abs, err := filepath.Abs(filepath.Join(fs.root, filepath.FromSlash(cleanPath(name))))
+	if err != nil {
+		fs.logger.Errorf("Error resolving absolute path: %v", err)
+		return "", err
+	}
+
+	// Ensure the resolved path is within the user's root directory
+	rel, err := filepath.Rel(fs.root, abs)
+	if err != nil {
+		fs.logger.Errorf("Error getting relative path: %v", err)
+		return "", errors.New("access denied")
+	}
+	if rel == ".." || strings.HasPrefix(rel, ".."+string(filepath.Separator)) {
+		fs.logger.Warnf("Attempt to escape root directory: %s -> %s", name, abs)
+		return "", errors.New("access denied")
+	}
+
+	fs.logger.Infof("Resolved path: %s", abs)
+	return abs, nil
+}
+
+func (fs *LocalFS) Open(name string) (File, error) {
+	p, err := fs.resolve(name)
+	if err != nil {
+		return nil, err
+	}
+	return os.Open(p)
+}
+
+func (fs *LocalFS) OpenFile(name string, flag int, perm os.FileMode) (File, error) {
+	p, err := fs.resolve(name)
+	if err != nil {
+		return nil, err
+	}
+	return os.OpenFile(p, flag, perm)
+}
+
+func (fs *LocalFS) Stat(name string) (os.FileInfo, error) {
+	p, err := fs.resolve(name)
+	if err != nil {
+		return nil, err
+	}
+	return os.Stat(p)
+}
+
+func (fs *LocalFS) Lstat(name string) (os.FileInfo, error) {
+	p, err := fs.resolve(name)
+	if err != nil {
+		return nil, err
+	}
+	return os.Lstat(p)
+}
+
+func (fs *LocalFS) ReadDir(name string) ([]os.FileInfo, error) {
+	p, err := fs.resolve(name)
+	if err != nil {
+		return nil, err
+	}
+	dir, err := os.Open(p)
+	if err != nil {
+		return nil, err
+	}
+	defer dir.Close()
+	return dir.Readdir(-1)
+}
+
+func (fs *LocalFS) MkdirAll(name string, perm os.FileMode) error {
+	p, err := fs.resolve(name)
+	if err != nil {
+		return err
+	}
+	return os.MkdirAll(p, perm)
+}
+
+func (fs *LocalFS) Remove(name string) error {
+	p, err := fs.resolve(name)
+	if err != nil {
+		return err
+	}
+	return os.Remove(p)
+}
+
+func (fs *LocalFS) RemoveAll(name string) error {
+	p, err := fs.resolve(name)
+	if err != nil {
+		return err
+	}
+	if p == fs.root {
+		return os.ErrPermission
+	}
+	return os.RemoveAll(p)
+}
+
+func (fs *LocalFS) Rename(oldname, newname string) error {
+	from, err := fs.resolve(oldname)
+	if err != nil {
+		return err
+	}
+	to, err := fs.resolve(newname)
+	if err != nil {
+		return err
+	}
+	return os.Rename(from, to)
+}
+
+func (fs *LocalFS) Chmod(name string, mode os.FileMode) error {
+	p, err := fs.resolve(name)
+	if err != nil {
+		return err
+	}
+	return os.Chmod(p, mode)
+}
+
+func (fs *LocalFS) Chtimes(name string, atime, mtime time.Time) error {
+	p, err := fs.resolve(name)
+	if err != nil {
+		return err
+	}
+	return os.Chtimes(p, atime, mtime)
+}
+
+// Chown is a no-op on Windows, which has no numeric owners.
+func (fs *LocalFS) Chown(name string, uid, gid int) error {
+	p, err := fs.resolve(name)
+	if err != nil {
+		return err
+	}
+	if runtime.GOOS == "windows" {
+		fs.logger.Debugf("Skipping chown on Windows for %s (uid=%d gid=%d)", p, uid, gid)
+		return nil
+	}
+	return os.Chown(p, uid, gid)
+}
+
+func (fs *LocalFS) Truncate(name string, size int64) error {
+	p, err := fs.resolve(name)
+	if err != nil {
+		return err
+	}
+	return os.Truncate(p, size)
+}
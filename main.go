@@ -1,30 +1,23 @@
 package main
 
 import (
-	"bytes"
 	"context"
 	"crypto/rand"
 	"crypto/rsa"
 	"crypto/x509"
 	"encoding/pem"
-	"fmt"
-	"io"
 	"log"
-	"net"
 	"os"
 	"path/filepath"
+	"strconv"
 	"strings"
 	"time"
 
-	"github.com/pkg/sftp"
 	"go.uber.org/zap"
 	"go.uber.org/zap/zapcore"
-	"golang.org/x/crypto/bcrypt"
 	"golang.org/x/crypto/ssh"
 	"gopkg.in/natefinch/lumberjack.v2"
 
-	"github.com/joho/godotenv"
-
 	_ "github.com/lib/pq"
 	_ "modernc.org/sqlite"
 )
@@ -36,6 +29,45 @@ func getEnvOrDefault(key, defaultValue string) string {
 	return defaultValue
 }
 
+func getEnvInt(key string, defaultValue int) int {
+	value := os.Getenv(key)
+	if value == "" {
+		return defaultValue
+	}
+	n, err := strconv.Atoi(value)
+	if err != nil {
+		log.Printf("Invalid integer for %s (%q), using %d", key, value, defaultValue)
+		return defaultValue
+	}
+	return n
+}
+
+func getEnvBool(key string, defaultValue bool) bool {
+	value := os.Getenv(key)
+	if value == "" {
+		return defaultValue
+	}
+	b, err := strconv.ParseBool(value)
+	if err != nil {
+		log.Printf("Invalid boolean for %s (%q), using %v", key, value, defaultValue)
+		return defaultValue
+	}
+	return b
+}
+
+func getEnvDuration(key string, defaultValue time.Duration) time.Duration {
+	value := os.Getenv(key)
+	if value == "" {
+		return defaultValue
+	}
+	d, err := time.ParseDuration(value)
+	if err != nil {
+		log.Printf("Invalid duration for %s (%q), using %s", key, value, defaultValue)
+		return defaultValue
+	}
+	return d
+}
+
 func initLogger() (*zap.SugaredLogger, error) {
 	logPath := getEnvOrDefault("LOG_PATH", "./logs/sftp.log")
 	logLevel := getEnvOrDefault("LOG_LEVEL", "info")
@@ -52,6 +84,10 @@ func initLogger() (*zap.SugaredLogger, error) {
 	}
 	file := zapcore.AddSync(rotator)
 	console := zapcore.AddSync(os.Stdout)
+	if len(os.Args) > 1 {
+		// admin commands keep stdout for their results
+		console = zapcore.AddSync(os.Stderr)
+	}
 
 	encoderCfg := zap.NewProductionEncoderConfig()
 	encoderCfg.TimeKey = "ts"
@@ -80,7 +116,7 @@ func initLogger() (*zap.SugaredLogger, error) {
 }
 
 func main() {
-	err := godotenv.Load()
+	err := loadEnv()
 	if err != nil {
 		log.Fatal("Error loading .env file")
 	}
@@ -103,155 +139,78 @@ func main() {
 		logger.Warnf("Failed to create USERS_ROOT (%s): %v", usersBase, err)
 	}
 
-	logger.Infof("Starting SFTP server on %s", listenAddr)
+	args, out := parseGlobalFlags(os.Args[1:])
+	if len(args) > 0 {
+		if handled, err := runLocalCommand(args, out, hostKeyPath); handled {
+			if err != nil {
+				logger.Errorf("%v", err)
+				os.Exit(1)
+			}
+			return
+		}
+	}
+
 	store := NewUserStore(dsn)
 	if store == nil {
 		logger.Fatal("Failed to connect to the user store.")
 	}
 	defer store.db.Close()
 
-	hostSigner, err := loadOrCreateHostKey(hostKeyPath)
-	if err != nil {
-		logger.Fatalf("Failed to load or create host key: %v", err)
+	// "migrate" inspects and upgrades the schema itself; everything else needs it current
+	if len(args) == 0 || args[0] != "migrate" {
+		if err := store.ensureSchema(context.Background(), getEnvBool("DB_AUTO_MIGRATE", true)); err != nil {
+			logger.Fatalf("Failed to migrate the database schema: %v", err)
+		}
 	}
-	sshConfig := &ssh.ServerConfig{
-		NoClientAuth: false,
-		PasswordCallback: func(c ssh.ConnMetadata, pass []byte) (*ssh.Permissions, error) {
-			logger.Infof("Password auth attempt for user: %s", c.User())
-			cxt, cancel := context.WithTimeout(context.Background(), 5*time.Second)
-			defer cancel()
-			user, err := store.FetchUserByUsername(cxt, c.User())
-			if err != nil {
-				logger.Warnf("User %s not found: %v", c.User(), err)
-				return nil, err
-			}
-			if user.Disabled {
-				logger.Warnf("User %s is disabled", c.User())
-				return nil, fmt.Errorf("user disabled")
-			}
-			if !user.PasswordHash.Valid {
-				logger.Warnf("User %s has no password set", c.User())
-				return nil, fmt.Errorf("no password set")
-			}
-			//use bcrypt to compare password
-			if err := bcrypt.CompareHashAndPassword([]byte(user.PasswordHash.String), pass); err != nil {
-				logger.Warnf("Invalid password for user %s: %v", c.User(), err)
-				return nil, fmt.Errorf("invalid password")
-			}
-			//attach user info to session
-			perms := &ssh.Permissions{Extensions: map[string]string{"username": user.Username}}
-			return perms, nil
-		},
-		PublicKeyCallback: func(c ssh.ConnMetadata, key ssh.PublicKey) (*ssh.Permissions, error) {
-			logger.Infof("Public key auth attempt for user: %s", c.User())
-			cxt, cancel := context.WithTimeout(context.Background(), 5*time.Second)
-			defer cancel()
-			user, err := store.FetchUserByUsername(cxt, c.User())
-			if err != nil {
-				logger.Warnf("User %s not found: %v", c.User(), err)
-				return nil, err
-			}
-			if user.Disabled {
-				logger.Warnf("User %s is disabled", c.User())
-				return nil, fmt.Errorf("user disabled")
-			}
-			if !user.PublicKey.Valid {
-				logger.Warnf("User %s has no public key set", c.User())
-				return nil, fmt.Errorf("no public key set")
-			}
-			authorizedKey, _, _, _, err := ssh.ParseAuthorizedKey([]byte(user.PublicKey.String))
-			if err != nil {
-				logger.Warnf("Invalid public key for user %s: %v", c.User(), err)
-				return nil, fmt.Errorf("invalid public key")
-			}
-			// compare marshaled keys to avoid depending on ssh.KeysEqual
-			if !bytes.Equal(key.Marshal(), authorizedKey.Marshal()) {
-				logger.Warnf("Public key mismatch for user %s", c.User())
-				return nil, fmt.Errorf("public key mismatch")
-			}
-			//attach user info to session
-			perms := &ssh.Permissions{Extensions: map[string]string{"username": user.Username}}
-			return perms, nil
-		},
+
+	// Admin subcommands run against the store and exit instead of serving.
+	if len(args) > 0 {
+		if err := runCommand(store, args, out); err != nil {
+			logger.Errorf("%v", err)
+			os.Exit(1)
+		}
+		return
+	}
+
+	logger.Infof("Starting SFTP server on %s", listenAddr)
+
+	// Temporary files of uploads interrupted by a crash or restart. After a
+	// hand-off the previous process may still be writing its own.
+	if os.Getenv(inheritedFDsEnv) == "" {
+		go purgeUploadTemps(usersBase, time.Now(), logger)
 	}
 
-	sshConfig.AddHostKey(hostSigner)
-	listener, err := net.Listen("tcp", listenAddr)
+	stop := make(chan struct{})
+	defender := newDefender(store, logger)
+	go defender.run(getEnvDuration("DEFENDER_SYNC_INTERVAL", 30*time.Second), stop)
+	go runQuotaScans(getEnvDuration("QUOTA_SCAN_INTERVAL", time.Hour), logger, stop)
+
+	srv := &server{store: store, defender: defender, sessions: newSessionRegistry(), limits: newConnLimits(), logger: logger}
+	state, err := loadServerState(store, defender, srv.checkUserSessions, logger)
 	if err != nil {
+		logger.Fatalf("%v", err)
+	}
+	srv.state.Store(state)
+	go srv.sessions.dumpOnSignal(logger)
+	if srv.admin, err = startAdminAPI(store, srv.sessions, logger); err != nil {
+		logger.Fatalf("Failed to start the admin API: %v", err)
+	}
+	if srv.metrics, err = startMetrics(srv.sessions, logger); err != nil {
+		logger.Fatalf("Failed to start the metrics endpoint: %v", err)
+	}
+	if srv.listener, err = listen("sftp", listenAddr); err != nil {
 		logger.Fatalf("Failed to listen on %s: %v", listenAddr, err)
 	}
-	logger.Infof("Listening on %s", listenAddr)
-	for {
-		nConn, err := listener.Accept()
-		if err != nil {
-			logger.Errorf("Failed to accept incoming connection: %v", err)
-			continue
-		}
-		go func(conn net.Conn) {
-			defer conn.Close()
-			sshConn, chans, reqs, err := ssh.NewServerConn(conn, sshConfig)
-			if err != nil {
-				logger.Errorf("Failed to handshake: %v", err)
-				return
-			}
-			logger.Infof("New SSH connection from %s (%s)", sshConn.RemoteAddr(), sshConn.ClientVersion())
-			// Discard global requests
-			go ssh.DiscardRequests(reqs)
-			//handle channels
-			for newChannel := range chans {
-				if newChannel.ChannelType() != "session" {
-					newChannel.Reject(ssh.UnknownChannelType, "unknown channel type")
-					logger.Warnf("Unknown channel type: %s", newChannel.ChannelType())
-					continue
-				}
-				channel, requests, err := newChannel.Accept()
-				if err != nil {
-					logger.Errorf("Could not accept channel: %v", err)
-					continue
-				}
-				go func(in <-chan *ssh.Request) {
-					for req := range in {
-						if req.Type == "subsystem" && len(req.Payload) >= 4 && string(req.Payload[4:]) == "sftp" {
-							// Handle SFTP subsystem request
-							//Accept the request
-							err := req.Reply(true, nil)
-							if err != nil {
-								logger.Errorf("Could not reply to request: %v", err)
-								return
-							}
-							// Fetch user info from session
-							username := sshConn.Permissions.Extensions["username"]
-							cxt, cancel := context.WithTimeout(context.Background(), 5*time.Second)
-							user, err := store.FetchUserByUsername(cxt, username)
-							cancel()
-							if err != nil {
-								logger.Errorf("Failed to fetch user %s: %v", username, err)
-								channel.Close()
-								return
-							}
-							handler := &SftpHandler{user: user, logger: logger}
-							handlers := sftp.Handlers{FileGet: handler, FilePut: handler, FileCmd: handler, FileList: handler}
-							server := sftp.NewRequestServer(channel, handlers)
-							if err := server.Serve(); err == io.EOF {
-								server.Close()
-								logger.Infof("SFTP client exited session.")
-							} else if err != nil {
-								logger.Errorf("SFTP server completed with error: %v", err)
-							}
-							return
-						} else {
-							err := req.Reply(false, nil)
-							if err != nil {
-								logger.Errorf("Failed to reply to client: %v", err)
-							}
-							logger.Warnf("Unknown request type: %s", req.Type)
-							continue
-						}
-					}
-				}(requests)
-			}
-		}(nConn)
+	logger.Infof("Listening on %s", srv.listener.Addr())
+	if notifyReady() {
+		logger.Infof("Took over the listeners from the previous process")
 	}
+
+	go srv.serve()
+	srv.handleSignals()
+	srv.shutdown(getEnvDuration("SHUTDOWN_TIMEOUT", 30*time.Second))
+	close(stop)
+	logger.Infof("Server stopped")
 }
 
 // Load or create host key
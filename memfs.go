@@ -0,0 +1,330 @@
+package main
+
+import (
+	"io"
+	"os"
+	"path"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// MemFS is a FileSystem kept entirely in memory. It is meant for tests and for
+// ephemeral drop boxes whose contents need not survive a restart.
+type MemFS struct {
+	mu    sync.RWMutex
+	nodes map[string]*memNode // keyed by cleanPath
+}
+
+type memNode struct {
+	name    string
+	dir     bool
+	mode    os.FileMode
+	modTime time.Time
+	data    []byte
+}
+
+func NewMemFS() *MemFS {
+	return &MemFS{nodes: map[string]*memNode{
+		"/": {name: "/", dir: true, mode: os.ModeDir | 0755, modTime: time.Now()},
+	}}
+}
+
+func memErr(op, name string, err error) error {
+	return &os.PathError{Op: op, Path: name, Err: err}
+}
+
+// lookup returns the node for a cleaned path; the caller holds the lock.
+func (fs *MemFS) lookup(op, p string) (*memNode, error) {
+	n, ok := fs.nodes[p]
+	if !ok {
+		return nil, memErr(op, p, os.ErrNotExist)
+	}
+	return n, nil
+}
+
+// isChild reports whether p is strictly below dir.
+func isChild(dir, p string) bool {
+	if dir == "/" {
+		return p != "/"
+	}
+	return strings.HasPrefix(p, dir+"/")
+}
+
+func (fs *MemFS) Open(name string) (File, error) {
+	return fs.OpenFile(name, os.O_RDONLY, 0)
+}
+
+func (fs *MemFS) OpenFile(name string, flag int, perm os.FileMode) (File, error) {
+	p := cleanPath(name)
+	fs.mu.Lock()
+	defer fs.mu.Unlock()
+	n, ok := fs.nodes[p]
+	switch {
+	case ok && flag&(os.O_CREATE|os.O_EXCL) == os.O_CREATE|os.O_EXCL:
+		return nil, memErr("open", p, os.ErrExist)
+	case ok && n.dir && flag&(os.O_WRONLY|os.O_RDWR) != 0:
+		return nil, memErr("open", p, os.ErrInvalid)
+	case !ok && flag&os.O_CREATE == 0:
+		return nil, memErr("open", p, os.ErrNotExist)
+	case !ok:
+		parent, err := fs.lookup("open", path.Dir(p))
+		if err != nil {
+			return nil, err
+		}
+		if !parent.dir {
+			return nil, memErr("open", p, os.ErrInvalid)
+		}
+		n = &memNode{name: path.Base(p), mode: perm & os.ModePerm, modTime: time.Now()}
+		fs.nodes[p] = n
+	}
+	if flag&os.O_TRUNC != 0 && !n.dir {
+		n.data = nil
+		n.modTime = time.Now()
+	}
+	return &memFile{fs: fs, node: n, flag: flag}, nil
+}
+
+func (fs *MemFS) Stat(name string) (os.FileInfo, error) {
+	p := cleanPath(name)
+	fs.mu.RLock()
+	defer fs.mu.RUnlock()
+	n, err := fs.lookup("stat", p)
+	if err != nil {
+		return nil, err
+	}
+	return n.info(), nil
+}
+
+// Lstat is Stat: MemFS has no symlinks.
+func (fs *MemFS) Lstat(name string) (os.FileInfo, error) {
+	return fs.Stat(name)
+}
+
+func (fs *MemFS) ReadDir(name string) ([]os.FileInfo, error) {
+	p := cleanPath(name)
+	fs.mu.RLock()
+	defer fs.mu.RUnlock()
+	n, err := fs.lookup("readdir", p)
+	if err != nil {
+		return nil, err
+	}
+	if !n.dir {
+		return nil, memErr("readdir", p, os.ErrInvalid)
+	}
+	var fis []os.FileInfo
+	for child, cn := range fs.nodes {
+		if child != "/" && path.Dir(child) == p {
+			fis = append(fis, cn.info())
+		}
+	}
+	sort.Slice(fis, func(i, j int) bool { return fis[i].Name() < fis[j].Name() })
+	return fis, nil
+}
+
+func (fs *MemFS) MkdirAll(name string, perm os.FileMode) error {
+	p := cleanPath(name)
+	fs.mu.Lock()
+	defer fs.mu.Unlock()
+	var missing []string
+	for dir := p; ; dir = path.Dir(dir) {
+		n, ok := fs.nodes[dir]
+		if ok {
+			if !n.dir {
+				return memErr("mkdir", dir, os.ErrExist)
+			}
+			break
+		}
+		missing = append(missing, dir)
+	}
+	now := time.Now()
+	for _, dir := range missing {
+		fs.nodes[dir] = &memNode{name: path.Base(dir), dir: true, mode: os.ModeDir | perm&os.ModePerm, modTime: now}
+	}
+	return nil
+}
+
+func (fs *MemFS) Remove(name string) error {
+	p := cleanPath(name)
+	fs.mu.Lock()
+	defer fs.mu.Unlock()
+	n, err := fs.lookup("remove", p)
+	if err != nil {
+		return err
+	}
+	if p == "/" {
+		return memErr("remove", p, os.ErrPermission)
+	}
+	if n.dir {
+		for child := range fs.nodes {
+			if isChild(p, child) {
+				return memErr("remove", p, os.ErrExist)
+			}
+		}
+	}
+	delete(fs.nodes, p)
+	return nil
+}
+
+func (fs *MemFS) RemoveAll(name string) error {
+	p := cleanPath(name)
+	if p == "/" {
+		return memErr("removeall", p, os.ErrPermission)
+	}
+	fs.mu.Lock()
+	defer fs.mu.Unlock()
+	for child := range fs.nodes {
+		if child == p || isChild(p, child) {
+			delete(fs.nodes, child)
+		}
+	}
+	return nil
+}
+
+func (fs *MemFS) Rename(oldname, newname string) error {
+	from, to := cleanPath(oldname), cleanPath(newname)
+	fs.mu.Lock()
+	defer fs.mu.Unlock()
+	n, err := fs.lookup("rename", from)
+	if err != nil {
+		return err
+	}
+	if from == "/" || isChild(from, to) {
+		return memErr("rename", from, os.ErrInvalid)
+	}
+	if from == to {
+		return nil
+	}
+	parent, err := fs.lookup("rename", path.Dir(to))
+	if err != nil {
+		return err
+	}
+	if !parent.dir {
+		return memErr("rename", to, os.ErrInvalid)
+	}
+	if existing, ok := fs.nodes[to]; ok && (existing.dir || n.dir) {
+		return memErr("rename", to, os.ErrExist)
+	}
+	for child, cn := range fs.nodes {
+		if isChild(from, child) {
+			delete(fs.nodes, child)
+			fs.nodes[to+strings.TrimPrefix(child, from)] = cn
+		}
+	}
+	delete(fs.nodes, from)
+	n.name = path.Base(to)
+	fs.nodes[to] = n
+	return nil
+}
+
+func (fs *MemFS) Chmod(name string, mode os.FileMode) error {
+	p := cleanPath(name)
+	fs.mu.Lock()
+	defer fs.mu.Unlock()
+	n, err := fs.lookup("chmod", p)
+	if err != nil {
+		return err
+	}
+	n.mode = n.mode&^os.ModePerm | mode&os.ModePerm
+	return nil
+}
+
+func (fs *MemFS) Chtimes(name string, atime, mtime time.Time) error {
+	p := cleanPath(name)
+	fs.mu.Lock()
+	defer fs.mu.Unlock()
+	n, err := fs.lookup("chtimes", p)
+	if err != nil {
+		return err
+	}
+	n.modTime = mtime
+	return nil
+}
+
+// Chown only checks that name exists; MemFS does not track owners.
+func (fs *MemFS) Chown(name string, uid, gid int) error {
+	p := cleanPath(name)
+	fs.mu.RLock()
+	defer fs.mu.RUnlock()
+	_, err := fs.lookup("chown", p)
+	return err
+}
+
+func (fs *MemFS) Truncate(name string, size int64) error {
+	p := cleanPath(name)
+	fs.mu.Lock()
+	defer fs.mu.Unlock()
+	n, err := fs.lookup("truncate", p)
+	if err != nil {
+		return err
+	}
+	if n.dir || size < 0 {
+		return memErr("truncate", p, os.ErrInvalid)
+	}
+	n.truncate(size)
+	return nil
+}
+
+func (n *memNode) truncate(size int64) {
+	if size <= int64(len(n.data)) {
+		n.data = n.data[:size]
+	} else {
+		n.data = append(n.data, make([]byte, size-int64(len(n.data)))...)
+	}
+	n.modTime = time.Now()
+}
+
+func (n *memNode) info() os.FileInfo {
+	mode := n.mode
+	if n.dir {
+		mode |= os.ModeDir
+	}
+	return &fileInfo{name: n.name, size: int64(len(n.data)), mode: mode, modTime: n.modTime}
+}
+
+// memFile is an open handle on a memNode. The node stays valid after a rename
+// or removal, as an open file does on disk.
+type memFile struct {
+	fs   *MemFS
+	node *memNode
+	flag int
+}
+
+func (f *memFile) ReadAt(b []byte, off int64) (int, error) {
+	if f.flag&os.O_WRONLY != 0 {
+		return 0, os.ErrPermission
+	}
+	f.fs.mu.RLock()
+	defer f.fs.mu.RUnlock()
+	if f.node.dir {
+		return 0, os.ErrInvalid
+	}
+	if off >= int64(len(f.node.data)) {
+		return 0, io.EOF
+	}
+	n := copy(b, f.node.data[off:])
+	if n < len(b) {
+		return n, io.EOF
+	}
+	return n, nil
+}
+
+func (f *memFile) WriteAt(b []byte, off int64) (int, error) {
+	if f.flag&(os.O_WRONLY|os.O_RDWR) == 0 {
+		return 0, os.ErrPermission
+	}
+	f.fs.mu.Lock()
+	defer f.fs.mu.Unlock()
+	if f.flag&os.O_APPEND != 0 {
+		off = int64(len(f.node.data))
+	}
+	if end := off + int64(len(b)); end > int64(len(f.node.data)) {
+		f.node.truncate(end)
+	}
+	copy(f.node.data[off:], b)
+	f.node.modTime = time.Now()
+	return len(b), nil
+}
+
+func (f *memFile) Close() error { return nil }
@@ -0,0 +1,373 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"math"
+	"net/http"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/pkg/sftp"
+	"go.uber.org/zap"
+	"golang.org/x/crypto/ssh"
+)
+
+// Metrics are served at /metrics in the Prometheus text format. Label values
+// come from small fixed sets (reasons, auth methods, SFTP methods, error
+// types), never from usernames, addresses or paths, so the number of series
+// stays bounded.
+var (
+	metricConnectionsAccepted = newCounterVec("sftp_connections_accepted_total", "Connections accepted for the SSH handshake.")
+	metricConnectionsRejected = newCounterVec("sftp_connections_rejected_total", "Connections refused, by reason: ip_filter, banned, limit (before the handshake) or user_sessions (at authentication).", "reason")
+	metricHandshakeFailures   = newCounterVec("sftp_handshake_failures_total", "SSH handshakes that failed, by reason: auth, timeout or protocol.", "reason")
+	metricAuthAttempts        = newCounterVec("sftp_auth_attempts_total", "Authentication attempts by method and result (success, partial or failure).", "method", "result")
+	metricOperations          = newCounterVec("sftp_operations_total", "SFTP requests handled, by method.", "method")
+	metricOperationDuration   = newHistogramVec("sftp_operation_duration_seconds", "Time taken to handle SFTP requests, by method. For Get, Put and Open this is opening the file.",
+		[]float64{.001, .005, .01, .025, .05, .1, .25, .5, 1, 2.5, 5, 10}, "method")
+	metricTransferBytes = newCounterVec("sftp_transfer_bytes_total", "File data transferred, by direction: upload or download.", "direction")
+	metricErrors        = newCounterVec("sftp_errors_total", "Failed SFTP requests and file reads and writes, by error type.", "type")
+)
+
+// metricFamily is a metric with all of its series.
+type metricFamily interface {
+	write(w io.Writer)
+}
+
+var (
+	metricFamiliesMu sync.Mutex
+	metricFamilies   []metricFamily
+)
+
+func registerMetric(m metricFamily) {
+	metricFamiliesMu.Lock()
+	defer metricFamiliesMu.Unlock()
+	metricFamilies = append(metricFamilies, m)
+}
+
+// counterVec is a counter with one series per combination of label values.
+type counterVec struct {
+	name, help string
+	labels     []string
+
+	mu     sync.Mutex
+	values map[string]float64 // by labelKey
+}
+
+func newCounterVec(name, help string, labels ...string) *counterVec {
+	c := &counterVec{name: name, help: help, labels: labels, values: map[string]float64{}}
+	registerMetric(c)
+	return c
+}
+
+// add increases the series of the given label values by v.
+func (c *counterVec) add(v float64, values ...string) {
+	key := labelKey(values)
+	c.mu.Lock()
+	c.values[key] += v
+	c.mu.Unlock()
+}
+
+func (c *counterVec) inc(values ...string) {
+	c.add(1, values...)
+}
+
+func (c *counterVec) write(w io.Writer) {
+	fmt.Fprintf(w, "# HELP %s %s\n# TYPE %s counter\n", c.name, c.help, c.name)
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if len(c.labels) == 0 && len(c.values) == 0 {
+		fmt.Fprintf(w, "%s 0\n", c.name)
+	}
+	for _, key := range sortedKeys(c.values) {
+		fmt.Fprintf(w, "%s%s %s\n", c.name, formatLabels(c.labels, key, ""), formatValue(c.values[key]))
+	}
+}
+
+// histogramVec counts observations in cumulative buckets, with one series per
+// combination of label values.
+type histogramVec struct {
+	name, help string
+	buckets    []float64 // upper bounds, ascending
+	labels     []string
+
+	mu     sync.Mutex
+	series map[string]*histogram // by labelKey
+}
+
+type histogram struct {
+	counts []uint64 // per bucket, not cumulative; the last one is +Inf
+	sum    float64
+	count  uint64
+}
+
+func newHistogramVec(name, help string, buckets []float64, labels ...string) *histogramVec {
+	h := &histogramVec{name: name, help: help, buckets: buckets, labels: labels, series: map[string]*histogram{}}
+	registerMetric(h)
+	return h
+}
+
+func (h *histogramVec) observe(v float64, values ...string) {
+	key := labelKey(values)
+	i := sort.SearchFloat64s(h.buckets, v)
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	s := h.series[key]
+	if s == nil {
+		s = &histogram{counts: make([]uint64, len(h.buckets)+1)}
+		h.series[key] = s
+	}
+	s.counts[i]++
+	s.sum += v
+	s.count++
+}
+
+func (h *histogramVec) write(w io.Writer) {
+	fmt.Fprintf(w, "# HELP %s %s\n# TYPE %s histogram\n", h.name, h.help, h.name)
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	for _, key := range sortedKeys(h.series) {
+		s := h.series[key]
+		var cumulative uint64
+		for i, count := range s.counts {
+			cumulative += count
+			le := "+Inf"
+			if i < len(h.buckets) {
+				le = formatValue(h.buckets[i])
+			}
+			fmt.Fprintf(w, "%s_bucket%s %d\n", h.name, formatLabels(h.labels, key, le), cumulative)
+		}
+		fmt.Fprintf(w, "%s_sum%s %s\n", h.name, formatLabels(h.labels, key, ""), formatValue(s.sum))
+		fmt.Fprintf(w, "%s_count%s %d\n", h.name, formatLabels(h.labels, key, ""), s.count)
+	}
+}
+
+// gaugeFunc is a gauge whose value is read when metrics are scraped.
+type gaugeFunc struct {
+	name, help string
+	value      func() float64
+}
+
+func registerGaugeFunc(name, help string, value func() float64) {
+	registerMetric(&gaugeFunc{name: name, help: help, value: value})
+}
+
+func (g *gaugeFunc) write(w io.Writer) {
+	fmt.Fprintf(w, "# HELP %s %s\n# TYPE %s gauge\n%s %s\n", g.name, g.help, g.name, g.name, formatValue(g.value()))
+}
+
+// labelKey joins label values into a map key. The separator cannot appear in
+// valid UTF-8.
+func labelKey(values []string) string {
+	return strings.Join(values, "\xff")
+}
+
+func sortedKeys[V any](m map[string]V) []string {
+	keys := make([]string, 0, len(m))
+	for k := range m {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	return keys
+}
+
+// formatLabels renders the label set of a series, with le appended for
+// histogram buckets if it is not empty.
+func formatLabels(names []string, key, le string) string {
+	var pairs []string
+	if len(names) > 0 {
+		for i, v := range strings.Split(key, "\xff") {
+			pairs = append(pairs, names[i]+`="`+escapeLabelValue(v)+`"`)
+		}
+	}
+	if le != "" {
+		pairs = append(pairs, `le="`+le+`"`)
+	}
+	if len(pairs) == 0 {
+		return ""
+	}
+	return "{" + strings.Join(pairs, ",") + "}"
+}
+
+func escapeLabelValue(v string) string {
+	return strings.NewReplacer(`\`, `\\`, `"`, `\"`, "\n", `\n`).Replace(v)
+}
+
+func formatValue(v float64) string {
+	switch {
+	case math.IsInf(v, 1):
+		return "+Inf"
+	case math.IsInf(v, -1):
+		return "-Inf"
+	}
+	return strconv.FormatFloat(v, 'g', -1, 64)
+}
+
+// writeMetrics writes every registered metric in the Prometheus text format.
+func writeMetrics(w io.Writer) {
+	metricFamiliesMu.Lock()
+	families := append([]metricFamily(nil), metricFamilies...)
+	metricFamiliesMu.Unlock()
+	for _, m := range families {
+		m.write(w)
+	}
+}
+
+// startMetrics serves /metrics on METRICS_LISTEN_ADDR, if set.
+func startMetrics(sessions *sessionRegistry, logger *zap.SugaredLogger) (*http.Server, error) {
+	addr := getEnvOrDefault("METRICS_LISTEN_ADDR", "")
+	if addr == "" {
+		return nil, nil
+	}
+	registerGaugeFunc("sftp_sessions_active", "Open SSH sessions.", func() float64 { return float64(sessions.count()) })
+	mux := http.NewServeMux()
+	mux.HandleFunc("GET /metrics", func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "text/plain; version=0.0.4; charset=utf-8")
+		writeMetrics(w)
+	})
+	srv := &http.Server{
+		Addr:              addr,
+		Handler:           mux,
+		ReadHeaderTimeout: 10 * time.Second,
+	}
+	listener, err := listen("metrics", addr)
+	if err != nil {
+		return nil, err
+	}
+	go func() {
+		if err := srv.Serve(listener); err != nil && !errors.Is(err, http.ErrServerClosed) {
+			logger.Errorf("Metrics endpoint stopped: %v", err)
+		}
+	}()
+	logger.Infof("Metrics listening on http://%s/metrics", listener.Addr())
+	return srv, nil
+}
+
+// authMethodLabel maps the method of an authentication attempt, which the
+// client names, to a bounded label value.
+func authMethodLabel(method string) string {
+	switch method {
+	case "none", "password", "publickey", "keyboard-interactive":
+		return method
+	}
+	return "other"
+}
+
+// authResultLabel classifies the outcome of an authentication attempt.
+func authResultLabel(err error) string {
+	var partial *ssh.PartialSuccessError
+	switch {
+	case err == nil:
+		return "success"
+	case errors.As(err, &partial):
+		return "partial"
+	}
+	return "failure"
+}
+
+// handshakeFailureLabel classifies the error of a failed SSH handshake.
+func handshakeFailureLabel(err error) string {
+	var authErr *ssh.ServerAuthError
+	switch {
+	case errors.Is(err, os.ErrDeadlineExceeded):
+		return "timeout"
+	case errors.As(err, &authErr):
+		return "auth"
+	}
+	return "protocol"
+}
+
+// errorTypeLabel classifies an error returned to an SFTP client.
+func errorTypeLabel(err error) string {
+	switch {
+	case errors.Is(err, os.ErrPermission):
+		return "permission_denied"
+	case errors.Is(err, os.ErrNotExist):
+		return "not_found"
+	case errors.Is(err, os.ErrExist):
+		return "already_exists"
+	case errors.Is(err, errQuotaExceeded):
+		return "quota_exceeded"
+	case errors.Is(err, sftp.ErrSSHFxOpUnsupported):
+		return "unsupported"
+	case errors.Is(err, os.ErrInvalid):
+		return "invalid"
+	}
+	return "other"
+}
+
+// instrumentedHandler records the requests handled by h. It forwards each
+// handler interface SftpHandler implements; a new one needs adding here too.
+type instrumentedHandler struct {
+	h *SftpHandler
+}
+
+var (
+	_ sftp.OpenFileWriter   = instrumentedHandler{}
+	_ sftp.StatVFSFileCmder = instrumentedHandler{}
+	_ sftp.LstatFileLister  = instrumentedHandler{}
+)
+
+// observeRequest records a request with the given method started at start.
+// Methods are the fixed names the request server gives them.
+func observeRequest(method string, start time.Time, err error) {
+	metricOperations.inc(method)
+	metricOperationDuration.observe(time.Since(start).Seconds(), method)
+	if err != nil {
+		metricErrors.inc(errorTypeLabel(err))
+	}
+}
+
+func (m instrumentedHandler) Fileread(r *sftp.Request) (io.ReaderAt, error) {
+	start := time.Now()
+	file, err := m.h.Fileread(r)
+	observeRequest(r.Method, start, err)
+	return file, err
+}
+
+func (m instrumentedHandler) Filewrite(r *sftp.Request) (io.WriterAt, error) {
+	start := time.Now()
+	file, err := m.h.Filewrite(r)
+	observeRequest(r.Method, start, err)
+	return file, err
+}
+
+func (m instrumentedHandler) OpenFile(r *sftp.Request) (sftp.WriterAtReaderAt, error) {
+	start := time.Now()
+	file, err := m.h.OpenFile(r)
+	observeRequest(r.Method, start, err)
+	return file, err
+}
+
+func (m instrumentedHandler) Filecmd(r *sftp.Request) error {
+	start := time.Now()
+	err := m.h.Filecmd(r)
+	observeRequest(r.Method, start, err)
+	return err
+}
+
+func (m instrumentedHandler) StatVFS(r *sftp.Request) (*sftp.StatVFS, error) {
+	start := time.Now()
+	st, err := m.h.StatVFS(r)
+	observeRequest("StatVFS", start, err)
+	return st, err
+}
+
+func (m instrumentedHandler) Filelist(r *sftp.Request) (sftp.ListerAt, error) {
+	start := time.Now()
+	lister, err := m.h.Filelist(r)
+	observeRequest(r.Method, start, err)
+	return lister, err
+}
+
+func (m instrumentedHandler) Lstat(r *sftp.Request) (sftp.ListerAt, error) {
+	start := time.Now()
+	lister, err := m.h.Lstat(r)
+	observeRequest(r.Method, start, err)
+	return lister, err
+}
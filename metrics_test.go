@@ -0,0 +1,62 @@
+package main
+
+import (
+	"bytes"
+	"testing"
+)
+
+func TestWriteMetrics(t *testing.T) {
+	metricFamiliesMu.Lock()
+	saved := metricFamilies
+	metricFamilies = nil
+	metricFamiliesMu.Unlock()
+	t.Cleanup(func() {
+		metricFamiliesMu.Lock()
+		metricFamilies = saved
+		metricFamiliesMu.Unlock()
+	})
+
+	newCounterVec("test_idle_total", "A counter nothing was added to.")
+	newCounterVec("test_unused_total", "A labelled counter nothing was added to.", "reason")
+	requests := newCounterVec("test_requests_total", "Requests by method and result.", "method", "result")
+	requests.inc("Get", "ok")
+	requests.add(2.5, "Get", "ok")
+	requests.inc("Put", `quote " backslash \ newline`+"\n")
+	duration := newHistogramVec("test_duration_seconds", "Durations.", []float64{.1, 1}, "method")
+	for _, v := range []float64{.05, .1, .5, 3} {
+		duration.observe(v, "Get")
+	}
+	duration.observe(.5, "Put")
+	registerGaugeFunc("test_open", "Open things.", func() float64 { return 3 })
+
+	var buf bytes.Buffer
+	writeMetrics(&buf)
+	want := `# HELP test_idle_total A counter nothing was added to.
+# TYPE test_idle_total counter
+test_idle_total 0
+# HELP test_unused_total A labelled counter nothing was added to.
+# TYPE test_unused_total counter
+# HELP test_requests_total Requests by method and result.
+# TYPE test_requests_total counter
+test_requests_total{method="Get",result="ok"} 3.5
+test_requests_total{method="Put",result="quote \" backslash \\ newline\n"} 1
+# HELP test_duration_seconds Durations.
+# TYPE test_duration_seconds histogram
+test_duration_seconds_bucket{method="Get",le="0.1"} 2
+test_duration_seconds_bucket{method="Get",le="1"} 3
+test_duration_seconds_bucket{method="Get",le="+Inf"} 4
+test_duration_seconds_sum{method="Get"} 3.65
+test_duration_seconds_count{method="Get"} 4
+test_duration_seconds_bucket{method="Put",le="0.1"} 0
+test_duration_seconds_bucket{method="Put",le="1"} 1
+test_duration_seconds_bucket{method="Put",le="+Inf"} 1
+test_duration_seconds_sum{method="Put"} 0.5
+test_duration_seconds_count{method="Put"} 1
+# HELP test_open Open things.
+# TYPE test_open gauge
+test_open 3
+`
+	if got := buf.String(); got != want {
+		t.Errorf("writeMetrics wrote\n%s\nwant\n%s", got, want)
+	}
+}
@@ -0,0 +1,373 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"embed"
+	"fmt"
+	"io/fs"
+	"path"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// migrationFiles holds the schema as numbered scripts, one directory per
+// DB_TYPE (e.g. migrations/sqlite/0002_nullable_user_perms.sql). They are
+// applied in version order and recorded in schema_migrations. Published
+// migrations are never edited; schema changes go in a new one.
+//
+//go:embed migrations
+var migrationFiles embed.FS
+
+// Keys of the postgres advisory lock and the MySQL named lock held while migrating.
+const (
+	migrationLockID   = 0x76736674 // "vsft"
+	migrationLockName = "v-sftp.schema_migrations"
+)
+
+// Migration is one versioned schema change.
+type Migration struct {
+	Version int
+	Name    string
+	SQL     string
+}
+
+func (m Migration) String() string {
+	return fmt.Sprintf("%04d_%s", m.Version, m.Name)
+}
+
+// MigrationStatus is a known or recorded migration and when it was applied.
+// Migrations recorded in the database but missing from this build (written by
+// a newer version) have no SQL.
+type MigrationStatus struct {
+	Migration
+	AppliedAt sql.NullTime
+}
+
+// loadMigrations returns the embedded migrations for d ordered by version.
+func loadMigrations(d dialect) ([]Migration, error) {
+	dir := path.Join("migrations", string(d))
+	entries, err := fs.ReadDir(migrationFiles, dir)
+	if err != nil {
+		return nil, fmt.Errorf("no migrations for database type %q", d)
+	}
+	var migrations []Migration
+	for _, e := range entries {
+		base, ok := strings.CutSuffix(e.Name(), ".sql")
+		if e.IsDir() || !ok {
+			continue
+		}
+		num, name, _ := strings.Cut(base, "_")
+		version, err := strconv.Atoi(num)
+		if err != nil || version <= 0 {
+			return nil, fmt.Errorf("migration %s: name must start with a positive version number", e.Name())
+		}
+		b, err := migrationFiles.ReadFile(path.Join(dir, e.Name()))
+		if err != nil {
+			return nil, err
+		}
+		migrations = append(migrations, Migration{Version: version, Name: name, SQL: string(b)})
+	}
+	sort.Slice(migrations, func(i, j int) bool { return migrations[i].Version < migrations[j].Version })
+	for i := 1; i < len(migrations); i++ {
+		if migrations[i].Version == migrations[i-1].Version {
+			return nil, fmt.Errorf("migrations %s and %s share a version", migrations[i-1], migrations[i])
+		}
+	}
+	return migrations, nil
+}
+
+// migrationsTableExists reports whether schema_migrations has been created.
+func (s *UserStore) migrationsTableExists(ctx context.Context, q querier) (bool, error) {
+	var n int
+	err := q.QueryRowContext(ctx, s.dialect.tableExistsQuery(), "schema_migrations").Scan(&n)
+	return n > 0, err
+}
+
+// querier is a database, connection or transaction to run statements on, such
+// as the migration connection or a transaction on it.
+type querier interface {
+	ExecContext(ctx context.Context, query string, args ...any) (sql.Result, error)
+	QueryContext(ctx context.Context, query string, args ...any) (*sql.Rows, error)
+	QueryRowContext(ctx context.Context, query string, args ...any) *sql.Row
+}
+
+// MigrationStatus lists every migration, applied or not, by version. It does
+// not modify the database.
+func (s *UserStore) MigrationStatus(ctx context.Context) ([]MigrationStatus, error) {
+	migrations, err := loadMigrations(s.dialect)
+	if err != nil {
+		return nil, err
+	}
+	byVersion := make(map[int]*MigrationStatus, len(migrations))
+	for _, m := range migrations {
+		byVersion[m.Version] = &MigrationStatus{Migration: m}
+	}
+	exists, err := s.migrationsTableExists(ctx, s.db)
+	if err != nil {
+		return nil, err
+	}
+	if exists {
+		rows, err := s.db.QueryContext(ctx, `SELECT version, name, applied_at FROM schema_migrations`)
+		if err != nil {
+			return nil, err
+		}
+		defer rows.Close()
+		for rows.Next() {
+			var version int
+			var name string
+			var appliedAt time.Time
+			if err := rows.Scan(&version, &name, &appliedAt); err != nil {
+				return nil, err
+			}
+			st, ok := byVersion[version]
+			if !ok {
+				st = &MigrationStatus{Migration: Migration{Version: version, Name: name}}
+				byVersion[version] = st
+			}
+			st.AppliedAt = sql.NullTime{Time: appliedAt, Valid: true}
+		}
+		if err := rows.Err(); err != nil {
+			return nil, err
+		}
+	}
+	statuses := make([]MigrationStatus, 0, len(byVersion))
+	for _, st := range byVersion {
+		statuses = append(statuses, *st)
+	}
+	sort.Slice(statuses, func(i, j int) bool { return statuses[i].Version < statuses[j].Version })
+	return statuses, nil
+}
+
+// PendingMigrations returns the migrations of this build not yet applied.
+func (s *UserStore) PendingMigrations(ctx context.Context) ([]Migration, error) {
+	statuses, err := s.MigrationStatus(ctx)
+	if err != nil {
+		return nil, err
+	}
+	var pending []Migration
+	for _, st := range statuses {
+		if !st.AppliedAt.Valid {
+			pending = append(pending, st.Migration)
+		}
+	}
+	return pending, nil
+}
+
+// Migrate applies the pending migrations in order, each in its own transaction,
+// and returns those it applied. Instances migrating the same database at once
+// wait for each other: postgres and MySQL take a named lock for the whole run
+// and SQLite takes the write lock (BEGIN IMMEDIATE) for each migration,
+// checking again that it is still pending once it holds it. MySQL commits DDL
+// implicitly, so its migrations must be safe to run again after a failure.
+func (s *UserStore) Migrate(ctx context.Context) ([]Migration, error) {
+	migrations, err := loadMigrations(s.dialect)
+	if err != nil {
+		return nil, err
+	}
+	// Locks and pragmas are per connection, so pin one
+	conn, err := s.db.Conn(ctx)
+	if err != nil {
+		return nil, err
+	}
+	defer conn.Close()
+
+	checkForeignKeys := false
+	switch s.dialect {
+	case dialectSQLite:
+		if _, err := conn.ExecContext(ctx, `PRAGMA busy_timeout = 30000`); err != nil {
+			return nil, err
+		}
+		// Rebuilding a table, SQLite's way to alter a column, must not cascade
+		// to the rows referencing it; the pragma has no effect inside a transaction.
+		if err := conn.QueryRowContext(ctx, `PRAGMA foreign_keys`).Scan(&checkForeignKeys); err != nil {
+			return nil, err
+		}
+		if checkForeignKeys {
+			if _, err := conn.ExecContext(ctx, `PRAGMA foreign_keys = OFF`); err != nil {
+				return nil, err
+			}
+			defer conn.ExecContext(context.Background(), `PRAGMA foreign_keys = ON`)
+		}
+	case dialectPostgres:
+		if _, err := conn.ExecContext(ctx, `SELECT pg_advisory_lock($1)`, migrationLockID); err != nil {
+			return nil, fmt.Errorf("locking schema_migrations: %w", err)
+		}
+		defer conn.ExecContext(context.Background(), `SELECT pg_advisory_unlock($1)`, migrationLockID)
+	case dialectMySQL:
+		var locked sql.NullInt64
+		if err := conn.QueryRowContext(ctx, `SELECT GET_LOCK(?, 300)`, migrationLockName).Scan(&locked); err != nil {
+			return nil, fmt.Errorf("locking schema_migrations: %w", err)
+		}
+		if locked.Int64 != 1 {
+			return nil, fmt.Errorf("locking schema_migrations: timed out waiting for another instance")
+		}
+		defer conn.ExecContext(context.Background(), `SELECT RELEASE_LOCK(?)`, migrationLockName)
+	}
+
+	if _, err := conn.ExecContext(ctx, fmt.Sprintf(`CREATE TABLE IF NOT EXISTS schema_migrations (
+  version INTEGER PRIMARY KEY,
+  name TEXT NOT NULL,
+  applied_at %s NOT NULL
+)`, s.dialect.timestampType())); err != nil {
+		return nil, fmt.Errorf("creating schema_migrations: %w", err)
+	}
+
+	var applied []Migration
+	for _, m := range migrations {
+		ok, err := s.applyMigration(ctx, conn, m, checkForeignKeys)
+		if err != nil {
+			return applied, fmt.Errorf("migration %s: %w", m, err)
+		}
+		if ok {
+			s.logger.Infof("Applied migration %s", m)
+			applied = append(applied, m)
+		}
+	}
+	return applied, nil
+}
+
+// applyMigration runs m in a transaction on conn and records it, unless it has
+// already been applied.
+func (s *UserStore) applyMigration(ctx context.Context, conn *sql.Conn, m Migration, checkForeignKeys bool) (bool, error) {
+	var q querier
+	var commit func() error
+	var rollback func()
+	if s.dialect == dialectSQLite {
+		if _, err := conn.ExecContext(ctx, `BEGIN IMMEDIATE`); err != nil {
+			return false, err
+		}
+		q = conn
+		commit = func() error {
+			_, err := conn.ExecContext(ctx, `COMMIT`)
+			return err
+		}
+		rollback = func() { conn.ExecContext(context.Background(), `ROLLBACK`) }
+	} else {
+		tx, err := conn.BeginTx(ctx, nil)
+		if err != nil {
+			return false, err
+		}
+		q, commit, rollback = tx, tx.Commit, func() { tx.Rollback() }
+	}
+
+	var n int
+	err := q.QueryRowContext(ctx, fmt.Sprintf(`SELECT COUNT(*) FROM schema_migrations WHERE version = %s`, s.placeholder(1)), m.Version).Scan(&n)
+	if err != nil || n > 0 {
+		rollback()
+		return false, err
+	}
+	// The MySQL driver runs one statement per call
+	statements := []string{m.SQL}
+	if s.dialect == dialectMySQL {
+		statements = splitStatements(m.SQL)
+	}
+	for _, stmt := range statements {
+		if _, err := q.ExecContext(ctx, stmt); err != nil {
+			rollback()
+			return false, err
+		}
+	}
+	if checkForeignKeys {
+		if err := foreignKeyCheck(ctx, q); err != nil {
+			rollback()
+			return false, err
+		}
+	}
+	insert := fmt.Sprintf(`INSERT INTO schema_migrations (version, name, applied_at) VALUES (%s, %s, %s)`,
+		s.placeholder(1), s.placeholder(2), s.placeholder(3))
+	if _, err := q.ExecContext(ctx, insert, m.Version, m.Name, time.Now().UTC()); err != nil {
+		rollback()
+		return false, err
+	}
+	if err := commit(); err != nil {
+		rollback()
+		return false, err
+	}
+	return true, nil
+}
+
+// splitStatements splits a script on the semicolons that end its statements,
+// skipping those in quotes and comments. Parts holding only comments are
+// dropped, as the server rejects them as empty queries.
+func splitStatements(script string) []string {
+	var statements []string
+	var quote byte
+	start, content := 0, false
+	for i := 0; i < len(script); i++ {
+		c := script[i]
+		switch {
+		case quote != 0:
+			if c == '\\' && quote != '`' {
+				i++ // MySQL escapes quotes with backslashes too
+			} else if c == quote {
+				quote = 0
+			}
+		case c == '\'' || c == '"' || c == '`':
+			quote, content = c, true
+		case c == '-' && strings.HasPrefix(script[i:], "--"), c == '#':
+			if end := strings.IndexByte(script[i:], '\n'); end >= 0 {
+				i += end
+			} else {
+				i = len(script)
+			}
+		case c == '/' && strings.HasPrefix(script[i:], "/*"):
+			if end := strings.Index(script[i+2:], "*/"); end >= 0 {
+				i += end + 3
+			} else {
+				i = len(script)
+			}
+		case c == ';':
+			if content {
+				statements = append(statements, strings.TrimSpace(script[start:i]))
+			}
+			start, content = i+1, false
+		case c != ' ' && c != '\t' && c != '\r' && c != '\n':
+			content = true
+		}
+	}
+	if content {
+		statements = append(statements, strings.TrimSpace(script[start:]))
+	}
+	return statements
+}
+
+// foreignKeyCheck fails if the SQLite database has rows whose foreign keys
+// point nowhere, which a migration run with enforcement off could leave.
+func foreignKeyCheck(ctx context.Context, q querier) error {
+	rows, err := q.QueryContext(ctx, `PRAGMA foreign_key_check`)
+	if err != nil {
+		return err
+	}
+	defer rows.Close()
+	if rows.Next() {
+		return fmt.Errorf("foreign key violations after migrating (see PRAGMA foreign_key_check)")
+	}
+	return rows.Err()
+}
+
+// ensureSchema migrates the database at startup, or with autoMigrate off (set
+// by DB_AUTO_MIGRATE) only verifies that nothing is pending, leaving upgrades
+// to `v-sftp migrate up`.
+func (s *UserStore) ensureSchema(ctx context.Context, autoMigrate bool) error {
+	if autoMigrate {
+		applied, err := s.Migrate(ctx)
+		if err != nil {
+			return err
+		}
+		if len(applied) == 0 {
+			s.logger.Infof("Database schema is up to date")
+		}
+		return nil
+	}
+	pending, err := s.PendingMigrations(ctx)
+	if err != nil {
+		return err
+	}
+	if len(pending) > 0 {
+		return fmt.Errorf("%d pending migration(s), starting with %s; run `v-sftp migrate up`", len(pending), pending[0])
+	}
+	return nil
+}
@@ -0,0 +1,150 @@
+package main
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+
+	"go.uber.org/zap"
+)
+
+func TestSplitStatements(t *testing.T) {
+	tests := []struct {
+		name   string
+		script string
+		want   []string
+	}{
+		{"plain", "CREATE TABLE a (x INT);\nCREATE TABLE b (y INT);\n", []string{"CREATE TABLE a (x INT)", "CREATE TABLE b (y INT)"}},
+		{"no final semicolon", "SELECT 1;\nSELECT 2", []string{"SELECT 1", "SELECT 2"}},
+		{"single quotes", "INSERT INTO t VALUES ('a;b');SELECT 1;", []string{"INSERT INTO t VALUES ('a;b')", "SELECT 1"}},
+		{"doubled quote", "INSERT INTO t VALUES ('it''s;');SELECT 1;", []string{"INSERT INTO t VALUES ('it''s;')", "SELECT 1"}},
+		{"backslash quote", `INSERT INTO t VALUES ('it\'s;');SELECT 1;`, []string{`INSERT INTO t VALUES ('it\'s;')`, "SELECT 1"}},
+		{"double quotes and backticks", "SELECT \"a;\", `b;c` FROM t;", []string{"SELECT \"a;\", `b;c` FROM t"}},
+		{"line comment", "SELECT 1; -- not; a statement\nSELECT 2;", []string{"SELECT 1", "-- not; a statement\nSELECT 2"}},
+		{"hash comment", "SELECT 1; # not; a statement\nSELECT 2;", []string{"SELECT 1", "# not; a statement\nSELECT 2"}},
+		{"block comment", "SELECT /* a; b */ 1;", []string{"SELECT /* a; b */ 1"}},
+		{"quote in comment", "-- don't\nSELECT 1;", []string{"-- don't\nSELECT 1"}},
+		{"column comment", "CREATE TABLE t (\n  scope VARCHAR(16), -- 'user'; or 'group'\n  x INT\n);", []string{"CREATE TABLE t (\n  scope VARCHAR(16), -- 'user'; or 'group'\n  x INT\n)"}},
+		{"comments only", "-- header\n;\n/* nothing */;\n-- trailer\n", nil},
+		{"trailing comment", "SELECT 1;\n-- done", []string{"SELECT 1"}},
+		{"empty statements", ";;\n;", nil},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := splitStatements(tt.script); !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("splitStatements(%q) = %q, want %q", tt.script, got, tt.want)
+			}
+		})
+	}
+}
+
+func TestLoadMigrations(t *testing.T) {
+	var versions [][]int
+	for _, d := range []dialect{dialectSQLite, dialectPostgres, dialectMySQL} {
+		migrations, err := loadMigrations(d)
+		if err != nil {
+			t.Fatalf("%s: %v", d, err)
+		}
+		var v []int
+		for i, m := range migrations {
+			if m.Version != i+1 {
+				t.Errorf("%s: migration %s, want version %d", d, m, i+1)
+			}
+			if m.SQL == "" {
+				t.Errorf("%s: migration %s is empty", d, m)
+			}
+			v = append(v, m.Version)
+		}
+		versions = append(versions, v)
+	}
+	// every database gets every schema change
+	if !reflect.DeepEqual(versions[0], versions[1]) || !reflect.DeepEqual(versions[0], versions[2]) {
+		t.Errorf("migration versions differ between databases: %v", versions)
+	}
+}
+
+// testMigrate migrates the empty database at dsn, checks that nothing is left
+// pending and that a second run applies nothing. MySQL migrations must also
+// run again over their own result, as after a failure halfway.
+func testMigrate(t *testing.T, d dialect, dsn string) {
+	db, err := d.open(dsn)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+	s := &UserStore{dialect: d, db: db, logger: zap.NewNop().Sugar()}
+	ctx := context.Background()
+
+	want, err := loadMigrations(d)
+	if err != nil {
+		t.Fatal(err)
+	}
+	applied, err := s.Migrate(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(applied) != len(want) {
+		t.Errorf("applied %v, want %v", applied, want)
+	}
+	pending, err := s.PendingMigrations(ctx)
+	if err != nil || len(pending) > 0 {
+		t.Errorf("pending after migrating: %v, %v", pending, err)
+	}
+	statuses, err := s.MigrationStatus(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, st := range statuses {
+		if !st.AppliedAt.Valid {
+			t.Errorf("migration %s not recorded", st.Migration)
+		}
+	}
+	if applied, err = s.Migrate(ctx); err != nil || len(applied) > 0 {
+		t.Errorf("second run applied %v, %v", applied, err)
+	}
+	if err := s.ensureSchema(ctx, false); err != nil {
+		t.Errorf("ensureSchema: %v", err)
+	}
+	if d == dialectMySQL {
+		if _, err := db.ExecContext(ctx, `DELETE FROM schema_migrations`); err != nil {
+			t.Fatal(err)
+		}
+		if applied, err = s.Migrate(ctx); err != nil || len(applied) != len(want) {
+			t.Errorf("rerun applied %v, %v; want %v", applied, err, want)
+		}
+	}
+}
+
+func TestMigrateSQLite(t *testing.T) {
+	testMigrate(t, dialectSQLite, filepath.Join(t.TempDir(), "sftp.db"))
+}
+
+func TestMigratePostgres(t *testing.T) {
+	dsn := os.Getenv("POSTGRES_TEST_DSN")
+	if dsn == "" {
+		t.Skip("POSTGRES_TEST_DSN not set")
+	}
+	testMigrate(t, dialectPostgres, dsn)
+}
+
+func TestMigrateMySQL(t *testing.T) {
+	dsn := os.Getenv("MYSQL_TEST_DSN")
+	if dsn == "" {
+		t.Skip("MYSQL_TEST_DSN not set")
+	}
+	testMigrate(t, dialectMySQL, dsn)
+}
+
+func TestEnsureSchemaReportsPending(t *testing.T) {
+	db, err := dialectSQLite.open(filepath.Join(t.TempDir(), "sftp.db"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+	s := &UserStore{dialect: dialectSQLite, db: db, logger: zap.NewNop().Sugar()}
+	if err := s.ensureSchema(context.Background(), false); err == nil {
+		t.Error("ensureSchema without migrating accepted an empty database")
+	}
+}
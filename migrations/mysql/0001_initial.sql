@@ -0,0 +1,110 @@
+-- MySQL 8 / MariaDB 10.3 or newer. Tables use a binary collation so names and
+-- paths compare case-sensitively, as on SQLite and PostgreSQL; indexed columns
+-- are VARCHAR because TEXT cannot be UNIQUE or have a default.
+CREATE TABLE IF NOT EXISTS sftp_users (
+  id INT AUTO_INCREMENT PRIMARY KEY,
+  display_name TEXT NOT NULL,
+  group_name VARCHAR(255) NOT NULL,
+  username VARCHAR(255) UNIQUE NOT NULL,
+  password_hash TEXT,        -- bcrypt hash; nullable if using key auth only
+  public_key TEXT,           -- optional: authorized public key (openssh format)
+  root_path TEXT NOT NULL,   -- absolute path on host; empty: the group's root_template or BASE_FS_ROOT/<username>
+  perms INT,                 -- bitmask: 1=Read,2=List,4=Write,8=Delete; finer bits in README. NULL: the group's perms
+  disabled BOOLEAN DEFAULT FALSE,
+  created_at DATETIME DEFAULT CURRENT_TIMESTAMP
+) DEFAULT CHARSET = utf8mb4 COLLATE = utf8mb4_bin;
+
+CREATE TABLE IF NOT EXISTS sftp_user_keys (
+  id INT AUTO_INCREMENT PRIMARY KEY,
+  user_id INT NOT NULL,
+  public_key TEXT NOT NULL,  -- authorized public key (openssh format)
+  comment TEXT,
+  enabled BOOLEAN DEFAULT TRUE,
+  expires_at DATETIME,       -- optional: key is rejected after this time
+  last_used_at DATETIME,
+  created_at DATETIME DEFAULT CURRENT_TIMESTAMP,
+  FOREIGN KEY (user_id) REFERENCES sftp_users(id) ON DELETE CASCADE
+) DEFAULT CHARSET = utf8mb4 COLLATE = utf8mb4_bin;
+
+CREATE TABLE IF NOT EXISTS sftp_user_totp (
+  user_id INT PRIMARY KEY,
+  secret TEXT NOT NULL,                  -- base32 RFC 6238 secret
+  after_password BOOLEAN DEFAULT TRUE,   -- require a code after password auth
+  after_publickey BOOLEAN DEFAULT FALSE, -- require a code after public key/certificate auth
+  last_used_step BIGINT,                 -- last accepted time step (replay protection)
+  created_at DATETIME DEFAULT CURRENT_TIMESTAMP,
+  FOREIGN KEY (user_id) REFERENCES sftp_users(id) ON DELETE CASCADE
+) DEFAULT CHARSET = utf8mb4 COLLATE = utf8mb4_bin;
+
+CREATE TABLE IF NOT EXISTS sftp_user_recovery_codes (
+  id INT AUTO_INCREMENT PRIMARY KEY,
+  user_id INT NOT NULL,
+  code_hash TEXT NOT NULL,   -- bcrypt hash of a one-time recovery code
+  used_at DATETIME,
+  created_at DATETIME DEFAULT CURRENT_TIMESTAMP,
+  FOREIGN KEY (user_id) REFERENCES sftp_users(id) ON DELETE CASCADE
+) DEFAULT CHARSET = utf8mb4 COLLATE = utf8mb4_bin;
+
+CREATE TABLE IF NOT EXISTS sftp_bans (
+  id INT AUTO_INCREMENT PRIMARY KEY,
+  kind VARCHAR(16) NOT NULL,    -- 'ip' or 'user'
+  value VARCHAR(255) NOT NULL,  -- IP address or username
+  reason TEXT,
+  strikes INT NOT NULL DEFAULT 1, -- number of bans so far; drives escalation
+  banned_until DATETIME NOT NULL,
+  created_at DATETIME DEFAULT CURRENT_TIMESTAMP,
+  UNIQUE (kind, value)
+) DEFAULT CHARSET = utf8mb4 COLLATE = utf8mb4_bin;
+
+CREATE TABLE IF NOT EXISTS sftp_ip_rules (
+  id INT AUTO_INCREMENT PRIMARY KEY,
+  scope VARCHAR(16) NOT NULL,  -- 'user' or 'group'
+  name VARCHAR(255) NOT NULL,  -- username or group_name the rule applies to
+  action VARCHAR(16) NOT NULL, -- 'allow' or 'deny'
+  cidr VARCHAR(64) NOT NULL,   -- IPv4/IPv6 network (e.g. 203.0.113.0/24, 2001:db8::/32) or single address
+  created_at DATETIME DEFAULT CURRENT_TIMESTAMP
+) DEFAULT CHARSET = utf8mb4 COLLATE = utf8mb4_bin;
+
+CREATE TABLE IF NOT EXISTS sftp_user_storage (
+  user_id INT PRIMARY KEY,
+  backend VARCHAR(16),                     -- 'local', 'memory' or 's3'; NULL: FS_BACKEND
+  upload_mode VARCHAR(16),                 -- 'direct' or 'atomic'; NULL: UPLOAD_MODE
+  endpoint VARCHAR(255) NOT NULL DEFAULT '', -- s3: host[:port] of the S3 API
+  region VARCHAR(64),
+  bucket VARCHAR(255) NOT NULL DEFAULT '',
+  prefix VARCHAR(1024) NOT NULL DEFAULT '',  -- key prefix the user's root maps to
+  access_key TEXT,                         -- null: use AWS_*/MINIO_* environment credentials
+  secret_key TEXT,
+  use_ssl BOOLEAN NOT NULL DEFAULT TRUE,
+  created_at DATETIME DEFAULT CURRENT_TIMESTAMP,
+  FOREIGN KEY (user_id) REFERENCES sftp_users(id) ON DELETE CASCADE
+) DEFAULT CHARSET = utf8mb4 COLLATE = utf8mb4_bin;
+
+CREATE TABLE IF NOT EXISTS sftp_quotas (
+  id INT AUTO_INCREMENT PRIMARY KEY,
+  scope VARCHAR(16) NOT NULL,  -- 'user' or 'group'; a user row overrides the group's
+  name VARCHAR(255) NOT NULL,  -- username or group_name the quota applies to
+  max_bytes BIGINT,            -- total size of the user's files; NULL: unlimited
+  max_files BIGINT,            -- number of files; NULL: unlimited
+  created_at DATETIME DEFAULT CURRENT_TIMESTAMP,
+  UNIQUE (scope, name)
+) DEFAULT CHARSET = utf8mb4 COLLATE = utf8mb4_bin;
+
+CREATE TABLE IF NOT EXISTS sftp_path_perms (
+  id INT AUTO_INCREMENT PRIMARY KEY,
+  scope VARCHAR(16) NOT NULL,  -- 'user' or 'group'
+  name VARCHAR(255) NOT NULL,  -- username or group_name the entry applies to
+  path VARCHAR(255) NOT NULL,  -- virtual path prefix, e.g. /inbox; covers everything below it
+  perms INT NOT NULL,          -- bitmask as in sftp_users.perms; the longest matching path wins
+  created_at DATETIME DEFAULT CURRENT_TIMESTAMP,
+  UNIQUE (scope, name, path)
+) DEFAULT CHARSET = utf8mb4 COLLATE = utf8mb4_bin;
+
+CREATE TABLE IF NOT EXISTS sftp_groups (
+  id INT AUTO_INCREMENT PRIMARY KEY,
+  name VARCHAR(255) UNIQUE NOT NULL, -- matched against sftp_users.group_name
+  description TEXT,
+  perms INT,                 -- default perms of members whose perms is NULL
+  root_template TEXT,        -- default root of members with an empty root_path, e.g. /srv/sftp/{group}/{username}
+  created_at DATETIME DEFAULT CURRENT_TIMESTAMP
+) DEFAULT CHARSET = utf8mb4 COLLATE = utf8mb4_bin;
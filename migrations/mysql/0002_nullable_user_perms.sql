@@ -0,0 +1,4 @@
+-- Let sftp_users.perms be NULL so users can take their group's perms. Already
+-- the case for databases created by 0001; kept so versions match the other
+-- dialects.
+ALTER TABLE sftp_users MODIFY perms INT NULL;
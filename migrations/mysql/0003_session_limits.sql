@@ -0,0 +1,12 @@
+-- Per-user and per-group session timeouts. Each column left NULL falls back to
+-- the group's row, then to the server-wide setting; 0 disables the timeout.
+CREATE TABLE IF NOT EXISTS sftp_session_limits (
+  id INT AUTO_INCREMENT PRIMARY KEY,
+  scope VARCHAR(16) NOT NULL,   -- 'user' or 'group'
+  name VARCHAR(255) NOT NULL,   -- username or group_name the limits apply to
+  idle_timeout INT,             -- seconds without SFTP requests before the session is closed; NULL: IDLE_TIMEOUT
+  keepalive_interval INT,       -- seconds between keepalive requests to the client; NULL: KEEPALIVE_INTERVAL
+  max_session_time INT,         -- seconds a connection may stay open; NULL: MAX_SESSION_TIME
+  created_at DATETIME DEFAULT CURRENT_TIMESTAMP,
+  UNIQUE (scope, name)
+) DEFAULT CHARSET = utf8mb4 COLLATE = utf8mb4_bin;
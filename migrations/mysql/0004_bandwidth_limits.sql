@@ -0,0 +1,12 @@
+-- Per-user and per-group bandwidth limits in bytes per second, shared by all
+-- sessions of a user. Each column left NULL falls back to the group's row,
+-- then to UPLOAD_RATE_LIMIT / DOWNLOAD_RATE_LIMIT; 0 is unlimited.
+CREATE TABLE IF NOT EXISTS sftp_bandwidth_limits (
+  id INT AUTO_INCREMENT PRIMARY KEY,
+  scope VARCHAR(16) NOT NULL,   -- 'user' or 'group'
+  name VARCHAR(255) NOT NULL,   -- username or group_name the limits apply to
+  upload_rate BIGINT,           -- bytes per second; NULL: the group's, then UPLOAD_RATE_LIMIT; 0: unlimited
+  download_rate BIGINT,         -- bytes per second; NULL: the group's, then DOWNLOAD_RATE_LIMIT; 0: unlimited
+  created_at DATETIME DEFAULT CURRENT_TIMESTAMP,
+  UNIQUE (scope, name)
+) DEFAULT CHARSET = utf8mb4 COLLATE = utf8mb4_bin;
@@ -0,0 +1,103 @@
+CREATE TABLE IF NOT EXISTS sftp_users (
+  id SERIAL PRIMARY KEY,
+  display_name TEXT NOT NULL,
+  group_name TEXT NOT NULL,
+  username TEXT UNIQUE NOT NULL,
+  password_hash TEXT,        -- bcrypt hash; nullable if using key auth only
+  public_key TEXT,           -- optional: authorized public key (openssh format)
+  root_path TEXT NOT NULL,   -- absolute path on host; empty: the group's root_template or BASE_FS_ROOT/<username>
+  perms INTEGER,             -- bitmask: 1=Read,2=List,4=Write,8=Delete; finer bits in README. NULL: the group's perms
+  disabled BOOLEAN DEFAULT FALSE,
+  created_at TIMESTAMP DEFAULT now()
+);
+
+CREATE TABLE IF NOT EXISTS sftp_user_keys (
+  id SERIAL PRIMARY KEY,
+  user_id INTEGER NOT NULL REFERENCES sftp_users(id) ON DELETE CASCADE,
+  public_key TEXT NOT NULL,  -- authorized public key (openssh format)
+  comment TEXT,
+  enabled BOOLEAN DEFAULT TRUE,
+  expires_at TIMESTAMP,      -- optional: key is rejected after this time
+  last_used_at TIMESTAMP,
+  created_at TIMESTAMP DEFAULT now()
+);
+
+CREATE TABLE IF NOT EXISTS sftp_user_totp (
+  user_id INTEGER PRIMARY KEY REFERENCES sftp_users(id) ON DELETE CASCADE,
+  secret TEXT NOT NULL,                  -- base32 RFC 6238 secret
+  after_password BOOLEAN DEFAULT TRUE,   -- require a code after password auth
+  after_publickey BOOLEAN DEFAULT FALSE, -- require a code after public key/certificate auth
+  last_used_step BIGINT,                 -- last accepted time step (replay protection)
+  created_at TIMESTAMP DEFAULT now()
+);
+
+CREATE TABLE IF NOT EXISTS sftp_user_recovery_codes (
+  id SERIAL PRIMARY KEY,
+  user_id INTEGER NOT NULL REFERENCES sftp_users(id) ON DELETE CASCADE,
+  code_hash TEXT NOT NULL,   -- bcrypt hash of a one-time recovery code
+  used_at TIMESTAMP,
+  created_at TIMESTAMP DEFAULT now()
+);
+
+CREATE TABLE IF NOT EXISTS sftp_bans (
+  id SERIAL PRIMARY KEY,
+  kind TEXT NOT NULL,         -- 'ip' or 'user'
+  value TEXT NOT NULL,        -- IP address or username
+  reason TEXT,
+  strikes INTEGER NOT NULL DEFAULT 1, -- number of bans so far; drives escalation
+  banned_until TIMESTAMP NOT NULL,
+  created_at TIMESTAMP DEFAULT now(),
+  UNIQUE (kind, value)
+);
+
+CREATE TABLE IF NOT EXISTS sftp_ip_rules (
+  id SERIAL PRIMARY KEY,
+  scope TEXT NOT NULL,       -- 'user' or 'group'
+  name TEXT NOT NULL,        -- username or group_name the rule applies to
+  action TEXT NOT NULL,      -- 'allow' or 'deny'
+  cidr TEXT NOT NULL,        -- IPv4/IPv6 network (e.g. 203.0.113.0/24, 2001:db8::/32) or single address
+  created_at TIMESTAMP DEFAULT now()
+);
+
+CREATE TABLE IF NOT EXISTS sftp_user_storage (
+  user_id INTEGER PRIMARY KEY REFERENCES sftp_users(id) ON DELETE CASCADE,
+  backend TEXT,                       -- 'local', 'memory' or 's3'; NULL: FS_BACKEND
+  upload_mode TEXT,                   -- 'direct' or 'atomic'; NULL: UPLOAD_MODE
+  endpoint TEXT NOT NULL DEFAULT '',  -- s3: host[:port] of the S3 API
+  region TEXT,
+  bucket TEXT NOT NULL DEFAULT '',
+  prefix TEXT NOT NULL DEFAULT '',    -- key prefix the user's root maps to
+  access_key TEXT,                    -- null: use AWS_*/MINIO_* environment credentials
+  secret_key TEXT,
+  use_ssl BOOLEAN NOT NULL DEFAULT TRUE,
+  created_at TIMESTAMP DEFAULT now()
+);
+
+CREATE TABLE IF NOT EXISTS sftp_quotas (
+  id SERIAL PRIMARY KEY,
+  scope TEXT NOT NULL,       -- 'user' or 'group'; a user row overrides the group's
+  name TEXT NOT NULL,        -- username or group_name the quota applies to
+  max_bytes BIGINT,          -- total size of the user's files; NULL: unlimited
+  max_files BIGINT,          -- number of files; NULL: unlimited
+  created_at TIMESTAMP DEFAULT now(),
+  UNIQUE (scope, name)
+);
+
+CREATE TABLE IF NOT EXISTS sftp_path_perms (
+  id SERIAL PRIMARY KEY,
+  scope TEXT NOT NULL,       -- 'user' or 'group'
+  name TEXT NOT NULL,        -- username or group_name the entry applies to
+  path TEXT NOT NULL,        -- virtual path prefix, e.g. /inbox; covers everything below it
+  perms INTEGER NOT NULL,    -- bitmask as in sftp_users.perms; the longest matching path wins
+  created_at TIMESTAMP DEFAULT now(),
+  UNIQUE (scope, name, path)
+);
+
+CREATE TABLE IF NOT EXISTS sftp_groups (
+  id SERIAL PRIMARY KEY,
+  name TEXT UNIQUE NOT NULL, -- matched against sftp_users.group_name
+  description TEXT,
+  perms INTEGER,             -- default perms of members whose perms is NULL
+  root_template TEXT,        -- default root of members with an empty root_path, e.g. /srv/sftp/{group}/{username}
+  created_at TIMESTAMP DEFAULT now()
+);
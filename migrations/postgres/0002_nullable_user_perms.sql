@@ -0,0 +1,2 @@
+-- Let sftp_users.perms be NULL so users can take their group's perms.
+ALTER TABLE sftp_users ALTER COLUMN perms DROP NOT NULL;
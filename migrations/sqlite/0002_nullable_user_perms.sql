@@ -0,0 +1,23 @@
+-- Let sftp_users.perms be NULL so users can take their group's perms. SQLite
+-- cannot drop a NOT NULL constraint, so the table is rebuilt; the runner turns
+-- foreign key enforcement off meanwhile, which keeps the rows of tables that
+-- reference sftp_users.
+CREATE TABLE sftp_users_new (
+  id INTEGER PRIMARY KEY AUTOINCREMENT,
+  display_name TEXT NOT NULL,
+  group_name TEXT NOT NULL,
+  username TEXT UNIQUE NOT NULL,
+  password_hash TEXT,        -- bcrypt hash; nullable if using key auth only
+  public_key TEXT,           -- optional: authorized public key (openssh format)
+  root_path TEXT NOT NULL,   -- absolute path on host; empty: the group's root_template or BASE_FS_ROOT/<username>
+  perms INTEGER,             -- bitmask: 1=Read,2=List,4=Write,8=Delete; finer bits in README. NULL: the group's perms
+  disabled BOOLEAN DEFAULT 0,
+  created_at DATETIME DEFAULT CURRENT_TIMESTAMP
+);
+
+INSERT INTO sftp_users_new (id, display_name, group_name, username, password_hash, public_key, root_path, perms, disabled, created_at)
+  SELECT id, display_name, group_name, username, password_hash, public_key, root_path, perms, disabled, created_at FROM sftp_users;
+
+DROP TABLE sftp_users;
+
+ALTER TABLE sftp_users_new RENAME TO sftp_users;
@@ -0,0 +1,12 @@
+-- Per-user and per-group session timeouts. Each column left NULL falls back to
+-- the group's row, then to the server-wide setting; 0 disables the timeout.
+CREATE TABLE IF NOT EXISTS sftp_session_limits (
+  id INTEGER PRIMARY KEY AUTOINCREMENT,
+  scope TEXT NOT NULL,          -- 'user' or 'group'
+  name TEXT NOT NULL,           -- username or group_name the limits apply to
+  idle_timeout INTEGER,         -- seconds without SFTP requests before the session is closed; NULL: IDLE_TIMEOUT
+  keepalive_interval INTEGER,   -- seconds between keepalive requests to the client; NULL: KEEPALIVE_INTERVAL
+  max_session_time INTEGER,     -- seconds a connection may stay open; NULL: MAX_SESSION_TIME
+  created_at DATETIME DEFAULT CURRENT_TIMESTAMP,
+  UNIQUE (scope, name)
+);
@@ -0,0 +1,53 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"strings"
+
+	"go.uber.org/zap"
+	"golang.org/x/crypto/bcrypt"
+	"golang.org/x/crypto/ssh"
+)
+
+// UserProvider is the source of SFTP accounts and their credentials. The SQL
+// UserStore is the default implementation; LDAPUserProvider serves accounts
+// from a directory. State owned by the server itself (keys usage, TOTP, bans,
+// IP rules) always stays in the SQL store.
+type UserProvider interface {
+	// FetchUserByUsername returns the account or an error if it does not exist.
+	FetchUserByUsername(ctx context.Context, username string) (*User, error)
+	// CheckPassword returns nil if password is valid for user.
+	CheckPassword(ctx context.Context, user *User, password []byte) error
+	// MatchUserKey returns the user's active key equal to key. Keys that do not
+	// come from sftp_user_keys are reported with a zero ID.
+	MatchUserKey(ctx context.Context, user *User, key ssh.PublicKey) (*UserKey, error)
+}
+
+// CheckPassword implements UserProvider using the bcrypt hash in sftp_users.
+func (s *UserStore) CheckPassword(ctx context.Context, user *User, password []byte) error {
+	if !user.PasswordHash.Valid {
+		return fmt.Errorf("no password set")
+	}
+	//use bcrypt to compare password
+	if err := bcrypt.CompareHashAndPassword([]byte(user.PasswordHash.String), password); err != nil {
+		return fmt.Errorf("invalid password")
+	}
+	return nil
+}
+
+// newUserProvider selects the account backend from USER_PROVIDER (sql or ldap).
+func newUserProvider(store *UserStore, logger *zap.SugaredLogger) (UserProvider, error) {
+	switch kind := strings.ToLower(getEnvOrDefault("USER_PROVIDER", "sql")); kind {
+	case "sql":
+		return store, nil
+	case "ldap":
+		config, err := newLDAPConfigFromEnv()
+		if err != nil {
+			return nil, err
+		}
+		return NewLDAPUserProvider(config, logger)
+	default:
+		return nil, fmt.Errorf("unknown USER_PROVIDER %q", kind)
+	}
+}
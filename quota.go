@@ -0,0 +1,322 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+	"os"
+	"path"
+	"sync"
+	"time"
+
+	"go.uber.org/zap"
+)
+
+// Quota scopes stored in sftp_quotas.
+const (
+	QuotaScopeUser  = "user"
+	QuotaScopeGroup = "group"
+)
+
+// errQuotaExceeded is returned to the client as SSH_FX_FAILURE with this message.
+var errQuotaExceeded = errors.New("quota exceeded")
+
+// Quota limits the total size and number of files in a user's root. A null
+// limit means unlimited.
+type Quota struct {
+	MaxBytes sql.NullInt64
+	MaxFiles sql.NullInt64
+}
+
+// FetchQuota returns the user's quota: their own row in sftp_quotas if there is
+// one, otherwise their group's, otherwise nil. A group quota applies to each
+// member separately.
+func (s *UserStore) FetchQuota(ctx context.Context, user *User) (*Quota, error) {
+	query := fmt.Sprintf(`SELECT scope, max_bytes, max_files FROM sftp_quotas WHERE (scope = 'user' AND name = %s) OR (scope = 'group' AND name = %s)`,
+		s.placeholder(1), s.placeholder(2))
+	rows, err := s.db.QueryContext(ctx, query, user.Username, user.GroupName)
+	if err != nil {
+		s.logger.Errorf("Error fetching quota: %v", err)
+		return nil, err
+	}
+	defer rows.Close()
+	var userQuota, groupQuota *Quota
+	for rows.Next() {
+		var scope string
+		var q Quota
+		if err := rows.Scan(&scope, &q.MaxBytes, &q.MaxFiles); err != nil {
+			return nil, err
+		}
+		if scope == QuotaScopeUser {
+			userQuota = &q
+		} else {
+			groupQuota = &q
+		}
+	}
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+	if userQuota != nil {
+		return userQuota, nil
+	}
+	return groupQuota, nil
+}
+
+// quotaUsage is the space used by one user, shared by all of their sessions.
+// It is counted once when the first session starts, then kept up to date by
+// the handlers and corrected by periodic rescans. A nil *quotaUsage means the
+// user has no quota and nothing is tracked.
+type quotaUsage struct {
+	username string
+	logger   *zap.SugaredLogger
+	refs     int // sessions using it, guarded by quotaUsagesMu
+
+	mu      sync.Mutex
+	limit   Quota
+	fs      FileSystem
+	scanned bool
+	bytes   int64
+	files   int64
+}
+
+var (
+	quotaUsagesMu sync.Mutex
+	quotaUsages   = map[string]*quotaUsage{}
+)
+
+// acquireQuotaUsage returns the usage of user, whose root is fs, scanning it if
+// no other session of the user is open. Call release when the session ends.
+func acquireQuotaUsage(user *User, limit Quota, fs FileSystem, logger *zap.SugaredLogger) (*quotaUsage, error) {
+	quotaUsagesMu.Lock()
+	u, ok := quotaUsages[user.Username]
+	if !ok {
+		u = &quotaUsage{username: user.Username, logger: logger}
+		quotaUsages[user.Username] = u
+	}
+	u.refs++
+	quotaUsagesMu.Unlock()
+
+	u.mu.Lock()
+	defer u.mu.Unlock()
+	u.limit = limit
+	u.fs = fs
+	if !u.scanned {
+		bytes, files, err := diskUsage(fs, "/")
+		if err != nil {
+			u.release()
+			return nil, fmt.Errorf("scanning usage of %s: %w", user.Username, err)
+		}
+		u.bytes, u.files, u.scanned = bytes, files, true
+		logger.Debugf("Usage of %s: %d bytes in %d files", user.Username, bytes, files)
+	}
+	return u, nil
+}
+
+// release drops a session's reference; the usage is forgotten with the last one.
+func (u *quotaUsage) release() {
+	if u == nil {
+		return
+	}
+	quotaUsagesMu.Lock()
+	defer quotaUsagesMu.Unlock()
+	if u.refs--; u.refs == 0 && quotaUsages[u.username] == u {
+		delete(quotaUsages, u.username)
+	}
+}
+
+// reserve adds to the usage, or returns errQuotaExceeded if an increase would
+// go over a limit. Decreases always succeed.
+func (u *quotaUsage) reserve(bytes, files int64) error {
+	if u == nil {
+		return nil
+	}
+	u.mu.Lock()
+	defer u.mu.Unlock()
+	if bytes > 0 && u.limit.MaxBytes.Valid && u.bytes+bytes > u.limit.MaxBytes.Int64 {
+		return errQuotaExceeded
+	}
+	if files > 0 && u.limit.MaxFiles.Valid && u.files+files > u.limit.MaxFiles.Int64 {
+		return errQuotaExceeded
+	}
+	u.addLocked(bytes, files)
+	return nil
+}
+
+// adjust adds to the usage without checking the limits.
+func (u *quotaUsage) adjust(bytes, files int64) {
+	if u == nil {
+		return
+	}
+	u.mu.Lock()
+	defer u.mu.Unlock()
+	u.addLocked(bytes, files)
+}
+
+func (u *quotaUsage) addLocked(bytes, files int64) {
+	u.bytes = max(u.bytes+bytes, 0)
+	u.files = max(u.files+files, 0)
+}
+
+// snapshot returns the current usage and limits.
+func (u *quotaUsage) snapshot() (bytes, files int64, limit Quota) {
+	u.mu.Lock()
+	defer u.mu.Unlock()
+	return u.bytes, u.files, u.limit
+}
+
+// currentQuotaUsage returns the tracked usage of a user with an open session.
+func currentQuotaUsage(username string) (bytes, files int64, ok bool) {
+	quotaUsagesMu.Lock()
+	u, ok := quotaUsages[username]
+	quotaUsagesMu.Unlock()
+	if !ok {
+		return 0, 0, false
+	}
+	bytes, files, _ = u.snapshot()
+	return bytes, files, true
+}
+
+// rescan recounts the usage from the filesystem to correct drift, e.g. from
+// changes made outside the server or interrupted transfers.
+func (u *quotaUsage) rescan() error {
+	u.mu.Lock()
+	fs := u.fs
+	u.mu.Unlock()
+	bytes, files, err := diskUsage(fs, "/")
+	if err != nil {
+		return err
+	}
+	u.mu.Lock()
+	defer u.mu.Unlock()
+	if bytes != u.bytes || files != u.files {
+		u.logger.Debugf("Usage of %s corrected from %d bytes in %d files to %d bytes in %d files", u.username, u.bytes, u.files, bytes, files)
+	}
+	u.bytes, u.files = bytes, files
+	return nil
+}
+
+// runQuotaScans rescans the usage of every user with an open session until stop is closed.
+func runQuotaScans(interval time.Duration, logger *zap.SugaredLogger, stop <-chan struct{}) {
+	if interval <= 0 {
+		return
+	}
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+		case <-stop:
+			return
+		}
+		quotaUsagesMu.Lock()
+		usages := make([]*quotaUsage, 0, len(quotaUsages))
+		for _, u := range quotaUsages {
+			usages = append(usages, u)
+		}
+		quotaUsagesMu.Unlock()
+		for _, u := range usages {
+			if err := u.rescan(); err != nil {
+				logger.Errorf("Failed to rescan usage of %s: %v", u.username, err)
+			}
+		}
+	}
+}
+
+// diskUsage returns the total size and number of files under name. Directories
+// are not counted, nor are temporary files of atomic uploads in progress,
+// which the handlers account to the file being uploaded.
+func diskUsage(fs FileSystem, name string) (bytes, files int64, err error) {
+	fi, err := fs.Stat(name)
+	if err != nil {
+		return 0, 0, err
+	}
+	if !fi.IsDir() {
+		return fi.Size(), 1, nil
+	}
+	entries, err := fs.ReadDir(name)
+	if err != nil {
+		return 0, 0, err
+	}
+	for _, e := range entries {
+		switch {
+		case e.IsDir():
+			b, f, err := diskUsage(fs, path.Join(name, e.Name()))
+			if err != nil && !os.IsNotExist(err) {
+				return 0, 0, err
+			}
+			bytes += b
+			files += f
+		case !isUploadTemp(e.Name()):
+			bytes += e.Size()
+			files++
+		}
+	}
+	return bytes, files, nil
+}
+
+// quotaFile charges the growth of a file open for writing to the user's usage
+// and fails writes that would go over the quota.
+type quotaFile struct {
+	File
+	usage *quotaUsage
+
+	mu   sync.Mutex
+	size int64
+
+	// Atomic uploads and backends with atomic writes only: a failed Close
+	// means the upload was discarded and the previous file, replaced bytes
+	// long, is still in place.
+	atomic   bool
+	created  bool
+	replaced int64
+}
+
+func (f *quotaFile) WriteAt(b []byte, off int64) (int, error) {
+	f.mu.Lock()
+	oldSize, end := f.size, off+int64(len(b))
+	if end > oldSize {
+		if err := f.usage.reserve(end-oldSize, 0); err != nil {
+			f.mu.Unlock()
+			// make an atomic upload discard the file rather than keep it truncated
+			f.TransferError(err)
+			return 0, err
+		}
+		f.size = end
+	}
+	f.mu.Unlock()
+	n, err := f.File.WriteAt(b, off)
+	if err != nil && end > oldSize {
+		f.mu.Lock()
+		// Give back what was not written, unless a later write has grown the
+		// file past end and so still covers it.
+		if f.size == end {
+			f.size = max(off+int64(n), oldSize)
+			f.usage.adjust(f.size-end, 0)
+		}
+		f.mu.Unlock()
+	}
+	return n, err
+}
+
+// TransferError passes the notification on to the wrapped file.
+func (f *quotaFile) TransferError(err error) {
+	if te, ok := f.File.(interface{ TransferError(error) }); ok {
+		te.TransferError(err)
+	}
+}
+
+func (f *quotaFile) Close() error {
+	err := f.File.Close()
+	if err != nil && f.atomic {
+		f.mu.Lock()
+		size := f.size
+		f.mu.Unlock()
+		var files int64
+		if f.created {
+			files = -1
+		}
+		f.usage.adjust(f.replaced-size, files)
+	}
+	return err
+}
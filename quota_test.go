@@ -0,0 +1,187 @@
+package main
+
+import (
+	"database/sql"
+	"errors"
+	"os"
+	"testing"
+)
+
+// shortFile writes at most limit bytes in total, then fails.
+type shortFile struct {
+	File
+	limit int
+}
+
+var errDiskFull = errors.New("disk full")
+
+func (f *shortFile) WriteAt(b []byte, off int64) (int, error) {
+	if len(b) > f.limit {
+		n := f.limit
+		f.limit = 0
+		return n, errDiskFull
+	}
+	f.limit -= len(b)
+	return len(b), nil
+}
+
+func TestQuotaReserve(t *testing.T) {
+	u := &quotaUsage{limit: Quota{MaxBytes: sql.NullInt64{Int64: 100, Valid: true}, MaxFiles: sql.NullInt64{Int64: 2, Valid: true}}}
+	if err := u.reserve(60, 1); err != nil {
+		t.Fatal(err)
+	}
+	if err := u.reserve(41, 0); !errors.Is(err, errQuotaExceeded) {
+		t.Errorf("reserve over max bytes = %v", err)
+	}
+	if err := u.reserve(0, 2); !errors.Is(err, errQuotaExceeded) {
+		t.Errorf("reserve over max files = %v", err)
+	}
+	if err := u.reserve(40, 1); err != nil {
+		t.Errorf("reserve up to the limits = %v", err)
+	}
+	if err := u.reserve(-10, -1); err != nil {
+		t.Errorf("decrease = %v", err)
+	}
+	u.adjust(-200, -5)
+	if bytes, files, _ := u.snapshot(); bytes != 0 || files != 0 {
+		t.Errorf("usage went negative: %d bytes, %d files", bytes, files)
+	}
+	var none *quotaUsage
+	if err := none.reserve(1<<40, 1<<20); err != nil {
+		t.Errorf("nil usage reserve = %v", err)
+	}
+}
+
+func TestQuotaFileWriteError(t *testing.T) {
+	tests := []struct {
+		name      string
+		size      int64 // before the write
+		limit     int   // bytes the file accepts
+		off       int64
+		len       int
+		wantBytes int64 // usage after the write
+		wantSize  int64
+	}{
+		{"nothing written", 0, 0, 0, 10, 0, 0},
+		{"partly written", 0, 4, 0, 10, 4, 4},
+		{"past the end", 5, 3, 10, 10, 13, 13},
+		{"partly within the file", 10, 2, 5, 10, 10, 10},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			u := &quotaUsage{bytes: tt.size, limit: Quota{MaxBytes: sql.NullInt64{Int64: 100, Valid: true}}}
+			f := &quotaFile{File: &shortFile{limit: tt.limit}, usage: u, size: tt.size}
+			if _, err := f.WriteAt(make([]byte, tt.len), tt.off); !errors.Is(err, errDiskFull) {
+				t.Fatalf("WriteAt = %v, want %v", err, errDiskFull)
+			}
+			if bytes, _, _ := u.snapshot(); bytes != tt.wantBytes {
+				t.Errorf("usage %d bytes, want %d", bytes, tt.wantBytes)
+			}
+			if f.size != tt.wantSize {
+				t.Errorf("size %d, want %d", f.size, tt.wantSize)
+			}
+		})
+	}
+}
+
+// gatedFile fails writes at offset 0 once failed is closed and accepts
+// every other write.
+type gatedFile struct {
+	File
+	started, failed chan struct{}
+}
+
+func (f *gatedFile) WriteAt(b []byte, off int64) (int, error) {
+	if off == 0 {
+		close(f.started)
+		<-f.failed
+		return 0, errDiskFull
+	}
+	return len(b), nil
+}
+
+func TestQuotaFileWriteErrorAfterLaterWrite(t *testing.T) {
+	u := &quotaUsage{limit: Quota{MaxBytes: sql.NullInt64{Int64: 100, Valid: true}}}
+	file := &gatedFile{started: make(chan struct{}), failed: make(chan struct{})}
+	f := &quotaFile{File: file, usage: u}
+	done := make(chan error)
+	go func() {
+		_, err := f.WriteAt(make([]byte, 10), 0)
+		done <- err
+	}()
+	<-file.started
+	// a later write grows the file past the failing one, whose bytes it keeps
+	if _, err := f.WriteAt(make([]byte, 10), 10); err != nil {
+		t.Fatal(err)
+	}
+	close(file.failed)
+	if err := <-done; !errors.Is(err, errDiskFull) {
+		t.Fatalf("WriteAt = %v, want %v", err, errDiskFull)
+	}
+	if bytes, _, _ := u.snapshot(); bytes != 20 || f.size != 20 {
+		t.Errorf("usage %d bytes, size %d; want 20, 20", bytes, f.size)
+	}
+}
+
+// closeFailFS is a filesystem whose files fail to close, like an S3 upload
+// whose multipart upload cannot be completed.
+type closeFailFS struct {
+	*MemFS
+	atomicWrites bool
+}
+
+func (fs *closeFailFS) AtomicWrites() bool { return fs.atomicWrites }
+
+func (fs *closeFailFS) OpenFile(name string, flag int, perm os.FileMode) (File, error) {
+	f, err := fs.MemFS.OpenFile(name, flag, perm)
+	if err != nil {
+		return nil, err
+	}
+	return &closeFailFile{f}, nil
+}
+
+type closeFailFile struct{ File }
+
+func (f *closeFailFile) Close() error {
+	f.File.Close()
+	return errDiskFull
+}
+
+func TestQuotaFileCloseError(t *testing.T) {
+	tests := []struct {
+		name         string
+		atomicWrites bool
+		existing     bool
+		wantBytes    int64
+		wantFiles    int64
+	}{
+		{"atomic writes, new file", true, false, 4, 1},
+		{"atomic writes, replaced file", true, true, 4, 1},
+		// written in place, so the bytes are there
+		{"direct writes, new file", false, false, 14, 2},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			files := map[string]string{"/kept": "kept"}
+			if tt.existing {
+				files = map[string]string{"/upload": "kept"}
+			}
+			h, mem := newTestHandler(t, allPerms, nil, files)
+			h.fs = &closeFailFS{MemFS: mem, atomicWrites: tt.atomicWrites}
+			h.quota = &quotaUsage{bytes: 4, files: 1, limit: Quota{MaxBytes: sql.NullInt64{Int64: 100, Valid: true}}}
+			f, err := h.openWrite("/upload", os.O_WRONLY|os.O_CREATE|os.O_TRUNC)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if _, err := f.WriteAt(make([]byte, 10), 0); err != nil {
+				t.Fatal(err)
+			}
+			if err := f.Close(); !errors.Is(err, errDiskFull) {
+				t.Fatalf("Close = %v, want %v", err, errDiskFull)
+			}
+			if bytes, files, _ := h.quota.snapshot(); bytes != tt.wantBytes || files != tt.wantFiles {
+				t.Errorf("usage %d bytes in %d files, want %d in %d", bytes, files, tt.wantBytes, tt.wantFiles)
+			}
+		})
+	}
+}
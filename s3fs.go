@@ -0,0 +1,583 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/minio/minio-go/v7"
+	"github.com/minio/minio-go/v7/pkg/credentials"
+	"go.uber.org/zap"
+)
+
+const (
+	// s3PartSize is the multipart upload part size. S3 requires at least 5 MiB
+	// for every part but the last.
+	s3PartSize = 8 << 20
+	// s3MaxPending bounds how much out-of-order upload data is held back while
+	// waiting for the missing earlier bytes.
+	s3MaxPending  = 64 << 20
+	s3ReadAhead   = 1 << 20
+	s3MaxCopySize = 5 << 30
+)
+
+// s3ListPage is the number of keys asked for per list request; tests lower it.
+var s3ListPage = 1000
+
+// S3FS serves a user's root from a bucket prefix on S3 or an S3-compatible
+// service such as MinIO. Directories are key prefixes; MkdirAll stores an empty
+// "<dir>/" marker object so that empty directories survive.
+type S3FS struct {
+	core   minio.Core
+	bucket string
+	prefix string // "" or "some/prefix/"
+	logger *zap.SugaredLogger
+}
+
+// NewS3FS connects to the endpoint in storage. Without stored credentials the
+// standard AWS_*/MINIO_* environment variables are used.
+func NewS3FS(storage *UserStorage, logger *zap.SugaredLogger) (*S3FS, error) {
+	if storage.Endpoint == "" || storage.Bucket == "" {
+		return nil, fmt.Errorf("s3 storage for user %d needs an endpoint and a bucket", storage.UserID)
+	}
+	creds := credentials.NewChainCredentials([]credentials.Provider{&credentials.EnvAWS{}, &credentials.EnvMinio{}})
+	if storage.AccessKey.Valid {
+		creds = credentials.NewStaticV4(storage.AccessKey.String, storage.SecretKey.String, "")
+	}
+	client, err := minio.New(storage.Endpoint, &minio.Options{
+		Creds:        creds,
+		Secure:       storage.UseSSL,
+		Region:       storage.Region.String,
+		BucketLookup: minio.BucketLookupPath,
+	})
+	if err != nil {
+		return nil, err
+	}
+	prefix := strings.Trim(storage.Prefix, "/")
+	if prefix != "" {
+		prefix += "/"
+	}
+	return &S3FS{core: minio.Core{Client: client}, bucket: storage.Bucket, prefix: prefix, logger: logger}, nil
+}
+
+// key maps an SFTP path to its object key.
+func (fs *S3FS) key(p string) string {
+	return fs.prefix + strings.TrimPrefix(cleanPath(p), "/")
+}
+
+// dirPrefix is the key prefix of the entries of directory p.
+func (fs *S3FS) dirPrefix(p string) string {
+	if cleanPath(p) == "/" {
+		return fs.prefix
+	}
+	return fs.key(p) + "/"
+}
+
+func s3Err(op, name string, err error) error {
+	switch minio.ToErrorResponse(err).Code {
+	case "NoSuchKey", "NotFound":
+		err = os.ErrNotExist
+	case "AccessDenied":
+		err = os.ErrPermission
+	}
+	return &os.PathError{Op: op, Path: name, Err: err}
+}
+
+// list calls fn for every page of keys under prefix, following continuation tokens.
+func (fs *S3FS) list(ctx context.Context, prefix, delimiter string, fn func(minio.ListBucketV2Result) (bool, error)) error {
+	token := ""
+	for {
+		res, err := fs.core.ListObjectsV2(fs.bucket, prefix, "", token, delimiter, s3ListPage)
+		if err != nil {
+			return err
+		}
+		more, err := fn(res)
+		if err != nil || !more || !res.IsTruncated || res.NextContinuationToken == "" {
+			return err
+		}
+		token = res.NextContinuationToken
+		if ctx.Err() != nil {
+			return ctx.Err()
+		}
+	}
+}
+
+// hasEntries reports whether anything other than the directory marker exists under prefix.
+func (fs *S3FS) hasEntries(prefix string, ignoreMarker bool) (bool, error) {
+	res, err := fs.core.ListObjectsV2(fs.bucket, prefix, "", "", "/", 2)
+	if err != nil {
+		return false, err
+	}
+	if len(res.CommonPrefixes) > 0 {
+		return true, nil
+	}
+	for _, obj := range res.Contents {
+		if !ignoreMarker || obj.Key != prefix {
+			return true, nil
+		}
+	}
+	return false, nil
+}
+
+func (fs *S3FS) Stat(name string) (os.FileInfo, error) {
+	p := cleanPath(name)
+	if p == "/" {
+		return &fileInfo{name: "/", mode: os.ModeDir | 0755}, nil
+	}
+	ctx := context.Background()
+	obj, err := fs.core.StatObject(ctx, fs.bucket, fs.key(p), minio.StatObjectOptions{})
+	if err == nil {
+		return &fileInfo{name: path.Base(p), size: obj.Size, mode: 0644, modTime: obj.LastModified}, nil
+	}
+	if err := s3Err("stat", p, err); !os.IsNotExist(err) {
+		return nil, err
+	}
+	found, err := fs.hasEntries(fs.dirPrefix(p), false)
+	if err != nil {
+		return nil, s3Err("stat", p, err)
+	}
+	if !found {
+		return nil, &os.PathError{Op: "stat", Path: p, Err: os.ErrNotExist}
+	}
+	return &fileInfo{name: path.Base(p), mode: os.ModeDir | 0755}, nil
+}
+
+// AtomicWrites reports that uploads only become visible when closed.
+func (fs *S3FS) AtomicWrites() bool { return true }
+
+// Lstat is Stat: object storage has no symlinks.
+func (fs *S3FS) Lstat(name string) (os.FileInfo, error) {
+	return fs.Stat(name)
+}
+
+func (fs *S3FS) ReadDir(name string) ([]os.FileInfo, error) {
+	p := cleanPath(name)
+	if p != "/" {
+		fi, err := fs.Stat(p)
+		if err != nil {
+			return nil, err
+		}
+		if !fi.IsDir() {
+			return nil, &os.PathError{Op: "readdir", Path: p, Err: os.ErrInvalid}
+		}
+	}
+	prefix := fs.dirPrefix(p)
+	var fis []os.FileInfo
+	err := fs.list(context.Background(), prefix, "/", func(res minio.ListBucketV2Result) (bool, error) {
+		for _, cp := range res.CommonPrefixes {
+			fis = append(fis, &fileInfo{name: strings.TrimSuffix(strings.TrimPrefix(cp.Prefix, prefix), "/"), mode: os.ModeDir | 0755})
+		}
+		for _, obj := range res.Contents {
+			if obj.Key == prefix {
+				continue // directory marker
+			}
+			fis = append(fis, &fileInfo{name: strings.TrimPrefix(obj.Key, prefix), size: obj.Size, mode: 0644, modTime: obj.LastModified})
+		}
+		return true, nil
+	})
+	if err != nil {
+		return nil, s3Err("readdir", p, err)
+	}
+	return fis, nil
+}
+
+func (fs *S3FS) MkdirAll(name string, perm os.FileMode) error {
+	p := cleanPath(name)
+	if p == "/" {
+		return nil
+	}
+	fi, err := fs.Stat(p)
+	if err == nil {
+		if !fi.IsDir() {
+			return &os.PathError{Op: "mkdir", Path: p, Err: os.ErrExist}
+		}
+		return nil
+	}
+	if !os.IsNotExist(err) {
+		return err
+	}
+	_, err = fs.core.PutObject(context.Background(), fs.bucket, fs.dirPrefix(p), bytes.NewReader(nil), 0, "", "", minio.PutObjectOptions{})
+	if err != nil {
+		return s3Err("mkdir", p, err)
+	}
+	return nil
+}
+
+func (fs *S3FS) Open(name string) (File, error) {
+	p := cleanPath(name)
+	fi, err := fs.Stat(p)
+	if err != nil {
+		return nil, err
+	}
+	if fi.IsDir() {
+		return nil, &os.PathError{Op: "open", Path: p, Err: os.ErrInvalid}
+	}
+	return &s3ReadFile{fs: fs, key: fs.key(p), size: fi.Size()}, nil
+}
+
+// OpenFile supports reading and whole-object writes. Objects cannot be modified
+// in place, so a write handle must create or truncate the object and replaces it
+// when closed, and O_RDWR and O_APPEND are refused.
+func (fs *S3FS) OpenFile(name string, flag int, perm os.FileMode) (File, error) {
+	p := cleanPath(name)
+	if flag&(os.O_WRONLY|os.O_RDWR) == 0 {
+		return fs.Open(p)
+	}
+	if flag&(os.O_RDWR|os.O_APPEND) != 0 {
+		return nil, &os.PathError{Op: "open", Path: p, Err: errors.ErrUnsupported}
+	}
+	fi, err := fs.Stat(p)
+	switch {
+	case err == nil && fi.IsDir():
+		return nil, &os.PathError{Op: "open", Path: p, Err: os.ErrInvalid}
+	case err == nil && flag&(os.O_CREATE|os.O_EXCL) == os.O_CREATE|os.O_EXCL:
+		return nil, &os.PathError{Op: "open", Path: p, Err: os.ErrExist}
+	case err == nil && flag&os.O_TRUNC == 0:
+		// Objects cannot be written in place, so a resume would lose the existing data.
+		return nil, &os.PathError{Op: "open", Path: p, Err: errors.ErrUnsupported}
+	case err != nil && !os.IsNotExist(err):
+		return nil, err
+	case err != nil && flag&os.O_CREATE == 0:
+		return nil, err
+	}
+	return &s3WriteFile{fs: fs, key: fs.key(p), pending: map[int64][]byte{}}, nil
+}
+
+func (fs *S3FS) Remove(name string) error {
+	p := cleanPath(name)
+	if p == "/" {
+		return &os.PathError{Op: "remove", Path: p, Err: os.ErrPermission}
+	}
+	fi, err := fs.Stat(p)
+	if err != nil {
+		return err
+	}
+	key := fs.key(p)
+	if fi.IsDir() {
+		key = fs.dirPrefix(p)
+		nonEmpty, err := fs.hasEntries(key, true)
+		if err != nil {
+			return s3Err("remove", p, err)
+		}
+		if nonEmpty {
+			return &os.PathError{Op: "remove", Path: p, Err: os.ErrExist}
+		}
+	}
+	if err := fs.core.RemoveObject(context.Background(), fs.bucket, key, minio.RemoveObjectOptions{}); err != nil {
+		return s3Err("remove", p, err)
+	}
+	return nil
+}
+
+// objectsUnder returns every object below directory p, markers included.
+func (fs *S3FS) objectsUnder(ctx context.Context, p string) ([]minio.ObjectInfo, error) {
+	var objects []minio.ObjectInfo
+	err := fs.list(ctx, fs.dirPrefix(p), "", func(res minio.ListBucketV2Result) (bool, error) {
+		objects = append(objects, res.Contents...)
+		return true, nil
+	})
+	return objects, err
+}
+
+func (fs *S3FS) RemoveAll(name string) error {
+	p := cleanPath(name)
+	if p == "/" {
+		return &os.PathError{Op: "removeall", Path: p, Err: os.ErrPermission}
+	}
+	ctx := context.Background()
+	found, err := fs.objectsUnder(ctx, p)
+	if err != nil {
+		return s3Err("removeall", p, err)
+	}
+	found = append(found, minio.ObjectInfo{Key: fs.key(p)})
+	objects := make(chan minio.ObjectInfo, len(found))
+	for _, obj := range found {
+		objects <- obj
+	}
+	close(objects)
+	for rerr := range fs.core.RemoveObjects(ctx, fs.bucket, objects, minio.RemoveObjectsOptions{}) {
+		if minio.ToErrorResponse(rerr.Err).Code == "NoSuchKey" {
+			continue
+		}
+		return s3Err("removeall", p, rerr.Err)
+	}
+	return nil
+}
+
+// move copies one object server-side and deletes the source. A single copy
+// request is limited to 5 GiB; larger objects are copied in parts.
+func (fs *S3FS) move(ctx context.Context, from, to string, size int64) error {
+	var err error
+	if size <= s3MaxCopySize {
+		_, err = fs.core.CopyObject(ctx, fs.bucket, from, fs.bucket, to, nil, minio.CopySrcOptions{}, minio.PutObjectOptions{})
+	} else {
+		_, err = fs.core.ComposeObject(ctx,
+			minio.CopyDestOptions{Bucket: fs.bucket, Object: to},
+			minio.CopySrcOptions{Bucket: fs.bucket, Object: from})
+	}
+	if err != nil {
+		return err
+	}
+	return fs.core.RemoveObject(ctx, fs.bucket, from, minio.RemoveObjectOptions{})
+}
+
+// Rename copies and deletes every object involved; renaming a directory is not
+// atomic and costs one copy per object below it.
+func (fs *S3FS) Rename(oldname, newname string) error {
+	from, to := cleanPath(oldname), cleanPath(newname)
+	if from == "/" || to == "/" || strings.HasPrefix(to, from+"/") {
+		return &os.PathError{Op: "rename", Path: from, Err: os.ErrInvalid}
+	}
+	fi, err := fs.Stat(from)
+	if err != nil {
+		return err
+	}
+	ctx := context.Background()
+	if !fi.IsDir() {
+		if err := fs.move(ctx, fs.key(from), fs.key(to), fi.Size()); err != nil {
+			return s3Err("rename", from, err)
+		}
+		return nil
+	}
+	if _, err := fs.Stat(to); err == nil {
+		return &os.PathError{Op: "rename", Path: to, Err: os.ErrExist}
+	}
+	objects, err := fs.objectsUnder(ctx, from)
+	if err != nil {
+		return s3Err("rename", from, err)
+	}
+	src, dst := fs.dirPrefix(from), fs.dirPrefix(to)
+	for _, obj := range objects {
+		if err := fs.move(ctx, obj.Key, dst+strings.TrimPrefix(obj.Key, src), obj.Size); err != nil {
+			return s3Err("rename", from, err)
+		}
+	}
+	return nil
+}
+
+// Chmod, Chown and Chtimes are accepted and ignored: objects have no mode,
+// owner or settable modification time.
+func (fs *S3FS) Chmod(name string, mode os.FileMode) error {
+	_, err := fs.Stat(name)
+	return err
+}
+
+func (fs *S3FS) Chown(name string, uid, gid int) error {
+	_, err := fs.Stat(name)
+	return err
+}
+
+func (fs *S3FS) Chtimes(name string, atime, mtime time.Time) error {
+	_, err := fs.Stat(name)
+	return err
+}
+
+// Truncate only succeeds when it would not change the object.
+func (fs *S3FS) Truncate(name string, size int64) error {
+	fi, err := fs.Stat(name)
+	if err != nil {
+		return err
+	}
+	if fi.IsDir() || fi.Size() != size {
+		return &os.PathError{Op: "truncate", Path: cleanPath(name), Err: errors.ErrUnsupported}
+	}
+	return nil
+}
+
+// s3ReadFile serves ReadAt with ranged GETs. Each GET fetches at least
+// s3ReadAhead bytes and the window is kept, so the small sequential reads of
+// an SFTP download do not cost one request each.
+type s3ReadFile struct {
+	fs   *S3FS
+	key  string
+	size int64
+
+	mu     sync.Mutex
+	window []byte
+	start  int64 // offset of window[0]
+}
+
+func (f *s3ReadFile) ReadAt(b []byte, off int64) (int, error) {
+	if off >= f.size {
+		return 0, io.EOF
+	}
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	end := min(off+int64(len(b)), f.size)
+	if off < f.start || end > f.start+int64(len(f.window)) {
+		if err := f.fetch(off, min(off+max(int64(len(b)), s3ReadAhead), f.size)); err != nil {
+			return 0, err
+		}
+	}
+	n := copy(b, f.window[off-f.start:end-f.start])
+	if n < len(b) {
+		return n, io.EOF
+	}
+	return n, nil
+}
+
+// fetch loads bytes [from, to) into the window.
+func (f *s3ReadFile) fetch(from, to int64) error {
+	opts := minio.GetObjectOptions{}
+	if err := opts.SetRange(from, to-1); err != nil {
+		return err
+	}
+	body, _, _, err := f.fs.core.GetObject(context.Background(), f.fs.bucket, f.key, opts)
+	if err != nil {
+		return s3Err("read", f.key, err)
+	}
+	defer body.Close()
+	window := make([]byte, to-from)
+	if _, err := io.ReadFull(body, window); err != nil {
+		return s3Err("read", f.key, err)
+	}
+	f.window, f.start = window, from
+	return nil
+}
+
+func (f *s3ReadFile) WriteAt(b []byte, off int64) (int, error) {
+	return 0, os.ErrPermission
+}
+
+func (f *s3ReadFile) Close() error { return nil }
+
+// s3WriteFile streams sequential writes into a multipart upload. Writes that
+// arrive ahead of the current offset are held until the gap is filled; writes
+// behind it (rewrites) are refused. Small files are stored with a single PUT.
+type s3WriteFile struct {
+	fs  *S3FS
+	key string
+
+	mu       sync.Mutex
+	buf      bytes.Buffer
+	offset   int64 // next byte expected
+	pending  map[int64][]byte
+	held     int
+	uploadID string
+	parts    []minio.CompletePart
+	err      error
+	closed   bool
+}
+
+func (f *s3WriteFile) ReadAt(b []byte, off int64) (int, error) {
+	return 0, os.ErrPermission
+}
+
+func (f *s3WriteFile) WriteAt(b []byte, off int64) (int, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if f.err != nil {
+		return 0, f.err
+	}
+	switch {
+	case off < f.offset:
+		return 0, fmt.Errorf("s3: cannot rewrite offset %d of %s", off, f.key)
+	case off > f.offset:
+		// A resent write replaces the data held for its offset
+		held := f.held - len(f.pending[off]) + len(b)
+		if held > s3MaxPending {
+			return 0, fmt.Errorf("s3: too much out-of-order data for %s", f.key)
+		}
+		f.pending[off] = bytes.Clone(b)
+		f.held = held
+		return len(b), nil
+	}
+	f.buf.Write(b)
+	f.offset += int64(len(b))
+	for {
+		next, ok := f.pending[f.offset]
+		if !ok {
+			break
+		}
+		delete(f.pending, f.offset)
+		f.held -= len(next)
+		f.buf.Write(next)
+		f.offset += int64(len(next))
+	}
+	for f.buf.Len() >= s3PartSize {
+		if f.err = f.uploadPart(s3PartSize); f.err != nil {
+			return 0, f.err
+		}
+	}
+	return len(b), nil
+}
+
+// TransferError makes Close abort the upload instead of storing a partial object.
+func (f *s3WriteFile) TransferError(err error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if f.err == nil {
+		f.err = err
+	}
+}
+
+func (f *s3WriteFile) uploadPart(size int) error {
+	ctx := context.Background()
+	if f.uploadID == "" {
+		id, err := f.fs.core.NewMultipartUpload(ctx, f.fs.bucket, f.key, minio.PutObjectOptions{})
+		if err != nil {
+			return s3Err("write", f.key, err)
+		}
+		f.uploadID = id
+	}
+	number := len(f.parts) + 1
+	part, err := f.fs.core.PutObjectPart(ctx, f.fs.bucket, f.key, f.uploadID, number,
+		bytes.NewReader(f.buf.Next(size)), int64(size), minio.PutObjectPartOptions{})
+	if err != nil {
+		return s3Err("write", f.key, err)
+	}
+	f.parts = append(f.parts, minio.CompletePart{PartNumber: number, ETag: part.ETag})
+	return nil
+}
+
+func (f *s3WriteFile) abort() {
+	if f.uploadID == "" {
+		return
+	}
+	if err := f.fs.core.AbortMultipartUpload(context.Background(), f.fs.bucket, f.key, f.uploadID); err != nil {
+		f.fs.logger.Warnf("Failed to abort multipart upload of %s: %v", f.key, err)
+	}
+}
+
+// Close stores the object. Nothing is visible in the bucket before Close.
+func (f *s3WriteFile) Close() error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if f.closed {
+		return f.err
+	}
+	f.closed = true
+	if f.err == nil && len(f.pending) > 0 {
+		f.err = fmt.Errorf("s3: upload of %s has gaps", f.key)
+	}
+	if f.err != nil {
+		f.abort()
+		return f.err
+	}
+	ctx := context.Background()
+	if f.uploadID == "" {
+		size := int64(f.buf.Len())
+		if _, err := f.fs.core.PutObject(ctx, f.fs.bucket, f.key, &f.buf, size, "", "", minio.PutObjectOptions{}); err != nil {
+			f.err = s3Err("write", f.key, err)
+		}
+		return f.err
+	}
+	if f.buf.Len() > 0 {
+		if f.err = f.uploadPart(f.buf.Len()); f.err != nil {
+			f.abort()
+			return f.err
+		}
+	}
+	if _, err := f.fs.core.CompleteMultipartUpload(ctx, f.fs.bucket, f.key, f.uploadID, f.parts, minio.PutObjectOptions{}); err != nil {
+		f.err = s3Err("write", f.key, err)
+		f.abort()
+	}
+	return f.err
+}
@@ -0,0 +1,362 @@
+package main
+
+import (
+	"bytes"
+	"crypto/rand"
+	"database/sql"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/minio/minio-go/v7"
+	"go.uber.org/zap"
+)
+
+// fakeS3 answers the ranged GETs of s3ReadFile and records their ranges.
+type fakeS3 struct {
+	mu      sync.Mutex
+	objects map[string][]byte // by bucket/key
+	ranges  []string
+}
+
+func (s *fakeS3) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	data, ok := s.objects[strings.TrimPrefix(r.URL.Path, "/")]
+	if r.Method != http.MethodGet || !ok {
+		w.WriteHeader(http.StatusNotFound)
+		return
+	}
+	var from, to int
+	if _, err := fmt.Sscanf(r.Header.Get("Range"), "bytes=%d-%d", &from, &to); err != nil || to >= len(data) {
+		w.WriteHeader(http.StatusRequestedRangeNotSatisfiable)
+		return
+	}
+	s.ranges = append(s.ranges, fmt.Sprintf("%d-%d", from, to))
+	w.Header().Set("Content-Range", fmt.Sprintf("bytes %d-%d/%d", from, to, len(data)))
+	w.Header().Set("Content-Length", fmt.Sprint(to-from+1))
+	w.Header().Set("ETag", `"fake"`)
+	w.Header().Set("Last-Modified", time.Now().UTC().Format(http.TimeFormat))
+	w.WriteHeader(http.StatusPartialContent)
+	w.Write(data[from : to+1])
+}
+
+func (s *fakeS3) takeRanges() []string {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	r := s.ranges
+	s.ranges = nil
+	return r
+}
+
+func randomBytes(t *testing.T, n int) []byte {
+	t.Helper()
+	b := make([]byte, n)
+	if _, err := rand.Read(b); err != nil {
+		t.Fatal(err)
+	}
+	return b
+}
+
+func TestS3ReadFileWindow(t *testing.T) {
+	data := randomBytes(t, 3*s3ReadAhead+100)
+	fake := &fakeS3{objects: map[string][]byte{"bucket/file": data}}
+	srv := httptest.NewServer(fake)
+	defer srv.Close()
+	fs, err := NewS3FS(&UserStorage{
+		Endpoint:  strings.TrimPrefix(srv.URL, "http://"),
+		Bucket:    "bucket",
+		Region:    sql.NullString{String: "us-east-1", Valid: true},
+		AccessKey: sql.NullString{String: "key", Valid: true},
+		SecretKey: sql.NullString{String: "secret", Valid: true},
+	}, zap.NewNop().Sugar())
+	if err != nil {
+		t.Fatal(err)
+	}
+	f := &s3ReadFile{fs: fs, key: "file", size: int64(len(data))}
+	const chunk = 32 << 10
+	size := int64(len(data))
+
+	tests := []struct {
+		name    string
+		off     int64
+		len     int
+		want    int
+		wantErr error
+		fetched []string
+	}{
+		{"first read fetches the read-ahead", 0, chunk, chunk, nil, []string{fmt.Sprintf("0-%d", s3ReadAhead-1)}},
+		{"within the window", chunk, chunk, chunk, nil, nil},
+		{"end of the window", s3ReadAhead - chunk, chunk, chunk, nil, nil},
+		{"across the window end", s3ReadAhead - 10, chunk, chunk, nil, []string{fmt.Sprintf("%d-%d", s3ReadAhead-10, 2*s3ReadAhead-11)}},
+		{"behind the window", 0, chunk, chunk, nil, []string{fmt.Sprintf("0-%d", s3ReadAhead-1)}},
+		{"larger than the read-ahead", s3ReadAhead, s3ReadAhead + 5, s3ReadAhead + 5, nil, []string{fmt.Sprintf("%d-%d", s3ReadAhead, 2*s3ReadAhead+4)}},
+		{"short read at the end", size - 10, chunk, 10, io.EOF, []string{fmt.Sprintf("%d-%d", size-10, size-1)}},
+		{"at the end", size, chunk, 0, io.EOF, nil},
+		{"past the end", size + 5, chunk, 0, io.EOF, nil},
+	}
+	for _, tt := range tests {
+		b := make([]byte, tt.len)
+		n, err := f.ReadAt(b, tt.off)
+		if n != tt.want || err != tt.wantErr {
+			t.Errorf("%s: ReadAt(%d, %d) = %d, %v; want %d, %v", tt.name, tt.len, tt.off, n, err, tt.want, tt.wantErr)
+			continue
+		}
+		if n > 0 && !bytes.Equal(b[:n], data[tt.off:tt.off+int64(n)]) {
+			t.Errorf("%s: wrong data", tt.name)
+		}
+		if got := fake.takeRanges(); fmt.Sprint(got) != fmt.Sprint(tt.fetched) {
+			t.Errorf("%s: fetched %v, want %v", tt.name, got, tt.fetched)
+		}
+	}
+}
+
+func newTestS3WriteFile() *s3WriteFile {
+	return &s3WriteFile{key: "file", pending: map[int64][]byte{}}
+}
+
+func TestS3WriteFileOutOfOrder(t *testing.T) {
+	f := newTestS3WriteFile()
+	write := func(s string, off int64) {
+		t.Helper()
+		if n, err := f.WriteAt([]byte(s), off); n != len(s) || err != nil {
+			t.Fatalf("WriteAt(%q, %d) = %d, %v", s, off, n, err)
+		}
+	}
+	write("cc", 4)
+	write("ddd", 6)
+	if f.offset != 0 || f.held != 5 || f.buf.Len() != 0 {
+		t.Fatalf("after writes ahead: offset %d, held %d, buffered %d; want 0, 5, 0", f.offset, f.held, f.buf.Len())
+	}
+	write("aa", 0)
+	if f.offset != 2 || f.held != 5 {
+		t.Fatalf("with a gap left: offset %d, held %d; want 2, 5", f.offset, f.held)
+	}
+	write("bb", 2)
+	if f.offset != 9 || f.held != 0 || len(f.pending) != 0 || f.buf.String() != "aabbccddd" {
+		t.Fatalf("after filling the gap: offset %d, held %d, pending %d, buffered %q", f.offset, f.held, len(f.pending), f.buf.String())
+	}
+	if _, err := f.WriteAt([]byte("x"), 3); err == nil {
+		t.Error("rewrite behind the offset accepted")
+	}
+}
+
+func TestS3WriteFileResentWrite(t *testing.T) {
+	f := newTestS3WriteFile()
+	b := make([]byte, 1<<20)
+	// Resending one write must not count its data again
+	for i := 0; i < 2*s3MaxPending/len(b); i++ {
+		if _, err := f.WriteAt(b, 1); err != nil {
+			t.Fatalf("resend %d: %v", i, err)
+		}
+	}
+	if f.held != len(b) {
+		t.Errorf("held %d, want %d", f.held, len(b))
+	}
+	if _, err := f.WriteAt(b[:10], 1); err != nil {
+		t.Fatal(err)
+	}
+	if f.held != 10 {
+		t.Errorf("after a shorter resend held %d, want 10", f.held)
+	}
+	if _, err := f.WriteAt(b[:1], 0); err != nil {
+		t.Fatal(err)
+	}
+	if f.held != 0 || f.offset != 11 {
+		t.Errorf("after filling the gap: held %d, offset %d; want 0, 11", f.held, f.offset)
+	}
+}
+
+func TestS3WriteFileMaxPending(t *testing.T) {
+	f := newTestS3WriteFile()
+	b := make([]byte, s3MaxPending/2)
+	if _, err := f.WriteAt(b, 1); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := f.WriteAt(b, int64(1+len(b))); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := f.WriteAt([]byte("x"), int64(1+2*len(b))); err == nil {
+		t.Error("write over s3MaxPending accepted")
+	}
+}
+
+func TestS3WriteFileCloseWithGap(t *testing.T) {
+	f := newTestS3WriteFile()
+	if _, err := f.WriteAt([]byte("later"), 10); err != nil {
+		t.Fatal(err)
+	}
+	err := f.Close()
+	if err == nil || !strings.Contains(err.Error(), "gaps") {
+		t.Fatalf("Close = %v, want a gap error", err)
+	}
+	if err := f.Close(); err == nil {
+		t.Error("second Close succeeded")
+	}
+
+	f = newTestS3WriteFile()
+	f.TransferError(io.ErrUnexpectedEOF)
+	if _, err := f.WriteAt([]byte("x"), 0); err != io.ErrUnexpectedEOF {
+		t.Errorf("WriteAt after TransferError = %v", err)
+	}
+	if err := f.Close(); err != io.ErrUnexpectedEOF {
+		t.Errorf("Close after TransferError = %v", err)
+	}
+}
+
+// newTestS3FS connects to the bucket given by S3_TEST_ENDPOINT, S3_TEST_BUCKET,
+// S3_TEST_ACCESS_KEY and S3_TEST_SECRET_KEY (e.g. a local MinIO) under a
+// fresh prefix, which is emptied when the test ends.
+func newTestS3FS(t *testing.T) *S3FS {
+	endpoint := os.Getenv("S3_TEST_ENDPOINT")
+	if endpoint == "" {
+		t.Skip("S3_TEST_ENDPOINT not set")
+	}
+	fs, err := NewS3FS(&UserStorage{
+		Endpoint:  endpoint,
+		Bucket:    os.Getenv("S3_TEST_BUCKET"),
+		Prefix:    fmt.Sprintf("v-sftp-test-%d", time.Now().UnixNano()),
+		Region:    sql.NullString{String: os.Getenv("S3_TEST_REGION"), Valid: os.Getenv("S3_TEST_REGION") != ""},
+		AccessKey: sql.NullString{String: os.Getenv("S3_TEST_ACCESS_KEY"), Valid: true},
+		SecretKey: sql.NullString{String: os.Getenv("S3_TEST_SECRET_KEY"), Valid: true},
+		UseSSL:    getEnvBool("S3_TEST_USE_SSL", false),
+	}, zap.NewNop().Sugar())
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() {
+		objects, err := fs.objectsUnder(t.Context(), "/")
+		if err != nil {
+			t.Logf("cleanup: %v", err)
+		}
+		for _, obj := range objects {
+			fs.core.RemoveObject(t.Context(), fs.bucket, obj.Key, minio.RemoveObjectOptions{})
+		}
+	})
+	return fs
+}
+
+// writeS3File uploads data in SFTP-sized writes, swapping each pair of
+// writes so that every other one arrives ahead of the offset.
+func writeS3File(t *testing.T, fs *S3FS, name string, data []byte) {
+	t.Helper()
+	f, err := fs.OpenFile(name, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0644)
+	if err != nil {
+		t.Fatal(err)
+	}
+	const chunk = 32 << 10
+	for off := 0; off < len(data); off += 2 * chunk {
+		for _, o := range []int{off + chunk, off} {
+			if o >= len(data) {
+				continue
+			}
+			if _, err := f.WriteAt(data[o:min(o+chunk, len(data))], int64(o)); err != nil {
+				t.Fatalf("WriteAt(%d): %v", o, err)
+			}
+		}
+	}
+	if err := f.Close(); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func readS3File(t *testing.T, fs *S3FS, name string) []byte {
+	t.Helper()
+	f, err := fs.Open(name)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+	var out []byte
+	b := make([]byte, 32<<10)
+	for off := int64(0); ; {
+		n, err := f.ReadAt(b, off)
+		out = append(out, b[:n]...)
+		off += int64(n)
+		if err == io.EOF {
+			return out
+		}
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+}
+
+func TestS3Integration(t *testing.T) {
+	fs := newTestS3FS(t)
+
+	// Multipart: two full parts and a short last one
+	big := randomBytes(t, 2*s3PartSize+12345)
+	writeS3File(t, fs, "/dir/big.bin", big)
+	if fi, err := fs.Stat("/dir/big.bin"); err != nil || fi.Size() != int64(len(big)) {
+		t.Fatalf("Stat = %v, %v; want size %d", fi, err, len(big))
+	}
+	if got := readS3File(t, fs, "/dir/big.bin"); !bytes.Equal(got, big) {
+		t.Fatal("multipart upload read back differently")
+	}
+	// Ranged reads at arbitrary offsets
+	f, err := fs.Open("/dir/big.bin")
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, off := range []int64{s3PartSize - 7, 3, int64(len(big)) - 100} {
+		b := make([]byte, 4096)
+		n, err := f.ReadAt(b, off)
+		want := big[off:min(off+4096, int64(len(big)))]
+		if !bytes.Equal(b[:n], want) || (err != nil && err != io.EOF) {
+			t.Errorf("ReadAt(%d) = %d, %v", off, n, err)
+		}
+	}
+	f.Close()
+
+	// Single PUT
+	writeS3File(t, fs, "/dir/small.txt", []byte("hello"))
+	if got := readS3File(t, fs, "/dir/small.txt"); string(got) != "hello" {
+		t.Errorf("small file = %q", got)
+	}
+	if err := fs.MkdirAll("/dir/empty", 0755); err != nil {
+		t.Fatal(err)
+	}
+
+	// Listing over several pages
+	defer func(n int) { s3ListPage = n }(s3ListPage)
+	s3ListPage = 2
+	for i := range 5 {
+		writeS3File(t, fs, fmt.Sprintf("/dir/sub/%d.txt", i), []byte{byte(i)})
+	}
+	fis, err := fs.ReadDir("/dir/sub")
+	if err != nil || len(fis) != 5 {
+		t.Fatalf("ReadDir over pages = %d entries, %v; want 5", len(fis), err)
+	}
+	fis, err = fs.ReadDir("/dir")
+	if err != nil || len(fis) != 4 {
+		t.Fatalf("ReadDir(/dir) = %d entries, %v; want big.bin, small.txt, empty and sub", len(fis), err)
+	}
+
+	// Renaming a directory moves everything below it, markers included
+	if err := fs.Rename("/dir", "/moved"); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := fs.Stat("/dir"); !errors.Is(err, os.ErrNotExist) {
+		t.Errorf("Stat of the old directory = %v", err)
+	}
+	if got := readS3File(t, fs, "/moved/big.bin"); !bytes.Equal(got, big) {
+		t.Error("renamed file reads back differently")
+	}
+	if fi, err := fs.Stat("/moved/empty"); err != nil || !fi.IsDir() {
+		t.Errorf("Stat of the renamed empty directory = %v, %v", fi, err)
+	}
+	if fis, err := fs.ReadDir("/moved/sub"); err != nil || len(fis) != 5 {
+		t.Errorf("ReadDir(/moved/sub) = %d entries, %v; want 5", len(fis), err)
+	}
+	if err := fs.Remove("/moved/sub"); !errors.Is(err, os.ErrExist) {
+		t.Errorf("Remove of a non-empty directory = %v", err)
+	}
+}
@@ -0,0 +1,535 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"os"
+	"os/exec"
+	"os/signal"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"syscall"
+	"time"
+
+	"github.com/joho/godotenv"
+	"github.com/pkg/sftp"
+	"go.uber.org/zap"
+	"golang.org/x/crypto/ssh"
+)
+
+// serverState is the part of the configuration that SIGHUP reloads: the host
+// key, user CAs and revocation list, auth hook, user provider, global IP lists
+// and timeouts. Each connection uses the state current when it was accepted.
+type serverState struct {
+	sshConfig *ssh.ServerConfig
+	auth      *sshAuth
+	globalIPs *ipFilter
+
+	handshakeTimeout time.Duration   // 0: none
+	timeouts         SessionTimeouts // defaults for users and groups without their own
+	keepaliveMissed  int             // unanswered keepalive intervals before disconnecting
+}
+
+// loadServerState builds the server state from the environment. sessionLimit
+// refuses logins of users with too many sessions.
+func loadServerState(store *UserStore, defender *defender, sessionLimit func(string) error, logger *zap.SugaredLogger) (*serverState, error) {
+	users, err := newUserProvider(store, logger)
+	if err != nil {
+		return nil, fmt.Errorf("failed to set up user provider: %w", err)
+	}
+	globalIPs, err := newGlobalIPFilter()
+	if err != nil {
+		return nil, fmt.Errorf("invalid global IP list: %w", err)
+	}
+	hostSigner, err := loadOrCreateHostKey(getEnvOrDefault("HOST_KEY_PATH", "./data/host_key"))
+	if err != nil {
+		return nil, fmt.Errorf("failed to load or create host key: %w", err)
+	}
+	certAuthority, err := loadUserCertAuthority(
+		getEnvOrDefault("TRUSTED_USER_CA_KEYS", ""),
+		getEnvOrDefault("REVOKED_KEYS_PATH", ""),
+	)
+	if err != nil {
+		return nil, fmt.Errorf("failed to load user certificate authorities: %w", err)
+	}
+	logger.Infof("Loaded %d trusted user CA key(s)", len(certAuthority.authorities))
+	hook := newAuthHookFromEnv(users, logger)
+	if hook != nil {
+		logger.Infof("Delegating password and key authentication to %s", hook.url)
+	}
+	auth := newSSHAuth(users, store, logger, certAuthority, defender, hook, sessionLimit)
+	sshConfig := &ssh.ServerConfig{NoClientAuth: false}
+	auth.configure(sshConfig)
+	sshConfig.AddHostKey(hostSigner)
+	return &serverState{
+		sshConfig:        sshConfig,
+		auth:             auth,
+		globalIPs:        globalIPs,
+		handshakeTimeout: getEnvDuration("HANDSHAKE_TIMEOUT", 2*time.Minute),
+		timeouts:         defaultSessionTimeouts(),
+		keepaliveMissed:  getEnvInt("KEEPALIVE_MAX_MISSED", 3),
+	}, nil
+}
+
+// server accepts SSH connections and serves the SFTP subsystem.
+type server struct {
+	store    *UserStore
+	defender *defender
+	sessions *sessionRegistry
+	limits   *connLimits
+	admin    *http.Server // nil without ADMIN_LISTEN_ADDR
+	metrics  *http.Server // nil without METRICS_LISTEN_ADDR
+	logger   *zap.SugaredLogger
+
+	state    atomic.Pointer[serverState]
+	listener net.Listener
+	conns    sync.WaitGroup
+	stopping atomic.Bool
+}
+
+// serve accepts connections until the listener is closed.
+func (s *server) serve() {
+	for {
+		nConn, err := s.listener.Accept()
+		if err != nil {
+			if s.stopping.Load() || errors.Is(err, net.ErrClosed) {
+				return
+			}
+			s.logger.Errorf("Failed to accept incoming connection: %v", err)
+			continue
+		}
+		state := s.state.Load()
+		// Drop banned or globally blocked sources before spending any work on the SSH handshake
+		if ip, ok := addrIP(nConn.RemoteAddr()); ok && !state.globalIPs.Empty() {
+			if err := state.globalIPs.Check(ip); err != nil {
+				s.logger.Warnf("Rejecting connection from %s: %v", nConn.RemoteAddr(), err)
+				metricConnectionsRejected.inc("ip_filter")
+				nConn.Close()
+				continue
+			}
+		}
+		if until, banned := s.defender.Banned(BanKindIP, remoteIP(nConn.RemoteAddr())); banned {
+			s.logger.Warnf("Rejecting connection from banned address %s (until %s)", nConn.RemoteAddr(), until.Format(time.RFC3339))
+			metricConnectionsRejected.inc("banned")
+			nConn.Close()
+			continue
+		}
+		ip := remoteIP(nConn.RemoteAddr())
+		if err := s.limits.acquire(ip); err != nil {
+			s.logger.Warnf("Rejecting connection from %s: %v", nConn.RemoteAddr(), err)
+			metricConnectionsRejected.inc("limit")
+			go rejectConn(nConn, err.(*limitError))
+			continue
+		}
+		metricConnectionsAccepted.inc()
+		s.conns.Add(1)
+		go func() {
+			defer s.conns.Done()
+			defer s.limits.release(ip)
+			s.handleConn(nConn, state)
+		}()
+	}
+}
+
+// handleConn runs the SSH handshake on conn and serves its session channels.
+func (s *server) handleConn(conn net.Conn, state *serverState) {
+	logger := s.logger
+	defer conn.Close()
+	if state.handshakeTimeout > 0 {
+		conn.SetDeadline(time.Now().Add(state.handshakeTimeout))
+	}
+	sshConn, chans, reqs, err := ssh.NewServerConn(conn, state.sshConfig)
+	s.limits.handshakeDone()
+	if err != nil {
+		metricHandshakeFailures.inc(handshakeFailureLabel(err))
+	}
+	if errors.Is(err, os.ErrDeadlineExceeded) {
+		logger.Warnf("Handshake with %s timed out after %s", conn.RemoteAddr(), state.handshakeTimeout)
+		return
+	}
+	if err != nil {
+		logger.Errorf("Failed to handshake: %v", err)
+		return
+	}
+	conn.SetDeadline(time.Time{})
+	// Discard global requests
+	go ssh.DiscardRequests(reqs)
+	// The limit was checked during authentication; this catches logins of the
+	// same user that completed their handshakes at the same time.
+	session, err := s.sessions.add(sshConn, s.limits.userSessions())
+	if err != nil {
+		logger.Warnf("Rejecting session from %s: %v", sshConn.RemoteAddr(), err)
+		metricConnectionsRejected.inc("user_sessions")
+		sshConn.Close()
+		return
+	}
+	defer s.sessions.remove(session.ID)
+	logger.Infof("New SSH connection from %s (%s), session %s", sshConn.RemoteAddr(), sshConn.ClientVersion(), session.ID)
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	state.auth.touchKey(ctx, sshConn.Permissions)
+	user, err := state.auth.sessionUser(ctx, sshConn.Permissions)
+	var timeouts SessionTimeouts
+	if err == nil {
+		timeouts, err = s.store.FetchSessionTimeouts(ctx, user, state.timeouts)
+	}
+	cancel()
+	if err != nil {
+		logger.Errorf("Failed to fetch user %s: %v", session.Username, err)
+		sshConn.Close()
+		return
+	}
+	defer superviseSession(sshConn, session, timeouts, state.keepaliveMissed, logger)()
+	var channels atomic.Int32 // open session channels
+	//handle channels
+	for newChannel := range chans {
+		if newChannel.ChannelType() != "session" {
+			newChannel.Reject(ssh.UnknownChannelType, "unknown channel type")
+			logger.Warnf("Unknown channel type: %s", newChannel.ChannelType())
+			continue
+		}
+		if limit := s.limits.channels(); limit > 0 && int(channels.Load()) >= limit {
+			newChannel.Reject(ssh.ResourceShortage, fmt.Sprintf("too many channels on this connection (limit %d)", limit))
+			logger.Warnf("Rejecting channel of session %s (%s): too many channels on this connection (limit %d)", session.ID, session.Username, limit)
+			continue
+		}
+		channel, requests, err := newChannel.Accept()
+		if err != nil {
+			logger.Errorf("Could not accept channel: %v", err)
+			continue
+		}
+		channels.Add(1)
+		go func(in <-chan *ssh.Request) {
+			defer channels.Add(-1)
+			for req := range in {
+				if req.Type == "subsystem" && len(req.Payload) >= 4 && string(req.Payload[4:]) == "sftp" {
+					// Handle SFTP subsystem request
+					//Accept the request
+					err := req.Reply(true, nil)
+					if err != nil {
+						logger.Errorf("Could not reply to request: %v", err)
+						return
+					}
+					cxt, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+					handler, err := newSftpHandler(cxt, s.store, user, session, logger)
+					cancel()
+					if err != nil {
+						logger.Errorf("Failed to open filesystem for user %s: %v", user.Username, err)
+						channel.Close()
+						return
+					}
+					instrumented := instrumentedHandler{handler}
+					handlers := sftp.Handlers{FileGet: instrumented, FilePut: instrumented, FileCmd: instrumented, FileList: instrumented}
+					server := sftp.NewRequestServer(session.trackChannel(channel), handlers)
+					if err := server.Serve(); err == io.EOF {
+						server.Close()
+						logger.Infof("SFTP client exited session.")
+					} else if err != nil {
+						logger.Errorf("SFTP server completed with error: %v", err)
+					}
+					handler.Close()
+					return
+				} else {
+					err := req.Reply(false, nil)
+					if err != nil {
+						logger.Errorf("Failed to reply to client: %v", err)
+					}
+					logger.Warnf("Unknown request type: %s", req.Type)
+					continue
+				}
+			}
+		}(requests)
+	}
+}
+
+// reload rereads .env and replaces the server state. Open connections keep
+// the state they started with. On error the previous state stays in use.
+func (s *server) reload() error {
+	if err := reloadEnv(); err != nil {
+		return err
+	}
+	state, err := loadServerState(s.store, s.defender, s.checkUserSessions, s.logger)
+	if err != nil {
+		return err
+	}
+	s.state.Store(state)
+	s.limits.configure()
+	reloadBandwidthLimits(s.store, s.logger)
+	return nil
+}
+
+// checkUserSessions refuses a login of username when the user already has
+// MAX_SESSIONS_PER_USER sessions.
+func (s *server) checkUserSessions(username string) error {
+	return s.sessions.checkUser(username, s.limits.userSessions())
+}
+
+// shutdownHTTP stops srv, if any, waiting up to timeout for requests in progress.
+func shutdownHTTP(srv *http.Server, timeout time.Duration) error {
+	if srv == nil {
+		return nil
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), timeout)
+	defer cancel()
+	return srv.Shutdown(ctx)
+}
+
+// shutdown stops accepting connections and waits up to timeout for the open
+// ones to end before disconnecting them.
+func (s *server) shutdown(timeout time.Duration) {
+	s.stopping.Store(true)
+	s.listener.Close()
+	if err := shutdownHTTP(s.admin, 5*time.Second); err != nil {
+		s.logger.Warnf("Failed to stop the admin API: %v", err)
+	}
+	if err := shutdownHTTP(s.metrics, 5*time.Second); err != nil {
+		s.logger.Warnf("Failed to stop the metrics endpoint: %v", err)
+	}
+	done := make(chan struct{})
+	go func() {
+		s.conns.Wait()
+		close(done)
+	}()
+	if n := s.sessions.count(); n > 0 {
+		s.logger.Infof("Waiting up to %s for %d session(s) to end", timeout, n)
+	}
+	select {
+	case <-done:
+		return
+	case <-time.After(timeout):
+	}
+	n := 0
+	for _, session := range s.sessions.list() {
+		if s.sessions.close(session.ID) {
+			n++
+		}
+	}
+	s.logger.Warnf("Shutdown timeout reached, disconnected %d session(s)", n)
+	select {
+	case <-done:
+	case <-time.After(5 * time.Second):
+		s.logger.Warnf("Connections still open after disconnecting; exiting anyway")
+	}
+}
+
+// handleSignals reloads on SIGHUP and hands the listeners to a new process on
+// handOffSignals (SIGUSR2 where available). It returns when SIGTERM or SIGINT
+// is received, or after a successful hand-off; the caller then shuts down.
+func (s *server) handleSignals() {
+	signals := make(chan os.Signal, 1)
+	signal.Notify(signals, append([]os.Signal{syscall.SIGTERM, os.Interrupt, syscall.SIGHUP}, handOffSignals...)...)
+	defer signal.Stop(signals)
+	for sig := range signals {
+		switch sig {
+		case syscall.SIGHUP:
+			if err := s.reload(); err != nil {
+				s.logger.Errorf("Failed to reload configuration, keeping the current one: %v", err)
+				continue
+			}
+			s.logger.Infof("Reloaded configuration")
+		case syscall.SIGTERM, os.Interrupt:
+			s.logger.Infof("Received %s, shutting down", sig)
+			return
+		default:
+			pid, err := handOff(s.logger)
+			if err != nil {
+				s.logger.Errorf("Failed to hand the listeners to a new process: %v", err)
+				continue
+			}
+			s.logger.Infof("Process %d took over the listeners, shutting down", pid)
+			return
+		}
+	}
+}
+
+// processEnv records which variables were set before .env was loaded; they
+// take precedence over the file, also when it is reloaded.
+var (
+	processEnv map[string]bool
+	dotenvKeys []string
+)
+
+// loadEnv loads .env into the environment without overriding variables set
+// by the caller.
+func loadEnv() error {
+	processEnv = map[string]bool{}
+	for _, kv := range os.Environ() {
+		processEnv[strings.SplitN(kv, "=", 2)[0]] = true
+	}
+	return reloadEnv()
+}
+
+// reloadEnv applies the current content of .env. Variables removed from the
+// file since the last load are unset.
+func reloadEnv() error {
+	values, err := godotenv.Read()
+	if err != nil {
+		return err
+	}
+	for _, key := range dotenvKeys {
+		if _, ok := values[key]; !ok {
+			os.Unsetenv(key)
+		}
+	}
+	dotenvKeys = dotenvKeys[:0]
+	for key, value := range values {
+		if processEnv[key] {
+			continue
+		}
+		os.Setenv(key, value)
+		dotenvKeys = append(dotenvKeys, key)
+	}
+	return nil
+}
+
+// callerEnv returns the environment without the variables loaded from .env,
+// so that a process started with it reads its own .env.
+func callerEnv() []string {
+	if processEnv == nil {
+		return os.Environ()
+	}
+	var env []string
+	for _, kv := range os.Environ() {
+		if processEnv[strings.SplitN(kv, "=", 2)[0]] {
+			env = append(env, kv)
+		}
+	}
+	return env
+}
+
+// inheritedFDsEnv names, in order, the sockets a process receives from its
+// predecessor as file descriptors 3 and up. The last one, "ready", is a pipe
+// written to once the new process accepts connections.
+const inheritedFDsEnv = "V_SFTP_INHERITED_FDS"
+
+var (
+	inheritedOnce sync.Once
+	inheritedMu   sync.Mutex
+	inherited     map[string]*os.File // by name, until taken
+
+	listenersMu   sync.Mutex
+	listenerNames []string // in the order the listeners were opened
+	listeners     = map[string]net.Listener{}
+)
+
+// takeInherited returns the inherited descriptor called name, if any. Each
+// one is returned once.
+func takeInherited(name string) *os.File {
+	inheritedOnce.Do(func() {
+		inherited = map[string]*os.File{}
+		if names := os.Getenv(inheritedFDsEnv); names != "" {
+			for i, n := range strings.Split(names, ",") {
+				inherited[n] = os.NewFile(uintptr(3+i), n)
+			}
+		}
+		os.Unsetenv(inheritedFDsEnv)
+	})
+	inheritedMu.Lock()
+	defer inheritedMu.Unlock()
+	f := inherited[name]
+	delete(inherited, name)
+	return f
+}
+
+// listen opens a TCP listener on addr, or takes over the one called name from
+// the previous process after a hand-off. Listeners are handed on in turn.
+func listen(name, addr string) (net.Listener, error) {
+	var l net.Listener
+	if f := takeInherited(name); f != nil {
+		var err error
+		l, err = net.FileListener(f)
+		f.Close()
+		if err != nil {
+			return nil, fmt.Errorf("inherited %s listener: %w", name, err)
+		}
+	} else {
+		var err error
+		if l, err = net.Listen("tcp", addr); err != nil {
+			return nil, err
+		}
+	}
+	listenersMu.Lock()
+	defer listenersMu.Unlock()
+	listenerNames = append(listenerNames, name)
+	listeners[name] = l
+	return l, nil
+}
+
+// notifyReady tells the previous process, if any, that this one accepts
+// connections, so that it can stop. It reports whether there was one.
+func notifyReady() bool {
+	f := takeInherited("ready")
+	if f == nil {
+		return false
+	}
+	f.Write([]byte{1})
+	f.Close()
+	return true
+}
+
+// handOff starts a new server process from the current executable, passing
+// it the listeners, and waits until it is ready. Connections queue on the
+// shared sockets meanwhile, so none are refused.
+func handOff(logger *zap.SugaredLogger) (int, error) {
+	exe, err := os.Executable()
+	if err != nil {
+		return 0, err
+	}
+	listenersMu.Lock()
+	var names []string
+	var files []*os.File
+	for _, name := range listenerNames {
+		tl, ok := listeners[name].(*net.TCPListener)
+		if !ok {
+			continue
+		}
+		f, err := tl.File()
+		if err != nil {
+			listenersMu.Unlock()
+			return 0, err
+		}
+		defer f.Close()
+		names = append(names, name)
+		files = append(files, f)
+	}
+	listenersMu.Unlock()
+
+	ready, readyW, err := os.Pipe()
+	if err != nil {
+		return 0, err
+	}
+	defer ready.Close()
+	cmd := exec.Command(exe)
+	cmd.Env = append(callerEnv(), inheritedFDsEnv+"="+strings.Join(append(names, "ready"), ","))
+	cmd.ExtraFiles = append(files, readyW)
+	cmd.Stdout, cmd.Stderr = os.Stdout, os.Stderr
+	err = cmd.Start()
+	readyW.Close()
+	if err != nil {
+		return 0, err
+	}
+	logger.Infof("Started process %d to take over the listeners", cmd.Process.Pid)
+	go cmd.Wait()
+
+	// The read ends with EOF if the new process exits without getting ready.
+	result := make(chan error, 1)
+	go func() {
+		b := make([]byte, 1)
+		_, err := ready.Read(b)
+		result <- err
+	}()
+	select {
+	case err := <-result:
+		if err != nil {
+			return 0, fmt.Errorf("process %d exited before accepting connections", cmd.Process.Pid)
+		}
+		return cmd.Process.Pid, nil
+	case <-time.After(time.Minute):
+		cmd.Process.Kill()
+		return 0, fmt.Errorf("process %d not ready after a minute", cmd.Process.Pid)
+	}
+}
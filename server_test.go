@@ -0,0 +1,68 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+// TestEnvHelperProcess is run by TestHandOffEnv as the new process: it loads
+// .env like main does and prints the variables the test asks about.
+func TestEnvHelperProcess(t *testing.T) {
+	if os.Getenv("V_SFTP_ENV_HELPER") != "1" {
+		t.Skip("run by TestHandOffEnv")
+	}
+	if err := loadEnv(); err != nil {
+		fmt.Println(err)
+		os.Exit(1)
+	}
+	fmt.Printf("file=%s caller=%s removed=%s\n", os.Getenv("V_SFTP_TEST_FILE"), os.Getenv("V_SFTP_TEST_CALLER"), os.Getenv("V_SFTP_TEST_REMOVED"))
+	os.Exit(0)
+}
+
+func TestHandOffEnv(t *testing.T) {
+	dir := t.TempDir()
+	t.Chdir(dir)
+	t.Setenv("V_SFTP_TEST_CALLER", "caller")
+	savedEnv, savedKeys := processEnv, dotenvKeys
+	t.Cleanup(func() {
+		for _, key := range dotenvKeys {
+			os.Unsetenv(key)
+		}
+		processEnv, dotenvKeys = savedEnv, savedKeys
+	})
+	writeEnv := func(content string) {
+		if err := os.WriteFile(filepath.Join(dir, ".env"), []byte(content), 0o600); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	writeEnv("V_SFTP_TEST_FILE=old\nV_SFTP_TEST_CALLER=file\nV_SFTP_TEST_REMOVED=old\n")
+	dotenvKeys = nil
+	if err := loadEnv(); err != nil {
+		t.Fatal(err)
+	}
+	if got := os.Getenv("V_SFTP_TEST_FILE"); got != "old" {
+		t.Fatalf("V_SFTP_TEST_FILE = %q after loading .env", got)
+	}
+	for _, kv := range callerEnv() {
+		if key := strings.SplitN(kv, "=", 2)[0]; key == "V_SFTP_TEST_FILE" || key == "V_SFTP_TEST_REMOVED" {
+			t.Errorf("callerEnv passes on %s from .env", kv)
+		}
+	}
+
+	// the new process reads the .env as it is when the hand-off happens
+	writeEnv("V_SFTP_TEST_FILE=new\nV_SFTP_TEST_CALLER=file\n")
+	cmd := exec.Command(os.Args[0], "-test.run=^TestEnvHelperProcess$")
+	cmd.Env = append(callerEnv(), "V_SFTP_ENV_HELPER=1")
+	out, err := cmd.CombinedOutput()
+	if err != nil {
+		t.Fatalf("%v: %s", err, out)
+	}
+	if want := "file=new caller=caller removed=\n"; string(out) != want {
+		t.Errorf("new process got %q, want %q", out, want)
+	}
+}
@@ -0,0 +1,314 @@
+package main
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"os"
+	"os/signal"
+	"sort"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"go.uber.org/zap"
+	"golang.org/x/crypto/ssh"
+)
+
+// Session is an authenticated SSH connection with its transfer statistics.
+type Session struct {
+	ID            string
+	Username      string
+	RemoteAddr    string
+	ClientVersion string
+	AuthMethod    string // the auth-method extension set by sshAuth
+	StartedAt     time.Time
+
+	conn       ssh.Conn
+	bytesIn    atomic.Int64  // uploaded by the client
+	bytesOut   atomic.Int64  // downloaded by the client
+	lastActive atomic.Int64  // Unix nanoseconds of the last SFTP request
+	done       chan struct{} // closed when the session is removed
+
+	mu      sync.Mutex
+	handles map[*openHandle]struct{}
+}
+
+// openHandle is a file the client has open.
+type openHandle struct {
+	path     string
+	mode     string // read, write or read-write
+	openedAt time.Time
+	bytes    atomic.Int64
+}
+
+// HandleInfo describes an open file of a session.
+type HandleInfo struct {
+	Path     string
+	Mode     string
+	OpenedAt time.Time
+	Bytes    int64 // transferred through this handle
+}
+
+// Bytes returns the bytes uploaded and downloaded so far.
+func (s *Session) Bytes() (in, out int64) {
+	return s.bytesIn.Load(), s.bytesOut.Load()
+}
+
+// Done returns a channel that is closed when the session's connection has
+// ended. It is nil for a nil session.
+func (s *Session) Done() <-chan struct{} {
+	if s == nil {
+		return nil
+	}
+	return s.done
+}
+
+// LastActive returns when the client last sent an SFTP request, or when the
+// session started if it has sent none.
+func (s *Session) LastActive() time.Time {
+	return time.Unix(0, s.lastActive.Load())
+}
+
+// trackChannel marks the session active whenever the client sends data on ch.
+func (s *Session) trackChannel(ch ssh.Channel) io.ReadWriteCloser {
+	return &sessionChannel{Channel: ch, session: s}
+}
+
+type sessionChannel struct {
+	ssh.Channel
+	session *Session
+}
+
+func (c *sessionChannel) Read(b []byte) (int, error) {
+	n, err := c.Channel.Read(b)
+	if n > 0 {
+		c.session.lastActive.Store(time.Now().UnixNano())
+	}
+	return n, err
+}
+
+// Handles returns the files the client has open, oldest first.
+func (s *Session) Handles() []HandleInfo {
+	s.mu.Lock()
+	list := make([]HandleInfo, 0, len(s.handles))
+	for h := range s.handles {
+		list = append(list, HandleInfo{Path: h.path, Mode: h.mode, OpenedAt: h.openedAt, Bytes: h.bytes.Load()})
+	}
+	s.mu.Unlock()
+	sort.Slice(list, func(i, j int) bool { return list[i].OpenedAt.Before(list[j].OpenedAt) })
+	return list
+}
+
+// trackFile counts the transfers through file, open at p, until it is closed.
+// s may be nil.
+func (s *Session) trackFile(file File, p, mode string) File {
+	if s == nil {
+		return file
+	}
+	h := &openHandle{path: p, mode: mode, openedAt: time.Now()}
+	s.mu.Lock()
+	s.handles[h] = struct{}{}
+	s.mu.Unlock()
+	return &sessionFile{File: file, session: s, handle: h}
+}
+
+// sessionFile counts the bytes read and written through a file handle.
+type sessionFile struct {
+	File
+	session *Session
+	handle  *openHandle
+	closed  atomic.Bool
+}
+
+func (f *sessionFile) ReadAt(b []byte, off int64) (int, error) {
+	n, err := f.File.ReadAt(b, off)
+	f.session.bytesOut.Add(int64(n))
+	f.handle.bytes.Add(int64(n))
+	metricTransferBytes.add(float64(n), "download")
+	if err != nil && err != io.EOF {
+		metricErrors.inc(errorTypeLabel(err))
+	}
+	return n, err
+}
+
+func (f *sessionFile) WriteAt(b []byte, off int64) (int, error) {
+	n, err := f.File.WriteAt(b, off)
+	f.session.bytesIn.Add(int64(n))
+	f.handle.bytes.Add(int64(n))
+	metricTransferBytes.add(float64(n), "upload")
+	if err != nil {
+		metricErrors.inc(errorTypeLabel(err))
+	}
+	return n, err
+}
+
+// TransferError passes the notification on to the wrapped file.
+func (f *sessionFile) TransferError(err error) {
+	if te, ok := f.File.(interface{ TransferError(error) }); ok {
+		te.TransferError(err)
+	}
+}
+
+func (f *sessionFile) Close() error {
+	if !f.closed.Swap(true) {
+		f.session.mu.Lock()
+		delete(f.session.handles, f.handle)
+		f.session.mu.Unlock()
+	}
+	return f.File.Close()
+}
+
+// sessionRegistry tracks the open sessions so that they can be listed and
+// disconnected.
+type sessionRegistry struct {
+	mu       sync.Mutex
+	sessions map[string]*Session
+}
+
+func newSessionRegistry() *sessionRegistry {
+	return &sessionRegistry{sessions: map[string]*Session{}}
+}
+
+// add registers conn, which has completed its handshake, and returns its
+// session, or a *limitError if its user already has maxPerUser sessions (0:
+// unlimited). Call remove when the connection ends.
+func (r *sessionRegistry) add(conn *ssh.ServerConn, maxPerUser int) (*Session, error) {
+	id := make([]byte, 8)
+	rand.Read(id)
+	s := &Session{
+		ID:            hex.EncodeToString(id),
+		Username:      conn.User(),
+		RemoteAddr:    conn.RemoteAddr().String(),
+		ClientVersion: string(conn.ClientVersion()),
+		StartedAt:     time.Now(),
+		conn:          conn,
+		handles:       map[*openHandle]struct{}{},
+		done:          make(chan struct{}),
+	}
+	s.lastActive.Store(s.StartedAt.UnixNano())
+	if conn.Permissions != nil {
+		if username := conn.Permissions.Extensions["username"]; username != "" {
+			s.Username = username
+		}
+		s.AuthMethod = conn.Permissions.Extensions["auth-method"]
+	}
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if err := r.checkUserLocked(s.Username, maxPerUser); err != nil {
+		return nil, err
+	}
+	r.sessions[s.ID] = s
+	return s, nil
+}
+
+// checkUser returns a *limitError if username already has maxPerUser sessions
+// (0: unlimited).
+func (r *sessionRegistry) checkUser(username string, maxPerUser int) error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return r.checkUserLocked(username, maxPerUser)
+}
+
+func (r *sessionRegistry) checkUserLocked(username string, maxPerUser int) error {
+	if maxPerUser <= 0 {
+		return nil
+	}
+	n := 0
+	for _, other := range r.sessions {
+		if other.Username == username {
+			n++
+		}
+	}
+	if n >= maxPerUser {
+		return &limitError{disconnectTooManyConnections, fmt.Sprintf("too many sessions of %s (limit %d)", username, maxPerUser)}
+	}
+	return nil
+}
+
+// remove forgets a session whose connection has ended.
+func (r *sessionRegistry) remove(id string) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if s := r.sessions[id]; s != nil {
+		close(s.done)
+		delete(r.sessions, id)
+	}
+}
+
+// count returns the number of open sessions.
+func (r *sessionRegistry) count() int {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return len(r.sessions)
+}
+
+// get returns an open session, or nil.
+func (r *sessionRegistry) get(id string) *Session {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return r.sessions[id]
+}
+
+// list returns the open sessions, oldest first.
+func (r *sessionRegistry) list() []*Session {
+	r.mu.Lock()
+	list := make([]*Session, 0, len(r.sessions))
+	for _, s := range r.sessions {
+		list = append(list, s)
+	}
+	r.mu.Unlock()
+	sort.Slice(list, func(i, j int) bool { return list[i].StartedAt.Before(list[j].StartedAt) })
+	return list
+}
+
+// close disconnects a session. It reports whether the session was open.
+func (r *sessionRegistry) close(id string) bool {
+	s := r.get(id)
+	if s != nil {
+		s.conn.Close()
+	}
+	return s != nil
+}
+
+// closeUser disconnects every session of a user and returns how many there were.
+func (r *sessionRegistry) closeUser(username string) int {
+	n := 0
+	for _, s := range r.list() {
+		if s.Username == username {
+			s.conn.Close()
+			n++
+		}
+	}
+	return n
+}
+
+// dump logs every open session with its open files.
+func (r *sessionRegistry) dump(logger *zap.SugaredLogger) {
+	sessions := r.list()
+	logger.Infof("%d open session(s)", len(sessions))
+	now := time.Now()
+	for _, s := range sessions {
+		in, out := s.Bytes()
+		handles := s.Handles()
+		logger.Infof("Session %s: user %s from %s (%s, %s), up %s, idle %s, %d bytes in, %d bytes out, %d open file(s)",
+			s.ID, s.Username, s.RemoteAddr, s.ClientVersion, s.AuthMethod, now.Sub(s.StartedAt).Round(time.Second), now.Sub(s.LastActive()).Round(time.Second), in, out, len(handles))
+		for _, h := range handles {
+			logger.Infof("Session %s: %s open for %s since %s, %d bytes", s.ID, h.Path, h.Mode, now.Sub(h.OpenedAt).Round(time.Second), h.Bytes)
+		}
+	}
+}
+
+// dumpOnSignal logs the open sessions whenever the process receives one of
+// sessionDumpSignals (SIGUSR1 where available).
+func (r *sessionRegistry) dumpOnSignal(logger *zap.SugaredLogger) {
+	if len(sessionDumpSignals) == 0 {
+		return
+	}
+	signals := make(chan os.Signal, 1)
+	signal.Notify(signals, sessionDumpSignals...)
+	for range signals {
+		r.dump(logger)
+	}
+}
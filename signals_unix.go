@@ -0,0 +1,15 @@
+//go:build !windows
+
+package main
+
+import (
+	"os"
+	"syscall"
+)
+
+var (
+	// sessionDumpSignals make the server log its open sessions.
+	sessionDumpSignals = []os.Signal{syscall.SIGUSR1}
+	// handOffSignals make the server pass its listeners to a new process and stop.
+	handOffSignals = []os.Signal{syscall.SIGUSR2}
+)
@@ -0,0 +1,10 @@
+package main
+
+import "os"
+
+// Windows has no SIGUSR1 or SIGUSR2, and cannot pass sockets to a child
+// process: use the admin API to list sessions, and restart to upgrade.
+var (
+	sessionDumpSignals []os.Signal
+	handOffSignals     []os.Signal
+)
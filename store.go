@@ -5,21 +5,49 @@ import (
 	"database/sql"
 	"fmt"
 	"log"
-	"os"
-	"strings"
 
 	"go.uber.org/zap"
 )
 
-type Permission uint8
+// Permission is a bitmask of the operations a user may perform. Read, Write
+// and Delete are the original coarse bits; Expand maps them onto the finer
+// bits, so values stored before those existed keep their meaning.
+type Permission uint32
 
 const (
-	PermRead   Permission = 1 << 0 //1
+	PermRead   Permission = 1 << 0 //1: download
 	PermList   Permission = 1 << 1 //2
-	PermWrite  Permission = 1 << 2 //4
-	PermDelete Permission = 1 << 3 //8
+	PermWrite  Permission = 1 << 2 //4: every change but deletion
+	PermDelete Permission = 1 << 3 //8: delete files and directories
+
+	PermDownload      Permission = 1 << 4  //16
+	PermUpload        Permission = 1 << 5  //32: create and write new files
+	PermOverwrite     Permission = 1 << 6  //64: write to, truncate or replace existing files
+	PermCreateDir     Permission = 1 << 7  //128
+	PermRename        Permission = 1 << 8  //256
+	PermDeleteFile    Permission = 1 << 9  //512
+	PermDeleteDir     Permission = 1 << 10 //1024
+	PermChmod         Permission = 1 << 11 //2048
+	PermChtimes       Permission = 1 << 12 //4096
+	PermChown         Permission = 1 << 13 //8192
+	PermCreateSymlink Permission = 1 << 14 //16384
 )
 
+// Expand returns p with the coarse Read, Write and Delete bits replaced by the
+// fine bits they stand for. Handlers only check fine bits and List.
+func (p Permission) Expand() Permission {
+	if p&PermRead != 0 {
+		p |= PermDownload
+	}
+	if p&PermWrite != 0 {
+		p |= PermUpload | PermOverwrite | PermCreateDir | PermRename | PermChmod | PermChtimes | PermChown | PermCreateSymlink
+	}
+	if p&PermDelete != 0 {
+		p |= PermDeleteFile | PermDeleteDir
+	}
+	return p &^ (PermRead | PermWrite | PermDelete)
+}
+
 type User struct {
 	ID           int
 	DisplayName  string
@@ -33,14 +61,17 @@ type User struct {
 }
 
 type UserStore struct {
-	dbType string
-	db     *sql.DB
-	logger *zap.SugaredLogger
+	dialect dialect
+	db      *sql.DB
+	logger  *zap.SugaredLogger
 }
 
 func NewUserStore(dsn string) *UserStore {
-	dbType := getEnvOrDefault("DB_TYPE", "sqlite")
-	db, err := sql.Open(dbType, dsn)
+	d, err := parseDialect(getEnvOrDefault("DB_TYPE", "sqlite"))
+	if err != nil {
+		panic(err)
+	}
+	db, err := d.open(dsn)
 	if err != nil {
 		panic(err)
 	}
@@ -49,97 +80,31 @@ func NewUserStore(dsn string) *UserStore {
 		log.Fatalf("Failed to initialize logger: %v", err)
 	}
 
-	// Ensure DB schema exists; if sftp_users table missing, apply ddl.sql
-	if err := applyDDLIfNeeded(dbType,db, logger); err != nil {
-		logger.Fatalf("Failed to apply DDL: %v", err)
-	}
-
-	return &UserStore{db: db, logger: logger, dbType: dbType }
+	return &UserStore{db: db, logger: logger, dialect: d}
 }
 
-func applyDDLIfNeeded(dbType string, db *sql.DB, logger *zap.SugaredLogger) error {
-	logger.Infof("Checking for sftp_users table")
-	// Try a simple query against the table
-	var tmp int
-	err := db.QueryRow("SELECT 1 FROM sftp_users LIMIT 1").Scan(&tmp)
-	if err == nil {
-		logger.Infof("sftp_users table exists")
-		return nil
-	}
-	logger.Warnf("sftp_users table not found or inaccessible (%v). Attempting to apply ddl.sql", err)
-
-	ddlBytes, rerr := os.ReadFile(dbType + "_ddl.sql")
-	if rerr != nil {
-		logger.Errorf("Failed to read ddl.sql: %v", rerr)
-		return rerr
-	}
-	ddl := string(ddlBytes)
-
-	// Execute the DDL. Some drivers/drivers' Exec may not accept multiple statements;
-	// try Exec as-is first, then fallback to splitting on semicolon.
-	if _, execErr := db.Exec(ddl); execErr == nil {
-		logger.Infof("Applied ddl.sql successfully")
-		return nil
-	} else {
-		logger.Warnf("Exec of ddl.sql failed: %v — attempting split-exec", execErr)
-		// naive split; acceptable for simple SQL files
-		statements := splitSQLStatements(ddl)
-		tx, terr := db.Begin()
-		if terr != nil {
-			logger.Errorf("Failed to begin transaction for applying DDL: %v", terr)
-			return terr
-		}
-		for _, stmt := range statements {
-			if stmt = trimWhitespace(stmt); stmt == "" {
-				continue
-			}
-			if _, serr := tx.Exec(stmt); serr != nil {
-				_ = tx.Rollback()
-				logger.Errorf("Failed to execute statement: %v", serr)
-				return serr
-			}
-		}
-		if cerr := tx.Commit(); cerr != nil {
-			logger.Errorf("Failed to commit DDL transaction: %v", cerr)
-			return cerr
-		}
-		logger.Infof("Applied ddl.sql successfully (split-exec)")
-		return nil
+func (s *UserStore) FetchUserByUsername(ctx context.Context, username string) (*User, error) {
+	s.logger.Infof("Fetching user by username: %s", username)
+
+	// The user's group, if it has a row in sftp_groups, supplies unset settings
+	query := fmt.Sprintf(`SELECT u.id, u.display_name, u.group_name, u.username, u.password_hash, u.public_key, u.root_path, u.perms, u.disabled, g.name, g.description, g.perms, g.root_template FROM sftp_users u LEFT JOIN sftp_groups g ON g.name = u.group_name WHERE u.username = %s`, s.placeholder(1))
+
+	row := s.db.QueryRowContext(ctx, query, username)
+	var user User
+	var perms sql.NullInt64
+	var groupName sql.NullString
+	var group Group
+	err := row.Scan(&user.ID, &user.DisplayName, &user.GroupName, &user.Username, &user.PasswordHash, &user.PublicKey, &user.RootPath, &perms, &user.Disabled,
+		&groupName, &group.Description, &group.Perms, &group.RootTemplate)
+	if err != nil {
+		s.logger.Errorf("Error fetching user: %v", err)
+		return nil, err
 	}
-}
-
-func splitSQLStatements(ddl string) []string {
-	return []string(filterEmpty(strings.Split(ddl, ";")))
-}
-
-func trimWhitespace(s string) string { return strings.TrimSpace(s) }
-
-func filterEmpty(in []string) []string {
-	out := make([]string, 0, len(in))
-	for _, s := range in {
-		if strings.TrimSpace(s) != "" {
-			out = append(out, s)
-		}
+	var g *Group
+	if groupName.Valid {
+		group.Name = groupName.String
+		g = &group
 	}
-	return out
-}
-
-func (s *UserStore) FetchUserByUsername(ctx context.Context, username string) (*User, error) {
-    s.logger.Infof("Fetching user by username: %s", username)
-
-    // Use driver-specific placeholder
-    placeholder := "?"
-    if strings.EqualFold(s.dbType, "postgres") {
-        placeholder = "$1"
-    }
-    query := fmt.Sprintf(`SELECT id, display_name, group_name, username, password_hash, public_key, root_path, perms, disabled FROM sftp_users WHERE username = %s`, placeholder)
-
-    row := s.db.QueryRowContext(ctx, query, username)
-    var user User
-    err := row.Scan(&user.ID, &user.DisplayName, &user.GroupName, &user.Username, &user.PasswordHash, &user.PublicKey, &user.RootPath, &user.Perms, &user.Disabled)
-    if err != nil {
-        s.logger.Errorf("Error fetching user: %v", err)
-        return nil, err
-    }
-    return &user, nil
+	g.applyTo(&user, perms)
+	return &user, nil
 }
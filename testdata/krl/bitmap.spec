@@ -0,0 +1,16 @@
+serial: 200
+serial: 202
+serial: 204
+serial: 206
+serial: 208
+serial: 210
+serial: 212
+serial: 214
+serial: 216
+serial: 218
+serial: 220
+serial: 222
+serial: 224
+serial: 226
+serial: 228
+serial: 230
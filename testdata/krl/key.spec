@@ -0,0 +1 @@
+key: ssh-ed25519 AAAAC3NzaC1lZDI1NTE5AAAAICS9wjdPxa5qJLwRpQ/qYSFCwqNYEdDejRTS6rXVnIf5 u1
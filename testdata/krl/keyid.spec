@@ -0,0 +1 @@
+id: build-bot@example
@@ -0,0 +1,2 @@
+serial: 5
+serial: 1000000
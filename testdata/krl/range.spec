@@ -0,0 +1 @@
+serial: 1000-2000
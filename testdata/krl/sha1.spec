@@ -0,0 +1 @@
+sha1: ssh-ed25519 AAAAC3NzaC1lZDI1NTE5AAAAIGdGFPSRBmrmCaxpozowBI8Ri9tQHXKQlf3RJjOk9zO1 u2
@@ -0,0 +1 @@
+sha256: ssh-ed25519 AAAAC3NzaC1lZDI1NTE5AAAAIPLNVI8VtTreYG134s/UjjGR7BM6It0G560rrbx8+n3b u3
@@ -0,0 +1,143 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+	"sync/atomic"
+	"time"
+
+	"go.uber.org/zap"
+	"golang.org/x/crypto/ssh"
+)
+
+// keepaliveRequest is the global request OpenSSH servers send to probe
+// clients (ClientAliveInterval). Clients answer it, usually with a failure.
+const keepaliveRequest = "keepalive@openssh.com"
+
+// Scopes of the rows in sftp_session_limits and sftp_bandwidth_limits.
+const (
+	SessionLimitScopeUser  = "user"
+	SessionLimitScopeGroup = "group"
+)
+
+// SessionTimeouts bound how long a connection may stay idle or open. A zero
+// duration disables the timeout.
+type SessionTimeouts struct {
+	Idle        time.Duration // without SFTP requests
+	Keepalive   time.Duration // between keepalive requests
+	MaxLifetime time.Duration // since the connection was authenticated
+}
+
+// defaultSessionTimeouts reads the server-wide timeouts from the environment.
+func defaultSessionTimeouts() SessionTimeouts {
+	return SessionTimeouts{
+		Idle:        getEnvDuration("IDLE_TIMEOUT", 0),
+		Keepalive:   getEnvDuration("KEEPALIVE_INTERVAL", 30*time.Second),
+		MaxLifetime: getEnvDuration("MAX_SESSION_TIME", 0),
+	}
+}
+
+// FetchSessionTimeouts returns the user's timeouts: each column of their own
+// row in sftp_session_limits that is set, otherwise their group's, otherwise
+// the one from defaults. Values are stored in seconds.
+func (s *UserStore) FetchSessionTimeouts(ctx context.Context, user *User, defaults SessionTimeouts) (SessionTimeouts, error) {
+	query := fmt.Sprintf(`SELECT scope, idle_timeout, keepalive_interval, max_session_time FROM sftp_session_limits WHERE (scope = 'user' AND name = %s) OR (scope = 'group' AND name = %s)`,
+		s.placeholder(1), s.placeholder(2))
+	rows, err := s.db.QueryContext(ctx, query, user.Username, user.GroupName)
+	if err != nil {
+		s.logger.Errorf("Error fetching session limits: %v", err)
+		return defaults, err
+	}
+	defer rows.Close()
+	var userRow, groupRow [3]sql.NullInt64
+	for rows.Next() {
+		var scope string
+		var row [3]sql.NullInt64
+		if err := rows.Scan(&scope, &row[0], &row[1], &row[2]); err != nil {
+			return defaults, err
+		}
+		if scope == SessionLimitScopeUser {
+			userRow = row
+		} else {
+			groupRow = row
+		}
+	}
+	if err := rows.Err(); err != nil {
+		return defaults, err
+	}
+	t := defaults
+	for i, d := range []*time.Duration{&t.Idle, &t.Keepalive, &t.MaxLifetime} {
+		switch {
+		case userRow[i].Valid:
+			*d = time.Duration(userRow[i].Int64) * time.Second
+		case groupRow[i].Valid:
+			*d = time.Duration(groupRow[i].Int64) * time.Second
+		}
+	}
+	return t, nil
+}
+
+// superviseSession closes conn, the connection of session, once it has been
+// idle or open for too long, or once maxMissed keepalive requests in a row
+// went unanswered. Call the returned function when the connection ends.
+func superviseSession(conn ssh.Conn, session *Session, t SessionTimeouts, maxMissed int, logger *zap.SugaredLogger) (stop func()) {
+	done := make(chan struct{})
+	var timers []*time.Timer
+	if t.MaxLifetime > 0 {
+		timers = append(timers, time.AfterFunc(t.MaxLifetime, func() {
+			logger.Infof("Closing session %s (%s): maximum session time of %s reached", session.ID, session.Username, t.MaxLifetime)
+			conn.Close()
+		}))
+	}
+	if t.Idle > 0 {
+		var idle *time.Timer
+		idle = time.AfterFunc(t.Idle, func() {
+			if d := time.Since(session.LastActive()); d < t.Idle {
+				idle.Reset(t.Idle - d)
+				return
+			}
+			logger.Infof("Closing session %s (%s): idle for %s", session.ID, session.Username, t.Idle)
+			conn.Close()
+		})
+		timers = append(timers, idle)
+	}
+	if t.Keepalive > 0 && maxMissed > 0 {
+		go func() {
+			ticker := time.NewTicker(t.Keepalive)
+			defer ticker.Stop()
+			// One request is in flight at a time; the ssh package serializes them.
+			var pending atomic.Bool
+			missed := 0
+			for {
+				select {
+				case <-done:
+					return
+				case <-ticker.C:
+				}
+				if pending.Load() {
+					if missed++; missed >= maxMissed {
+						logger.Warnf("Closing session %s (%s): keepalive unanswered for %s", session.ID, session.Username, time.Duration(missed)*t.Keepalive)
+						conn.Close()
+						return
+					}
+					continue
+				}
+				missed = 0
+				pending.Store(true)
+				go func() {
+					// A refusal is an answer too; only an error means the connection is gone.
+					if _, _, err := conn.SendRequest(keepaliveRequest, true, nil); err == nil {
+						pending.Store(false)
+					}
+				}()
+			}
+		}()
+	}
+	return func() {
+		close(done)
+		for _, timer := range timers {
+			timer.Stop()
+		}
+	}
+}
@@ -0,0 +1,157 @@
+package main
+
+import (
+	"context"
+	"crypto/hmac"
+	"crypto/sha1"
+	"crypto/subtle"
+	"database/sql"
+	"encoding/base32"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"strings"
+	"time"
+
+	"golang.org/x/crypto/bcrypt"
+)
+
+// RFC 6238 parameters as used by common authenticator apps.
+const (
+	totpPeriod = 30 * time.Second
+	totpDigits = 6
+	totpSkew   = 1 // accept codes from one step before/after to absorb clock drift
+)
+
+// UserTOTP is the second-factor configuration stored in sftp_user_totp.
+type UserTOTP struct {
+	UserID         int
+	Secret         string // base32, as shown to authenticator apps
+	AfterPassword  bool   // require a code after a successful password
+	AfterPublicKey bool   // require a code after a successful public key/certificate
+	LastUsedStep   sql.NullInt64
+}
+
+// Required reports whether a code must follow the given first-factor method.
+func (t *UserTOTP) Required(method string) bool {
+	if t == nil {
+		return false
+	}
+	switch method {
+	case "password", "keyboard-interactive":
+		return t.AfterPassword
+	case "publickey":
+		return t.AfterPublicKey
+	default:
+		return false
+	}
+}
+
+func decodeTOTPSecret(secret string) ([]byte, error) {
+	secret = strings.ToUpper(strings.ReplaceAll(strings.TrimSpace(secret), " ", ""))
+	return base32.StdEncoding.WithPadding(base32.NoPadding).DecodeString(strings.TrimRight(secret, "="))
+}
+
+// totpCode computes the HOTP value (RFC 4226) for the given time step.
+func totpCode(key []byte, step uint64) string {
+	var msg [8]byte
+	binary.BigEndian.PutUint64(msg[:], step)
+	mac := hmac.New(sha1.New, key)
+	mac.Write(msg[:])
+	sum := mac.Sum(nil)
+	offset := sum[len(sum)-1] & 0x0f
+	value := binary.BigEndian.Uint32(sum[offset:offset+4]) & 0x7fffffff
+	mod := uint32(1)
+	for i := 0; i < totpDigits; i++ {
+		mod *= 10
+	}
+	return fmt.Sprintf("%0*d", totpDigits, value%mod)
+}
+
+// matchTOTP returns the time step the code is valid for, or false if it does not match.
+func matchTOTP(secret, code string, now time.Time) (int64, bool) {
+	key, err := decodeTOTPSecret(secret)
+	if err != nil || len(code) != totpDigits {
+		return 0, false
+	}
+	current := now.Unix() / int64(totpPeriod/time.Second)
+	for delta := int64(-totpSkew); delta <= totpSkew; delta++ {
+		step := current + delta
+		if subtle.ConstantTimeCompare([]byte(totpCode(key, uint64(step))), []byte(code)) == 1 {
+			return step, true
+		}
+	}
+	return 0, false
+}
+
+// FetchUserTOTP returns the user's TOTP configuration, or nil if none is enrolled.
+func (s *UserStore) FetchUserTOTP(ctx context.Context, userID int) (*UserTOTP, error) {
+	query := fmt.Sprintf(`SELECT user_id, secret, after_password, after_publickey, last_used_step FROM sftp_user_totp WHERE user_id = %s`, s.placeholder(1))
+	var t UserTOTP
+	err := s.db.QueryRowContext(ctx, query, userID).Scan(&t.UserID, &t.Secret, &t.AfterPassword, &t.AfterPublicKey, &t.LastUsedStep)
+	if errors.Is(err, sql.ErrNoRows) {
+		return nil, nil
+	}
+	if err != nil {
+		s.logger.Errorf("Error fetching TOTP settings: %v", err)
+		return nil, err
+	}
+	return &t, nil
+}
+
+// VerifyTOTP checks a code against the user's secret. A code whose time step has
+// already been used is rejected so an observed code cannot be replayed.
+func (s *UserStore) VerifyTOTP(ctx context.Context, t *UserTOTP, code string) (bool, error) {
+	step, ok := matchTOTP(t.Secret, strings.TrimSpace(code), time.Now())
+	if !ok {
+		return false, nil
+	}
+	query := fmt.Sprintf(`UPDATE sftp_user_totp SET last_used_step = %s WHERE user_id = %s AND (last_used_step IS NULL OR last_used_step < %s)`,
+		s.placeholder(1), s.placeholder(2), s.placeholder(3))
+	res, err := s.db.ExecContext(ctx, query, step, t.UserID, step)
+	if err != nil {
+		return false, err
+	}
+	n, err := res.RowsAffected()
+	if err != nil {
+		return false, err
+	}
+	return n == 1, nil
+}
+
+// UseRecoveryCode consumes one of the user's unused recovery codes.
+func (s *UserStore) UseRecoveryCode(ctx context.Context, userID int, code string) (bool, error) {
+	code = strings.TrimSpace(code)
+	if code == "" {
+		return false, nil
+	}
+	query := fmt.Sprintf(`SELECT id, code_hash FROM sftp_user_recovery_codes WHERE user_id = %s AND used_at IS NULL`, s.placeholder(1))
+	rows, err := s.db.QueryContext(ctx, query, userID)
+	if err != nil {
+		return false, err
+	}
+	matched := 0
+	for rows.Next() {
+		var id int
+		var hash string
+		if err := rows.Scan(&id, &hash); err != nil {
+			rows.Close()
+			return false, err
+		}
+		if bcrypt.CompareHashAndPassword([]byte(hash), []byte(code)) == nil {
+			matched = id
+			break
+		}
+	}
+	rows.Close()
+	if matched == 0 {
+		return false, rows.Err()
+	}
+	update := fmt.Sprintf(`UPDATE sftp_user_recovery_codes SET used_at = %s WHERE id = %s AND used_at IS NULL`, s.placeholder(1), s.placeholder(2))
+	res, err := s.db.ExecContext(ctx, update, time.Now().UTC(), matched)
+	if err != nil {
+		return false, err
+	}
+	n, err := res.RowsAffected()
+	return n == 1, err
+}
@@ -0,0 +1,143 @@
+package main
+
+import (
+	"context"
+	"encoding/base32"
+	"testing"
+	"time"
+
+	"golang.org/x/crypto/bcrypt"
+)
+
+// rfc6238Secret is the SHA-1 key of the RFC 6238 test vectors.
+const rfc6238Secret = "12345678901234567890"
+
+func TestTOTPCodeRFC6238(t *testing.T) {
+	// Appendix B, SHA-1, truncated to the last 6 of the 8 digits
+	tests := []struct {
+		unix int64
+		want string
+	}{
+		{59, "287082"},
+		{1111111109, "081804"},
+		{1111111111, "050471"},
+		{1234567890, "005924"},
+		{2000000000, "279037"},
+		{20000000000, "353130"},
+	}
+	for _, tt := range tests {
+		if got := totpCode([]byte(rfc6238Secret), uint64(tt.unix/30)); got != tt.want {
+			t.Errorf("totpCode at %d = %s, want %s", tt.unix, got, tt.want)
+		}
+	}
+}
+
+func TestMatchTOTP(t *testing.T) {
+	secret := base32.StdEncoding.EncodeToString([]byte(rfc6238Secret))
+	now := time.Unix(1111111111, 0)
+	current := now.Unix() / 30
+	for _, delta := range []int64{-2, -1, 0, 1, 2} {
+		code := totpCode([]byte(rfc6238Secret), uint64(current+delta))
+		step, ok := matchTOTP(secret, code, now)
+		if want := delta >= -1 && delta <= 1; ok != want {
+			t.Errorf("code of step %+d accepted = %v, want %v", delta, ok, want)
+		} else if ok && step != current+delta {
+			t.Errorf("code of step %+d matched step %d, want %d", delta, step, current+delta)
+		}
+	}
+	// secrets are accepted as authenticator apps show them
+	if _, ok := matchTOTP("gezd gnbv gy3t qojq gezd gnbv gy3t qojq", "050471", now); !ok {
+		t.Error("lower-case secret with spaces rejected")
+	}
+	for _, code := range []string{"", "50471", "0050471", "123456"} {
+		if _, ok := matchTOTP(secret, code, now); ok {
+			t.Errorf("code %q accepted", code)
+		}
+	}
+	if _, ok := matchTOTP("not base32!", "050471", now); ok {
+		t.Error("invalid secret accepted")
+	}
+}
+
+// newTestTOTPUser creates alice, enrolled with rfc6238Secret and the given recovery codes.
+func newTestTOTPUser(t *testing.T, s *UserStore, recoveryCodes ...string) *UserTOTP {
+	t.Helper()
+	ctx := context.Background()
+	u := &UserRecord{Username: "alice", DisplayName: "alice", GroupName: "default"}
+	if err := s.CreateUser(ctx, u); err != nil {
+		t.Fatal(err)
+	}
+	secret := base32.StdEncoding.EncodeToString([]byte(rfc6238Secret))
+	if _, err := s.db.ExecContext(ctx, `INSERT INTO sftp_user_totp (user_id, secret) VALUES (?, ?)`, u.ID, secret); err != nil {
+		t.Fatal(err)
+	}
+	for _, code := range recoveryCodes {
+		hash, err := bcrypt.GenerateFromPassword([]byte(code), bcrypt.MinCost)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if _, err := s.db.ExecContext(ctx, `INSERT INTO sftp_user_recovery_codes (user_id, code_hash) VALUES (?, ?)`, u.ID, string(hash)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	totp, err := s.FetchUserTOTP(ctx, u.ID)
+	if err != nil || totp == nil {
+		t.Fatalf("FetchUserTOTP = %v, %v", totp, err)
+	}
+	return totp
+}
+
+func TestVerifyTOTPRefusesReuse(t *testing.T) {
+	ctx := context.Background()
+	s := newTestStore(t)
+	totp := newTestTOTPUser(t, s)
+	if !totp.Required("password") || totp.Required("publickey") {
+		t.Errorf("default requirement: after password %v, after public key %v", totp.Required("password"), totp.Required("publickey"))
+	}
+	// near the end of a step the next one could start between the calls
+	if time.Now().Unix()%30 > 25 {
+		time.Sleep(5 * time.Second)
+	}
+	current := time.Now().Unix() / 30
+	code := func(delta int64) string { return totpCode([]byte(rfc6238Secret), uint64(current+delta)) }
+
+	if ok, err := s.VerifyTOTP(ctx, totp, " "+code(0)+" "); err != nil || !ok {
+		t.Fatalf("current code = %v, %v", ok, err)
+	}
+	if ok, err := s.VerifyTOTP(ctx, totp, code(0)); err != nil || ok {
+		t.Errorf("reused code = %v, %v", ok, err)
+	}
+	// an earlier step, though within the drift allowed, is a replay as well
+	if ok, err := s.VerifyTOTP(ctx, totp, code(-1)); err != nil || ok {
+		t.Errorf("code of the previous step = %v, %v", ok, err)
+	}
+	if ok, err := s.VerifyTOTP(ctx, totp, code(1)); err != nil || !ok {
+		t.Errorf("code of the next step = %v, %v", ok, err)
+	}
+	stored, err := s.FetchUserTOTP(ctx, totp.UserID)
+	if err != nil || stored.LastUsedStep.Int64 != current+1 {
+		t.Errorf("last_used_step = %v, %v; want %d", stored.LastUsedStep, err, current+1)
+	}
+}
+
+func TestUseRecoveryCode(t *testing.T) {
+	ctx := context.Background()
+	s := newTestStore(t)
+	totp := newTestTOTPUser(t, s, "alpha-bravo", "charlie-delta")
+	tests := []struct {
+		code string
+		want bool
+	}{
+		{"wrong", false},
+		{"", false},
+		{"alpha-bravo", true},
+		{"alpha-bravo", false}, // used up
+		{" charlie-delta\n", true},
+		{"charlie-delta", false},
+	}
+	for _, tt := range tests {
+		if ok, err := s.UseRecoveryCode(ctx, totp.UserID, tt.code); err != nil || ok != tt.want {
+			t.Errorf("UseRecoveryCode(%q) = %v, %v; want %v", tt.code, ok, err, tt.want)
+		}
+	}
+}
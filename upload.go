@@ -0,0 +1,153 @@
+package main
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"fmt"
+	"io/fs"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+
+	"go.uber.org/zap"
+)
+
+// Upload modes, set by UPLOAD_MODE or per user in sftp_user_storage.upload_mode.
+const (
+	// UploadModeDirect writes straight into the destination file.
+	UploadModeDirect = "direct"
+	// UploadModeAtomic writes to a hidden temporary file next to the destination
+	// and renames it into place when the client closes the handle.
+	UploadModeAtomic = "atomic"
+)
+
+// uploadTempSuffix marks temporary upload files so they can be purged.
+const uploadTempSuffix = ".sftp-upload"
+
+// atomicWriter is implemented by filesystems whose writes only become visible
+// when the handle is closed, which makes the temporary file unnecessary.
+type atomicWriter interface {
+	AtomicWrites() bool
+}
+
+// uploadMode returns the mode for a user with the given storage settings (may be nil).
+func uploadMode(storage *UserStorage) (string, error) {
+	mode := getEnvOrDefault("UPLOAD_MODE", UploadModeDirect)
+	if storage != nil && storage.UploadMode.Valid {
+		mode = storage.UploadMode.String
+	}
+	switch mode = strings.ToLower(mode); mode {
+	case UploadModeDirect, UploadModeAtomic:
+		return mode, nil
+	default:
+		return "", fmt.Errorf("unknown upload mode %q", mode)
+	}
+}
+
+// uploadTempName returns a hidden, unique name in the same directory as p.
+func uploadTempName(p string) (string, error) {
+	var b [8]byte
+	if _, err := rand.Read(b[:]); err != nil {
+		return "", err
+	}
+	return path.Join(path.Dir(p), "."+path.Base(p)+"."+hex.EncodeToString(b[:])+uploadTempSuffix), nil
+}
+
+func isUploadTemp(name string) bool {
+	return strings.HasPrefix(name, ".") && strings.HasSuffix(name, uploadTempSuffix)
+}
+
+// atomicUpload is the handle of an upload in atomic mode. Close renames the
+// temporary file over the destination; if a write failed or the transfer was
+// interrupted, the temporary file is removed and the destination is untouched.
+type atomicUpload struct {
+	fs     FileSystem
+	file   File
+	temp   string
+	final  string
+	logger *zap.SugaredLogger
+
+	mu     sync.Mutex
+	failed error
+}
+
+func (u *atomicUpload) ReadAt(b []byte, off int64) (int, error) {
+	return u.file.ReadAt(b, off)
+}
+
+func (u *atomicUpload) WriteAt(b []byte, off int64) (int, error) {
+	n, err := u.file.WriteAt(b, off)
+	if err != nil {
+		u.fail(err)
+	}
+	return n, err
+}
+
+// TransferError is called by the request server when the session ends with the
+// handle still open.
+func (u *atomicUpload) TransferError(err error) {
+	u.fail(err)
+}
+
+func (u *atomicUpload) fail(err error) {
+	u.mu.Lock()
+	defer u.mu.Unlock()
+	if u.failed == nil {
+		u.failed = err
+	}
+}
+
+func (u *atomicUpload) Close() error {
+	err := u.file.Close()
+	u.mu.Lock()
+	if err == nil {
+		err = u.failed
+	}
+	u.mu.Unlock()
+	if err == nil {
+		if err = u.fs.Rename(u.temp, u.final); err == nil {
+			u.logger.Debugf("Upload of %s completed", u.final)
+			return nil
+		}
+	}
+	u.logger.Warnf("Upload of %s failed, discarding it: %v", u.final, err)
+	if rerr := u.fs.Remove(u.temp); rerr != nil && !os.IsNotExist(rerr) {
+		u.logger.Errorf("Failed to remove temporary upload %s: %v", u.temp, rerr)
+	}
+	return err
+}
+
+// purgeUploadTemps removes temporary upload files under root that were last
+// modified before cutoff; they belong to transfers interrupted by a crash or
+// restart.
+func purgeUploadTemps(root string, cutoff time.Time, logger *zap.SugaredLogger) {
+	removed := 0
+	err := filepath.WalkDir(root, func(p string, d fs.DirEntry, err error) error {
+		if err != nil {
+			logger.Warnf("Skipping %s while purging temporary uploads: %v", p, err)
+			return nil
+		}
+		if d.IsDir() || !isUploadTemp(d.Name()) {
+			return nil
+		}
+		info, err := d.Info()
+		if err != nil || !info.ModTime().Before(cutoff) {
+			return nil
+		}
+		if err := os.Remove(p); err != nil {
+			logger.Warnf("Failed to remove orphaned upload %s: %v", p, err)
+			return nil
+		}
+		removed++
+		return nil
+	})
+	if err != nil {
+		logger.Warnf("Purging temporary uploads under %s: %v", root, err)
+	}
+	if removed > 0 {
+		logger.Infof("Removed %d orphaned temporary upload(s) under %s", removed, root)
+	}
+}
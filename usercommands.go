@@ -0,0 +1,517 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+
+	"golang.org/x/crypto/bcrypt"
+	"golang.org/x/crypto/ssh"
+)
+
+// userJSON is a user as printed by the admin commands and the admin API.
+type userJSON struct {
+	ID             int         `json:"id"`
+	Username       string      `json:"username"`
+	DisplayName    string      `json:"display_name"`
+	GroupName      string      `json:"group_name"`
+	RootPath       string      `json:"root_path"`
+	Perms          *Permission `json:"perms"` // null: the group's
+	Disabled       bool        `json:"disabled"`
+	HasPassword    bool        `json:"has_password"`
+	CreatedAt      *time.Time  `json:"created_at,omitempty"`
+	EffectiveRoot  *string     `json:"effective_root_path,omitempty"`
+	EffectivePerms *Permission `json:"effective_perms,omitempty"`
+	Keys           []keyJSON   `json:"keys,omitempty"`
+}
+
+func newUserJSON(u *UserRecord) userJSON {
+	v := userJSON{
+		ID:          u.ID,
+		Username:    u.Username,
+		DisplayName: u.DisplayName,
+		GroupName:   u.GroupName,
+		RootPath:    u.RootPath,
+		Disabled:    u.Disabled,
+		HasPassword: u.PasswordHash.Valid && u.PasswordHash.String != "",
+	}
+	if u.Perms.Valid {
+		p := Permission(u.Perms.Int64)
+		v.Perms = &p
+	}
+	if u.CreatedAt.Valid {
+		v.CreatedAt = &u.CreatedAt.Time
+	}
+	return v
+}
+
+// keyJSON is an authorized key as printed by the admin commands and the admin API.
+type keyJSON struct {
+	ID          int        `json:"id"`
+	Type        string     `json:"type,omitempty"`
+	Fingerprint string     `json:"fingerprint,omitempty"`
+	PublicKey   string     `json:"public_key"`
+	Comment     string     `json:"comment,omitempty"`
+	Enabled     bool       `json:"enabled"`
+	ExpiresAt   *time.Time `json:"expires_at,omitempty"`
+	LastUsedAt  *time.Time `json:"last_used_at,omitempty"`
+}
+
+func newKeyJSON(k *UserKey) keyJSON {
+	v := keyJSON{ID: k.ID, PublicKey: k.PublicKey, Comment: k.Comment.String, Enabled: k.Enabled}
+	if pub, _, _, _, err := ssh.ParseAuthorizedKey([]byte(k.PublicKey)); err == nil {
+		v.Type, v.Fingerprint = pub.Type(), ssh.FingerprintSHA256(pub)
+	}
+	if k.ExpiresAt.Valid {
+		v.ExpiresAt = &k.ExpiresAt.Time
+	}
+	if k.LastUsedAt.Valid {
+		v.LastUsedAt = &k.LastUsedAt.Time
+	}
+	return v
+}
+
+func formatPerms(p *Permission) string {
+	if p == nil {
+		return "(group)"
+	}
+	if *p == 0 {
+		return "0 (none)"
+	}
+	return fmt.Sprintf("%d %s", *p, *p)
+}
+
+// parsePermsFlag parses --perms: a bitmask, or "inherit" (or nothing) for the group's.
+func parsePermsFlag(s string) (sql.NullInt64, error) {
+	if s = strings.TrimSpace(s); s == "" || s == "inherit" {
+		return sql.NullInt64{}, nil
+	}
+	p, err := ParsePermission(s)
+	if err != nil {
+		return sql.NullInt64{}, err
+	}
+	return sql.NullInt64{Int64: int64(p), Valid: true}, nil
+}
+
+// parseAuthorizedKeyArg reads a key given inline, as @file or as - (stdin),
+// and returns the authorized_keys line and its comment.
+func parseAuthorizedKeyArg(arg string) (string, string, error) {
+	line := arg
+	switch {
+	case arg == "-":
+		b, err := io.ReadAll(os.Stdin)
+		if err != nil {
+			return "", "", err
+		}
+		line = string(b)
+	case strings.HasPrefix(arg, "@"):
+		b, err := os.ReadFile(arg[1:])
+		if err != nil {
+			return "", "", err
+		}
+		line = string(b)
+	}
+	return parseAuthorizedKey(line)
+}
+
+// parseAuthorizedKey checks that line holds one authorized_keys entry and
+// returns it trimmed, with its comment.
+func parseAuthorizedKey(line string) (string, string, error) {
+	line = strings.TrimSpace(line)
+	_, comment, _, rest, err := ssh.ParseAuthorizedKey([]byte(line))
+	if err != nil {
+		return "", "", fmt.Errorf("invalid public key: %w", err)
+	}
+	if len(strings.TrimSpace(string(rest))) > 0 {
+		return "", "", fmt.Errorf("expected a single public key")
+	}
+	return line, comment, nil
+}
+
+// parseExpiry accepts RFC 3339 times and plain dates (midnight UTC).
+func parseExpiry(s string) (time.Time, error) {
+	if t, err := time.Parse(time.RFC3339, s); err == nil {
+		return t, nil
+	}
+	return time.Parse("2006-01-02", s)
+}
+
+// fetchUserRecord is FetchUserRecord with a readable error for unknown users.
+func fetchUserRecord(cxt context.Context, store *UserStore, username string) (*UserRecord, error) {
+	u, err := store.FetchUserRecord(cxt, username)
+	if errors.Is(err, sql.ErrNoRows) {
+		return nil, fmt.Errorf("no user %q", username)
+	}
+	return u, err
+}
+
+func runUserCommand(store *UserStore, args []string, out cmdOutput) error {
+	cxt, cancel := context.WithTimeout(context.Background(), 30*time.Second)
+	defer cancel()
+	if len(args) == 0 {
+		return fmt.Errorf("missing user subcommand\n%s", commandUsage)
+	}
+	switch args[0] {
+	case "list":
+		users, err := store.ListUsers(cxt)
+		if err != nil {
+			return err
+		}
+		list := make([]userJSON, 0, len(users))
+		for i := range users {
+			list = append(list, newUserJSON(&users[i]))
+		}
+		return out.print(list, func() error {
+			w := table()
+			fmt.Fprintln(w, "ID\tUSERNAME\tDISPLAY NAME\tGROUP\tSTATE\tPERMS\tROOT")
+			for _, u := range list {
+				state := "enabled"
+				if u.Disabled {
+					state = "disabled"
+				}
+				fmt.Fprintf(w, "%d\t%s\t%s\t%s\t%s\t%s\t%s\n", u.ID, u.Username, u.DisplayName, u.GroupName, state, formatPerms(u.Perms), u.RootPath)
+			}
+			return w.Flush()
+		})
+	case "show":
+		if len(args) != 2 {
+			return fmt.Errorf("usage: user show <name>")
+		}
+		return showUser(cxt, store, args[1], out)
+	case "add":
+		return addUser(cxt, store, args[1:], out)
+	case "update":
+		return updateUser(cxt, store, args[1:], out)
+	case "disable", "enable":
+		if len(args) != 2 {
+			return fmt.Errorf("usage: user %s <name>", args[0])
+		}
+		u, err := fetchUserRecord(cxt, store, args[1])
+		if err != nil {
+			return err
+		}
+		u.Disabled = args[0] == "disable"
+		if _, err := store.UpdateUser(cxt, u); err != nil {
+			return err
+		}
+		return out.print(newUserJSON(u), func() error {
+			fmt.Printf("User %s %sd\n", u.Username, args[0])
+			return nil
+		})
+	case "delete":
+		if len(args) != 2 {
+			return fmt.Errorf("usage: user delete <name>")
+		}
+		deleted, err := store.DeleteUser(cxt, args[1])
+		if err != nil {
+			return err
+		}
+		if !deleted {
+			return fmt.Errorf("no user %q", args[1])
+		}
+		return out.print(map[string]string{"deleted": args[1]}, func() error {
+			fmt.Printf("Deleted user %s\n", args[1])
+			return nil
+		})
+	case "passwd":
+		fs := newFlagSet("user passwd")
+		clearPassword := fs.Bool("clear", false, "")
+		rest, err := parseFlags(fs, args[1:])
+		if err != nil || len(rest) != 1 {
+			return fmt.Errorf("usage: user passwd <name> [--clear]")
+		}
+		if _, err := fetchUserRecord(cxt, store, rest[0]); err != nil {
+			return err
+		}
+		var hash sql.NullString
+		if !*clearPassword {
+			password, err := readPassword()
+			if err != nil {
+				return err
+			}
+			b, err := bcrypt.GenerateFromPassword([]byte(password), bcrypt.DefaultCost)
+			if err != nil {
+				return err
+			}
+			hash = sql.NullString{String: string(b), Valid: true}
+		}
+		if _, err := store.SetUserPassword(cxt, rest[0], hash); err != nil {
+			return err
+		}
+		return out.print(map[string]any{"username": rest[0], "has_password": hash.Valid}, func() error {
+			if hash.Valid {
+				fmt.Printf("Password of %s changed\n", rest[0])
+			} else {
+				fmt.Printf("Password of %s removed\n", rest[0])
+			}
+			return nil
+		})
+	case "key":
+		return runUserKeyCommand(cxt, store, args[1:], out)
+	default:
+		return fmt.Errorf("unknown user subcommand %q\n%s", args[0], commandUsage)
+	}
+}
+
+func showUser(cxt context.Context, store *UserStore, username string, out cmdOutput) error {
+	u, err := fetchUserRecord(cxt, store, username)
+	if err != nil {
+		return err
+	}
+	v := newUserJSON(u)
+	// the settings a login gets once the group's defaults are applied
+	effective, err := store.FetchUserByUsername(cxt, username)
+	if err != nil {
+		return err
+	}
+	v.EffectiveRoot, v.EffectivePerms = &effective.RootPath, &effective.Perms
+	keys, err := store.FetchUserKeys(cxt, u.ID)
+	if err != nil {
+		return err
+	}
+	for i := range keys {
+		v.Keys = append(v.Keys, newKeyJSON(&keys[i]))
+	}
+	return out.print(v, func() error {
+		w := table()
+		fmt.Fprintf(w, "ID:\t%d\n", v.ID)
+		fmt.Fprintf(w, "Username:\t%s\n", v.Username)
+		fmt.Fprintf(w, "Display name:\t%s\n", v.DisplayName)
+		fmt.Fprintf(w, "Group:\t%s\n", v.GroupName)
+		fmt.Fprintf(w, "Disabled:\t%t\n", v.Disabled)
+		fmt.Fprintf(w, "Password:\t%t\n", v.HasPassword)
+		fmt.Fprintf(w, "Root:\t%s\n", v.RootPath)
+		fmt.Fprintf(w, "Effective root:\t%s\n", *v.EffectiveRoot)
+		fmt.Fprintf(w, "Perms:\t%s\n", formatPerms(v.Perms))
+		fmt.Fprintf(w, "Effective perms:\t%s\n", formatPerms(v.EffectivePerms))
+		if v.CreatedAt != nil {
+			fmt.Fprintf(w, "Created:\t%s\n", v.CreatedAt.Local().Format(time.RFC3339))
+		}
+		fmt.Fprintf(w, "Keys:\t%d\n", len(v.Keys))
+		if err := w.Flush(); err != nil {
+			return err
+		}
+		if len(v.Keys) > 0 {
+			return printKeys(v.Keys)
+		}
+		return nil
+	})
+}
+
+func addUser(cxt context.Context, store *UserStore, args []string, out cmdOutput) error {
+	fs := newFlagSet("user add")
+	displayName := fs.String("display-name", "", "")
+	group := fs.String("group", "default", "")
+	root := fs.String("root", "", "")
+	perms := fs.String("perms", "", "")
+	askPassword := fs.Bool("password", false, "")
+	key := fs.String("key", "", "")
+	disabled := fs.Bool("disabled", false, "")
+	rest, err := parseFlags(fs, args)
+	if err != nil || len(rest) != 1 {
+		return fmt.Errorf("usage: user add <name> [--display-name s] [--group g] [--root path] [--perms p] [--password] [--key key|@file] [--disabled]")
+	}
+	u := &UserRecord{Username: rest[0], DisplayName: *displayName, GroupName: *group, RootPath: *root, Disabled: *disabled}
+	if u.DisplayName == "" {
+		u.DisplayName = u.Username
+	}
+	if u.Perms, err = parsePermsFlag(*perms); err != nil {
+		return err
+	}
+	var userKey *UserKey
+	if *key != "" {
+		line, comment, err := parseAuthorizedKeyArg(*key)
+		if err != nil {
+			return err
+		}
+		userKey = &UserKey{PublicKey: line, Comment: sql.NullString{String: comment, Valid: comment != ""}, Enabled: true}
+	}
+	if *askPassword {
+		password, err := readPassword()
+		if err != nil {
+			return err
+		}
+		b, err := bcrypt.GenerateFromPassword([]byte(password), bcrypt.DefaultCost)
+		if err != nil {
+			return err
+		}
+		u.PasswordHash = sql.NullString{String: string(b), Valid: true}
+	}
+	if _, err := store.FetchUserRecord(cxt, u.Username); err == nil {
+		return fmt.Errorf("user %q already exists", u.Username)
+	}
+	var keys []*UserKey
+	if userKey != nil {
+		keys = append(keys, userKey)
+	}
+	if err := store.CreateUser(cxt, u, keys...); err != nil {
+		return err
+	}
+	v := newUserJSON(u)
+	for _, k := range keys {
+		v.Keys = append(v.Keys, newKeyJSON(k))
+	}
+	return out.print(v, func() error {
+		fmt.Printf("Created user %s (id %d)\n", u.Username, u.ID)
+		return nil
+	})
+}
+
+func updateUser(cxt context.Context, store *UserStore, args []string, out cmdOutput) error {
+	fs := newFlagSet("user update")
+	displayName := fs.String("display-name", "", "")
+	group := fs.String("group", "", "")
+	root := fs.String("root", "", "")
+	perms := fs.String("perms", "", "")
+	rename := fs.String("rename", "", "")
+	rest, err := parseFlags(fs, args)
+	if err != nil || len(rest) != 1 {
+		return fmt.Errorf("usage: user update <name> [--display-name s] [--group g] [--root path] [--perms p|inherit] [--rename new]")
+	}
+	u, err := fetchUserRecord(cxt, store, rest[0])
+	if err != nil {
+		return err
+	}
+	// only the flags given change the user
+	var flagErr error
+	fs.Visit(func(f *flag.Flag) {
+		switch f.Name {
+		case "display-name":
+			u.DisplayName = *displayName
+		case "group":
+			u.GroupName = *group
+		case "root":
+			u.RootPath = *root
+		case "perms":
+			u.Perms, flagErr = parsePermsFlag(*perms)
+		case "rename":
+			u.Username = strings.TrimSpace(*rename)
+			if u.Username == "" {
+				flagErr = fmt.Errorf("--rename needs a name")
+			}
+		}
+	})
+	if flagErr != nil {
+		return flagErr
+	}
+	if u.Username != rest[0] {
+		if _, err := store.FetchUserRecord(cxt, u.Username); err == nil {
+			return fmt.Errorf("user %q already exists", u.Username)
+		}
+	}
+	if _, err := store.UpdateUser(cxt, u); err != nil {
+		return err
+	}
+	return out.print(newUserJSON(u), func() error {
+		fmt.Printf("Updated user %s\n", u.Username)
+		return nil
+	})
+}
+
+func runUserKeyCommand(cxt context.Context, store *UserStore, args []string, out cmdOutput) error {
+	if len(args) == 0 {
+		return fmt.Errorf("missing user key subcommand\n%s", commandUsage)
+	}
+	switch args[0] {
+	case "list":
+		if len(args) != 2 {
+			return fmt.Errorf("usage: user key list <name>")
+		}
+		u, err := fetchUserRecord(cxt, store, args[1])
+		if err != nil {
+			return err
+		}
+		keys, err := store.FetchUserKeys(cxt, u.ID)
+		if err != nil {
+			return err
+		}
+		list := make([]keyJSON, 0, len(keys))
+		for i := range keys {
+			list = append(list, newKeyJSON(&keys[i]))
+		}
+		return out.print(list, func() error { return printKeys(list) })
+	case "add":
+		fs := newFlagSet("user key add")
+		comment := fs.String("comment", "", "")
+		expires := fs.String("expires", "", "")
+		rest, err := parseFlags(fs, args[1:])
+		if err != nil || len(rest) != 2 {
+			return fmt.Errorf("usage: user key add <name> <key|@file|-> [--comment s] [--expires time]")
+		}
+		u, err := fetchUserRecord(cxt, store, rest[0])
+		if err != nil {
+			return err
+		}
+		line, keyComment, err := parseAuthorizedKeyArg(rest[1])
+		if err != nil {
+			return err
+		}
+		if *comment != "" {
+			keyComment = *comment
+		}
+		k := &UserKey{UserID: u.ID, PublicKey: line, Comment: sql.NullString{String: keyComment, Valid: keyComment != ""}, Enabled: true}
+		if *expires != "" {
+			t, err := parseExpiry(*expires)
+			if err != nil {
+				return fmt.Errorf("invalid --expires %q: want RFC 3339 or YYYY-MM-DD", *expires)
+			}
+			k.ExpiresAt = sql.NullTime{Time: t, Valid: true}
+		}
+		if err := store.AddUserKey(cxt, k); err != nil {
+			return err
+		}
+		v := newKeyJSON(k)
+		return out.print(v, func() error {
+			fmt.Printf("Added key %d (%s) to %s\n", v.ID, v.Fingerprint, u.Username)
+			return nil
+		})
+	case "remove":
+		if len(args) != 3 {
+			return fmt.Errorf("usage: user key remove <name> <id>")
+		}
+		u, err := fetchUserRecord(cxt, store, args[1])
+		if err != nil {
+			return err
+		}
+		id, err := strconv.Atoi(args[2])
+		if err != nil {
+			return fmt.Errorf("invalid key id %q", args[2])
+		}
+		removed, err := store.DeleteUserKey(cxt, u.ID, id)
+		if err != nil {
+			return err
+		}
+		if !removed {
+			return fmt.Errorf("user %s has no key %d", u.Username, id)
+		}
+		return out.print(map[string]any{"username": u.Username, "deleted_key": id}, func() error {
+			fmt.Printf("Removed key %d from %s\n", id, u.Username)
+			return nil
+		})
+	default:
+		return fmt.Errorf("unknown user key subcommand %q\n%s", args[0], commandUsage)
+	}
+}
+
+func printKeys(keys []keyJSON) error {
+	w := table()
+	fmt.Fprintln(w, "KEY ID\tTYPE\tFINGERPRINT\tCOMMENT\tENABLED\tEXPIRES\tLAST USED")
+	for _, k := range keys {
+		expires, lastUsed := "", ""
+		if k.ExpiresAt != nil {
+			expires = k.ExpiresAt.Local().Format(time.RFC3339)
+		}
+		if k.LastUsedAt != nil {
+			lastUsed = k.LastUsedAt.Local().Format(time.RFC3339)
+		}
+		fmt.Fprintf(w, "%d\t%s\t%s\t%s\t%t\t%s\t%s\n", k.ID, k.Type, k.Fingerprint, k.Comment, k.Enabled, expires, lastUsed)
+	}
+	return w.Flush()
+}
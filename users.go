@@ -0,0 +1,222 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+	"time"
+)
+
+// UserRecord is a row of sftp_users as stored, before the group's defaults are
+// applied (see FetchUserByUsername for the effective settings).
+type UserRecord struct {
+	ID           int
+	Username     string
+	DisplayName  string
+	GroupName    string
+	PasswordHash sql.NullString // bcrypt hash
+	PublicKey    sql.NullString
+	RootPath     string        // empty: the group's root_template or BASE_FS_ROOT/<username>
+	Perms        sql.NullInt64 // NULL: the group's perms
+	Disabled     bool
+	CreatedAt    sql.NullTime
+}
+
+const userRecordColumns = `id, username, display_name, group_name, password_hash, public_key, root_path, perms, disabled, created_at`
+
+func scanUserRecord(scan func(dest ...any) error) (*UserRecord, error) {
+	var u UserRecord
+	err := scan(&u.ID, &u.Username, &u.DisplayName, &u.GroupName, &u.PasswordHash, &u.PublicKey, &u.RootPath, &u.Perms, &u.Disabled, &u.CreatedAt)
+	if err != nil {
+		return nil, err
+	}
+	return &u, nil
+}
+
+// ListUsers returns every user ordered by username.
+func (s *UserStore) ListUsers(ctx context.Context) ([]UserRecord, error) {
+	rows, err := s.db.QueryContext(ctx, `SELECT `+userRecordColumns+` FROM sftp_users ORDER BY username`)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	var users []UserRecord
+	for rows.Next() {
+		u, err := scanUserRecord(rows.Scan)
+		if err != nil {
+			return nil, err
+		}
+		users = append(users, *u)
+	}
+	return users, rows.Err()
+}
+
+// FetchUserRecord returns the stored row of a user, or sql.ErrNoRows.
+func (s *UserStore) FetchUserRecord(ctx context.Context, username string) (*UserRecord, error) {
+	query := fmt.Sprintf(`SELECT %s FROM sftp_users WHERE username = %s`, userRecordColumns, s.placeholder(1))
+	return scanUserRecord(s.db.QueryRowContext(ctx, query, username).Scan)
+}
+
+// CreateUser inserts u together with keys, or nothing if any insert fails, and
+// sets their IDs and creation times.
+func (s *UserStore) CreateUser(ctx context.Context, u *UserRecord, keys ...*UserKey) error {
+	tx, err := s.db.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	insert := fmt.Sprintf(`INSERT INTO sftp_users (username, display_name, group_name, password_hash, public_key, root_path, perms, disabled) VALUES (%s, %s, %s, %s, %s, %s, %s, %s)`,
+		s.placeholder(1), s.placeholder(2), s.placeholder(3), s.placeholder(4), s.placeholder(5), s.placeholder(6), s.placeholder(7), s.placeholder(8))
+	if _, err := tx.ExecContext(ctx, insert, u.Username, u.DisplayName, u.GroupName, u.PasswordHash, u.PublicKey, u.RootPath, u.Perms, u.Disabled); err != nil {
+		return err
+	}
+	// LastInsertId is not supported by every driver; the username is unique
+	query := fmt.Sprintf(`SELECT %s FROM sftp_users WHERE username = %s`, userRecordColumns, s.placeholder(1))
+	created, err := scanUserRecord(tx.QueryRowContext(ctx, query, u.Username).Scan)
+	if err != nil {
+		return err
+	}
+	for _, k := range keys {
+		k.UserID = created.ID
+		if err := s.insertUserKey(ctx, tx, k); err != nil {
+			return err
+		}
+	}
+	if err := tx.Commit(); err != nil {
+		return err
+	}
+	u.ID, u.CreatedAt = created.ID, created.CreatedAt
+	return nil
+}
+
+// UpdateUser saves every field of u except the password hash, which
+// SetUserPassword changes, and the ID and creation time. A new username is
+// carried over to the user's rows in scopeTables and to a lockout in
+// sftp_bans; rows left under the new name by an earlier account are dropped
+// first, so the user does not pick them up. It reports whether the user exists.
+func (s *UserStore) UpdateUser(ctx context.Context, u *UserRecord) (bool, error) {
+	tx, err := s.db.BeginTx(ctx, nil)
+	if err != nil {
+		return false, err
+	}
+	defer tx.Rollback()
+
+	var oldName string
+	err = tx.QueryRowContext(ctx, fmt.Sprintf(`SELECT username FROM sftp_users WHERE id = %s`, s.placeholder(1)), u.ID).Scan(&oldName)
+	if errors.Is(err, sql.ErrNoRows) {
+		return false, nil
+	}
+	if err != nil {
+		return false, err
+	}
+	update := fmt.Sprintf(`UPDATE sftp_users SET username = %s, display_name = %s, group_name = %s, public_key = %s, root_path = %s, perms = %s, disabled = %s WHERE id = %s`,
+		s.placeholder(1), s.placeholder(2), s.placeholder(3), s.placeholder(4), s.placeholder(5), s.placeholder(6), s.placeholder(7), s.placeholder(8))
+	if _, err := tx.ExecContext(ctx, update, u.Username, u.DisplayName, u.GroupName, u.PublicKey, u.RootPath, u.Perms, u.Disabled, u.ID); err != nil {
+		return false, err
+	}
+	if u.Username != oldName {
+		for _, table := range scopeTables {
+			stale := fmt.Sprintf(`DELETE FROM %s WHERE scope = 'user' AND name = %s`, table, s.placeholder(1))
+			if _, err := tx.ExecContext(ctx, stale, u.Username); err != nil {
+				return false, err
+			}
+			rename := fmt.Sprintf(`UPDATE %s SET name = %s WHERE scope = 'user' AND name = %s`, table, s.placeholder(1), s.placeholder(2))
+			if _, err := tx.ExecContext(ctx, rename, u.Username, oldName); err != nil {
+				return false, err
+			}
+		}
+		stale := fmt.Sprintf(`DELETE FROM sftp_bans WHERE kind = 'user' AND value = %s`, s.placeholder(1))
+		if _, err := tx.ExecContext(ctx, stale, u.Username); err != nil {
+			return false, err
+		}
+		rename := fmt.Sprintf(`UPDATE sftp_bans SET value = %s WHERE kind = 'user' AND value = %s`, s.placeholder(1), s.placeholder(2))
+		if _, err := tx.ExecContext(ctx, rename, u.Username, oldName); err != nil {
+			return false, err
+		}
+	}
+	return true, tx.Commit()
+}
+
+// SetUserPassword stores a new bcrypt hash for the user; an invalid hash
+// removes password authentication. It reports whether the user exists.
+func (s *UserStore) SetUserPassword(ctx context.Context, username string, hash sql.NullString) (bool, error) {
+	update := fmt.Sprintf(`UPDATE sftp_users SET password_hash = %s WHERE username = %s`, s.placeholder(1), s.placeholder(2))
+	res, err := s.db.ExecContext(ctx, update, hash, username)
+	if err != nil {
+		return false, err
+	}
+	n, err := res.RowsAffected()
+	return n > 0, err
+}
+
+// DeleteUser removes the user with their keys, 2FA settings, storage settings
+// and their own rows in scopeTables (quota, IP rules, path permissions and
+// session limits), so that a new user with the same name starts clean.
+// Foreign key enforcement is optional in SQLite, so the dependent rows are
+// deleted explicitly. It reports whether the user existed.
+func (s *UserStore) DeleteUser(ctx context.Context, username string) (bool, error) {
+	tx, err := s.db.BeginTx(ctx, nil)
+	if err != nil {
+		return false, err
+	}
+	defer tx.Rollback()
+
+	var id int
+	err = tx.QueryRowContext(ctx, fmt.Sprintf(`SELECT id FROM sftp_users WHERE username = %s`, s.placeholder(1)), username).Scan(&id)
+	if errors.Is(err, sql.ErrNoRows) {
+		return false, nil
+	}
+	if err != nil {
+		return false, err
+	}
+	for _, table := range []string{"sftp_user_keys", "sftp_user_totp", "sftp_user_recovery_codes", "sftp_user_storage"} {
+		if _, err := tx.ExecContext(ctx, fmt.Sprintf(`DELETE FROM %s WHERE user_id = %s`, table, s.placeholder(1)), id); err != nil {
+			return false, err
+		}
+	}
+	for _, table := range scopeTables {
+		if _, err := tx.ExecContext(ctx, fmt.Sprintf(`DELETE FROM %s WHERE scope = 'user' AND name = %s`, table, s.placeholder(1)), username); err != nil {
+			return false, err
+		}
+	}
+	if _, err := tx.ExecContext(ctx, fmt.Sprintf(`DELETE FROM sftp_users WHERE id = %s`, s.placeholder(1)), id); err != nil {
+		return false, err
+	}
+	return true, tx.Commit()
+}
+
+// AddUserKey registers a key and sets its ID.
+func (s *UserStore) AddUserKey(ctx context.Context, k *UserKey) error {
+	return s.insertUserKey(ctx, s.db, k)
+}
+
+func (s *UserStore) insertUserKey(ctx context.Context, q querier, k *UserKey) error {
+	insert := fmt.Sprintf(`INSERT INTO sftp_user_keys (user_id, public_key, comment, enabled, expires_at, created_at) VALUES (%s, %s, %s, %s, %s, %s)`,
+		s.placeholder(1), s.placeholder(2), s.placeholder(3), s.placeholder(4), s.placeholder(5), s.placeholder(6))
+	now := time.Now().UTC()
+	if k.ExpiresAt.Valid {
+		k.ExpiresAt.Time = k.ExpiresAt.Time.UTC()
+	}
+	if _, err := q.ExecContext(ctx, insert, k.UserID, k.PublicKey, k.Comment, k.Enabled, k.ExpiresAt, now); err != nil {
+		return err
+	}
+	query := fmt.Sprintf(`SELECT MAX(id) FROM sftp_user_keys WHERE user_id = %s AND public_key = %s`, s.placeholder(1), s.placeholder(2))
+	if err := q.QueryRowContext(ctx, query, k.UserID, k.PublicKey).Scan(&k.ID); err != nil {
+		return err
+	}
+	k.CreatedAt = sql.NullTime{Time: now, Valid: true}
+	return nil
+}
+
+// DeleteUserKey removes one of the user's keys. It reports whether it existed.
+func (s *UserStore) DeleteUserKey(ctx context.Context, userID, keyID int) (bool, error) {
+	query := fmt.Sprintf(`DELETE FROM sftp_user_keys WHERE id = %s AND user_id = %s`, s.placeholder(1), s.placeholder(2))
+	res, err := s.db.ExecContext(ctx, query, keyID, userID)
+	if err != nil {
+		return false, err
+	}
+	n, err := res.RowsAffected()
+	return n > 0, err
+}
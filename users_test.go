@@ -0,0 +1,63 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"testing"
+)
+
+func TestCreateUserWithKeys(t *testing.T) {
+	ctx := context.Background()
+	s := newTestStore(t)
+	u := &UserRecord{Username: "alice", DisplayName: "Alice", GroupName: "default"}
+	keys := []*UserKey{
+		{PublicKey: "ssh-ed25519 AAAA one", Enabled: true},
+		{PublicKey: "ssh-ed25519 AAAA two", Enabled: true},
+	}
+	if err := s.CreateUser(ctx, u, keys...); err != nil {
+		t.Fatal(err)
+	}
+	if u.ID == 0 || !u.CreatedAt.Valid {
+		t.Errorf("created user has ID %d, created at %v", u.ID, u.CreatedAt)
+	}
+	stored, err := s.FetchUserKeys(ctx, u.ID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(stored) != len(keys) {
+		t.Fatalf("stored %d keys, want %d", len(stored), len(keys))
+	}
+	for i, k := range keys {
+		if k.UserID != u.ID || k.ID != stored[i].ID || stored[i].PublicKey != k.PublicKey {
+			t.Errorf("key %d = %+v, stored %+v", i, k, stored[i])
+		}
+	}
+}
+
+func TestCreateUserRollsBack(t *testing.T) {
+	ctx := context.Background()
+	s := newTestStore(t)
+	if _, err := s.db.ExecContext(ctx, `CREATE TRIGGER reject_key BEFORE INSERT ON sftp_user_keys WHEN NEW.public_key = 'bad' BEGIN SELECT RAISE(ABORT, 'key rejected'); END`); err != nil {
+		t.Fatal(err)
+	}
+	u := &UserRecord{Username: "alice", DisplayName: "alice", GroupName: "default"}
+	keys := []*UserKey{{PublicKey: "ssh-ed25519 AAAA good", Enabled: true}, {PublicKey: "bad", Enabled: true}}
+	if err := s.CreateUser(ctx, u, keys...); err == nil {
+		t.Fatal("CreateUser succeeded with a rejected key")
+	}
+	if u.ID != 0 {
+		t.Errorf("user ID set to %d after a failed create", u.ID)
+	}
+	if _, err := s.FetchUserRecord(ctx, "alice"); !errors.Is(err, sql.ErrNoRows) {
+		t.Errorf("user stored after a failed create: %v", err)
+	}
+	var n int
+	if err := s.db.QueryRowContext(ctx, `SELECT COUNT(*) FROM sftp_user_keys`).Scan(&n); err != nil || n != 0 {
+		t.Errorf("%d keys stored after a failed create, %v", n, err)
+	}
+	// the name is free to be used again
+	if err := s.CreateUser(ctx, u, keys[0]); err != nil {
+		t.Error(err)
+	}
+}
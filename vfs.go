@@ -0,0 +1,154 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path"
+	"strings"
+	"sync"
+	"time"
+
+	"go.uber.org/zap"
+)
+
+// FileSystem is the storage behind an SftpHandler. Names are SFTP paths:
+// slash-separated and relative to the user's virtual root, so "/", "" and "."
+// all mean the root and ".." can never climb above it. Implementations return
+// errors that satisfy os.IsNotExist / os.IsExist where the os package would.
+type FileSystem interface {
+	// Open opens name for reading.
+	Open(name string) (File, error)
+	// OpenFile opens name with os.O_* flags, like os.OpenFile. The parent
+	// directory must exist.
+	OpenFile(name string, flag int, perm os.FileMode) (File, error)
+	Stat(name string) (os.FileInfo, error)
+	Lstat(name string) (os.FileInfo, error)
+	// ReadDir returns the entries of directory name.
+	ReadDir(name string) ([]os.FileInfo, error)
+	MkdirAll(name string, perm os.FileMode) error
+	// Remove removes a file or an empty directory.
+	Remove(name string) error
+	RemoveAll(name string) error
+	Rename(oldname, newname string) error
+	Chmod(name string, mode os.FileMode) error
+	Chtimes(name string, atime, mtime time.Time) error
+	Chown(name string, uid, gid int) error
+	Truncate(name string, size int64) error
+}
+
+// File is an open file handed to the SFTP request server, which closes it when
+// the client closes its handle.
+type File interface {
+	io.ReaderAt
+	io.WriterAt
+	io.Closer
+}
+
+// fileInfo is the os.FileInfo of backends that do not get one from the os package.
+type fileInfo struct {
+	name    string
+	size    int64
+	mode    os.FileMode
+	modTime time.Time
+}
+
+func (fi *fileInfo) Name() string       { return fi.name }
+func (fi *fileInfo) Size() int64        { return fi.size }
+func (fi *fileInfo) Mode() os.FileMode  { return fi.mode }
+func (fi *fileInfo) ModTime() time.Time { return fi.modTime }
+func (fi *fileInfo) IsDir() bool        { return fi.mode.IsDir() }
+func (fi *fileInfo) Sys() any           { return nil }
+
+// cleanPath normalises an SFTP path to a rooted, slash-separated form ("/a/b").
+func cleanPath(name string) string {
+	return path.Clean("/" + strings.ReplaceAll(name, "\\", "/"))
+}
+
+// UserStorage holds one user's storage settings (sftp_user_storage). Null
+// backend and upload mode fall back to FS_BACKEND and UPLOAD_MODE. The
+// endpoint, bucket, prefix and credentials are only used by the s3 backend.
+type UserStorage struct {
+	UserID     int
+	Backend    sql.NullString // local, memory or s3
+	UploadMode sql.NullString // direct or atomic
+	Endpoint   string         // host[:port], e.g. s3.eu-west-1.amazonaws.com or localhost:9000
+	Region     sql.NullString
+	Bucket     string
+	Prefix     string
+	AccessKey  sql.NullString
+	SecretKey  sql.NullString
+	UseSSL     bool
+}
+
+// FetchUserStorage returns the user's storage settings, or nil if there are none.
+func (s *UserStore) FetchUserStorage(ctx context.Context, userID int) (*UserStorage, error) {
+	query := fmt.Sprintf(`SELECT user_id, backend, upload_mode, endpoint, region, bucket, prefix, access_key, secret_key, use_ssl FROM sftp_user_storage WHERE user_id = %s`, s.placeholder(1))
+	var st UserStorage
+	err := s.db.QueryRowContext(ctx, query, userID).Scan(&st.UserID, &st.Backend, &st.UploadMode, &st.Endpoint, &st.Region, &st.Bucket, &st.Prefix, &st.AccessKey, &st.SecretKey, &st.UseSSL)
+	if errors.Is(err, sql.ErrNoRows) {
+		return nil, nil
+	}
+	if err != nil {
+		s.logger.Errorf("Error fetching storage settings: %v", err)
+		return nil, err
+	}
+	return &st, nil
+}
+
+var (
+	memFSMu sync.Mutex
+	memFSes = map[string]*MemFS{}
+)
+
+// openUserFileSystem fetches the user's storage settings and opens their
+// filesystem. Users not in the store (ID 0) get the defaults.
+func openUserFileSystem(ctx context.Context, store *UserStore, user *User, logger *zap.SugaredLogger) (FileSystem, *UserStorage, error) {
+	var storage *UserStorage
+	if user.ID != 0 {
+		var err error
+		if storage, err = store.FetchUserStorage(ctx, user.ID); err != nil {
+			return nil, nil, err
+		}
+	}
+	fs, err := newUserFileSystem(storage, user, logger)
+	if err != nil {
+		return nil, nil, err
+	}
+	return fs, storage, nil
+}
+
+// newUserFileSystem returns the storage for user: the backend in the user's
+// storage settings if set, FS_BACKEND otherwise. storage may be nil. local
+// (default) serves BASE_FS_ROOT on disk, memory keeps files in process memory
+// until the server exits and s3 serves a bucket prefix. A memory filesystem is
+// shared by all sessions of the same user.
+func newUserFileSystem(storage *UserStorage, user *User, logger *zap.SugaredLogger) (FileSystem, error) {
+	backend := getEnvOrDefault("FS_BACKEND", "local")
+	if storage != nil && storage.Backend.Valid {
+		backend = storage.Backend.String
+	}
+	switch backend = strings.ToLower(backend); backend {
+	case "local":
+		return NewLocalFS(getEnvOrDefault("BASE_FS_ROOT", "./data/fs"), user, logger)
+	case "memory":
+		memFSMu.Lock()
+		defer memFSMu.Unlock()
+		fs, ok := memFSes[user.Username]
+		if !ok {
+			fs = NewMemFS()
+			memFSes[user.Username] = fs
+		}
+		return fs, nil
+	case "s3":
+		if storage == nil {
+			return nil, fmt.Errorf("no sftp_user_storage row for s3 user %s", user.Username)
+		}
+		return NewS3FS(storage, logger)
+	default:
+		return nil, fmt.Errorf("unknown storage backend %q", backend)
+	}
+}